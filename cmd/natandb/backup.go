@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/backup"
+	"github.com/kapitanov/natandb/pkg/proto"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Take a backup of running NatanDB server",
+		Long: "Take a consistent point-in-time backup of running NatanDB server.\n" +
+			"Server keeps accepting writes while a backup is being taken.\n" +
+			"If a change ID of previous backup is specified, an incremental backup of changes after it is taken.\n" +
+			"Use \"restore -i\" to restore a data directory from a full backup and a chain of incremental ones.",
+		Args: cobra.NoArgs,
+	}
+	rootCmd.AddCommand(cmd)
+
+	output := cmd.Flags().StringP("output", "o", "backup.ndb", "path to backup file (must not exist)")
+	since := cmd.Flags().Uint64("since", 0, "change ID of base backup to take an incremental backup")
+
+	clientCommand(cmd, func(args []string, client proto.Client, ctx context.Context) error {
+		manifest, err := downloadBackup(ctx, client, *since, *output)
+		if err != nil {
+			log.Printf("unable to execute \"Backup\": %s", err)
+			return err
+		}
+
+		if quiet {
+			fmt.Fprintln(os.Stdout, manifest.ChangeID)
+		} else {
+			fmt.Printf("File:      %s\n", *output)
+			fmt.Printf("Kind:      %s\n", manifest.Kind)
+			if manifest.Kind == backup.KindIncremental {
+				fmt.Printf("Base:      %d\n", manifest.BaseChangeID)
+			}
+			fmt.Printf("Change ID: %d\n", manifest.ChangeID)
+			fmt.Printf("Created:   %s\n", manifest.CreatedAt)
+			fmt.Printf("SHA-256:   %x\n", manifest.PayloadChecksum)
+		}
+
+		return nil
+	})
+}
+
+// downloadBackup streams a backup from server into a file and verifies it
+// Backup is written into a temporary file first, so a partially downloaded backup never looks like a valid one
+func downloadBackup(ctx context.Context, client proto.Client, since uint64, path string) (*backup.Manifest, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil, fmt.Errorf("file \"%s\" already exists", path)
+	}
+
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(tempPath)
+	}()
+
+	stream, err := client.Backup(ctx, &proto.BackupRequest{SinceChangeId: since})
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		_, err = file.Write(chunk.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		length += len(chunk.Data)
+		log.Verbosef("received %d bytes", length)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read backup back to verify its checksums
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	b, err := backup.Read(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.Manifest, nil
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 
 	pkgLog "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -20,3 +21,13 @@ var Command = &cobra.Command{
 		os.Exit(0)
 	},
 }
+
+// encryptionKeyFlags adds encryption key flags to a command, so encrypted data files might be inspected
+func encryptionKeyFlags(cmd *cobra.Command) func() storage.DriverOption {
+	keyFile := cmd.Flags().String("encryption-key-file", "", "path to encryption key file (NATANDB_ENCRYPTION_KEY is used if not set)")
+	oldKeyFiles := cmd.Flags().StringArray("old-encryption-key-file", nil, "path to encryption key file that has been rotated out, might be repeated")
+
+	return func() storage.DriverOption {
+		return storage.EncryptionKeyFileOption(*keyFile, *oldKeyFiles...)
+	}
+}
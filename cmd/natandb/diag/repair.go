@@ -0,0 +1,127 @@
+package diag
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Repair data directory (server must not be running)",
+		Long: "Repair data directory (server must not be running)\n" +
+			"Damaged WAL is trimmed to the last valid commit, damaged snapshot is rebuilt from WAL if possible.\n" +
+			"Data directory is always backed up first.",
+	}
+	Command.AddCommand(cmd)
+
+	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
+	backupDir := cmd.Flags().String("backup", "", "path to backup directory (\"<data>.backup-<time>\" if not set)")
+	valueLog := cmd.Flags().Bool("value-log", false, "keep node values on disk (must match server's --value-log)")
+	encryptionKey := encryptionKeyFlags(cmd)
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		if *backupDir == "" {
+			*backupDir = fmt.Sprintf("%s.backup-%s", filepath.Clean(*dataDir), time.Now().Format("20060102-150405"))
+		}
+
+		err := copyDirectory(*dataDir, *backupDir)
+		if err != nil {
+			log.Printf("unable to back data up: %s", err)
+			panic(err)
+		}
+		log.Printf("data directory \"%s\" has been backed up into \"%s\"", *dataDir, *backupDir)
+
+		// Unlike other diag commands, repair converts data of older format versions,
+		// since it's been backed up already and WAL of an older version would be trimmed as a damaged one otherwise
+		driverOptions := []storage.DriverOption{
+			storage.DirectoryOption(*dataDir),
+			encryptionKey(),
+		}
+		if *valueLog {
+			driverOptions = append(driverOptions, storage.ValueLogOption(storage.DefaultValueCacheSize))
+		}
+
+		driver, err := storage.NewDriver(driverOptions...)
+		if err != nil {
+			log.Printf("unable to init storage driver: %s", err)
+			panic(err)
+		}
+
+		actions, verification, err := db.Repair(driver)
+		for _, action := range actions {
+			fmt.Printf("performed: %s\n", action)
+		}
+		if len(actions) > 0 {
+			fmt.Println()
+		}
+		if err != nil {
+			log.Printf("unable to repair data: %s", err)
+			os.Exit(1)
+		}
+
+		printVerification(verification)
+		if len(verification.Problems) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// copyDirectory copies every file of a directory into a new one
+func copyDirectory(src, dst string) error {
+	_, err := os.Stat(dst)
+	if err == nil {
+		return fmt.Errorf("\"%s\" already exists", dst)
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		return copyFile(path, target)
+	})
+}
+
+// copyFile copies a single file and flushes it to stable storage
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	return err
+}
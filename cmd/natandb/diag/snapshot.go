@@ -2,6 +2,8 @@ package diag
 
 import (
 	"fmt"
+	"io"
+	"runtime"
 	"strings"
 
 	"github.com/gosuri/uitable"
@@ -19,47 +21,110 @@ func init() {
 	Command.AddCommand(cmd)
 
 	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
+	key := cmd.Flags().StringP("key", "k", "", "look up a single key (only a part of indexed snapshot is read)")
+	encryptionKey := encryptionKeyFlags(cmd)
 
 	cmd.Run = func(c *cobra.Command, args []string) {
-		driver, err := storage.NewDriver(storage.DirectoryOption(*dataDir))
+		// Value log is always enabled, so snapshots that refer to it are readable too
+		driver, err := storage.NewDriver(
+			storage.DirectoryOption(*dataDir),
+			storage.ValueLogOption(0),
+			storage.AutoMigrateOption(false),
+			encryptionKey(),
+		)
 		if err != nil {
 			log.Printf("unable to init storage driver: %s", err)
 			panic(err)
 		}
 
-		f, err := driver.SnapshotFile().Read()
+		mapping, err := driver.SnapshotFile().Map()
 		if err != nil {
 			log.Printf("unable to read snapshot file: %s", err)
 			panic(err)
 		}
 
 		defer func() {
-			err = f.Close()
+			err = mapping.Close()
 			if err != nil {
 				log.Printf("unable to close snapshot file: %s", err)
 			}
 		}()
 
-		root, err := model.ReadSnapshot(f)
-		if err != nil {
+		var root *model.Root
+		var nodes []*model.Node
+		snapshot, err := model.OpenSnapshot(mapping, mapping.Size(), driver.ValueLog())
+		switch {
+		case err == model.ErrSnapshotNotIndexed:
+			// Snapshots without an index are read as a whole
+			log.Printf("snapshot has no index, reading it sequentially")
+			root, err = model.ReadSnapshotWithValueLog(io.NewSectionReader(mapping, 0, mapping.Size()), driver.ValueLog())
+			if err != nil {
+				log.Printf("unable to read snapshot: %s", err)
+				panic(err)
+			}
+
+		case err != nil:
 			log.Printf("unable to read snapshot: %s", err)
 			panic(err)
+
+		case *key != "":
+			node, err := snapshot.Get(*key)
+			if err != nil {
+				log.Printf("unable to read snapshot: %s", err)
+				panic(err)
+			}
+			if node != nil {
+				nodes = append(nodes, node)
+			}
+
+		default:
+			root, err = snapshot.Load(runtime.GOMAXPROCS(0))
+			if err != nil {
+				log.Printf("unable to read snapshot: %s", err)
+				panic(err)
+			}
+		}
+
+		var values func(node *model.Node) ([]model.Value, error)
+		var version uint64
+		if root == nil {
+			values = snapshot.Values
+			version = snapshot.LastChangeID()
+		} else {
+			values = root.Values
+			version = root.LastChangeID
+
+			for _, k := range root.Keys() {
+				if *key == "" || k == *key {
+					nodes = append(nodes, root.GetNode(k))
+				}
+			}
+		}
+
+		if *key != "" && len(nodes) == 0 {
+			log.Printf("key \"%s\" is not found", *key)
 		}
 
 		table := uitable.New()
 		table.MaxColWidth = 80
 		table.Wrap = true
 		table.AddRow("KEY", "VERSION", "VALUE")
-		for _, node := range root.NodesMap {
-			values := make([]string, len(node.Values))
-			for i, v := range node.Values {
-				values[i] = fmt.Sprintf("\"%s\"", string(v))
+		for _, node := range nodes {
+			nodeValues, err := values(node)
+			if err != nil {
+				log.Printf("unable to read values of \"%s\": %s", node.Key, err)
+				panic(err)
+			}
+
+			valueStrs := make([]string, len(nodeValues))
+			for i, v := range nodeValues {
+				valueStrs[i] = fmt.Sprintf("\"%s\"", string(v))
 			}
 
-			valueStr := fmt.Sprintf("[ %s ]", strings.Join(values, ", "))
+			valueStr := fmt.Sprintf("[ %s ]", strings.Join(valueStrs, ", "))
 			table.AddRow(node.Key, fmt.Sprintf("%d", node.LastChangeID), valueStr)
 		}
 		fmt.Println(table)
-		fmt.Printf("Version: %d\n", root.LastChangeID)
+		fmt.Printf("Version: %d\n", version)
 	}
 }
@@ -0,0 +1,76 @@
+package diag
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gosuri/uitable"
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify data directory (server must not be running)",
+	}
+	Command.AddCommand(cmd)
+
+	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
+	encryptionKey := encryptionKeyFlags(cmd)
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		// Value log is always enabled, so snapshots that refer to it are verifiable too
+		// Data of older format versions is verified as is, it's never converted
+		driver, err := storage.NewDriver(
+			storage.DirectoryOption(*dataDir),
+			storage.ValueLogOption(0),
+			storage.AutoMigrateOption(false),
+			encryptionKey(),
+		)
+		if err != nil {
+			log.Printf("unable to init storage driver: %s", err)
+			panic(err)
+		}
+
+		verification, err := db.Verify(driver)
+		if err != nil {
+			log.Printf("unable to verify data: %s", err)
+			panic(err)
+		}
+
+		printVerification(verification)
+		if len(verification.Problems) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// printVerification prints a summary of data verification and every problem found
+func printVerification(v *db.Verification) {
+	table := uitable.New()
+	table.AddRow("WAL SEGMENTS", v.WAL.Segments)
+	table.AddRow("WAL RECORDS", v.WAL.Records)
+	table.AddRow("WAL TRANSACTIONS", v.WAL.Transactions)
+	table.AddRow("WAL CHANGES", fmt.Sprintf("#%d..#%d", v.WAL.FirstID, v.WAL.LastCommitID))
+	table.AddRow("SNAPSHOT NODES", v.SnapshotNodes)
+	table.AddRow("SNAPSHOT CHANGE", fmt.Sprintf("#%d", v.SnapshotChangeID))
+	fmt.Println(table)
+	fmt.Println()
+
+	if len(v.Problems) == 0 {
+		fmt.Println("no problems found")
+		return
+	}
+
+	table = uitable.New()
+	table.MaxColWidth = 100
+	table.Wrap = true
+	table.AddRow("SOURCE", "PROBLEM", "REPAIR")
+	for _, p := range v.Problems {
+		table.AddRow(p.Source, p.Message, p.Repair)
+	}
+	fmt.Println(table)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/gosuri/uitable"
 	"github.com/spf13/cobra"
@@ -19,16 +20,23 @@ func init() {
 	Command.AddCommand(cmd)
 
 	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
+	encryptionKey := encryptionKeyFlags(cmd)
 	min := cmd.Flags().Uint64("min", 0, "min ID to display")
 	max := cmd.Flags().Uint64("max", ^uint64(0), "max ID to display")
 
 	cmd.Run = func(c *cobra.Command, args []string) {
-		driver, err := storage.NewDriver(storage.DirectoryOption(*dataDir))
+		driver, err := storage.NewDriver(storage.DirectoryOption(*dataDir), storage.AutoMigrateOption(false), encryptionKey())
 		if err != nil {
 			log.Printf("unable to init storage driver: %s", err)
 			panic(err)
 		}
 
+		segments, err := driver.WALFile().Segments()
+		if err != nil {
+			log.Printf("unable to list wal segments: %s", err)
+			panic(err)
+		}
+
 		wal, err := driver.WALFile().Read()
 		if err != nil {
 			log.Printf("unable to init wal: %s", err)
@@ -91,7 +99,11 @@ func init() {
 			}
 
 			valueStr := "NULL"
-			if r.Value != nil {
+			if r.Type == storage.WALCommitTx {
+				if t := r.CommitTime(); !t.IsZero() {
+					valueStr = t.UTC().Format(time.RFC3339Nano)
+				}
+			} else if r.Value != nil {
 				valueStr = string(r.Value)
 			}
 
@@ -99,5 +111,13 @@ func init() {
 		}
 
 		fmt.Println(table)
+		fmt.Println()
+
+		table = uitable.New()
+		table.AddRow("SEGMENT", "FILE", "LENGTH")
+		for _, segment := range segments {
+			table.AddRow(fmt.Sprintf("%d", segment.Index), segment.Name, fmt.Sprintf("%d bytes", segment.Length))
+		}
+		fmt.Println(table)
 	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gosuri/uitable"
+	"github.com/kapitanov/natandb/pkg/proto"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "health",
+		Short: "Get server state (and startup progress if server is starting)",
+		Args:  cobra.NoArgs,
+	}
+
+	rootCmd.AddCommand(cmd)
+
+	clientCommand(cmd, func(args []string, client proto.Client, ctx context.Context) error {
+		response, err := client.Health(ctx, &proto.None{})
+		if err != nil {
+			log.Printf("unable to execute \"Health\": %s", err)
+			return err
+		}
+
+		if quiet {
+			fmt.Println(response.State)
+			return nil
+		}
+
+		table := uitable.New()
+		table.AddRow("STATE", response.State)
+		if response.State == proto.HealthStatus_STARTING {
+			table.AddRow("RECORDS", response.ReplayedRecords)
+			if response.TotalBytes > 0 {
+				percent := float64(response.ReplayedBytes) * 100 / float64(response.TotalBytes)
+				table.AddRow("BYTES", fmt.Sprintf("%d of %d (%.1f%%)", response.ReplayedBytes, response.TotalBytes, percent))
+			} else {
+				table.AddRow("BYTES", response.ReplayedBytes)
+			}
+			if response.EtaMs > 0 {
+				table.AddRow("ETA", (time.Duration(response.EtaMs) * time.Millisecond).Round(time.Second))
+			}
+		} else {
+			table.AddRow("LAST CHANGE", response.LastChangeId)
+		}
+		if response.Replica != nil {
+			table.AddRow("PRIMARY", response.Replica.Primary)
+			table.AddRow("CONNECTED", response.Replica.Connected)
+			table.AddRow("PRIMARY CHANGE", response.Replica.PrimaryChangeId)
+			table.AddRow("LAG", response.Replica.Lag)
+			if response.Replica.Error != "" {
+				table.AddRow("ERROR", response.Replica.Error)
+			}
+		}
+		if cluster := response.Cluster; cluster != nil {
+			table.AddRow("ROLE", cluster.Role)
+			table.AddRow("TERM", cluster.Term)
+			table.AddRow("LEADER", cluster.Leader)
+		}
+		if f := response.Failover; f != nil {
+			table.AddRow("ROLE", f.Role)
+			table.AddRow("EPOCH", f.Epoch)
+			if f.LeaseRemainingMs > 0 {
+				table.AddRow("LEASE", time.Duration(f.LeaseRemainingMs)*time.Millisecond)
+			} else if response.Replica == nil && f.Primary != "" {
+				table.AddRow("PRIMARY", f.Primary)
+			}
+		}
+		if shard := response.Shard; shard != nil {
+			table.AddRow("SHARD", shard.Name)
+			table.AddRow("MAP VERSION", shard.MapVersion)
+		}
+		if proxy := response.Proxy; proxy != nil {
+			for _, upstream := range proxy.Upstreams {
+				state := fmt.Sprintf("healthy, last change %d", upstream.LastChangeId)
+				if !upstream.Healthy {
+					state = fmt.Sprintf("unhealthy (%s)", upstream.Error)
+				}
+				table.AddRow(strings.ToUpper(upstream.Role), fmt.Sprintf("%s: %s", upstream.Endpoint, state))
+			}
+		}
+		if region := response.Region; region != nil {
+			table.AddRow("REGION", region.Origin)
+			table.AddRow("CONFLICTS", region.Strategy)
+			for _, peer := range region.Peers {
+				state := fmt.Sprintf("region \"%s\", applied change %d of %d", peer.Origin, peer.AppliedChangeId, peer.PeerChangeId)
+				if !peer.Connected {
+					state = fmt.Sprintf("disconnected (%s)", peer.Error)
+				}
+				table.AddRow("PEER", fmt.Sprintf("%s: %s", peer.Endpoint, state))
+			}
+		}
+		if sync := response.SyncReplication; sync != nil {
+			state := "sync"
+			if sync.Degraded {
+				state = "degraded to async"
+			}
+			table.AddRow("SYNC REPLICAS", fmt.Sprintf("%d of %d connected (%s)", sync.Connected, sync.Required, state))
+		}
+		fmt.Printf("%s\n", table)
+		return nil
+	})
+}
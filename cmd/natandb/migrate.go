@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/gosuri/uitable"
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Convert data files into current (or specified) format version (server must not be running)",
+		Long: "Convert data files into current (or specified) format version (server must not be running).\n" +
+			"Server upgrades data files of older format versions on startup, this command allows to plan such an upgrade\n" +
+			"or to downgrade data files, so they are readable by an older server version.\n" +
+			"Every converted file is kept as \"<file>.v<version>.bak\".",
+	}
+	rootCmd.AddCommand(cmd)
+
+	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
+	dryRun := cmd.Flags().Bool("dry-run", false, "print what would be changed without changing anything")
+	walVersion := cmd.Flags().Uint32("wal-version", 0, "target WAL format version (current one if not set)")
+	snapshotVersion := cmd.Flags().Uint32("snapshot-version", 0, "target snapshot schema version (current one if not set)")
+	valueLog := cmd.Flags().Bool("value-log", false, "keep node values on disk (must match server's --value-log)")
+	encryptionKey := encryptionKeyFlags(cmd)
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		driverOptions := []storage.DriverOption{
+			storage.DirectoryOption(*dataDir),
+			storage.AutoMigrateOption(false),
+			encryptionKey(),
+		}
+		if *valueLog {
+			driverOptions = append(driverOptions, storage.ValueLogOption(storage.DefaultValueCacheSize))
+		}
+
+		driver, err := storage.NewDriver(driverOptions...)
+		if err != nil {
+			log.Errorf("unable to init storage driver: %s", err)
+			panic(err)
+		}
+
+		migrations, err := driver.WALFile().Migrations(*walVersion)
+		if err != nil {
+			log.Errorf("unable to plan wal migration: %s", err)
+			panic(err)
+		}
+
+		snapshot, err := model.SnapshotMigration(driver, *snapshotVersion)
+		if err != nil {
+			log.Errorf("unable to plan snapshot migration: %s", err)
+			panic(err)
+		}
+		if snapshot != nil {
+			migrations = append(migrations, snapshot)
+		}
+
+		if len(migrations) == 0 {
+			fmt.Println("data files are up to date")
+			return
+		}
+
+		table := uitable.New()
+		table.AddRow("FILE", "FROM", "TO", "CHANGES")
+		for _, m := range migrations {
+			table.AddRow(filepath.Base(m.Path), fmt.Sprintf("v%d", m.FromVersion), fmt.Sprintf("v%d", m.ToVersion), m.Description)
+		}
+		fmt.Println(table)
+		fmt.Println()
+
+		if *dryRun {
+			fmt.Println("dry run, nothing has been changed")
+			return
+		}
+
+		for _, m := range migrations {
+			err = m.Run()
+			if err != nil {
+				log.Errorf("unable to migrate \"%s\": %s", m.Path, err)
+				panic(err)
+			}
+		}
+		fmt.Printf("%d file(s) have been migrated\n", len(migrations))
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/kapitanov/natandb/cmd/natandb/diag"
 	"github.com/kapitanov/natandb/cmd/natandb/test"
 	pkgLog "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -80,10 +81,11 @@ type clientCommandFunc = func(args []string, client proto.Client, ctx context.Co
 
 func clientCommand(cmd *cobra.Command, callback clientCommandFunc) {
 	endpoint := cmd.Flags().StringP("endpoint", "e", "127.0.0.1:18081", "server endpoint")
+	clusterMap := cmd.Flags().String("cluster-map", "", "path to cluster map file of a sharded cluster (used instead of --endpoint)")
+	failoverGroup := cmd.Flags().StringSlice("failover-group", nil, "comma-separated endpoints of failover group servers, requests are sent to its current primary (used instead of --endpoint)")
 
 	cmd.Run = func(c *cobra.Command, args []string) {
-		log.Printf("connecting to %s...", *endpoint)
-		client, err := proto.NewClient(*endpoint)
+		client, err := connect(*endpoint, *clusterMap, *failoverGroup)
 		if err != nil {
 			log.Printf("unable to connect: %s", err)
 			panic(err)
@@ -116,6 +118,28 @@ func clientCommand(cmd *cobra.Command, callback clientCommandFunc) {
 	}
 }
 
+// connect creates a client of a single server, or a routing client of a sharded cluster if cluster map is specified,
+// or a client of failover group's primary if failover group is specified
+func connect(endpoint, clusterMapPath string, failoverGroup []string) (proto.Client, error) {
+	if len(failoverGroup) > 0 {
+		log.Printf("connecting to a failover group of %d servers...", len(failoverGroup))
+		return proto.NewFailoverGroupClient(failoverGroup)
+	}
+
+	if clusterMapPath == "" {
+		log.Printf("connecting to %s...", endpoint)
+		return proto.NewClient(endpoint)
+	}
+
+	clusterMap, err := proto.LoadClusterMap(clusterMapPath)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("connecting to %d shards...", len(clusterMap.Shards))
+	return proto.NewShardedClient(clusterMap)
+}
+
 type nodeCommandFunc = func(args []string, client proto.Client, ctx context.Context) (*proto.Node, error)
 
 func clientNodeCommand(cmd *cobra.Command, callback nodeCommandFunc) {
@@ -154,3 +178,14 @@ func clientNodeCommand(cmd *cobra.Command, callback nodeCommandFunc) {
 		return nil
 	})
 }
+
+// encryptionKeyFlags adds encryption key flags to a command
+// Returned function builds a storage driver option out of them (see storage.EncryptionKeyFileOption)
+func encryptionKeyFlags(cmd *cobra.Command) func() storage.DriverOption {
+	keyFile := cmd.Flags().String("encryption-key-file", "", "path to encryption key file (NATANDB_ENCRYPTION_KEY is used if not set)")
+	oldKeyFiles := cmd.Flags().StringArray("old-encryption-key-file", nil, "path to encryption key file that has been rotated out, might be repeated")
+
+	return func() storage.DriverOption {
+		return storage.EncryptionKeyFileOption(*keyFile, *oldKeyFiles...)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/proto"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "proxy",
+		Short: "Run a proxy server that shares a pool of upstream connections between many clients",
+		Long: "Run a proxy server that shares a pool of upstream connections between many clients.\n" +
+			"Proxy accepts the same API as NatanDB server. Writes are sent to primary server,\n" +
+			"reads are spread over healthy replicas (primary server is used if there are none).\n" +
+			"If a cluster map is specified, requests are routed to shards instead.",
+		Args: cobra.NoArgs,
+	}
+	rootCmd.AddCommand(cmd)
+
+	endpoint := cmd.Flags().StringP("listen", "l", "0.0.0.0:18080", "endpoint to listen")
+	primary := cmd.Flags().String("primary", "", "endpoint of primary server (or a cluster node)")
+	replicas := cmd.Flags().StringSlice("replica", nil, "comma-separated endpoints of replicas to send reads to")
+	clusterMap := cmd.Flags().String("cluster-map", "", "path to cluster map file of a sharded cluster (used instead of --primary)")
+	poolSize := cmd.Flags().Int("pool-size", proto.DefaultProxyPoolSize, "count of connections to each upstream server")
+	healthCheckInterval := cmd.Flags().Duration("health-check-interval", proto.DefaultProxyHealthCheckInterval, "interval between upstream health checks")
+	metricsEndpoint := cmd.Flags().String("metrics-listen", "", "endpoint of HTTP server that exposes \"/metrics\" and \"/health\" (disabled if not set)")
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		config := proto.ProxyConfig{
+			Endpoint:            *endpoint,
+			Primary:             *primary,
+			Replicas:            *replicas,
+			PoolSize:            *poolSize,
+			HealthCheckInterval: *healthCheckInterval,
+			MetricsEndpoint:     *metricsEndpoint,
+		}
+		if *clusterMap != "" {
+			m, err := proto.LoadClusterMap(*clusterMap)
+			if err != nil {
+				log.Errorf("unable to load cluster map: %s", err)
+				panic(err)
+			}
+			config.ClusterMap = m
+		}
+
+		proxy, err := proto.NewProxy(config)
+		if err != nil {
+			log.Errorf("unable to init proxy: %s", err)
+			panic(err)
+		}
+
+		defer func() {
+			err := proxy.Close()
+			if err != nil {
+				log.Errorf("unable to shutdown proxy: %s", err)
+				panic(err)
+			}
+		}()
+
+		err = proxy.Start()
+		if err != nil {
+			log.Errorf("unable to start proxy: %s", err)
+			panic(err)
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, os.Kill)
+
+		_ = <-signals
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/backup"
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore a data directory from a backup or from archived snapshot and WAL",
+		Long: "Restore a data directory from a backup or from archived snapshot and WAL.\n" +
+			"If backup files are specified, they are verified and installed into data directory.\n" +
+			"A full backup might be followed by a chain of incremental ones (\"-i full.ndb -i incr1.ndb -i incr2.ndb\").\n" +
+			"Otherwise WAL is replayed up to specified change ID or time (or up to its end if no target is specified).\n" +
+			"Transactions are restored as a whole, a transaction that crosses the target is dropped entirely.",
+	}
+	rootCmd.AddCommand(cmd)
+
+	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory to restore into (must be empty)")
+	inputs := cmd.Flags().StringArrayP("input", "i", nil, "path to backup file to restore from (see \"backup\" command), might be repeated")
+	archiveDir := cmd.Flags().StringP("archive", "a", "./archive", "path to WAL archive directory")
+	sourceDir := cmd.Flags().StringP("source", "s", "", "path to data directory whose WAL segments haven't been archived yet (it's only read, never converted)")
+	toChangeID := cmd.Flags().Uint64("to-change-id", 0, "ID of the last change to restore")
+	toTime := cmd.Flags().String("to-time", "", "max commit time of transactions to restore (RFC 3339, e.g. \"2021-05-01T15:04:05Z\")")
+	encryptionKey := encryptionKeyFlags(cmd)
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		if len(*inputs) > 0 {
+			if *toChangeID != 0 || *toTime != "" {
+				err := fmt.Errorf("recovery target can't be specified when restoring from a backup")
+				log.Errorf("%s", err)
+				panic(err)
+			}
+
+			err := restoreFromBackup(*inputs, *dataDir, encryptionKey())
+			if err != nil {
+				log.Errorf("unable to restore data: %s", err)
+				panic(err)
+			}
+			return
+		}
+
+		target := model.RecoveryTarget{
+			ChangeID: *toChangeID,
+		}
+		if *toTime != "" {
+			t, err := time.Parse(time.RFC3339, *toTime)
+			if err != nil {
+				log.Errorf("malformed time \"%s\": %s", *toTime, err)
+				panic(err)
+			}
+			target.Time = t
+		}
+
+		err := restoreFromArchive(*archiveDir, *sourceDir, *dataDir, target, encryptionKey())
+		if err != nil {
+			log.Errorf("unable to restore data: %s", err)
+			panic(err)
+		}
+	}
+}
+
+// restoreFromArchive rebuilds a data directory from archived snapshot and WAL segments
+// Encryption key option is used both to read archive and to write restored data
+func restoreFromArchive(archiveDir, sourceDir, dataDir string, target model.RecoveryTarget, encryptionKey storage.DriverOption) error {
+	err := checkEmptyDataDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	archive, err := storage.OpenWALArchive(archiveDir, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	// Pick the latest archived snapshot that precedes recovery target
+	snapshots, err := archive.Snapshots()
+	if err != nil {
+		return err
+	}
+	var base *storage.ArchivedSnapshot
+	for i := range snapshots {
+		s := snapshots[i]
+		if target.ChangeID != 0 && s.LastChangeID > target.ChangeID {
+			continue
+		}
+		if !target.Time.IsZero() && s.Time.After(target.Time) {
+			continue
+		}
+		base = &s
+	}
+
+	segments, err := archive.Segments(sourceDir)
+	if err != nil {
+		return err
+	}
+	if base == nil && (len(segments) == 0 || segments[0].Index != 1) {
+		return fmt.Errorf("no archived snapshot precedes recovery target and archive doesn't contain the first wal segment")
+	}
+
+	var snapshot io.ReadCloser
+	if base != nil {
+		log.Printf("restoring from snapshot \"%s\"", base.Name)
+		snapshot, err = archive.ReadSnapshot(*base)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = snapshot.Close()
+		}()
+	}
+
+	wal, err := archive.Read(sourceDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = wal.Close()
+	}()
+
+	root, lastCommit, err := model.Recover(snapshot, wal, target)
+	if err != nil {
+		return err
+	}
+
+	// New WAL continues ID counters and segment indices of restored one
+	lastID, lastTxID := root.LastChangeID, uint64(0)
+	if lastCommit != nil {
+		lastID, lastTxID = lastCommit.ID, lastCommit.TxID
+	}
+	nextSegment := 1
+	if len(segments) > 0 {
+		nextSegment = segments[len(segments)-1].Index + 1
+	}
+	err = installSnapshot(dataDir, root, nextSegment, lastID, lastTxID, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("data has been restored into \"%s\" up to change #%d", dataDir, root.LastChangeID)
+	log.Printf("restored database has a history of its own, so it should use a new WAL archive directory")
+	return nil
+}
+
+// restoreFromBackup verifies a chain of backup files and installs it into a data directory
+func restoreFromBackup(inputs []string, dataDir string, encryptionKey storage.DriverOption) error {
+	err := checkEmptyDataDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	chain := make([]*backup.Backup, len(inputs))
+	for i, input := range inputs {
+		chain[i], err = readBackupFile(input)
+		if err != nil {
+			return fmt.Errorf("unable to read backup \"%s\": %s", input, err)
+		}
+
+		m := chain[i].Manifest
+		log.Printf("%s backup \"%s\" of changes [%d..%d] has been verified", m.Kind, input, m.BaseChangeID+1, m.ChangeID)
+	}
+
+	root, changeID, err := backup.Restore(chain)
+	if err != nil {
+		return err
+	}
+
+	err = installSnapshot(dataDir, root, 1, changeID, 0, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("data has been restored into \"%s\" up to change #%d", dataDir, changeID)
+	return nil
+}
+
+// readBackupFile reads and verifies a backup file
+func readBackupFile(path string) (*backup.Backup, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return backup.Read(file)
+}
+
+// checkEmptyDataDir makes sure that data directory doesn't exist or is empty
+func checkEmptyDataDir(dataDir string) error {
+	entries, err := os.ReadDir(dataDir)
+	if err == nil && len(entries) > 0 {
+		return fmt.Errorf("data directory \"%s\" is not empty", dataDir)
+	}
+
+	return nil
+}
+
+// installSnapshot writes a model snapshot into a new data directory
+// and starts an empty WAL that continues specified ID counters
+func installSnapshot(dataDir string, root *model.Root, segment int, lastID, lastTxID uint64, encryptionKey storage.DriverOption) error {
+	// Data directory is empty, so there is nothing to convert
+	driver, err := storage.NewDriver(storage.DirectoryOption(dataDir), storage.AutoMigrateOption(false), encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	return installSnapshotInto(driver, root, segment, lastID, lastTxID)
+}
+
+// installSnapshotInto writes a model snapshot into an empty storage
+// and starts an empty WAL that continues specified ID counters
+func installSnapshotInto(driver storage.Driver, root *model.Root, segment int, lastID, lastTxID uint64) error {
+	file, err := driver.SnapshotFile().Write()
+	if err != nil {
+		return err
+	}
+	err = root.WriteSnapshot(file)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return driver.WALFile().Reset(segment, lastID, lastTxID)
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
+	"github.com/kapitanov/natandb/pkg/backup"
+	"github.com/kapitanov/natandb/pkg/cdc"
 	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/failover"
+	"github.com/kapitanov/natandb/pkg/model"
 	"github.com/kapitanov/natandb/pkg/proto"
+	"github.com/kapitanov/natandb/pkg/raft"
+	"github.com/kapitanov/natandb/pkg/region"
 	"github.com/kapitanov/natandb/pkg/storage"
 )
 
@@ -20,29 +31,127 @@ func init() {
 
 	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
 	endpoint := cmd.Flags().StringP("listen", "l", "0.0.0.0:18081", "endpoint to listen")
+	inMemory := cmd.Flags().Bool("in-memory", false, "keep all data in memory (data is lost on shutdown)")
+	walArchive := cmd.Flags().String("wal-archive", "", "path to WAL archive directory (WAL segments are dropped by vacuum if not set)")
+	walSegmentSize := cmd.Flags().Int64("wal-segment-size", storage.DefaultWALSegmentSize/(1024*1024), "max size of a single WAL segment file, in MiB")
+	walCompressionThreshold := cmd.Flags().Int("wal-compression-threshold", 0, "min length of WAL record value to compress, in bytes (compression is off if not set)")
+	valueLog := cmd.Flags().Bool("value-log", false, "keep node values on disk instead of memory (can't be combined with --wal-archive)")
+	valueCacheSize := cmd.Flags().Int64("value-cache-size", storage.DefaultValueCacheSize/(1024*1024), "max size of recently read values kept in memory, in MiB (used with --value-log)")
+	vacuumWALSize := cmd.Flags().Int64("vacuum-wal-size", db.DefaultVacuumPolicy.MinWALLength/(1024*1024), "WAL size that triggers background vacuum, in MiB")
+	vacuumWALRatio := cmd.Flags().Float64("vacuum-wal-ratio", db.DefaultVacuumPolicy.MinWALRatio, "ratio of WAL size to live data size that triggers background vacuum")
+	vacuumInterval := cmd.Flags().Duration("vacuum-interval", db.DefaultVacuumPolicy.MinInterval, "min interval between background vacuum runs")
+	vacuumWindow := cmd.Flags().String("vacuum-window", "", "time-of-day window for background vacuum, e.g. \"22:00-04:00\"")
+	replicaOf := cmd.Flags().String("replica-of", "", "endpoint of primary server to replicate from (replica is read-only)")
+	syncReplicas := cmd.Flags().Int("sync-replicas", 0, "count of replicas that must persist a transaction before its commit is acknowledged (replication is asynchronous if not set)")
+	syncTimeout := cmd.Flags().Duration("sync-timeout", 10*time.Second, "max time to wait for synchronous replicas (zero stands for \"wait forever\")")
+	syncDegradation := cmd.Flags().String("sync-degradation", "async", "what happens once --sync-timeout expires: \"async\" acknowledges commit and waits for replicas to catch up, \"error\" fails commit (transaction is committed locally anyway)")
+	cluster := cmd.Flags().StringSlice("cluster", nil, "comma-separated endpoints of every cluster node, including this one (3 or 5 nodes), writes are applied once a majority persists them (see README)")
+	clusterSelf := cmd.Flags().String("cluster-self", "", "endpoint of this node as listed within --cluster (--listen is used if not set)")
+	electionTimeout := cmd.Flags().Duration("election-timeout", raft.DefaultElectionTimeout, "min delay before a cluster node that hasn't heard from leader starts an election")
+	heartbeatInterval := cmd.Flags().Duration("heartbeat-interval", raft.DefaultHeartbeatInterval, "max delay between two messages from cluster leader to a follower")
+	regionID := cmd.Flags().String("region", "", "ID of server's region, server accepts writes and replicates them to --region-peer servers")
+	regionPeers := cmd.Flags().StringArray("region-peer", nil, "endpoint of a server of another region to replicate changes from (might be repeated, every region must be listed)")
+	conflictStrategy := cmd.Flags().String("conflict-strategy", string(region.LastWriterWins), "how conflicting writes of different regions are resolved: \"lww\" keeps the latest write, \"add-wins\" merges values as a set")
+	failoverGroup := cmd.Flags().StringSlice("failover-group", nil, "comma-separated endpoints of every server of failover group, including this one (a replica is promoted once primary is lost)")
+	failoverSelf := cmd.Flags().String("failover-self", "", "endpoint of this server as listed within --failover-group (--listen is used if not set)")
+	failoverLease := cmd.Flags().Duration("failover-lease", failover.DefaultLease, "time primary keeps accepting writes after a majority of failover group has acknowledged its heartbeat")
+	failoverHeartbeatInterval := cmd.Flags().Duration("failover-heartbeat-interval", failover.DefaultHeartbeatInterval, "delay between two heartbeats of failover group's primary")
+	cdcSinks := cmd.Flags().StringArray("cdc-sink", nil, "deliver committed transactions to a sink: \"stdout\", \"file:<path>\" or \"http(s)://<url>\" (might be repeated)")
+	cdcFileMaxSize := cmd.Flags().Int64("cdc-file-max-size", cdc.DefaultFileMaxSize/(1024*1024), "size of CDC file that triggers its rotation, in MiB")
+	cdcFileMaxFiles := cmd.Flags().Int("cdc-file-max-files", cdc.DefaultFileMaxFiles, "count of rotated CDC files to keep")
+	cdcHTTPTimeout := cmd.Flags().Duration("cdc-http-timeout", cdc.DefaultHTTPTimeout, "timeout of a single delivery to a CDC webhook")
+	encryptionKey := encryptionKeyFlags(cmd)
 
 	cmd.Run = func(c *cobra.Command, args []string) {
-		driver, err := storage.NewDriver(storage.DirectoryOption(*dataDir))
+		driverOptions := []storage.DriverOption{
+			storage.DirectoryOption(*dataDir),
+			storage.WALSegmentSizeOption(*walSegmentSize * 1024 * 1024),
+			storage.WALCompressionOption(*walCompressionThreshold),
+			encryptionKey(),
+		}
+		if *walArchive != "" {
+			driverOptions = append(driverOptions, storage.WALArchiveOption(*walArchive))
+		}
+		if *valueLog {
+			driverOptions = append(driverOptions, storage.ValueLogOption(*valueCacheSize*1024*1024))
+		}
+		if *inMemory {
+			log.Printf("running in in-memory mode, data will be lost on shutdown")
+			driverOptions = append(driverOptions, storage.InMemoryOption())
+		}
+
+		if len(*cluster) > 0 && (*replicaOf != "" || *syncReplicas > 0) {
+			err := fmt.Errorf("--cluster can't be combined with --replica-of or --sync-replicas")
+			log.Errorf("%s", err)
+			panic(err)
+		}
+
+		if *regionID != "" && (*replicaOf != "" || len(*cluster) > 0) {
+			err := fmt.Errorf("--region can't be combined with --replica-of or --cluster")
+			log.Errorf("%s", err)
+			panic(err)
+		}
+
+		if len(*failoverGroup) > 0 && (*replicaOf != "" || len(*cluster) > 0 || *regionID != "") {
+			err := fmt.Errorf("--failover-group can't be combined with --replica-of, --cluster or --region")
+			log.Errorf("%s", err)
+			panic(err)
+		}
+
+		strategy, err := region.ParseStrategy(*conflictStrategy)
 		if err != nil {
-			log.Errorf("unable to init storage driver: %s", err)
+			log.Errorf("%s", err)
 			panic(err)
 		}
 
-		engine, err := db.NewEngine(db.StorageDriverOption(driver), db.EnableBackgroundVacuumOption(true))
+		isEmpty := *inMemory || checkEmptyDataDir(*dataDir) == nil
+		driver, err := storage.NewDriver(driverOptions...)
 		if err != nil {
-			log.Errorf("unable to init engine: %s", err)
+			log.Errorf("unable to init storage driver: %s", err)
 			panic(err)
 		}
 
-		defer func() {
-			err := engine.Close()
+		// An empty replica is bootstrapped from a full backup of primary server
+		if *replicaOf != "" && isEmpty {
+			err = bootstrapReplica(driver, *replicaOf)
 			if err != nil {
-				log.Errorf("unable to shutdown engine: %s", err)
+				log.Errorf("unable to bootstrap replica from %s: %s", *replicaOf, err)
 				panic(err)
 			}
-		}()
+		}
+
+		vacuumPolicy := db.VacuumPolicy{
+			MinWALLength: *vacuumWALSize * 1024 * 1024,
+			MinWALRatio:  *vacuumWALRatio,
+			MinInterval:  *vacuumInterval,
+		}
+		vacuumPolicy.WindowStart, vacuumPolicy.WindowEnd, err = parseTimeWindow(*vacuumWindow)
+		if err != nil {
+			log.Errorf("malformed vacuum window: %s", err)
+			panic(err)
+		}
+
+		syncPolicy := db.SyncReplicationPolicy{
+			Replicas: *syncReplicas,
+			Timeout:  *syncTimeout,
+		}
+		syncPolicy.Degradation, err = db.ParseSyncDegradation(*syncDegradation)
+		if err != nil {
+			log.Errorf("malformed sync degradation policy: %s", err)
+			panic(err)
+		}
 
-		server := proto.NewServer(engine, *endpoint)
+		// Cluster leader applies and acknowledges a commit once a majority of nodes (including itself) has persisted it,
+		// so a transaction that has failed with a replication timeout is never visible unless a majority persists it later
+		if len(*cluster) > 0 {
+			syncPolicy.Replicas = len(*cluster) / 2
+			syncPolicy.Degradation = db.DegradeToError
+			syncPolicy.ApplyAfterAck = true
+		}
+
+		// Server is started before engine, so it reports startup progress while WAL is being replayed
+		progress := model.NewReplayProgress()
+		server := proto.NewStartingServer(progress, *endpoint)
 
 		err = server.Start()
 		if err != nil {
@@ -50,6 +159,41 @@ func init() {
 			panic(err)
 		}
 
+		// Server becomes a shard once it receives a cluster map (see "natandb shard")
+		err = server.EnableSharding(driver.StateFile("shard.json"))
+		if err != nil {
+			log.Errorf("unable to load shard state: %s", err)
+			_ = server.Close()
+			panic(err)
+		}
+
+		engineOptions := []db.Option{
+			db.StorageDriverOption(driver),
+			db.EnableBackgroundVacuumOption(true),
+			db.VacuumPolicyOption(vacuumPolicy),
+			db.ReplayProgressOption(progress),
+			db.SyncReplicationOption(syncPolicy),
+		}
+		// Cluster node stays read-only until it's elected as leader, failover group member until it's promoted
+		if *replicaOf != "" || len(*cluster) > 0 || len(*failoverGroup) > 0 {
+			engineOptions = append(engineOptions, db.ReplicaOption())
+		}
+
+		engine, err := db.NewEngine(engineOptions...)
+		if err != nil {
+			log.Errorf("unable to init engine: %s", err)
+			_ = server.Close()
+			panic(err)
+		}
+
+		defer func() {
+			err := engine.Close()
+			if err != nil {
+				log.Errorf("unable to shutdown engine: %s", err)
+				panic(err)
+			}
+		}()
+
 		defer func() {
 			err := server.Close()
 			if err != nil {
@@ -58,9 +202,226 @@ func init() {
 			}
 		}()
 
-		signals := make(chan os.Signal)
+		// Region engine stamps every transaction, so peer regions are able to resolve conflicts
+		var regionEngine *region.Engine
+		if *regionID != "" {
+			regionEngine, err = region.NewEngine(engine, *regionID, strategy)
+			if err != nil {
+				log.Errorf("unable to init region: %s", err)
+				panic(err)
+			}
+			engine = regionEngine
+		}
+
+		server.Ready(engine)
+
+		if regionEngine != nil {
+			r, err := proto.NewRegion(regionEngine, *regionPeers)
+			if err != nil {
+				log.Errorf("unable to connect to peer regions: %s", err)
+				panic(err)
+			}
+
+			server.SetRegion(r)
+			r.Start()
+
+			// Replication is stopped before server and engine
+			defer func() {
+				err := r.Close()
+				if err != nil {
+					log.Errorf("unable to stop replication: %s", err)
+				}
+			}()
+		}
+
+		if *replicaOf != "" {
+			replica, err := proto.NewReplica(engine, *replicaOf)
+			if err != nil {
+				log.Errorf("unable to connect to primary server: %s", err)
+				panic(err)
+			}
+
+			server.SetReplica(replica)
+			replica.Start()
+
+			// Replication is stopped before server and engine
+			defer func() {
+				err := replica.Close()
+				if err != nil {
+					log.Errorf("unable to stop replication: %s", err)
+				}
+			}()
+		}
+
+		if len(*cluster) > 0 {
+			config := raft.Config{
+				ID:                *clusterSelf,
+				Peers:             *cluster,
+				ElectionTimeout:   *electionTimeout,
+				HeartbeatInterval: *heartbeatInterval,
+			}
+			if config.ID == "" {
+				config.ID = *endpoint
+			}
+
+			transport := proto.NewRaftTransport()
+			node, err := raft.NewNode(config, engine, driver, transport)
+			if err != nil {
+				log.Errorf("unable to join cluster: %s", err)
+				panic(err)
+			}
+
+			server.SetCluster(node)
+			node.Start()
+
+			// Node leaves cluster before server and engine are stopped
+			defer func() {
+				err := node.Close()
+				if err != nil {
+					log.Errorf("unable to leave cluster: %s", err)
+				}
+				_ = transport.Close()
+			}()
+		}
+
+		if len(*failoverGroup) > 0 {
+			config := failover.Config{
+				ID:                *failoverSelf,
+				Group:             *failoverGroup,
+				Lease:             *failoverLease,
+				HeartbeatInterval: *failoverHeartbeatInterval,
+			}
+			if config.ID == "" {
+				config.ID = *endpoint
+			}
+
+			transport := proto.NewFailoverTransport()
+			replicator := proto.NewFailoverReplicator(engine, server)
+			node, err := failover.NewNode(config, engine, driver, transport, replicator)
+			if err != nil {
+				log.Errorf("unable to join failover group: %s", err)
+				panic(err)
+			}
+
+			server.SetFailover(node)
+			node.Start()
+
+			// Server leaves failover group before server and engine are stopped
+			defer func() {
+				err := node.Close()
+				if err != nil {
+					log.Errorf("unable to leave failover group: %s", err)
+				}
+				_ = transport.Close()
+			}()
+		}
+
+		sinkOptions := cdc.SinkOptions{
+			FileMaxSize:  *cdcFileMaxSize * 1024 * 1024,
+			FileMaxFiles: *cdcFileMaxFiles,
+			HTTPTimeout:  *cdcHTTPTimeout,
+		}
+		for _, definition := range *cdcSinks {
+			sink, err := cdc.ParseSink(definition, sinkOptions)
+			if err != nil {
+				log.Errorf("unable to init CDC sink: %s", err)
+				panic(err)
+			}
+
+			stream := cdc.NewStream(engine, definition, sink, driver.StateFile(cdc.CheckpointFileName(definition)))
+			stream.Start()
+
+			// Delivery is stopped before server and engine
+			defer func() {
+				err := stream.Close()
+				if err != nil {
+					log.Errorf("unable to stop CDC stream: %s", err)
+				}
+			}()
+		}
+
+		signals := make(chan os.Signal, 1)
 		signal.Notify(signals, os.Interrupt, os.Kill)
 
 		_ = <-signals
 	}
 }
+
+// bootstrapReplica downloads a full backup of primary server and installs it into an empty storage
+func bootstrapReplica(driver storage.Driver, primary string) error {
+	client, err := proto.NewClient(primary)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	dir, err := os.MkdirTemp("", "natandb-replica-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	log.Printf("downloading a full backup from %s...", primary)
+	path := filepath.Join(dir, "backup.ndb")
+	_, err = downloadBackup(context.Background(), client, 0, path)
+	if err != nil {
+		return err
+	}
+
+	b, err := readBackupFile(path)
+	if err != nil {
+		return err
+	}
+
+	root, changeID, err := backup.Restore([]*backup.Backup{b})
+	if err != nil {
+		return err
+	}
+
+	err = installSnapshotInto(driver, root, 1, changeID, 0)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("replica has been bootstrapped from %s up to change #%d", primary, changeID)
+	return nil
+}
+
+// parseTimeWindow parses a time-of-day window in a "HH:MM-HH:MM" format
+// An empty string stands for "any time"
+func parseTimeWindow(str string) (time.Duration, time.Duration, error) {
+	if str == "" {
+		return 0, 0, nil
+	}
+
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected \"HH:MM-HH:MM\" but got \"%s\"", str)
+	}
+
+	start, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+// parseTimeOfDay parses a time of day in a "HH:MM" format
+func parseTimeOfDay(str string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(str))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
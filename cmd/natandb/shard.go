@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kapitanov/natandb/pkg/proto"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:              "shard",
+		Short:            "Manage a sharded cluster",
+		TraverseChildren: true,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Printf("try \"%s --help\" for more information\n", cmd.CommandPath())
+			os.Exit(0)
+		},
+	}
+	rootCmd.AddCommand(cmd)
+
+	cmd.AddCommand(shardApplyCommand())
+	cmd.AddCommand(shardMoveCommand())
+}
+
+// shardApplyCommand creates a command that sends a cluster map to every shard
+func shardApplyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Send a cluster map to every shard (shards drop no keys, see \"shard move\")",
+		Args:  cobra.NoArgs,
+	}
+
+	clusterMap := cmd.Flags().String("cluster-map", "", "path to cluster map file")
+	_ = cmd.MarkFlagRequired("cluster-map")
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		m, err := proto.LoadClusterMap(*clusterMap)
+		if err != nil {
+			log.Errorf("unable to load cluster map: %s", err)
+			panic(err)
+		}
+
+		err = proto.ApplyClusterMap(interruptibleContext(), m)
+		if err != nil {
+			log.Errorf("unable to apply cluster map: %s", err)
+			panic(err)
+		}
+
+		log.Printf("cluster map v%d has been applied to %d shard(s)", m.Version, len(m.Shards))
+	}
+
+	return cmd
+}
+
+// shardMoveCommand creates a command that moves a range of keys to another shard while cluster serves requests
+func shardMoveCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "move",
+		Short: "Move a range of keys to another shard online",
+		Long: "Move a range of keys to another shard online.\n" +
+			"Keys are copied from a snapshot of every source shard, then changes are streamed until cutover.\n" +
+			"At cutover a new cluster map version is sent to every shard: source shards reject requests for moved keys\n" +
+			"and redirect clients to target shard, then moved keys are deleted from source shards.\n" +
+			"Updated cluster map is written back into cluster map file.",
+		Args: cobra.NoArgs,
+	}
+
+	clusterMap := cmd.Flags().String("cluster-map", "", "path to cluster map file")
+	target := cmd.Flags().String("to", "", "name of a shard that receives keys")
+	hashes := cmd.Flags().String("hashes", "", "range of key hashes to move (\"FROM-TO\", inclusive)")
+	keys := cmd.Flags().String("keys", "", "range of keys to move (\"FROM:TO\", TO is exclusive and might be empty)")
+	_ = cmd.MarkFlagRequired("cluster-map")
+	_ = cmd.MarkFlagRequired("to")
+
+	cmd.Run = func(c *cobra.Command, args []string) {
+		move, err := parseRangeMove(*target, *hashes, *keys)
+		if err != nil {
+			log.Errorf("malformed range: %s", err)
+			panic(err)
+		}
+
+		m, err := proto.LoadClusterMap(*clusterMap)
+		if err != nil {
+			log.Errorf("unable to load cluster map: %s", err)
+			panic(err)
+		}
+
+		next, err := proto.MoveRange(interruptibleContext(), m, move)
+		if err != nil {
+			log.Errorf("unable to move %s: %s", move, err)
+
+			// Shards have got a map that restores previous ranges, so it replaces the one they have rejected already
+			if next != nil && saveClusterMap(*clusterMap, next) == nil {
+				log.Printf("cluster map v%d has been written into \"%s\"", next.Version, *clusterMap)
+			}
+			panic(err)
+		}
+
+		err = saveClusterMap(*clusterMap, next)
+		if err != nil {
+			log.Errorf("unable to save cluster map v%d: %s", next.Version, err)
+			panic(err)
+		}
+
+		log.Printf("cluster map v%d has been written into \"%s\"", next.Version, *clusterMap)
+	}
+
+	return cmd
+}
+
+// parseRangeMove parses a range of keys from command line flags
+func parseRangeMove(target, hashes, keys string) (proto.RangeMove, error) {
+	move := proto.RangeMove{Target: target}
+	if (hashes == "") == (keys == "") {
+		return move, fmt.Errorf("either --hashes or --keys must be specified")
+	}
+
+	if keys != "" {
+		i := strings.Index(keys, ":")
+		if i < 0 {
+			return move, fmt.Errorf("\"%s\" is not a key range", keys)
+		}
+		move.Keys = &proto.KeyRange{From: keys[:i], To: keys[i+1:]}
+		return move, nil
+	}
+
+	parts := strings.SplitN(hashes, "-", 2)
+	if len(parts) != 2 {
+		return move, fmt.Errorf("\"%s\" is not a hash range", hashes)
+	}
+	from, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return move, err
+	}
+	to, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return move, err
+	}
+	move.Hashes = &proto.HashRange{From: uint32(from), To: uint32(to)}
+	return move, nil
+}
+
+// saveClusterMap replaces a cluster map file atomically
+func saveClusterMap(path string, m *proto.ClusterMap) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err = os.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// interruptibleContext returns a context that is cancelled on Ctrl+C
+func interruptibleContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	return ctx
+}
@@ -15,9 +15,23 @@ func init() {
 	rootCmd.AddCommand(cmd)
 
 	dataDir := cmd.Flags().StringP("data", "d", "./data", "path to data directory")
+	walArchive := cmd.Flags().String("wal-archive", "", "path to WAL archive directory (WAL segments are dropped if not set)")
+	valueLog := cmd.Flags().Bool("value-log", false, "keep node values on disk (must match server's --value-log)")
+	encryptionKey := encryptionKeyFlags(cmd)
 
 	cmd.Run = func(c *cobra.Command, args []string) {
-		driver, err := storage.NewDriver(storage.DirectoryOption(*dataDir))
+		driverOptions := []storage.DriverOption{
+			storage.DirectoryOption(*dataDir),
+			encryptionKey(),
+		}
+		if *walArchive != "" {
+			driverOptions = append(driverOptions, storage.WALArchiveOption(*walArchive))
+		}
+		if *valueLog {
+			driverOptions = append(driverOptions, storage.ValueLogOption(storage.DefaultValueCacheSize))
+		}
+
+		driver, err := storage.NewDriver(driverOptions...)
 		if err != nil {
 			log.Errorf("unable to init storage driver: %s", err)
 			panic(err)
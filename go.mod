@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/fatih/color v1.10.0 // indirect
 	github.com/golang/protobuf v1.5.2
+	github.com/golang/snappy v0.0.3
 	github.com/gosuri/uitable v0.0.4 // indirect
 	github.com/mattn/go-runewidth v0.0.12 // indirect
 	github.com/spf13/cobra v1.1.3 // indirect
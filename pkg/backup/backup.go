@@ -0,0 +1,533 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+var log = l.New("backup")
+
+// Backup archive binary format:
+//
+// +---+----------+----------------------------+
+// | # | Length   | Field                      |
+// +---+----------+----------------------------+
+// | 1 | 4 bytes  | Archive format version     |
+// | 2 | 1 byte   | Backup kind                |
+// | 3 | variable | Payload chunks[0]          |
+// |   | ...      | ...                        |
+// | N | variable | Payload chunks[N-1]        |
+// |   | 4 bytes  | Zero (end of payload)      |
+// |   | variable | Manifest                   |
+// +---+----------+----------------------------+
+//
+// Payload is split into chunks since its length is not known until it's written.
+// Each chunk has the following format:
+//
+// +---+---------+--------------+
+// | # | Length  | Field        |
+// +---+---------+--------------+
+// | 1 | 4 bytes | Chunk length |
+// | 2 | N bytes | Chunk data   |
+// +---+---------+--------------+
+//
+// Payload of a full backup is a model snapshot,
+// payload of an incremental backup is a sequence of WAL records.
+// Manifest follows payload, so an archive might be written in a single pass:
+//
+// +---+----------+-----------------------------+
+// | # | Length   | Field                       |
+// +---+----------+-----------------------------+
+// | 1 | 1 byte   | Backup kind                 |
+// | 2 | 8 bytes  | Change ID                   |
+// | 3 | 8 bytes  | Base change ID              |
+// | 4 | 8 bytes  | Creation time (unix nanosec)|
+// | 5 | 8 bytes  | Payload length              |
+// | 6 | 32 bytes | Payload SHA-256 checksum    |
+// | 7 | 32 bytes | Manifest SHA-256 checksum   |
+// +---+----------+-----------------------------+
+//
+// Archives of format version 1 contain full backups only,
+// they have neither backup kind in header nor base change ID in manifest.
+
+const (
+	// FormatVersion is a version of backup archive format
+	FormatVersion uint32 = 2
+
+	// formatVersionV1 is a version of backup archive format that supports full backups only
+	formatVersionV1 uint32 = 1
+
+	// chunkSize is a max length of payload chunk
+	chunkSize = 64 * 1024
+)
+
+var (
+	// ErrChecksumMismatch is returned when backup archive is corrupted
+	ErrChecksumMismatch = errors.New("backup checksum mismatch")
+)
+
+// Kind is a kind of backup
+type Kind uint8
+
+const (
+	// KindFull is a backup that contains a complete model snapshot
+	KindFull Kind = 1
+
+	// KindIncremental is a backup that contains WAL records committed after its base backup
+	KindIncremental Kind = 2
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindFull:
+		return "full"
+	case KindIncremental:
+		return "incremental"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(k))
+	}
+}
+
+// Manifest describes contents of backup archive
+type Manifest struct {
+	// Backup kind
+	Kind Kind
+	// ID of the last WAL record that is contained in backup
+	ChangeID uint64
+	// Change ID of base backup (incremental backups only)
+	// Incremental backup contains every WAL record after this change
+	BaseChangeID uint64
+	// Time when backup has been taken
+	CreatedAt time.Time
+	// Payload length in bytes
+	PayloadLength uint64
+	// Payload SHA-256 checksum
+	PayloadChecksum [sha256.Size]byte
+}
+
+func (m *Manifest) String() string {
+	return fmt.Sprintf(
+		"{ kind: %s, change_id: %d, base_change_id: %d, created_at: %s, payload: %d bytes, sha256: %x }",
+		m.Kind,
+		m.ChangeID,
+		m.BaseChangeID,
+		m.CreatedAt.Format(time.RFC3339),
+		m.PayloadLength,
+		m.PayloadChecksum,
+	)
+}
+
+// Backup is a verified contents of backup archive
+type Backup struct {
+	// Backup manifest
+	Manifest *Manifest
+	// Model snapshot (full backups only)
+	Snapshot *model.Root
+	// WAL records (incremental backups only)
+	Records []*storage.WALRecord
+}
+
+// WriteFull writes a full backup archive of specified model
+// Change ID is an ID of the last WAL record the model contains
+func WriteFull(w io.Writer, root *model.Root, changeID uint64) (*Manifest, error) {
+	manifest := &Manifest{
+		Kind:      KindFull,
+		ChangeID:  changeID,
+		CreatedAt: time.Now(),
+	}
+
+	err := writeArchive(w, manifest, root.ExportSnapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Verbosef("backup %s has been written", manifest)
+	return manifest, nil
+}
+
+// WriteIncremental writes an incremental backup archive of WAL records
+// Records must contain every change after base change ID up to change ID
+func WriteIncremental(w io.Writer, records []*storage.WALRecord, baseChangeID, changeID uint64) (*Manifest, error) {
+	manifest := &Manifest{
+		Kind:         KindIncremental,
+		ChangeID:     changeID,
+		BaseChangeID: baseChangeID,
+		CreatedAt:    time.Now(),
+	}
+
+	err := writeArchive(w, manifest, func(payload io.Writer) error {
+		for _, record := range records {
+			_, err := storage.WriteWALRecord(payload, record)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Verbosef("backup %s has been written", manifest)
+	return manifest, nil
+}
+
+// Read reads a backup archive and verifies its checksums
+func Read(r io.Reader) (*Backup, error) {
+	reader := bufio.NewReaderSize(r, chunkSize)
+
+	version, err := util.ReadUint32(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup format version: %s", err)
+	}
+	if version != FormatVersion && version != formatVersionV1 {
+		return nil, fmt.Errorf("incompatible backup format: #%d", version)
+	}
+
+	kind := KindFull
+	if version != formatVersionV1 {
+		k, err := util.ReadUint8(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup kind: %s", err)
+		}
+		kind = Kind(k)
+	}
+
+	payload := &payloadReader{
+		r:    reader,
+		hash: sha256.New(),
+	}
+	b := &Backup{}
+	switch kind {
+	case KindFull:
+		b.Snapshot, err = model.ReadSnapshot(payload)
+	case KindIncremental:
+		b.Records, err = readRecords(payload)
+	default:
+		err = fmt.Errorf("unsupported backup kind: %s", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup payload: %s", err)
+	}
+
+	// Payload readers stop at EOF, but payload is drained anyway to make sure that checksum covers it completely
+	_, err = io.Copy(io.Discard, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup payload: %s", err)
+	}
+
+	b.Manifest, err = readManifest(reader, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Manifest.PayloadLength != payload.length || !bytes.Equal(b.Manifest.PayloadChecksum[:], payload.hash.Sum(nil)) {
+		return nil, ErrChecksumMismatch
+	}
+
+	if b.Manifest.Kind != kind {
+		return nil, fmt.Errorf("malformed backup: %s backup has %s manifest", kind, b.Manifest.Kind)
+	}
+
+	err = b.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Verbosef("backup %s has been verified", b.Manifest)
+	return b, nil
+}
+
+// Restore restores a data model from a chain of backups: a full backup followed by incremental ones
+// Each incremental backup must start right where the previous backup ends
+// It returns restored model and ID of the last WAL record the chain contains
+// Snapshot of full backup is modified in place
+func Restore(chain []*Backup) (*model.Root, uint64, error) {
+	if len(chain) == 0 || chain[0].Manifest.Kind != KindFull {
+		return nil, 0, fmt.Errorf("backup chain must start with a full backup")
+	}
+
+	root := chain[0].Snapshot
+	changeID := chain[0].Manifest.ChangeID
+	for i, b := range chain[1:] {
+		if b.Manifest.Kind != KindIncremental {
+			return nil, 0, fmt.Errorf("backup #%d of the chain is not an incremental backup", i+2)
+		}
+
+		if b.Manifest.BaseChangeID != changeID {
+			return nil, 0, fmt.Errorf(
+				"backup chain is broken: backup #%d starts after change #%d, but previous backup ends at change #%d",
+				i+2,
+				b.Manifest.BaseChangeID,
+				changeID,
+			)
+		}
+
+		lastCommit, err := root.ReplayTransactions(&recordReader{records: b.Records}, model.RecoveryTarget{})
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(b.Records) > 0 && lastCommit != b.Records[len(b.Records)-1] {
+			return nil, 0, fmt.Errorf("malformed backup: backup #%d ends with an incomplete transaction", i+2)
+		}
+
+		changeID = b.Manifest.ChangeID
+	}
+
+	return root, changeID, nil
+}
+
+// validate checks that backup contents match its manifest
+func (b *Backup) validate() error {
+	switch b.Manifest.Kind {
+	case KindFull:
+		if b.Snapshot.LastChangeID > b.Manifest.ChangeID {
+			return fmt.Errorf(
+				"malformed backup: snapshot contains change #%d, but backup ends at change #%d",
+				b.Snapshot.LastChangeID,
+				b.Manifest.ChangeID,
+			)
+		}
+
+	case KindIncremental:
+		prevID := b.Manifest.BaseChangeID
+		for _, record := range b.Records {
+			if record.ID <= prevID || record.ID > b.Manifest.ChangeID {
+				return fmt.Errorf(
+					"malformed backup: record #%d is out of order within changes [%d..%d]",
+					record.ID,
+					b.Manifest.BaseChangeID+1,
+					b.Manifest.ChangeID,
+				)
+			}
+			prevID = record.ID
+		}
+	}
+
+	return nil
+}
+
+// readRecords reads WAL records until EOF
+func readRecords(r io.Reader) ([]*storage.WALRecord, error) {
+	records := make([]*storage.WALRecord, 0)
+	for {
+		record, err := storage.ReadWALRecord(r)
+		if err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+}
+
+// recordReader is a WAL reader that reads records from a slice
+type recordReader struct {
+	records []*storage.WALRecord
+}
+
+func (r *recordReader) Read() (*storage.WALRecord, error) {
+	if len(r.records) == 0 {
+		return nil, io.EOF
+	}
+
+	record := r.records[0]
+	r.records = r.records[1:]
+	return record, nil
+}
+
+func (r *recordReader) Close() error {
+	return nil
+}
+
+// writeArchive writes a backup archive with a payload produced by specified function
+// Payload length and checksum are filled into manifest
+func writeArchive(w io.Writer, manifest *Manifest, writePayload func(w io.Writer) error) error {
+	err := util.WriteUint32(w, FormatVersion)
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint8(w, uint8(manifest.Kind))
+	if err != nil {
+		return err
+	}
+
+	chunks := bufio.NewWriterSize(&chunkWriter{w: w}, chunkSize)
+	payload := &payloadWriter{
+		w:    chunks,
+		hash: sha256.New(),
+	}
+	err = writePayload(payload)
+	if err != nil {
+		return err
+	}
+	err = chunks.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Zero-length chunk terminates payload
+	err = util.WriteUint32(w, 0)
+	if err != nil {
+		return err
+	}
+
+	manifest.PayloadLength = payload.length
+	copy(manifest.PayloadChecksum[:], payload.hash.Sum(nil))
+	return writeManifest(w, manifest)
+}
+
+// writeManifest writes a manifest in its binary form
+func writeManifest(w io.Writer, manifest *Manifest) error {
+	var buffer bytes.Buffer
+	_ = util.WriteUint8(&buffer, uint8(manifest.Kind))
+	_ = util.WriteUint64(&buffer, manifest.ChangeID)
+	_ = util.WriteUint64(&buffer, manifest.BaseChangeID)
+	_ = util.WriteUint64(&buffer, uint64(manifest.CreatedAt.UnixNano()))
+	_ = util.WriteUint64(&buffer, manifest.PayloadLength)
+	_ = util.WriteBytes(&buffer, manifest.PayloadChecksum[:])
+
+	checksum := sha256.Sum256(buffer.Bytes())
+	_ = util.WriteBytes(&buffer, checksum[:])
+
+	return util.WriteBytes(w, buffer.Bytes())
+}
+
+// readManifest reads a manifest from its binary form and verifies its checksum
+func readManifest(r io.Reader, version uint32) (*Manifest, error) {
+	length := 1 + 8 + 8 + 8 + 8 + sha256.Size
+	if version == formatVersionV1 {
+		// Base change ID is missing
+		length -= 8
+	}
+
+	buffer, err := util.ReadBytes(r, length+sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %s", err)
+	}
+
+	checksum := sha256.Sum256(buffer[:length])
+	if !bytes.Equal(checksum[:], buffer[length:]) {
+		return nil, ErrChecksumMismatch
+	}
+
+	reader := bytes.NewReader(buffer)
+	kind, _ := util.ReadUint8(reader)
+	changeID, _ := util.ReadUint64(reader)
+	var baseChangeID uint64
+	if version != formatVersionV1 {
+		baseChangeID, _ = util.ReadUint64(reader)
+	}
+	createdAt, _ := util.ReadUint64(reader)
+	payloadLength, _ := util.ReadUint64(reader)
+
+	manifest := &Manifest{
+		Kind:          Kind(kind),
+		ChangeID:      changeID,
+		BaseChangeID:  baseChangeID,
+		CreatedAt:     time.Unix(0, int64(createdAt)),
+		PayloadLength: payloadLength,
+	}
+	_, _ = io.ReadFull(reader, manifest.PayloadChecksum[:])
+
+	// Nothing may follow a manifest
+	_, err = r.Read(make([]byte, 1))
+	if err != io.EOF {
+		return nil, fmt.Errorf("malformed backup: unexpected data after manifest")
+	}
+
+	return manifest, nil
+}
+
+// chunkWriter writes each buffer as a separate payload chunk
+type chunkWriter struct {
+	w io.Writer
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	err := util.WriteUint32(c.w, uint32(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	err = util.WriteBytes(c.w, p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// payloadWriter computes length and checksum of a payload
+type payloadWriter struct {
+	w      io.Writer
+	hash   hash.Hash
+	length uint64
+}
+
+func (p *payloadWriter) Write(buffer []byte) (int, error) {
+	n, err := p.w.Write(buffer)
+	_, _ = p.hash.Write(buffer[:n])
+	p.length += uint64(n)
+	return n, err
+}
+
+// payloadReader reads payload chunks until a zero-length chunk
+// and computes length and checksum of a payload
+type payloadReader struct {
+	r         io.Reader
+	hash      hash.Hash
+	length    uint64
+	remaining uint32
+	isEnd     bool
+}
+
+func (p *payloadReader) Read(buffer []byte) (int, error) {
+	for p.remaining == 0 {
+		if p.isEnd {
+			return 0, io.EOF
+		}
+
+		length, err := util.ReadUint32(p.r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		p.remaining = length
+		p.isEnd = length == 0
+	}
+
+	if uint32(len(buffer)) > p.remaining {
+		buffer = buffer[:p.remaining]
+	}
+
+	n, err := p.r.Read(buffer)
+	_, _ = p.hash.Write(buffer[:n])
+	p.length += uint64(n)
+	p.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
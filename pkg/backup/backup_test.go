@@ -0,0 +1,226 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	l "log"
+
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestFullBackup(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	// A large value makes payload span multiple chunks
+	root := createBackupTestModel(10)
+	node := root.GetOrCreateNode("large")
+	node.Values = append(node.Values, model.Value(strings.Repeat("x", 3*chunkSize)))
+
+	var buffer bytes.Buffer
+	manifest, err := WriteFull(&buffer, root, 42)
+	if err != nil {
+		t.Fatalf("ERROR: WriteFull(): %s", err)
+	}
+
+	b, err := Read(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatalf("ERROR: Read(): %s", err)
+	}
+
+	if b.Manifest.Kind != KindFull || b.Manifest.ChangeID != 42 {
+		t.Errorf("ERROR: unexpected manifest %s", b.Manifest)
+	}
+	if b.Manifest.PayloadChecksum != manifest.PayloadChecksum || b.Manifest.PayloadLength != manifest.PayloadLength {
+		t.Errorf("ERROR: expected manifest %s but got %s", manifest, b.Manifest)
+	}
+	if !b.Manifest.CreatedAt.Equal(manifest.CreatedAt) {
+		t.Errorf("ERROR: expected creation time %s but got %s", manifest.CreatedAt, b.Manifest.CreatedAt)
+	}
+
+	if fmt.Sprint(b.Snapshot.Keys()) != fmt.Sprint(root.Keys()) || b.Snapshot.LastChangeID != root.LastChangeID {
+		t.Errorf("ERROR: expected keys %v but got %v", root.Keys(), b.Snapshot.Keys())
+	}
+	if !b.Snapshot.GetNode("large").Values[0].Equal(node.Values[0]) {
+		t.Errorf("ERROR: large value doesn't match")
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	records := createBackupTestRecords(10)
+	var buffer bytes.Buffer
+	manifest, err := WriteIncremental(&buffer, records, 10, 42)
+	if err != nil {
+		t.Fatalf("ERROR: WriteIncremental(): %s", err)
+	}
+
+	b, err := Read(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatalf("ERROR: Read(): %s", err)
+	}
+
+	if b.Manifest.Kind != KindIncremental || b.Manifest.BaseChangeID != 10 || b.Manifest.ChangeID != 42 {
+		t.Errorf("ERROR: unexpected manifest %s", b.Manifest)
+	}
+	if b.Manifest.PayloadChecksum != manifest.PayloadChecksum {
+		t.Errorf("ERROR: expected manifest %s but got %s", manifest, b.Manifest)
+	}
+
+	if len(b.Records) != len(records) {
+		t.Fatalf("ERROR: expected %d records but got %d", len(records), len(b.Records))
+	}
+	for i := range records {
+		if b.Records[i].ID != records[i].ID || b.Records[i].Key != records[i].Key || b.Records[i].Type != records[i].Type {
+			t.Errorf("ERROR: expected record %v but got %v", records[i], b.Records[i])
+		}
+	}
+}
+
+func TestIncrementalBackupOutOfRange(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	// Records #11..#20 are not within changes [12..42]
+	var buffer bytes.Buffer
+	_, err := WriteIncremental(&buffer, createBackupTestRecords(10), 11, 42)
+	if err != nil {
+		t.Fatalf("ERROR: WriteIncremental(): %s", err)
+	}
+
+	_, err = Read(bytes.NewReader(buffer.Bytes()))
+	if err == nil {
+		t.Errorf("ERROR: backup with out of range records has been read successfully")
+	}
+}
+
+func TestCorruptedBackup(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	for _, archive := range createBackupTestArchives(t) {
+		for offset := range archive {
+			corrupted := make([]byte, len(archive))
+			copy(corrupted, archive)
+			corrupted[offset] ^= 0xFF
+
+			_, err := Read(bytes.NewReader(corrupted))
+			if err == nil {
+				t.Errorf("ERROR: backup with a corrupted byte at offset %d has been read successfully", offset)
+			}
+		}
+	}
+}
+
+func TestTruncatedBackup(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	for _, archive := range createBackupTestArchives(t) {
+		for length := 0; length < len(archive); length++ {
+			_, err := Read(bytes.NewReader(archive[:length]))
+			if err == nil {
+				t.Errorf("ERROR: backup truncated to %d bytes has been read successfully", length)
+			}
+		}
+
+		_, err := Read(io.MultiReader(bytes.NewReader(archive), strings.NewReader("x")))
+		if err == nil {
+			t.Errorf("ERROR: backup with trailing data has been read successfully")
+		}
+	}
+}
+
+func TestRestoreBackupChain(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	full := &Backup{
+		Manifest: &Manifest{Kind: KindFull, ChangeID: 10},
+		Snapshot: createBackupTestModel(3),
+	}
+	incremental := func(base, changeID uint64, records ...*storage.WALRecord) *Backup {
+		return &Backup{
+			Manifest: &Manifest{Kind: KindIncremental, BaseChangeID: base, ChangeID: changeID},
+			Records:  records,
+		}
+	}
+	first := incremental(10, 12,
+		&storage.WALRecord{ID: 11, TxID: 5, Type: storage.WALRemoveKey, Key: "key_0"},
+		&storage.WALRecord{ID: 12, TxID: 5, Type: storage.WALCommitTx},
+	)
+	second := incremental(12, 15,
+		&storage.WALRecord{ID: 14, TxID: 7, Type: storage.WALAddValue, Key: "new", Value: model.Value("value")},
+		&storage.WALRecord{ID: 15, TxID: 7, Type: storage.WALCommitTx},
+	)
+
+	root, changeID, err := Restore([]*Backup{full, first, second})
+	if err != nil {
+		t.Fatalf("ERROR: Restore(): %s", err)
+	}
+	if changeID != 15 {
+		t.Errorf("ERROR: expected change #15 but got #%d", changeID)
+	}
+	if fmt.Sprint(root.Keys()) != fmt.Sprint([]string{"key_1", "key_2", "new"}) {
+		t.Errorf("ERROR: unexpected keys %v", root.Keys())
+	}
+
+	brokenChains := [][]*Backup{
+		{},
+		{first},
+		{full, second},
+		{full, first, first},
+		{full, first, full},
+	}
+	for _, chain := range brokenChains {
+		_, _, err = Restore(chain)
+		if err == nil {
+			t.Errorf("ERROR: broken chain of %d backups has been restored successfully", len(chain))
+		}
+	}
+}
+
+// createBackupTestArchives returns a full and an incremental backup archive
+func createBackupTestArchives(t *testing.T) [][]byte {
+	var full bytes.Buffer
+	_, err := WriteFull(&full, createBackupTestModel(3), 42)
+	if err != nil {
+		t.Fatalf("ERROR: WriteFull(): %s", err)
+	}
+
+	var incremental bytes.Buffer
+	_, err = WriteIncremental(&incremental, createBackupTestRecords(3), 10, 42)
+	if err != nil {
+		t.Fatalf("ERROR: WriteIncremental(): %s", err)
+	}
+
+	return [][]byte{full.Bytes(), incremental.Bytes()}
+}
+
+// createBackupTestRecords returns records #11, #12, ... where each second record is a commit
+func createBackupTestRecords(count int) []*storage.WALRecord {
+	records := make([]*storage.WALRecord, count)
+	for i := range records {
+		id := uint64(11 + i)
+		if i%2 == 0 {
+			records[i] = &storage.WALRecord{ID: id, TxID: id, Type: storage.WALAddValue, Key: fmt.Sprintf("key_%d", i), Value: model.Value("value")}
+		} else {
+			records[i] = &storage.WALRecord{ID: id, TxID: id - 1, Type: storage.WALCommitTx}
+		}
+	}
+
+	return records
+}
+
+func createBackupTestModel(nodeCount int) *model.Root {
+	root := model.New()
+	for i := 0; i < nodeCount; i++ {
+		node := root.GetOrCreateNode(fmt.Sprintf("key_%d", i))
+		node.Values = []model.Value{model.Value(fmt.Sprintf("value_%d", i))}
+		node.LastChangeID = uint64(i + 1)
+		root.LastChangeID = node.LastChangeID
+	}
+
+	return root
+}
@@ -0,0 +1,334 @@
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/region"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+var log = l.New("cdc")
+
+const (
+	// batchSize is a max count of transactions delivered to a sink at once
+	batchSize = 100
+
+	// minBackoff is a delay before a failed delivery is retried
+	minBackoff = 1 * time.Second
+
+	// maxBackoff is a max delay before a delivery is retried after repeated failures
+	maxBackoff = 30 * time.Second
+)
+
+// Transaction is a committed transaction as it's delivered to sinks
+type Transaction struct {
+	// ID of transaction's commit record, sinks might use it to skip redelivered transactions
+	ID uint64 `json:"id"`
+
+	// Transaction ID
+	TxID uint64 `json:"tx"`
+
+	// Changes made by transaction
+	Changes []*Change `json:"changes"`
+}
+
+// Change is a single change of a transaction
+type Change struct {
+	// Change ID
+	ID uint64 `json:"id"`
+
+	// Change type: "add_value", "remove_value" or "remove_key"
+	Type string `json:"type"`
+
+	// Node key
+	Key string `json:"key"`
+
+	// Value that is added or removed (base64 encoded)
+	Value []byte `json:"value,omitempty"`
+}
+
+// Sink receives committed transactions
+type Sink interface {
+	// Deliver delivers a batch of transactions
+	// If an error is returned, batch is delivered again later, so a sink might receive a transaction more than once
+	Deliver(batch []*Transaction) error
+
+	// Close releases sink resources
+	Close() error
+}
+
+// Stream delivers transactions committed by an engine to a sink
+// ID of the last delivered transaction is kept within a checkpoint file, so delivery continues after restart
+// Every transaction is delivered at least once: vacuum routine keeps WAL records that haven't been delivered yet,
+// so WAL grows while sink is unavailable. If changes after checkpoint are unavailable anyway
+// (e.g. checkpoint file has been restored from an older backup), delivery is stopped for good (see Err)
+type Stream struct {
+	engine     db.Engine
+	name       string
+	sink       Sink
+	checkpoint storage.StateFile
+	mutex      sync.Mutex
+	lastID     uint64
+	err        error
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// checkpoint is a content of a checkpoint file
+type checkpoint struct {
+	Sink     string `json:"sink"`
+	ChangeID uint64 `json:"change_id"`
+}
+
+// CheckpointFileName returns a name of a checkpoint file for a sink with specified name
+func CheckpointFileName(name string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return fmt.Sprintf("cdc-%08x.json", h.Sum32())
+}
+
+// NewStream creates a stream of committed transactions to a sink
+// If checkpoint file is empty, transactions committed before the stream is started aren't delivered
+func NewStream(engine db.Engine, name string, sink Sink, checkpoint storage.StateFile) *Stream {
+	return &Stream{
+		engine:     engine,
+		name:       name,
+		sink:       sink,
+		checkpoint: checkpoint,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start starts delivery in background
+// Failed deliveries are retried until Close() is called
+func (s *Stream) Start() {
+	// Changes after checkpoint are retained before delivery starts, so vacuum never drops them
+	// If checkpoint can't be read, delivery keeps trying to read it
+	_, _ = s.readCheckpoint()
+	go s.run()
+}
+
+// LastChangeID returns ID of the last delivered transaction
+func (s *Stream) LastChangeID() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastID
+}
+
+// Err returns an error that has stopped delivery for good, nil if stream keeps delivering changes
+func (s *Stream) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.err
+}
+
+// Close stops delivery and closes sink
+func (s *Stream) Close() error {
+	close(s.stop)
+	<-s.done
+
+	return s.sink.Close()
+}
+
+func (s *Stream) run() {
+	defer close(s.done)
+
+	backoff := minBackoff
+	for {
+		delivered, err := s.deliverFeed()
+		if err == nil {
+			return
+		}
+		if err == db.ErrChangesUnavailable {
+			// Retrying is pointless, since dropped changes never come back
+			log.Errorf("unable to deliver changes to %s: %s, delivery is stopped", s.name, err)
+			s.mutex.Lock()
+			s.err = err
+			s.mutex.Unlock()
+			s.engine.ReleaseChanges(s.name)
+			return
+		}
+		if delivered {
+			backoff = minBackoff
+		}
+
+		log.Errorf("unable to deliver changes to %s: %s, retrying in %s", s.name, err, backoff)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// deliverFeed delivers transactions committed after checkpoint until stream is closed or an error occurs
+// It returns true if anything has been delivered
+func (s *Stream) deliverFeed() (bool, error) {
+	changeID, err := s.readCheckpoint()
+	if err != nil {
+		return false, err
+	}
+
+	feed, err := s.engine.Subscribe(changeID)
+	if err != nil {
+		if err == db.ErrShutdown {
+			return false, nil
+		}
+		return false, err
+	}
+	defer feed.Close()
+
+	log.Printf("delivering changes after #%d to %s", changeID, s.name)
+	delivered := false
+	for {
+		var batch [][]*storage.WALRecord
+		select {
+		case <-s.stop:
+			return delivered, nil
+		case records, ok := <-feed.Transactions():
+			if !ok {
+				if feed.Err() == db.ErrShutdown {
+					return delivered, nil
+				}
+				return delivered, fmt.Errorf("change feed has been stopped: %v", feed.Err())
+			}
+			batch = append(batch, records)
+		}
+
+		// Transactions that are ready are delivered at once
+	drain:
+		for len(batch) < batchSize {
+			select {
+			case records, ok := <-feed.Transactions():
+				if !ok {
+					break drain
+				}
+				batch = append(batch, records)
+			default:
+				break drain
+			}
+		}
+
+		err = s.deliver(batch)
+		if err != nil {
+			return delivered, err
+		}
+		delivered = true
+	}
+}
+
+// deliver delivers a batch of transactions and moves checkpoint past them
+func (s *Stream) deliver(batch [][]*storage.WALRecord) error {
+	transactions := make([]*Transaction, 0, len(batch))
+	var lastID uint64
+	for _, records := range batch {
+		lastID = records[len(records)-1].ID
+		tx := mapTransaction(records)
+		if len(tx.Changes) > 0 {
+			transactions = append(transactions, tx)
+		}
+	}
+
+	// Empty transactions (e.g. vacuum checkpoints) only move checkpoint
+	if len(transactions) > 0 {
+		err := s.sink.Deliver(transactions)
+		if err != nil {
+			return err
+		}
+		log.Verbosef("%d transaction(s) up to #%d have been delivered to %s", len(transactions), lastID, s.name)
+	}
+
+	return s.writeCheckpoint(lastID)
+}
+
+func (s *Stream) readCheckpoint() (uint64, error) {
+	data, err := s.checkpoint.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if data == nil {
+		changeID := s.engine.LastCommitID()
+		log.Printf("%s has no checkpoint, starting after change #%d", s.name, changeID)
+		return changeID, s.writeCheckpoint(changeID)
+	}
+
+	c := &checkpoint{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return 0, fmt.Errorf("malformed checkpoint: %s", err)
+	}
+
+	s.mutex.Lock()
+	s.lastID = c.ChangeID
+	s.mutex.Unlock()
+	s.engine.RetainChanges(s.name, c.ChangeID)
+	return c.ChangeID, nil
+}
+
+func (s *Stream) writeCheckpoint(changeID uint64) error {
+	data, err := json.Marshal(&checkpoint{Sink: s.name, ChangeID: changeID})
+	if err != nil {
+		return err
+	}
+
+	err = s.checkpoint.Write(data)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.lastID = changeID
+	s.mutex.Unlock()
+	s.engine.RetainChanges(s.name, changeID)
+	return nil
+}
+
+// mapTransaction converts WAL records of a committed transaction into a transaction event
+func mapTransaction(records []*storage.WALRecord) *Transaction {
+	commit := records[len(records)-1]
+	tx := &Transaction{
+		ID:      commit.ID,
+		TxID:    commit.TxID,
+		Changes: make([]*Change, 0, len(records)-1),
+	}
+
+	for _, record := range records {
+		// Replication state of regions isn't a part of data
+		if region.IsReserved(record.Key) {
+			continue
+		}
+
+		change := &Change{ID: record.ID, Key: record.Key}
+		switch record.Type {
+		case storage.WALAddValue:
+			change.Type = "add_value"
+			change.Value = record.Value
+		case storage.WALRemoveValue:
+			change.Type = "remove_value"
+			change.Value = record.Value
+		case storage.WALRemoveKey:
+			change.Type = "remove_key"
+		default:
+			continue
+		}
+
+		tx.Changes = append(tx.Changes, change)
+	}
+
+	return tx
+}
@@ -0,0 +1,254 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultFileMaxSize is a default size of NDJSON file that triggers rotation
+	DefaultFileMaxSize = 64 * 1024 * 1024
+
+	// DefaultFileMaxFiles is a default count of rotated NDJSON files to keep
+	DefaultFileMaxFiles = 5
+
+	// DefaultHTTPTimeout is a default timeout of a single HTTP delivery
+	DefaultHTTPTimeout = 10 * time.Second
+)
+
+// SinkOptions defines parameters of sinks created by ParseSink
+type SinkOptions struct {
+	// Size of NDJSON file that triggers rotation, in bytes
+	FileMaxSize int64
+
+	// Count of rotated NDJSON files to keep
+	FileMaxFiles int
+
+	// Timeout of a single HTTP delivery
+	HTTPTimeout time.Duration
+}
+
+// ParseSink creates a sink by its definition:
+// "stdout" writes NDJSON to standard output,
+// "file:<path>" appends NDJSON to a local file and rotates it,
+// "http://..." and "https://..." POST NDJSON batches to specified URL
+func ParseSink(definition string, options SinkOptions) (Sink, error) {
+	switch {
+	case definition == "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case strings.HasPrefix(definition, "file:"):
+		return NewFileSink(strings.TrimPrefix(definition, "file:"), options.FileMaxSize, options.FileMaxFiles)
+	case strings.HasPrefix(definition, "http://"), strings.HasPrefix(definition, "https://"):
+		return NewHTTPSink(definition, options.HTTPTimeout), nil
+	default:
+		return nil, fmt.Errorf("unknown sink \"%s\"", definition)
+	}
+}
+
+// encodeBatch encodes transactions as NDJSON, one transaction per line
+func encodeBatch(batch []*Transaction) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, tx := range batch {
+		err := encoder.Encode(tx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// writerSink writes NDJSON into a stream
+type writerSink struct {
+	writer *bufio.Writer
+}
+
+// NewWriterSink creates a sink that writes NDJSON into a stream (e.g. standard output)
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{writer: bufio.NewWriter(w)}
+}
+
+// Deliver writes transactions into a stream
+func (s *writerSink) Deliver(batch []*Transaction) error {
+	data, err := encodeBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+// Close does nothing, stream is owned by caller
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// fileSink appends NDJSON to a local file
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewFileSink creates a sink that appends NDJSON to a local file
+// Once file grows over maxSize bytes, it's renamed to "<path>.1" (previous rotated files are shifted),
+// at most maxFiles rotated files are kept
+func NewFileSink(path string, maxSize int64, maxFiles int) (Sink, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultFileMaxSize
+	}
+	if maxFiles < 0 {
+		maxFiles = 0
+	}
+
+	s := &fileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Deliver appends transactions to file and flushes it to disk
+func (s *fileSink) Deliver(batch []*Transaction) error {
+	data, err := encodeBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	if s.file == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rotate renames current file to "<path>.1" and opens a new one
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+
+	if s.maxFiles == 0 {
+		err = os.Remove(s.path)
+	} else {
+		for i := s.maxFiles - 1; i >= 1; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(s.path, s.path+".1")
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("file \"%s\" has been rotated", s.path)
+	return s.open()
+}
+
+// Close closes file
+func (s *fileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// httpSink POSTs NDJSON batches to a URL
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSink creates a sink that POSTs NDJSON batches to specified URL
+// Batch is delivered once server responds with a 2xx status
+func NewHTTPSink(url string, timeout time.Duration) Sink {
+	if timeout <= 0 {
+		timeout = DefaultHTTPTimeout
+	}
+
+	return &httpSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+// Deliver sends transactions to server
+func (s *httpSink) Deliver(batch []*Transaction) error {
+	data, err := encodeBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, response.Body)
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("server has responded with \"%s\"", response.Status)
+	}
+	return nil
+}
+
+// Close closes idle connections
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
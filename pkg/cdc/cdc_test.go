@@ -0,0 +1,306 @@
+package cdc_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/cdc"
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestStream(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = engine.Close() }()
+
+	write := func(i int) {
+		err := engine.Tx(func(tx db.TX) error {
+			_, e := tx.AddValue(db.Key(fmt.Sprintf("key_%d", i)), db.Value("value"))
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first delivery fails, so it's retried
+	var mutex sync.Mutex
+	received := make(map[string]int)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			tx := &cdc.Transaction{}
+			err := json.Unmarshal(scanner.Bytes(), tx)
+			if err != nil || len(tx.Changes) != 1 || tx.Changes[0].Type != "add_value" || string(tx.Changes[0].Value) != "value" {
+				t.Errorf("ERROR: malformed transaction %s (%v)", scanner.Text(), err)
+				continue
+			}
+			received[tx.Changes[0].Key]++
+		}
+	}))
+	defer server.Close()
+
+	check := func(expected ...int) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			mutex.Lock()
+			count := len(received)
+			mutex.Unlock()
+			if count >= len(expected) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, i := range expected {
+			if received[fmt.Sprintf("key_%d", i)] == 0 {
+				t.Errorf("ERROR: key_%d hasn't been delivered", i)
+			}
+		}
+		if len(received) != len(expected) {
+			t.Errorf("ERROR: %d keys have been delivered instead of %d", len(received), len(expected))
+		}
+		for key := range received {
+			delete(received, key)
+		}
+	}
+
+	start := func() *cdc.Stream {
+		stream := cdc.NewStream(engine, "test", cdc.NewHTTPSink(server.URL, 0), driver.StateFile("cdc.json"))
+		stream.Start()
+		return stream
+	}
+
+	// Transactions committed before the first start aren't delivered
+	write(0)
+	stream := start()
+	for stream.LastChangeID() != engine.LastCommitID() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 1; i <= 5; i++ {
+		write(i)
+	}
+	check(1, 2, 3, 4, 5)
+
+	err = stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivery continues from checkpoint
+	write(6)
+	write(7)
+	stream = start()
+	defer func() { _ = stream.Close() }()
+	check(6, 7)
+}
+
+func TestStreamWithVacuum(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = engine.Close() }()
+
+	write := func(i int) {
+		err := engine.Tx(func(tx db.TX) error {
+			_, e := tx.AddValue(db.Key(fmt.Sprintf("key_%d", i)), db.Value("value"))
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	vacuum := func() {
+		err := engine.Vacuum()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Changes that haven't been delivered yet are kept by vacuum while sink is unavailable
+	sink := &testSink{isDown: true}
+	stream := cdc.NewStream(engine, "test", sink, driver.StateFile("cdc.json"))
+	stream.Start()
+	defer func() { _ = stream.Close() }()
+	for i := 1; i <= 3; i++ {
+		write(i)
+		vacuum()
+	}
+
+	sink.setDown(false)
+	deadline := time.Now().Add(10 * time.Second)
+	for stream.LastChangeID() != engine.LastCommitID() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if keys := sink.keys(); len(keys) != 3 {
+		t.Errorf("ERROR: keys %v have been delivered instead of 3 keys", keys)
+	}
+	if stream.Err() != nil {
+		t.Errorf("ERROR: stream has been stopped: %s", stream.Err())
+	}
+
+	// Stream whose changes have been dropped anyway is stopped instead of retrying forever
+	vacuum()
+	checkpoint := driver.StateFile("stale.json")
+	err = checkpoint.Write([]byte(`{"sink":"stale","change_id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := cdc.NewStream(engine, "stale", &testSink{}, checkpoint)
+	stale.Start()
+	defer func() { _ = stale.Close() }()
+
+	deadline = time.Now().Add(10 * time.Second)
+	for stale.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stale.Err() != db.ErrChangesUnavailable {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrChangesUnavailable, stale.Err())
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir, err := ioutil.TempDir("", "natandb-cdc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	path := filepath.Join(dir, "changes.ndjson")
+	sink, err := cdc.NewFileSink(path, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 20; i++ {
+		tx := &cdc.Transaction{
+			ID:      uint64(i),
+			Changes: []*cdc.Change{{ID: uint64(i), Type: "remove_key", Key: fmt.Sprintf("key_%d", i)}},
+		}
+		err = sink.Deliver([]*cdc.Transaction{tx})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sink.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastID := uint64(21)
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Files contain every transaction once, newer files contain newer transactions
+		var ids []uint64
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			tx := &cdc.Transaction{}
+			err = json.Unmarshal(scanner.Bytes(), tx)
+			if err != nil {
+				t.Errorf("ERROR: malformed line \"%s\": %s", scanner.Text(), err)
+			}
+			ids = append(ids, tx.ID)
+		}
+		_ = file.Close()
+
+		if len(ids) == 0 || ids[len(ids)-1] != lastID-1 {
+			t.Errorf("ERROR: %s contains transactions %v, the last one must be %d", name, ids, lastID-1)
+		} else {
+			lastID = ids[0]
+		}
+	}
+
+	_, err = os.Stat(path + ".3")
+	if !os.IsNotExist(err) {
+		t.Errorf("ERROR: more than 2 rotated files are kept")
+	}
+}
+
+// testSink collects keys of delivered changes, deliveries fail while it's down
+type testSink struct {
+	mutex     sync.Mutex
+	isDown    bool
+	delivered []string
+}
+
+func (s *testSink) Deliver(batch []*cdc.Transaction) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isDown {
+		return fmt.Errorf("sink is down")
+	}
+	for _, tx := range batch {
+		for _, change := range tx.Changes {
+			s.delivered = append(s.delivered, change.Key)
+		}
+	}
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func (s *testSink) setDown(isDown bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.isDown = isDown
+}
+
+func (s *testSink) keys() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]string(nil), s.delivered...)
+}
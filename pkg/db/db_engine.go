@@ -11,21 +11,34 @@ import (
 
 var log = l.New("engine")
 
-const (
-	vacuumPeriod = 30 * time.Hour
-)
-
 type engine struct {
-	Model      *model.Root
-	ModelLock  *sync.Mutex
-	WAL        storage.WALWriter
-	Storage    storage.Driver
-	IsShutDown bool
+	// WriteDeadline is a UnixNano time after which writes are rejected, zero means no deadline
+	// It's accessed atomically, so it's the first field to be 64-bit aligned
+	WriteDeadline int64
+	Model         *model.Root
+	ModelLock     *sync.Mutex
+	VacuumLock    *sync.Mutex
+	WAL           storage.WALWriter
+	Storage       storage.Driver
+	IsShutDown    bool
+	IsReplica     bool
+	Feeds         []*changeFeed
+	Sync          *syncReplication
+	Committed     chan struct{}
+	Retained      map[string]uint64
+	Term          uint64
+	// Pending are transactions that have been written into WAL, but haven't been applied to model yet
+	// (see SyncReplicationPolicy.ApplyAfterAck)
+	Pending [][]*storage.WALRecord
 }
 
 type engineOptions struct {
 	driver                 storage.Driver
 	enableBackgroundVacuum bool
+	vacuumPolicy           VacuumPolicy
+	replayProgress         *model.ReplayProgress
+	isReplica              bool
+	syncPolicy             SyncReplicationPolicy
 }
 
 // Option is a configuration option of NewEngine()
@@ -45,15 +58,47 @@ func EnableBackgroundVacuumOption(enable bool) Option {
 	}
 }
 
+// VacuumPolicyOption sets a policy of background vacuum routine
+func VacuumPolicyOption(policy VacuumPolicy) Option {
+	return func(opts *engineOptions) {
+		opts.vacuumPolicy = policy
+	}
+}
+
+// ReplayProgressOption sets a tracker of write-ahead log replay progress
+// It might be used to report engine startup progress while NewEngine() is running
+func ReplayProgressOption(progress *model.ReplayProgress) Option {
+	return func(opts *engineOptions) {
+		opts.replayProgress = progress
+	}
+}
+
+// ReplicaOption makes engine read-only
+// Replica's data is changed only by transactions of a primary server (see ApplyTx)
+func ReplicaOption() Option {
+	return func(opts *engineOptions) {
+		opts.isReplica = true
+	}
+}
+
+// SyncReplicationOption makes commits wait until specified count of replicas persist them
+func SyncReplicationOption(policy SyncReplicationPolicy) Option {
+	return func(opts *engineOptions) {
+		opts.syncPolicy = policy
+	}
+}
+
 // NewEngine creates new instance of DB engine
 func NewEngine(options ...Option) (Engine, error) {
-	opts := &engineOptions{}
+	opts := &engineOptions{
+		vacuumPolicy: DefaultVacuumPolicy,
+	}
 	for _, f := range options {
 		f(opts)
 	}
 
 	log.Verbosef("initializing engine")
-	root, err := model.Restore(opts.driver)
+	root, err := model.Restore(opts.driver, opts.replayProgress)
 	if err != nil {
 		return nil, err
 	}
@@ -65,14 +110,26 @@ func NewEngine(options ...Option) (Engine, error) {
 	}
 
 	engine := &engine{
-		Model:     root,
-		ModelLock: new(sync.Mutex),
-		WAL:       wal,
-		Storage:   opts.driver,
+		Model:      root,
+		ModelLock:  new(sync.Mutex),
+		VacuumLock: new(sync.Mutex),
+		WAL:        wal,
+		Storage:    opts.driver,
+		IsReplica:  opts.isReplica,
+		Committed:  make(chan struct{}),
+	}
+
+	// Replicas never commit transactions of their own, but a read-only engine might be switched into primary mode later
+	if opts.syncPolicy.Replicas > 0 {
+		log.Printf("commits wait for %d replica(s), timeout is %s, degradation policy is \"%s\"", opts.syncPolicy.Replicas, opts.syncPolicy.Timeout, opts.syncPolicy.Degradation)
+		engine.Sync = newSyncReplication(opts.syncPolicy)
+		if opts.syncPolicy.ApplyAfterAck {
+			engine.Sync.onAck = engine.commitAcked
+		}
 	}
 
 	if opts.enableBackgroundVacuum {
-		engine.runBackgroundVacuum()
+		engine.runBackgroundVacuum(opts.vacuumPolicy)
 	}
 
 	log.Printf("engine is initialized")
@@ -81,9 +138,34 @@ func NewEngine(options ...Option) (Engine, error) {
 }
 
 // BeginTx starts new transaction
+// If primary holds transactions until replicas acknowledge them, it waits for them to be applied first
+// (see SyncReplicationPolicy.ApplyAfterAck), so a transaction never misses changes that precede it within WAL
 func (e *engine) BeginTx() (TX, error) {
+	return e.beginTx(true)
+}
+
+// beginTx starts new transaction, optionally waiting for pending transactions to be applied
+func (e *engine) beginTx(waitForPending bool) (TX, error) {
 	e.ModelLock.Lock()
 
+	var timeout <-chan time.Time
+	for waitForPending && len(e.Pending) > 0 && !e.IsReplica && !e.IsShutDown {
+		if timeout == nil && e.Sync.policy.Timeout > 0 {
+			timer := time.NewTimer(e.Sync.policy.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		committed := e.Committed
+		e.ModelLock.Unlock()
+		select {
+		case <-committed:
+		case <-timeout:
+			return nil, ErrReplicationTimeout
+		}
+		e.ModelLock.Lock()
+	}
+
 	if e.IsShutDown {
 		e.ModelLock.Unlock()
 		return nil, ErrShutdown
@@ -105,12 +187,20 @@ func (e *engine) EndTx() {
 
 // Tx executes a function within a transaction
 func (e *engine) Tx(fn func(tx TX) error) error {
-	tx, err := e.BeginTx()
+	return e.tx(true, fn)
+}
+
+// tx executes a function within a transaction, optionally waiting for pending transactions to be applied
+func (e *engine) tx(waitForPending bool, fn func(tx TX) error) error {
+	tx, err := e.beginTx(waitForPending)
 	if err != nil {
 		return err
 	}
+	isClosed := false
 	defer func() {
-		_ = tx.Close()
+		if !isClosed {
+			_ = tx.Close()
+		}
 	}()
 
 	err = fn(tx)
@@ -118,103 +208,32 @@ func (e *engine) Tx(fn func(tx TX) error) error {
 		return err
 	}
 
+	// Commit errors are returned to caller since transaction is lost in this case
 	tx.Commit()
-	return nil
+	isClosed = true
+	return tx.Close()
 }
 
-// Vacuum performs DB maintenance routine
-func (e *engine) Vacuum() error {
-	return e.Tx(func(tx TX) error {
-		log.Printf("compressing database")
-
-		// Write a model snapshot
-		file, err := e.Storage.SnapshotFile().Write()
-		if err != nil {
-			return err
-		}
-		err = e.Model.WriteSnapshot(file)
-		if err != nil {
-			_ = file.Close()
-			return err
-		}
-		err = file.Close()
-		if err != nil {
-			return err
-		}
-
-		// Close WAL transaction and shut down WAL
-		err = e.WAL.CommitTx()
-		if err != nil {
-			return err
-		}
-		err = e.WAL.Close()
-		if err != nil {
-			return err
-		}
-
-		// Clear WAL file
-		vacuum, err := e.Storage.WALFile().BeginVacuum(e.WAL)
-		if err != nil {
-			return err
-		}
-
-		// Create new WAL file
-		e.WAL, err = vacuum.End()
-		if err != nil {
-			return err
-		}
-
-		// Dump model state to WAL
-		err = e.Model.WriteToWAL(e.WAL)
-		if err != nil {
-			return err
-		}
-		err = e.WAL.Close()
-		if err != nil {
-			return err
-		}
-
-		// Reload engine state
-		e.Model, err = model.Restore(e.Storage)
-		if err != nil {
-			return err
-		}
-		e.WAL, err = e.Storage.WALFile().Write()
-		if err != nil {
-			return err
-		}
-
-		// Start new WAL transaction
-		err = e.WAL.BeginTx()
-		if err != nil {
-			return err
-		}
-
-		log.Printf("database compression completed")
-		return nil
-	})
-}
-
-// runBackgroundVacuum runs Vacuum routine in background
-func (e *engine) runBackgroundVacuum() {
-	go func() {
-		for {
-			time.Sleep(vacuumPeriod)
+// Close shuts engine down gracefully
+func (e *engine) Close() error {
+	// Wait for a running vacuum routine to complete
+	e.VacuumLock.Lock()
+	defer e.VacuumLock.Unlock()
 
-			err := e.Vacuum()
-			if err != nil {
-				if err == ErrShutdown {
-					return
-				}
+	// Reject any new transactions and stop change feeds
+	e.ModelLock.Lock()
+	e.IsShutDown = true
+	for _, feed := range e.Feeds {
+		feed.stop(ErrShutdown)
+	}
+	e.Feeds = nil
+	e.notifyCommit()
+	e.ModelLock.Unlock()
 
-				panic(err)
-			}
-		}
-	}()
-}
+	if e.Sync != nil {
+		e.Sync.close()
+	}
 
-// Close shuts engine down gracefully
-func (e *engine) Close() error {
 	err := e.WAL.Close()
 	if err != nil {
 		return err
@@ -225,14 +244,11 @@ func (e *engine) Close() error {
 		return err
 	}
 
-	defer func() {
-		_ = file.Close()
-	}()
-
 	err = e.Model.WriteSnapshot(file)
 	if err != nil {
+		file.Abort()
 		return err
 	}
 
-	return nil
+	return file.Close()
 }
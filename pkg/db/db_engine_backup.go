@@ -0,0 +1,104 @@
+package db
+
+import (
+	"io"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// Backup returns a consistent point-in-time copy of data model
+// and ID of the last WAL record the copy contains
+// Like Vacuum, it seals active WAL segment and builds a copy off the model lock,
+// but sealed segments are left in place
+// If values are kept within a value log, the copy must be exported before the next vacuum drops them
+func (e *engine) Backup() (*model.Root, uint64, error) {
+	e.VacuumLock.Lock()
+	defer e.VacuumLock.Unlock()
+
+	log.Printf("taking a backup")
+	startTime := time.Now()
+
+	_, _, root, lastID, err := e.sealAndRebuild(false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log.Printf("backup of change #%d has been taken in %s", lastID, time.Since(startTime))
+	return root, lastID, nil
+}
+
+// BackupSince returns WAL records that have been committed after specified change ID
+// and ID of the last committed change at the moment of backup
+// Records are read from WAL up to the last committed transaction, so transactions keep going while they are being read
+func (e *engine) BackupSince(changeID uint64) ([]*storage.WALRecord, uint64, error) {
+	e.VacuumLock.Lock()
+	defer e.VacuumLock.Unlock()
+
+	log.Printf("taking an incremental backup since change #%d", changeID)
+	startTime := time.Now()
+
+	// WAL is read up to the last committed transaction while transactions keep going,
+	// vacuum lock keeps its segments from being dropped
+	e.ModelLock.Lock()
+	if e.IsShutDown {
+		e.ModelLock.Unlock()
+		return nil, 0, ErrShutdown
+	}
+	lastID := e.lastCommitID()
+	e.ModelLock.Unlock()
+	if changeID > lastID {
+		log.Errorf("unable to take a backup since change #%d: last change is #%d", changeID, lastID)
+		return nil, 0, ErrNoSuchChange
+	}
+
+	wal, err := e.Storage.WALFile().ReadLive()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = wal.Close()
+	}()
+
+	records := make([]*storage.WALRecord, 0)
+	isFirst := true
+	for {
+		record, err := wal.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, err
+		}
+
+		// Every record before the first one is either covered by snapshot or doesn't exist,
+		// so WAL contains every change after specified one only if it starts right after it
+		if isFirst && record.ID > changeID+1 {
+			log.Errorf("unable to take a backup since change #%d: wal starts at change #%d", changeID, record.ID)
+			return nil, 0, ErrChangesUnavailable
+		}
+		isFirst = false
+
+		if record.ID > lastID {
+			break
+		}
+		if record.ID > changeID {
+			records = append(records, record)
+		}
+	}
+
+	if isFirst && changeID < lastID {
+		log.Errorf("unable to take a backup since change #%d: wal is empty", changeID)
+		return nil, 0, ErrChangesUnavailable
+	}
+
+	log.Printf(
+		"incremental backup of changes [%d..%d] has been taken in %s, %d records",
+		changeID+1,
+		lastID,
+		time.Since(startTime),
+		len(records),
+	)
+	return records, lastID, nil
+}
@@ -0,0 +1,339 @@
+package db_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// --------------------------------------------------------------------------------------------------------------------
+// Crash recovery tests
+// --------------------------------------------------------------------------------------------------------------------
+
+// crashTestState is an expected state of DB: a map of keys to their values
+type crashTestState map[string][]string
+
+// crashTestTx is a single transaction of crash test workload
+type crashTestTx struct {
+	Apply  func(tx db.TX) error
+	Expect func(state crashTestState)
+}
+
+// crashTestWorkload is a list of transactions that are executed by crash tests
+var crashTestWorkload = []crashTestTx{
+	{
+		Apply: func(tx db.TX) error {
+			_, err := tx.Set("a", []db.Value{db.Value("1"), db.Value("2")})
+			return err
+		},
+		Expect: func(state crashTestState) {
+			state["a"] = []string{"1", "2"}
+		},
+	},
+	{
+		Apply: func(tx db.TX) error {
+			_, err := tx.AddValue("b", db.Value("x"))
+			return err
+		},
+		Expect: func(state crashTestState) {
+			state["b"] = append(state["b"], "x")
+		},
+	},
+	{
+		Apply: func(tx db.TX) error {
+			_, err := tx.Set("a", []db.Value{db.Value("3")})
+			return err
+		},
+		Expect: func(state crashTestState) {
+			state["a"] = []string{"3"}
+		},
+	},
+	{
+		Apply: func(tx db.TX) error {
+			_, err := tx.AddValue("c", db.Value("y"))
+			if err != nil {
+				return err
+			}
+			_, err = tx.AddValue("c", db.Value("z"))
+			if err != nil {
+				return err
+			}
+			_, err = tx.RemoveValue("b", db.Value("x"))
+			return err
+		},
+		Expect: func(state crashTestState) {
+			state["c"] = append(state["c"], "y", "z")
+			delete(state, "b")
+		},
+	},
+	{
+		Apply: func(tx db.TX) error {
+			return tx.RemoveKey("a")
+		},
+		Expect: func(state crashTestState) {
+			delete(state, "a")
+		},
+	},
+}
+
+// TestCrashAfterCommit tests that committed transactions survive a crash
+func TestCrashAfterCommit(t *testing.T) {
+	injector, engine := createFaultyEngine(t)
+
+	committed := runCrashTestWorkload(engine)
+	if committed != len(crashTestWorkload) {
+		t.Fatalf("expected %d committed transactions but got %d", len(crashTestWorkload), committed)
+	}
+
+	checkCrashRecovery(t, injector, "after commit", committed)
+}
+
+// TestCrashAfterRollback tests that a rolled back transaction is never visible after a crash
+// while transactions that have been committed after it survive
+func TestCrashAfterRollback(t *testing.T) {
+	injector, engine := createFaultyEngine(t)
+
+	for _, tx := range crashTestWorkload {
+		err := engine.Tx(func(tx db.TX) error {
+			_, err := tx.Set("rolled_back", []db.Value{db.Value("value")})
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("rollback")
+		})
+		if err == nil {
+			t.Fatalf("expected an error but got nil")
+		}
+
+		err = engine.Tx(tx.Apply)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkCrashRecovery(t, injector, "after rollback", len(crashTestWorkload))
+}
+
+// TestCrashAtFailedWrite tests recovery after a crash that follows a failed write
+// Write failure is injected at every write of the workload one by one
+func TestCrashAtFailedWrite(t *testing.T) {
+	for n := 1; ; n++ {
+		injector, engine := createFaultyEngine(t)
+
+		injector.FailWrite(n)
+		committed := runCrashTestWorkload(engine)
+		checkCrashRecovery(t, injector, fmt.Sprintf("write #%d", n), committed)
+
+		if committed == len(crashTestWorkload) {
+			break
+		}
+	}
+}
+
+// TestCrashAtFailedSync tests recovery after a crash that follows a failed sync
+// Sync failure is injected at every sync of the workload one by one
+func TestCrashAtFailedSync(t *testing.T) {
+	for n := 1; ; n++ {
+		injector, engine := createFaultyEngine(t)
+
+		injector.FailSync(n)
+		committed := runCrashTestWorkload(engine)
+		checkCrashRecovery(t, injector, fmt.Sprintf("sync #%d", n), committed)
+
+		if committed == len(crashTestWorkload) {
+			break
+		}
+	}
+}
+
+// TestCrashWithTornWAL tests recovery of a WAL that is truncated at every possible offset
+func TestCrashWithTornWAL(t *testing.T) {
+	// Find out WAL length after each transaction
+	injector, engine := createFaultyEngine(t)
+	driver := createFaultyDriver(t, injector)
+	txEnds := make([]int64, 0)
+	for _, tx := range crashTestWorkload {
+		err := engine.Tx(tx.Apply)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		txEnds = append(txEnds, walLength(t, driver))
+	}
+
+	for offset := int64(0); offset < txEnds[len(txEnds)-1]; offset++ {
+		injector, engine := createFaultyEngine(t)
+		committed := runCrashTestWorkload(engine)
+		if committed != len(crashTestWorkload) {
+			t.Fatalf("expected %d committed transactions but got %d", len(crashTestWorkload), committed)
+		}
+
+		err := injector.Crash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		segments, err := createFaultyDriver(t, injector).WALFile().Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = injector.TruncateFile(filepath.Join(string(filepath.Separator), segments[0].Name), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 0
+		for expected < len(txEnds) && txEnds[expected] <= offset {
+			expected++
+		}
+
+		checkCrashRecovery(t, injector, fmt.Sprintf("offset %d", offset), expected)
+	}
+}
+
+// TestCrashAtFailedVacuum tests recovery after a crash that follows a failed vacuum
+// Write failure is injected at every write of vacuum routine one by one
+func TestCrashAtFailedVacuum(t *testing.T) {
+	for n := 1; ; n++ {
+		injector, engine := createFaultyEngine(t)
+		committed := runCrashTestWorkload(engine)
+
+		injector.FailWrite(n)
+		err := engine.Vacuum()
+		injector.FailWrite(0)
+
+		checkCrashRecovery(t, injector, fmt.Sprintf("vacuum write #%d", n), committed)
+
+		if err == nil {
+			break
+		}
+	}
+}
+
+func createFaultyDriver(t *testing.T, injector *storage.FaultInjector) storage.Driver {
+	driver, err := storage.NewDriver(storage.InMemoryOption(), storage.FaultInjectionOption(injector))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	return driver
+}
+
+func createFaultyEngine(t *testing.T) (*storage.FaultInjector, db.Engine) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	injector := storage.NewFaultInjector()
+	engine, err := db.NewEngine(db.StorageDriverOption(createFaultyDriver(t, injector)))
+	if err != nil {
+		t.Fatalf("NewEngine failed: %s", err)
+	}
+
+	return injector, engine
+}
+
+func walLength(t *testing.T, driver storage.Driver) int64 {
+	segments, err := driver.WALFile().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var length int64 = 0
+	for _, segment := range segments {
+		length += segment.Length
+	}
+	return length
+}
+
+// runCrashTestWorkload executes workload transactions until one of them fails
+// It returns a count of committed transactions
+func runCrashTestWorkload(engine db.Engine) int {
+	for i, tx := range crashTestWorkload {
+		err := engine.Tx(tx.Apply)
+		if err != nil {
+			return i
+		}
+	}
+
+	return len(crashTestWorkload)
+}
+
+// checkCrashRecovery simulates a crash, restarts an engine
+// and checks that DB contains exactly first "committed" transactions of workload
+func checkCrashRecovery(t *testing.T, injector *storage.FaultInjector, fault string, committed int) {
+	err := injector.Crash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(createFaultyDriver(t, injector)))
+	if err != nil {
+		t.Fatalf("%s: NewEngine failed after crash: %s", fault, err)
+	}
+
+	expected := make(crashTestState)
+	for _, tx := range crashTestWorkload[:committed] {
+		tx.Expect(expected)
+	}
+
+	actual := make(crashTestState)
+	err = engine.Tx(func(tx db.TX) error {
+		list, err := tx.List("", 0, 1000, 0)
+		if err != nil {
+			return err
+		}
+
+		for _, node := range list.Nodes {
+			values := make([]string, len(node.Values))
+			for i, v := range node.Values {
+				values[i] = string(v)
+			}
+			actual[string(node.Key)] = values
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: List failed after crash: %s", fault, err)
+	}
+
+	if formatCrashTestState(expected) != formatCrashTestState(actual) {
+		t.Errorf(
+			"%s: expected %d committed transactions %s but got %s",
+			fault,
+			committed,
+			formatCrashTestState(expected),
+			formatCrashTestState(actual),
+		)
+	}
+
+	// Engine must remain writable after recovery
+	err = engine.Tx(func(tx db.TX) error {
+		_, err := tx.AddValue("after_crash", db.Value("value"))
+		return err
+	})
+	if err != nil {
+		t.Errorf("%s: unable to write after crash: %s", fault, err)
+	}
+}
+
+func formatCrashTestState(state crashTestState) string {
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(fmt.Sprintf("%s=[%s];", k, strings.Join(state[k], ",")))
+	}
+	return sb.String()
+}
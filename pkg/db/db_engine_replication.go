@@ -0,0 +1,496 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// feedBufferSize is a max count of committed transactions buffered for a change feed consumer
+// Once consumer falls further behind, its feed is stopped with a ErrFeedOverflow error
+const feedBufferSize = 1024
+
+// changeFeed passes committed transactions to a consumer
+type changeFeed struct {
+	engine    *engine
+	pending   chan []*storage.WALRecord
+	output    chan []*storage.WALRecord
+	done      chan struct{}
+	mutex     sync.Mutex
+	err       error
+	isStopped bool
+}
+
+// Subscribe returns a feed of transactions that have been committed after specified change ID
+// Committed transactions are read from WAL first, then new ones are passed as soon as they are committed
+// If some of these transactions have been dropped by vacuum routine, a ErrChangesUnavailable error is returned
+func (e *engine) Subscribe(changeID uint64) (ChangeFeed, error) {
+	feed := &changeFeed{
+		engine:  e,
+		pending: make(chan []*storage.WALRecord, feedBufferSize),
+		output:  make(chan []*storage.WALRecord),
+		done:    make(chan struct{}),
+	}
+
+	// Feed is registered before WAL is read, so every transaction is either read from WAL or passed by publish()
+	e.ModelLock.Lock()
+	if e.IsShutDown {
+		e.ModelLock.Unlock()
+		return nil, ErrShutdown
+	}
+	e.Feeds = append(e.Feeds, feed)
+	e.ModelLock.Unlock()
+
+	records, lastID, err := e.BackupSince(changeID)
+	if err != nil {
+		feed.Close()
+		return nil, err
+	}
+
+	log.Printf("change feed has been started after change #%d", changeID)
+	go feed.run(splitTransactions(records), lastID)
+	return feed, nil
+}
+
+// publish passes a committed transaction to every change feed
+// Model lock must be held by caller
+func (e *engine) publish(records []*storage.WALRecord) {
+	e.notifyCommit()
+	if len(e.Feeds) == 0 {
+		return
+	}
+
+	feeds := e.Feeds[:0]
+	for _, feed := range e.Feeds {
+		select {
+		case feed.pending <- records:
+			feeds = append(feeds, feed)
+		default:
+			log.Errorf("change feed has fallen behind at tx #%d", records[0].TxID)
+			feed.stop(ErrFeedOverflow)
+		}
+	}
+	e.Feeds = feeds
+}
+
+// ApplyTx writes a transaction committed by a primary server into WAL and applies it to data model
+// It's used by replicas only (see ReplicaOption), transactions that have been applied already are skipped
+// If transactions are held until they are acknowledged, it's applied once primary reports it committed (see SetCommitIndex)
+func (e *engine) ApplyTx(records []*storage.WALRecord) error {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	if e.IsShutDown {
+		return ErrShutdown
+	}
+	if !e.IsReplica {
+		return fmt.Errorf("engine is not a replica")
+	}
+
+	isWritten, err := e.WAL.WriteTx(records)
+	if err != nil || !isWritten {
+		return err
+	}
+
+	if e.holdsCommits() {
+		e.Pending = append(e.Pending, records)
+	} else {
+		err = e.applyRecords(records)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Replicas might be followed by replicas of their own
+	e.publish(records)
+	return nil
+}
+
+// SetCommitIndex applies held transactions up to specified change ID (see SyncReplicationPolicy.ApplyAfterAck)
+// It's used by replicas once primary reports that their transactions have been committed
+func (e *engine) SetCommitIndex(changeID uint64) error {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	count := 0
+	for count < len(e.Pending) && commitIDOf(e.Pending[count]) <= changeID {
+		count++
+	}
+	return e.applyPending(count)
+}
+
+// CommitIndex returns ID of the last committed WAL record that has been applied to data model
+// It differs from LastCommitID while transactions are held until replicas acknowledge them
+func (e *engine) CommitIndex() uint64 {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	return e.commitIndex()
+}
+
+// commitIndex returns ID of the last committed WAL record that has been applied to data model
+// Model lock must be held by caller
+func (e *engine) commitIndex() uint64 {
+	// Record IDs are contiguous, so the first held transaction follows the last applied one
+	if len(e.Pending) > 0 {
+		return e.Pending[0][0].ID - 1
+	}
+	return e.lastCommitID()
+}
+
+// holdsCommits returns true if transactions are applied only once replicas acknowledge them
+func (e *engine) holdsCommits() bool {
+	return e.Sync != nil && e.Sync.policy.ApplyAfterAck
+}
+
+// commitAcked applies held transactions that enough replicas have acknowledged
+// Like a Raft leader, primary counts only acknowledgements of its own term's transactions:
+// once such transaction is applied, every transaction before it is applied as well
+func (e *engine) commitAcked(changeID uint64) {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	// Former primary learns which transactions are committed from a new one
+	if e.IsReplica {
+		return
+	}
+
+	count := 0
+	for i := 0; i < len(e.Pending) && commitIDOf(e.Pending[i]) <= changeID; i++ {
+		if e.Pending[i][len(e.Pending[i])-1].CommitTerm() == e.Term {
+			count = i + 1
+		}
+	}
+
+	err := e.applyPending(count)
+	if err != nil {
+		log.Errorf("unable to apply acknowledged transactions: %s", err)
+	}
+}
+
+// applyPending applies specified count of held transactions
+// Model lock must be held by caller
+func (e *engine) applyPending(count int) error {
+	if count == 0 {
+		return nil
+	}
+
+	for _, records := range e.Pending[:count] {
+		err := e.applyRecords(records)
+		if err != nil {
+			return err
+		}
+	}
+	e.Pending = e.Pending[count:]
+	e.notifyCommit()
+	return nil
+}
+
+// applyRecords applies a committed transaction to data model
+// Model lock must be held by caller
+func (e *engine) applyRecords(records []*storage.WALRecord) error {
+	for _, record := range records {
+		if record.Type == storage.WALCommitTx {
+			continue
+		}
+
+		err := e.Model.Apply(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitIDOf returns ID of transaction's commit record
+func commitIDOf(records []*storage.WALRecord) uint64 {
+	return records[len(records)-1].ID
+}
+
+// SetReadOnly switches engine between primary and replica modes (see ReplicaOption)
+// It's used by cluster nodes that change their roles
+// New primary writes an empty transaction if it holds transactions of previous primaries,
+// so they are applied once replicas acknowledge it (see commitAcked)
+func (e *engine) SetReadOnly(readOnly bool) {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	wasReplica := e.IsReplica
+	e.IsReplica = readOnly
+
+	// Transactions that wait for held ones either go on or fail with ErrReadOnly
+	e.notifyCommit()
+
+	if wasReplica && !readOnly && len(e.Pending) > 0 {
+		err := e.writeCheckpoint()
+		if err != nil {
+			log.Errorf("unable to write an empty transaction: %s", err)
+		}
+	}
+}
+
+// SetWriteDeadline makes engine reject writes and commits after specified time, zero time removes the deadline
+// It doesn't wait for running transactions, so a leader's lease is enforced even while model is locked
+func (e *engine) SetWriteDeadline(deadline time.Time) {
+	var value int64
+	if !deadline.IsZero() {
+		value = deadline.UnixNano()
+	}
+	atomic.StoreInt64(&e.WriteDeadline, value)
+}
+
+// isPastWriteDeadline returns true if writes are rejected by a deadline (see SetWriteDeadline)
+func (e *engine) isPastWriteDeadline() bool {
+	deadline := atomic.LoadInt64(&e.WriteDeadline)
+	return deadline != 0 && time.Now().UnixNano() >= deadline
+}
+
+// SetTerm sets a term of cluster leader that is stamped into subsequent commit records
+func (e *engine) SetTerm(term uint64) {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	e.WAL.SetTerm(term)
+	e.Term = term
+}
+
+// Install replaces replica's data with a snapshot of primary's data up to specified change ID
+// It's used when replica's WAL has diverged from primary's one or when primary has dropped changes replica needs
+// Every change feed is stopped, since feeds can't be continued after data has been replaced
+func (e *engine) Install(root *model.Root, changeID uint64) error {
+	e.VacuumLock.Lock()
+	defer e.VacuumLock.Unlock()
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	if e.IsShutDown {
+		return ErrShutdown
+	}
+	if !e.IsReplica {
+		return fmt.Errorf("engine is not a replica")
+	}
+
+	log.Printf("installing a snapshot of change #%d", changeID)
+	segments, err := e.Storage.WALFile().Segments()
+	if err != nil {
+		return err
+	}
+	segment := 1
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1].Index + 1
+	}
+
+	// Engine can't be used anymore if anything fails after WAL has been closed
+	err = e.WAL.Close()
+	if err != nil {
+		return err
+	}
+	e.IsShutDown = true
+
+	file, err := e.Storage.SnapshotFile().Write()
+	if err != nil {
+		return err
+	}
+	err = root.WriteSnapshot(file)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = e.Storage.WALFile().Reset(segment, changeID, 0)
+	if err != nil {
+		return err
+	}
+
+	e.Model, err = model.Restore(e.Storage, nil)
+	if err != nil {
+		return err
+	}
+	e.WAL, err = e.Storage.WALFile().Write()
+	if err != nil {
+		return err
+	}
+	e.IsShutDown = false
+	e.Pending = nil
+
+	for _, feed := range e.Feeds {
+		feed.stop(ErrChangesUnavailable)
+	}
+	e.Feeds = nil
+	e.notifyCommit()
+
+	log.Printf("snapshot of change #%d has been installed", changeID)
+	return nil
+}
+
+// SyncStatus returns a state of synchronous replication (see SyncReplicationOption)
+func (e *engine) SyncStatus() SyncReplicationStatus {
+	if e.Sync == nil {
+		return SyncReplicationStatus{}
+	}
+
+	return e.Sync.status()
+}
+
+// LastCommitID returns ID of the last committed WAL record
+// Replica requests transactions after this ID (see Subscribe)
+func (e *engine) LastCommitID() uint64 {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	return e.lastCommitID()
+}
+
+// lastCommitID returns ID of the last committed WAL record
+// Model lock must be held by caller
+func (e *engine) lastCommitID() uint64 {
+	// Replica's WAL might have no records at all if every segment has been dropped by vacuum
+	// Model can't be used otherwise, since it doesn't count commit records
+	id := e.WAL.LastCommit().ID
+	if id == 0 {
+		id = e.Model.LastChangeID
+	}
+	return id
+}
+
+// WaitForCommit blocks until a change with specified ID is committed (or applied by a replica)
+// Context error is returned if context is done first, ErrShutdown is returned if engine is closed
+func (e *engine) WaitForCommit(ctx context.Context, changeID uint64) error {
+	for {
+		e.ModelLock.Lock()
+		isShutDown := e.IsShutDown
+		lastID := e.commitIndex()
+		committed := e.Committed
+		e.ModelLock.Unlock()
+
+		if isShutDown {
+			return ErrShutdown
+		}
+		if lastID >= changeID {
+			return nil
+		}
+
+		select {
+		case <-committed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyCommit wakes up everyone who waits for a commit (see WaitForCommit)
+// Model lock must be held by caller
+func (e *engine) notifyCommit() {
+	close(e.Committed)
+	e.Committed = make(chan struct{})
+}
+
+// Transactions returns a channel of committed transactions, each one ends with a WALCommitTx record
+func (f *changeFeed) Transactions() <-chan []*storage.WALRecord {
+	return f.output
+}
+
+// Ack confirms that consumer has persisted transactions up to specified change ID
+// Consumers that acknowledge transactions are counted as replicas by synchronous replication
+func (f *changeFeed) Ack(changeID uint64) {
+	if f.engine.Sync != nil {
+		f.engine.Sync.ack(f, changeID)
+	}
+}
+
+// Err returns a reason why the channel has been closed, nil if feed has been closed by consumer
+func (f *changeFeed) Err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.err
+}
+
+// Close stops the feed
+func (f *changeFeed) Close() {
+	e := f.engine
+	e.ModelLock.Lock()
+	for i, feed := range e.Feeds {
+		if feed == f {
+			e.Feeds = append(e.Feeds[:i], e.Feeds[i+1:]...)
+			break
+		}
+	}
+	e.ModelLock.Unlock()
+
+	f.stop(nil)
+}
+
+// stop makes the feed close its channel
+func (f *changeFeed) stop(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.isStopped {
+		return
+	}
+	f.isStopped = true
+	f.err = err
+	close(f.done)
+
+	if f.engine.Sync != nil {
+		f.engine.Sync.remove(f)
+	}
+}
+
+// run passes transactions read from WAL, then transactions committed after lastID
+func (f *changeFeed) run(transactions [][]*storage.WALRecord, lastID uint64) {
+	defer close(f.output)
+
+	for _, records := range transactions {
+		select {
+		case f.output <- records:
+		case <-f.done:
+			return
+		}
+	}
+
+	for {
+		select {
+		case records := <-f.pending:
+			// Transactions that have been committed before WAL has been read are read from WAL already
+			if records[len(records)-1].ID <= lastID {
+				continue
+			}
+
+			select {
+			case f.output <- records:
+			case <-f.done:
+				return
+			}
+
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// splitTransactions splits WAL records into transactions
+// Records of an incomplete transaction are dropped
+func splitTransactions(records []*storage.WALRecord) [][]*storage.WALRecord {
+	transactions := make([][]*storage.WALRecord, 0)
+	start := 0
+	for i, record := range records {
+		if record.Type == storage.WALCommitTx {
+			transactions = append(transactions, records[start:i+1])
+			start = i + 1
+		}
+	}
+
+	return transactions
+}
@@ -0,0 +1,406 @@
+package db_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestReplication(t *testing.T) {
+	primary := createEngine(t)
+	write := func(i int) {
+		err := primary.Tx(func(tx db.TX) error {
+			_, e := tx.Set(db.Key(fmt.Sprintf("key_%d", i)), []db.Value{db.Value(fmt.Sprintf("value_%d", i))})
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		write(i)
+	}
+
+	// Replica is bootstrapped from a full backup
+	root, changeID, err := primary.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := driver.SnapshotFile().Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = root.WriteSnapshot(file)
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = driver.WALFile().Reset(1, changeID, 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replica, err := db.NewEngine(db.StorageDriverOption(driver), db.ReplicaOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := primary.Subscribe(replica.LastCommitID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 5; i < 10; i++ {
+		write(i)
+
+		// Rolled back transactions are dropped, vacuum writes transactions of its own
+		_ = primary.Tx(func(tx db.TX) error {
+			_, _ = tx.AddValue("rolled_back", db.Value("value"))
+			return fmt.Errorf("rollback")
+		})
+		if i == 7 {
+			err = primary.Vacuum()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	catchUp(t, primary, replica, feed)
+
+	for i := 0; i < 10; i++ {
+		checkReplicatedKey(t, replica, i)
+	}
+
+	// Replica rejects writes
+	for _, fn := range []func(tx db.TX) error{
+		func(tx db.TX) error {
+			_, e := tx.AddValue("key", db.Value("value"))
+			return e
+		},
+		func(tx db.TX) error {
+			_, e := tx.Set("key", []db.Value{db.Value("value")})
+			return e
+		},
+	} {
+		err = replica.Tx(fn)
+		if err != db.ErrReadOnly {
+			t.Errorf("ERROR: expected %s but got %v", db.ErrReadOnly, err)
+		}
+	}
+
+	// Replica continues from its last change after restart
+	feed.Close()
+	err = replica.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err = db.NewEngine(db.StorageDriverOption(driver), db.ReplicaOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err = primary.Subscribe(replica.LastCommitID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	write(10)
+	catchUp(t, primary, replica, feed)
+	checkReplicatedKey(t, replica, 10)
+}
+
+func TestChangeFeedOverflow(t *testing.T) {
+	engine := createEngine(t)
+
+	feed, err := engine.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Feed is stopped once its consumer falls too far behind
+	for i := 0; i < 2000; i++ {
+		err = engine.Tx(func(tx db.TX) error {
+			_, e := tx.AddValue("key", db.Value("value"))
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range feed.Transactions() {
+	}
+	if feed.Err() != db.ErrFeedOverflow {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrFeedOverflow, feed.Err())
+	}
+}
+
+// TestSubscribeKeepsWAL tests that subscribing to changes neither rolls WAL segments nor writes transactions
+func TestSubscribeKeepsWAL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = engine.Close()
+	}()
+
+	err = engine.Tx(func(tx db.TX) error {
+		_, e := tx.AddValue("key", db.Value("value"))
+		return e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := driver.WALFile().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changeID := engine.LastCommitID()
+
+	for i := 0; i < 20; i++ {
+		feed, err := engine.Subscribe(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := <-feed.Transactions()
+		if records[len(records)-1].ID != changeID {
+			t.Errorf("ERROR: feed has started with %v", records)
+		}
+		feed.Close()
+	}
+
+	after, err := driver.WALFile().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(segments) {
+		t.Errorf("ERROR: wal had %d segments, now it has %d", len(segments), len(after))
+	}
+	if engine.LastCommitID() != changeID {
+		t.Errorf("ERROR: last change was #%d, now it's #%d", changeID, engine.LastCommitID())
+	}
+}
+
+func TestWaitForCommit(t *testing.T) {
+	engine := createEngine(t)
+	write := func() uint64 {
+		var version uint64
+		err := engine.Tx(func(tx db.TX) error {
+			node, e := tx.AddValue("key", db.Value("value"))
+			if e == nil {
+				version = node.Version
+			}
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	version := write()
+	err := engine.WaitForCommit(context.Background(), version)
+	if err != nil {
+		t.Errorf("ERROR: committed change #%d hasn't been awaited: %s", version, err)
+	}
+
+	// Waiter is woken up by a commit
+	done := make(chan error, 1)
+	go func() {
+		done <- engine.WaitForCommit(context.Background(), version+2)
+	}()
+	write()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("ERROR: WaitForCommit() failed: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("ERROR: WaitForCommit() hasn't returned after commit")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = engine.WaitForCommit(ctx, version+100)
+	if err != context.DeadlineExceeded {
+		t.Errorf("ERROR: expected %s but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	engine := createEngine(t)
+	write := func(key db.Key, delay time.Duration) error {
+		return engine.Tx(func(tx db.TX) error {
+			_, e := tx.AddValue(key, db.Value("value"))
+			time.Sleep(delay)
+			return e
+		})
+	}
+
+	err := write("key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine.SetWriteDeadline(time.Now().Add(-time.Second))
+	err = write("expired", 0)
+	if err != db.ErrReadOnly {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrReadOnly, err)
+	}
+	err = engine.Tx(func(tx db.TX) error {
+		_, e := tx.List("", 0, 10, 0)
+		return e
+	})
+	if err != nil {
+		t.Errorf("ERROR: read has failed after write deadline: %s", err)
+	}
+
+	// Transaction that has started before deadline isn't committed after it
+	changeID := engine.LastCommitID()
+	engine.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	err = write("late", 100*time.Millisecond)
+	if err != db.ErrReadOnly {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrReadOnly, err)
+	}
+	if engine.LastCommitID() != changeID {
+		t.Errorf("ERROR: change #%d has been committed after write deadline", engine.LastCommitID())
+	}
+	err = engine.Tx(func(tx db.TX) error {
+		_, e := tx.Get("late")
+		return e
+	})
+	if err != db.ErrNoSuchKey {
+		t.Errorf("ERROR: change that hasn't been committed is visible (%v)", err)
+	}
+
+	engine.SetWriteDeadline(time.Time{})
+	err = write("key", 0)
+	if err != nil {
+		t.Errorf("ERROR: write has failed without a deadline: %s", err)
+	}
+}
+
+func TestWriteDeadlineFailover(t *testing.T) {
+	primary := createEngine(t)
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := db.NewEngine(db.StorageDriverOption(driver), db.ReplicaOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(engine db.Engine, key db.Key, delay time.Duration) error {
+		return engine.Tx(func(tx db.TX) error {
+			_, e := tx.AddValue(key, db.Value("value"))
+			time.Sleep(delay)
+			return e
+		})
+	}
+
+	err = write(primary, "key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err := primary.Subscribe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catchUp(t, primary, replica, feed)
+	feed.Close()
+
+	// Primary's lease expires while a transaction is running
+	primary.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	err = write(primary, "late", 100*time.Millisecond)
+	if err != db.ErrReadOnly {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrReadOnly, err)
+	}
+
+	// Replica is promoted, and old primary follows it
+	primary.SetReadOnly(true)
+	primary.SetWriteDeadline(time.Time{})
+	replica.SetReadOnly(false)
+	err = write(replica, "next", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed, err = replica.Subscribe(primary.LastCommitID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+	catchUp(t, replica, primary, feed)
+
+	err = primary.Tx(func(tx db.TX) error {
+		_, e := tx.Get("next")
+		return e
+	})
+	if err != nil {
+		t.Errorf("ERROR: change of new primary hasn't been applied: %s", err)
+	}
+}
+
+// catchUp applies transactions of a change feed to a replica until it reaches primary's last change
+func catchUp(t *testing.T, primary, replica db.Engine, feed db.ChangeFeed) {
+	timeout := time.After(10 * time.Second)
+	for replica.LastCommitID() < primary.LastCommitID() {
+		select {
+		case records, ok := <-feed.Transactions():
+			if !ok {
+				t.Fatalf("ERROR: change feed has been stopped: %v", feed.Err())
+			}
+
+			err := replica.ApplyTx(records)
+			if err != nil {
+				t.Fatalf("ERROR: ApplyTx() failed: %s", err)
+			}
+
+			// Transactions that have been applied already are skipped
+			err = replica.ApplyTx(records)
+			if err != nil {
+				t.Fatalf("ERROR: repeated ApplyTx() failed: %s", err)
+			}
+
+		case <-timeout:
+			t.Fatalf("ERROR: replica is at #%d while primary is at #%d", replica.LastCommitID(), primary.LastCommitID())
+		}
+	}
+}
+
+func checkReplicatedKey(t *testing.T, replica db.Engine, i int) {
+	err := replica.Tx(func(tx db.TX) error {
+		node, e := tx.Get(db.Key(fmt.Sprintf("key_%d", i)))
+		if e != nil {
+			return e
+		}
+		if len(node.Values) != 1 || string(node.Values[0]) != fmt.Sprintf("value_%d", i) {
+			return fmt.Errorf("unexpected node %s", node)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ERROR: key_%d: %s", i, err)
+	}
+}
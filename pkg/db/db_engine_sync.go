@@ -0,0 +1,254 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncDegradation defines what happens to a commit that hasn't been acknowledged by replicas in time
+type SyncDegradation int
+
+const (
+	// DegradeToAsync acknowledges a commit anyway and switches to asynchronous replication
+	// Synchronous replication is restored once enough replicas catch up with primary
+	DegradeToAsync SyncDegradation = iota
+
+	// DegradeToError fails a commit with a ErrReplicationTimeout error
+	// Transaction is committed locally anyway, so it's visible to subsequent reads (unless ApplyAfterAck is set)
+	DegradeToError
+)
+
+// ParseSyncDegradation parses a name of degradation policy ("async" or "error")
+func ParseSyncDegradation(str string) (SyncDegradation, error) {
+	switch strings.ToLower(str) {
+	case "async":
+		return DegradeToAsync, nil
+	case "error":
+		return DegradeToError, nil
+	default:
+		return 0, fmt.Errorf("expected \"async\" or \"error\" but got \"%s\"", str)
+	}
+}
+
+func (d SyncDegradation) String() string {
+	switch d {
+	case DegradeToAsync:
+		return "async"
+	case DegradeToError:
+		return "error"
+	default:
+		return fmt.Sprintf("SyncDegradation(%d)", int(d))
+	}
+}
+
+// SyncReplicationPolicy defines how commits wait for replicas
+// By default replication is primary-first: a transaction is applied and visible on primary before replicas acknowledge it,
+// so synchronous replication only delays commit acknowledgement (see ApplyAfterAck)
+type SyncReplicationPolicy struct {
+	// Replicas is a count of replicas that must persist a transaction before its commit is acknowledged
+	// Zero value turns synchronous replication off
+	Replicas int
+
+	// Timeout is a max time to wait for replicas, zero value stands for "wait forever"
+	Timeout time.Duration
+
+	// Degradation defines what happens once timeout expires
+	Degradation SyncDegradation
+
+	// ApplyAfterAck makes primary apply a transaction to data model only once enough replicas have acknowledged it,
+	// so a transaction that never reaches them is never visible. It's meant for cluster nodes:
+	// primary's transactions start only after previous commit is applied,
+	// and replicas apply transactions once primary reports them committed (see Engine.SetCommitIndex)
+	ApplyAfterAck bool
+}
+
+// SyncReplicationStatus is a state of synchronous replication
+type SyncReplicationStatus struct {
+	// Required is a count of replicas that must acknowledge each commit
+	Required int
+
+	// Connected is a count of connected replicas that acknowledge commits
+	Connected int
+
+	// IsDegraded is true if commits don't wait for replicas until enough of them catch up
+	IsDegraded bool
+}
+
+// syncReplication makes commits wait for acknowledgements of change feed consumers (see ChangeFeed.Ack)
+type syncReplication struct {
+	policy     SyncReplicationPolicy
+	mutex      sync.Mutex
+	acks       map[*changeFeed]uint64
+	waiters    []*syncWaiter
+	lastCommit uint64
+	isDegraded bool
+	done       chan struct{}
+	onAck      func(changeID uint64)
+}
+
+// syncWaiter is a commit waiting for replicas
+type syncWaiter struct {
+	changeID uint64
+	ready    chan struct{}
+}
+
+func newSyncReplication(policy SyncReplicationPolicy) *syncReplication {
+	return &syncReplication{
+		policy: policy,
+		acks:   make(map[*changeFeed]uint64),
+		done:   make(chan struct{}),
+	}
+}
+
+// wait blocks until enough replicas have acknowledged specified change
+func (s *syncReplication) wait(changeID uint64) error {
+	s.mutex.Lock()
+	if changeID > s.lastCommit {
+		s.lastCommit = changeID
+	}
+	if s.isDegraded || s.countAcks(changeID) >= s.policy.Replicas {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	waiter := &syncWaiter{changeID: changeID, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, waiter)
+	s.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if s.policy.Timeout > 0 {
+		timer := time.NewTimer(s.policy.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-s.done:
+		return ErrShutdown
+	case <-timeout:
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Change might have been acknowledged while mutex was being acquired
+	select {
+	case <-waiter.ready:
+		return nil
+	default:
+	}
+
+	if s.policy.Degradation == DegradeToError {
+		s.removeWaiter(waiter)
+		log.Errorf("change #%d hasn't been acknowledged by %d replica(s) in %s", changeID, s.policy.Replicas, s.policy.Timeout)
+		return ErrReplicationTimeout
+	}
+
+	// Every pending commit is acknowledged, since replicas are not waited for anymore
+	log.Errorf("change #%d hasn't been acknowledged by %d replica(s) in %s, switching to asynchronous replication", changeID, s.policy.Replicas, s.policy.Timeout)
+	s.isDegraded = true
+	for _, w := range s.waiters {
+		close(w.ready)
+	}
+	s.waiters = nil
+	return nil
+}
+
+// ack records that a change feed consumer has persisted changes up to specified ID
+// Then onAck callback (if any) gets ID of the last change that enough replicas have acknowledged
+func (s *syncReplication) ack(feed *changeFeed, changeID uint64) {
+	s.mutex.Lock()
+	if acked, exists := s.acks[feed]; exists && acked >= changeID {
+		s.mutex.Unlock()
+		return
+	}
+	s.acks[feed] = changeID
+
+	waiters := s.waiters[:0]
+	for _, w := range s.waiters {
+		if s.countAcks(w.changeID) >= s.policy.Replicas {
+			close(w.ready)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	s.waiters = waiters
+
+	if s.isDegraded && s.countAcks(s.lastCommit) >= s.policy.Replicas {
+		log.Printf("%d replica(s) have caught up at change #%d, switching back to synchronous replication", s.policy.Replicas, s.lastCommit)
+		s.isDegraded = false
+	}
+	acked := s.ackedID()
+	s.mutex.Unlock()
+
+	// Callback is invoked without the lock, since it takes model lock
+	if s.onAck != nil && acked != 0 {
+		s.onAck(acked)
+	}
+}
+
+// remove stops counting acknowledgements of a change feed
+func (s *syncReplication) remove(feed *changeFeed) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.acks, feed)
+}
+
+// status returns a state of synchronous replication
+func (s *syncReplication) status() SyncReplicationStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return SyncReplicationStatus{
+		Required:   s.policy.Replicas,
+		Connected:  len(s.acks),
+		IsDegraded: s.isDegraded,
+	}
+}
+
+// close releases waiting commits on engine shutdown
+func (s *syncReplication) close() {
+	close(s.done)
+}
+
+// countAcks returns a count of consumers that have acknowledged specified change
+func (s *syncReplication) countAcks(changeID uint64) int {
+	count := 0
+	for _, acked := range s.acks {
+		if acked >= changeID {
+			count++
+		}
+	}
+
+	return count
+}
+
+// ackedID returns ID of the last change that enough replicas have acknowledged, zero if there's no such change
+func (s *syncReplication) ackedID() uint64 {
+	if len(s.acks) < s.policy.Replicas {
+		return 0
+	}
+
+	acks := make([]uint64, 0, len(s.acks))
+	for _, acked := range s.acks {
+		acks = append(acks, acked)
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i] > acks[j] })
+	return acks[s.policy.Replicas-1]
+}
+
+// removeWaiter drops a commit from waiting list
+func (s *syncReplication) removeWaiter(waiter *syncWaiter) {
+	for i, w := range s.waiters {
+		if w == waiter {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package db_test
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestSyncReplication(t *testing.T) {
+	engine := createSyncEngine(t, db.SyncReplicationPolicy{
+		Replicas:    1,
+		Timeout:     100 * time.Millisecond,
+		Degradation: db.DegradeToError,
+	})
+	defer func() {
+		_ = engine.Close()
+	}()
+
+	// Commit fails without replicas, but transaction is committed locally anyway
+	err := addValue(engine, "key-1")
+	if err != db.ErrReplicationTimeout {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrReplicationTimeout, err)
+	}
+	checkKeyExists(t, engine, "key-1")
+
+	// Commit is acknowledged once replica persists it
+	feed, err := engine.Subscribe(engine.LastCommitID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for records := range feed.Transactions() {
+			feed.Ack(records[len(records)-1].ID)
+		}
+	}()
+
+	err = addValue(engine, "key-2")
+	if err != nil {
+		t.Errorf("ERROR: commit has failed: %s", err)
+	}
+	status := engine.SyncStatus()
+	if status.Required != 1 || status.Connected != 1 || status.IsDegraded {
+		t.Errorf("ERROR: unexpected status %+v", status)
+	}
+
+	// Replica stops counting once its feed is closed
+	feed.Close()
+	err = addValue(engine, "key-3")
+	if err != db.ErrReplicationTimeout {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrReplicationTimeout, err)
+	}
+}
+
+func TestSyncReplicationDegradation(t *testing.T) {
+	engine := createSyncEngine(t, db.SyncReplicationPolicy{
+		Replicas:    1,
+		Timeout:     100 * time.Millisecond,
+		Degradation: db.DegradeToAsync,
+	})
+	defer func() {
+		_ = engine.Close()
+	}()
+
+	feed, err := engine.Subscribe(engine.LastCommitID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	// Commit is acknowledged once timeout expires, subsequent commits don't wait for replicas
+	err = addValue(engine, "key-1")
+	if err != nil {
+		t.Errorf("ERROR: commit has failed: %s", err)
+	}
+	if !engine.SyncStatus().IsDegraded {
+		t.Errorf("ERROR: replication should be degraded")
+	}
+
+	start := time.Now()
+	err = addValue(engine, "key-2")
+	if err != nil {
+		t.Errorf("ERROR: commit has failed: %s", err)
+	}
+	if time.Since(start) >= 100*time.Millisecond {
+		t.Errorf("ERROR: degraded commit has waited for replicas")
+	}
+
+	// Synchronous replication is restored once replica catches up
+	var lastID uint64
+	for lastID < engine.LastCommitID() {
+		records := <-feed.Transactions()
+		lastID = records[len(records)-1].ID
+	}
+	feed.Ack(lastID)
+	if engine.SyncStatus().IsDegraded {
+		t.Errorf("ERROR: replication should not be degraded")
+	}
+}
+
+func TestSyncReplicationApplyAfterAck(t *testing.T) {
+	engine := createSyncEngine(t, db.SyncReplicationPolicy{
+		Replicas:      1,
+		Timeout:       100 * time.Millisecond,
+		Degradation:   db.DegradeToError,
+		ApplyAfterAck: true,
+	})
+	defer func() {
+		_ = engine.Close()
+	}()
+
+	feed, err := engine.Subscribe(engine.LastCommitID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	// Transaction that hasn't been acknowledged is written into WAL, but it's not applied
+	err = addValue(engine, "key-1")
+	if err != db.ErrReplicationTimeout {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrReplicationTimeout, err)
+	}
+	if engine.CommitIndex() >= engine.LastCommitID() {
+		t.Errorf("ERROR: transaction has been applied at #%d", engine.CommitIndex())
+	}
+	err = engine.Tx(func(tx db.TX) error { return nil })
+	if err != db.ErrReplicationTimeout {
+		t.Errorf("ERROR: transaction hasn't waited for a held one: %v", err)
+	}
+
+	// Snapshots contain applied transactions only
+	err = engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, changeID, err := engine.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.GetNode("key-1") != nil || changeID != engine.CommitIndex() {
+		t.Errorf("ERROR: backup of change #%d contains a held transaction", changeID)
+	}
+
+	// Transaction is applied once replica acknowledges it, even after commit has failed
+	feed.Ack(engine.LastCommitID())
+	if engine.CommitIndex() != engine.LastCommitID() {
+		t.Errorf("ERROR: transactions have been applied up to #%d instead of #%d", engine.CommitIndex(), engine.LastCommitID())
+	}
+	checkKeyExists(t, engine, "key-1")
+	root, _, err = engine.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.GetNode("key-1") == nil {
+		t.Errorf("ERROR: backup doesn't contain an applied transaction")
+	}
+}
+
+func createSyncEngine(t *testing.T, policy db.SyncReplicationPolicy) db.Engine {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver), db.SyncReplicationOption(policy))
+	if err != nil {
+		t.Fatalf("ERROR: NewEngine() failed: %s", err)
+	}
+
+	return engine
+}
+
+func addValue(engine db.Engine, key db.Key) error {
+	return engine.Tx(func(tx db.TX) error {
+		_, err := tx.AddValue(key, db.Value("value"))
+		return err
+	})
+}
+
+func checkKeyExists(t *testing.T, engine db.Engine, key db.Key) {
+	err := engine.Tx(func(tx db.TX) error {
+		_, err := tx.Get(key)
+		return err
+	})
+	if err != nil {
+		t.Errorf("ERROR: %s: %s", key, err)
+	}
+}
@@ -2,13 +2,16 @@ package db_test
 
 import (
 	"fmt"
+	"github.com/kapitanov/natandb/pkg/model"
 	"github.com/kapitanov/natandb/pkg/storage"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/kapitanov/natandb/pkg/db"
 	l "github.com/kapitanov/natandb/pkg/log"
@@ -46,6 +49,7 @@ func TestRemoveValueNoSuchKey(t *testing.T) {
 		t.Errorf("ERROR: expected node=nil but got %s", node)
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -66,6 +70,7 @@ func TestRemoveKeyNoSuchKey(t *testing.T) {
 		t.Errorf("ERROR: expected %s but got %s", db.ErrNoSuchKey, err)
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -95,6 +100,7 @@ func TestSetNewKey(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -120,6 +126,7 @@ func TestSetNewKeyWithEmptyValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -151,6 +158,7 @@ func TestSetExistingKey(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -161,6 +169,38 @@ func TestSetExistingKey(t *testing.T) {
 	checkGetNode(t, engine, node)
 }
 
+func TestSetExistingKeyWithDuplicateValues(t *testing.T) {
+	engine := createEngine(t)
+	tx, err := engine.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+	values := []db.Value{db.Value("old value"), db.Value("old value"), db.Value("other value")}
+	node, err := tx.Set(key, values)
+	if err != nil {
+		t.Errorf("ERROR: expected no error but got %s", err)
+		return
+	}
+
+	values = []db.Value{db.Value("value")}
+	node, err = tx.Set(key, values)
+	if err != nil {
+		t.Errorf("ERROR: expected no error but got %s", err)
+		return
+	}
+
+	tx.Commit()
+	err = tx.Close()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	checkNode(t, node, key, values, 7)
+	checkGetNode(t, engine, node)
+}
+
 func TestAddValue(t *testing.T) {
 	engine := createEngine(t)
 	tx, err := engine.BeginTx()
@@ -179,6 +219,7 @@ func TestAddValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -201,13 +242,14 @@ func TestAddValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value1, value1}, 2)
+	checkNode(t, node, key, []db.Value{value1, value1}, 3)
 	checkGetNode(t, engine, node)
 
 	tx, err = engine.BeginTx()
@@ -223,13 +265,14 @@ func TestAddValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value1, value1, value2}, 3)
+	checkNode(t, node, key, []db.Value{value1, value1, value2}, 5)
 	checkGetNode(t, engine, node)
 }
 
@@ -251,6 +294,7 @@ func TestRemoveValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -273,13 +317,14 @@ func TestRemoveValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value1, value2}, 4)
+	checkNode(t, node, key, []db.Value{value1, value2}, 5)
 	checkGetNode(t, engine, node)
 
 	// Remove value1 twice
@@ -295,13 +340,14 @@ func TestRemoveValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value2}, 5)
+	checkNode(t, node, key, []db.Value{value2}, 7)
 	checkGetNode(t, engine, node)
 
 	// Remove value1 once more
@@ -317,13 +363,14 @@ func TestRemoveValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value2}, 5)
+	checkNode(t, node, key, []db.Value{value2}, 7)
 	checkGetNode(t, engine, node)
 
 	// Remove value2 once
@@ -339,13 +386,14 @@ func TestRemoveValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{}, 6)
+	checkNode(t, node, key, []db.Value{}, 9)
 	// Empty nodes are dropped automatically
 	checkGetNoNode(t, engine, key)
 
@@ -356,8 +404,8 @@ func TestRemoveValue(t *testing.T) {
 	}
 
 	version := tx.GetVersion()
-	if version != 6 {
-		t.Errorf("ERROR: expected db.version=%d but got %d", 6, version)
+	if version != 9 {
+		t.Errorf("ERROR: expected db.version=%d but got %d", 9, version)
 	}
 
 	err = tx.Close()
@@ -386,6 +434,7 @@ func TestAddUniqueValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -408,6 +457,7 @@ func TestAddUniqueValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -429,13 +479,14 @@ func TestAddUniqueValue(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value1, value2}, 2)
+	checkNode(t, node, key, []db.Value{value1, value2}, 3)
 	checkGetNode(t, engine, node)
 }
 
@@ -457,6 +508,7 @@ func TestRemoveAllValues(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -479,13 +531,14 @@ func TestRemoveAllValues(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{value2}, 5)
+	checkNode(t, node, key, []db.Value{value2}, 6)
 	checkGetNode(t, engine, node)
 
 	// Remove value1 twice
@@ -501,6 +554,7 @@ func TestRemoveAllValues(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -522,13 +576,14 @@ func TestRemoveAllValues(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
 		return
 	}
 
-	checkNode(t, node, key, []db.Value{}, 7)
+	checkNode(t, node, key, []db.Value{}, 9)
 	// Empty nodes are dropped automatically
 	checkGetNoNode(t, engine, key)
 }
@@ -551,6 +606,7 @@ func TestRemoveKeyExistingKey(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -573,6 +629,7 @@ func TestRemoveKeyExistingKey(t *testing.T) {
 		return
 	}
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -587,8 +644,8 @@ func TestRemoveKeyExistingKey(t *testing.T) {
 		return
 	}
 
-	if tx.GetVersion() != 4 {
-		t.Errorf("ERROR: expected db.version=%d but got %d", 4, tx.GetVersion())
+	if tx.GetVersion() != 5 {
+		t.Errorf("ERROR: expected db.version=%d but got %d", 5, tx.GetVersion())
 	}
 
 	if err != nil {
@@ -672,6 +729,7 @@ func TestListNonEmpty(t *testing.T) {
 	}
 	sort.Slice(expectedNodes, cmp)
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -722,6 +780,7 @@ func TestListPaged(t *testing.T) {
 	}
 	sort.Slice(expectedNodes, cmp)
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -805,6 +864,7 @@ func TestListFiltered(t *testing.T) {
 	}
 	sort.Slice(expectedNodes, cmp)
 
+	tx.Commit()
 	err = tx.Close()
 	if err != nil {
 		t.Fatal(err)
@@ -814,6 +874,30 @@ func TestListFiltered(t *testing.T) {
 	checkNodeList(t, list, expectedNodes, uint(count), version)
 }
 
+func TestKeys(t *testing.T) {
+	engine := createEngine(t)
+	err := engine.Tx(func(tx db.TX) error {
+		for _, key := range []db.Key{"keys/b", "non-keys/a", "keys/a"} {
+			_, e := tx.Set(key, []db.Value{db.Value("value")})
+			if e != nil {
+				return e
+			}
+		}
+
+		keys := tx.Keys("keys/")
+		if len(keys) != 2 || keys[0] != "keys/a" || keys[1] != "keys/b" {
+			t.Errorf("ERROR: unexpected keys %v", keys)
+		}
+		if keys = tx.Keys(""); len(keys) != 3 {
+			t.Errorf("ERROR: unexpected keys %v", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // --------------------------------------------------------------------------------------------------------------------
 // Graceful shutdown tests
 // --------------------------------------------------------------------------------------------------------------------
@@ -886,6 +970,54 @@ func TestShutdownAndRestore(t *testing.T) {
 	checkGetNode(t, engine, node)
 }
 
+func TestInMemoryShutdownAndRestore(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Errorf("ERROR: NewDriver() failed: %s", err)
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatalf("NewEngine failed: %s", err)
+	}
+
+	values := []db.Value{db.Value("value")}
+	var node *db.Node
+	err = engine.Tx(func(tx db.TX) error {
+		var e error
+		node, e = tx.Set(key, values)
+		return e
+	})
+	if err != nil {
+		t.Errorf("ERROR: expected no error but got %s", err)
+		return
+	}
+
+	err = engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.Close()
+	if err != nil {
+		t.Errorf("ERROR: expected no error but got %s", err)
+		return
+	}
+
+	// In-memory data must survive as long as driver exists
+	engine, err = db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatalf("NewEngine failed: %s", err)
+	}
+
+	checkNode(t, node, key, values, 1)
+	checkGetNode(t, engine, node)
+}
+
 // --------------------------------------------------------------------------------------------------------------------
 // Vacuum tests
 // --------------------------------------------------------------------------------------------------------------------
@@ -1007,11 +1139,7 @@ func TestVacuum(t *testing.T) {
 	}
 }
 
-// --------------------------------------------------------------------------------------------------------------------
-// Test helpers
-// --------------------------------------------------------------------------------------------------------------------
-
-func createEngine(t *testing.T) db.Engine {
+func TestVacuumWithConcurrentWrites(t *testing.T) {
 	log.SetOutput(io.Discard)
 	l.SetMinLevel(l.Verbose)
 
@@ -1031,6 +1159,484 @@ func createEngine(t *testing.T) db.Engine {
 		t.Fatalf("NewEngine failed: %s", err)
 	}
 
+	const keyCount = 100
+	write := func(i int) error {
+		return engine.Tx(func(tx db.TX) error {
+			_, e := tx.Set(db.Key(fmt.Sprintf("key_%d", i)), []db.Value{db.Value(fmt.Sprintf("value_%d", i))})
+			return e
+		})
+	}
+
+	// Write keys while vacuum is running
+	errors := make(chan error, 1)
+	go func() {
+		for i := 0; i < keyCount; i++ {
+			e := write(i)
+			if e != nil {
+				errors <- e
+				return
+			}
+		}
+		errors <- nil
+	}()
+
+	for i := 0; i < 5; i++ {
+		err = engine.Vacuum()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = <-errors
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every key must survive a restart
+	// Engine is not closed here, otherwise its final snapshot would hide vacuum results
+	engine, err = db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatalf("NewEngine failed: %s", err)
+	}
+
+	for i := 0; i < keyCount; i++ {
+		k := db.Key(fmt.Sprintf("key_%d", i))
+		values := []db.Value{db.Value(fmt.Sprintf("value_%d", i))}
+		err = engine.Tx(func(tx db.TX) error {
+			node, e := tx.Get(k)
+			if e != nil {
+				return e
+			}
+
+			if len(node.Values) != 1 || !node.Values[0].Equal(values[0]) {
+				t.Errorf("ERROR: expected db.get(\"%s\").values=%s but got %s", k, values, node.Values)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ERROR: db.get(\"%s\"): %s", k, err)
+		}
+	}
+}
+
+func TestVacuumRotatesEncryptionKey(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+
+	open := func(key []byte, oldKeys ...[]byte) db.Engine {
+		driver, err := storage.NewDriver(storage.DirectoryOption(dir), storage.EncryptionKeyOption(key, oldKeys...))
+		if err != nil {
+			t.Fatalf("ERROR: NewDriver() failed: %s", err)
+		}
+
+		engine, err := db.NewEngine(db.StorageDriverOption(driver))
+		if err != nil {
+			t.Fatalf("NewEngine failed: %s", err)
+		}
+		return engine
+	}
+
+	engine := open(oldKey)
+	for i := 0; i < 10; i++ {
+		err := engine.Tx(func(tx db.TX) error {
+			_, e := tx.AddValue(key, db.Value(fmt.Sprintf("value_%d", i)))
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Vacuum rewrites data with a new key, so an old one is not needed anymore
+	engine = open(newKey, oldKey)
+	err := engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine = open(newKey)
+	err = engine.Tx(func(tx db.TX) error {
+		node, e := tx.Get(key)
+		if e != nil {
+			return e
+		}
+
+		if len(node.Values) != 10 {
+			t.Errorf("ERROR: expected 10 values but got %s", node.Values)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ERROR: db.get(\"%s\"): %s", key, err)
+	}
+}
+
+func TestVacuumPolicy(t *testing.T) {
+	policy := db.VacuumPolicy{
+		MinWALLength: 1000,
+		MinWALRatio:  2,
+		MinInterval:  time.Hour,
+		WindowStart:  22 * time.Hour,
+		WindowEnd:    4 * time.Hour,
+	}
+
+	night := time.Date(2021, 1, 1, 23, 0, 0, 0, time.Local)
+	day := time.Date(2021, 1, 1, 12, 0, 0, 0, time.Local)
+
+	cases := []struct {
+		name       string
+		walLength  int64
+		dataLength int64
+		lastVacuum time.Time
+		now        time.Time
+		expected   bool
+	}{
+		{"wal is large", 10000, 1000, time.Time{}, night, true},
+		{"wal is small", 500, 100, time.Time{}, night, false},
+		{"wal is compact", 10000, 8000, time.Time{}, night, false},
+		{"too early", 10000, 1000, night.Add(-time.Minute), night, false},
+		{"interval passed", 10000, 1000, night.Add(-2 * time.Hour), night, true},
+		{"out of window", 10000, 1000, time.Time{}, day, false},
+		{"window wraps midnight", 10000, 1000, time.Time{}, night.Add(4 * time.Hour), true},
+	}
+
+	for _, c := range cases {
+		actual := policy.ShouldVacuum(c.walLength, c.dataLength, c.lastVacuum, c.now)
+		if actual != c.expected {
+			t.Errorf("ERROR: %s: expected ShouldVacuum()=%v but got %v", c.name, c.expected, actual)
+		}
+	}
+}
+
+// TestVacuumWithWALArchive tests that vacuum keeps WAL in archive,
+// so data might be recovered to a point before it was deleted
+func TestVacuumWithWALArchive(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	dataDir := filepath.Join(dir, "data")
+	archiveDir := filepath.Join(dir, "archive")
+	driver, err := storage.NewDriver(storage.DirectoryOption(dataDir), storage.WALArchiveOption(archiveDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatalf("NewEngine failed: %s", err)
+	}
+
+	values := []db.Value{db.Value("value")}
+	var version uint64
+	err = engine.Tx(func(tx db.TX) error {
+		node, e := tx.Set(key, values)
+		if e != nil {
+			return e
+		}
+		version = node.Version
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
+		return tx.RemoveKey(key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := storage.OpenWALArchive(archiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := archive.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("ERROR: expected 2 archived snapshots but got %d", len(snapshots))
+	}
+
+	segments, err := archive.Segments("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[0].Index != 1 {
+		t.Fatalf("ERROR: expected 2 archived wal segments but got %v", segments)
+	}
+
+	wal, err := archive.Read(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = wal.Close()
+	}()
+
+	root, _, err := model.Recover(nil, wal, model.RecoveryTarget{ChangeID: version})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := root.GetNode(string(key))
+	if node == nil || len(node.Values) != 1 || !node.Values[0].Equal(values[0]) {
+		t.Errorf("ERROR: expected node \"%s\" to be recovered but got %v", key, node)
+	}
+}
+
+// TestVacuumWithArchivedSegment tests that vacuum succeeds if a WAL segment has been archived already,
+// e.g. when a previous vacuum has crashed, but it fails if an archived segment differs
+func TestVacuumWithArchivedSegment(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	archiveDir := filepath.Join(dir, "archive")
+	openEngine := func() db.Engine {
+		driver, err := storage.NewDriver(storage.DirectoryOption(dataDir), storage.WALArchiveOption(archiveDir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		engine, err := db.NewEngine(db.StorageDriverOption(driver))
+		if err != nil {
+			t.Fatalf("NewEngine failed: %s", err)
+		}
+		return engine
+	}
+
+	engine := openEngine()
+	err := engine.Tx(func(tx db.TX) error {
+		_, e := tx.Set(key, []db.Value{db.Value("value")})
+		return e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := os.ReadFile(filepath.Join(dataDir, "journal-000001.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivedPath := filepath.Join(archiveDir, "journal-000001.dat")
+
+	engine = openEngine()
+	defer func() {
+		_ = engine.Close()
+	}()
+
+	// Archived segment with other contents is never overwritten
+	err = os.WriteFile(archivedPath, append(append([]byte{}, segment...), 0), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.Vacuum()
+	if err == nil {
+		t.Errorf("ERROR: vacuum has overwritten an archived segment")
+	}
+
+	// Segment that has been archived before is kept as is
+	err = os.WriteFile(archivedPath, segment, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.Vacuum()
+	if err != nil {
+		t.Errorf("ERROR: vacuum has failed: %s", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------------------------------
+// Test helpers
+// --------------------------------------------------------------------------------------------------------------------
+
+func TestBackupWithConcurrentWrites(t *testing.T) {
+	engine := createEngine(t)
+
+	const keyCount = 100
+	write := func(i int) error {
+		return engine.Tx(func(tx db.TX) error {
+			_, e := tx.Set(db.Key(fmt.Sprintf("key_%d", i)), []db.Value{db.Value(fmt.Sprintf("value_%d", i))})
+			return e
+		})
+	}
+
+	// Write keys while backups are being taken
+	errors := make(chan error, 1)
+	go func() {
+		for i := 0; i < keyCount; i++ {
+			e := write(i)
+			if e != nil {
+				errors <- e
+				return
+			}
+		}
+		errors <- nil
+	}()
+
+	var prevChangeID uint64
+	for i := 0; i < 5; i++ {
+		root, changeID, err := engine.Backup()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if changeID < prevChangeID || changeID < root.LastChangeID {
+			t.Errorf("ERROR: unexpected backup change ID #%d (model change #%d, previous backup #%d)", changeID, root.LastChangeID, prevChangeID)
+		}
+		prevChangeID = changeID
+
+		// Keys are written one by one, so a consistent copy must contain first N keys
+		keys := root.Keys()
+		for j := range keys {
+			k := fmt.Sprintf("key_%d", j)
+			node := root.GetNode(k)
+			if node == nil || len(node.Values) != 1 || string(node.Values[0]) != fmt.Sprintf("value_%d", j) {
+				t.Errorf("ERROR: backup #%d with %d keys doesn't contain \"%s\"", i, len(keys), k)
+			}
+		}
+	}
+
+	err := <-errors
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Backup must contain every key that has been committed before it
+	root, _, err := engine.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Keys()) != keyCount {
+		t.Errorf("ERROR: expected %d keys in backup but got %d", keyCount, len(root.Keys()))
+	}
+}
+
+func TestBackupSince(t *testing.T) {
+	engine := createEngine(t)
+
+	write := func(i int) {
+		err := engine.Tx(func(tx db.TX) error {
+			_, e := tx.Set(db.Key(fmt.Sprintf("key_%d", i)), []db.Value{db.Value(fmt.Sprintf("value_%d", i))})
+			return e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		write(i)
+	}
+	root, baseChangeID, err := engine.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 5; i < 10; i++ {
+		write(i)
+	}
+	records, changeID, err := engine.BackupSince(baseChangeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records must contain every change after base backup and nothing else
+	if len(records) == 0 || records[0].ID != baseChangeID+1 || records[len(records)-1].ID != changeID {
+		t.Fatalf("ERROR: expected records [%d..%d] but got %d records", baseChangeID+1, changeID, len(records))
+	}
+
+	for _, record := range records {
+		if record.ID > root.LastChangeID {
+			err = root.Apply(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(root.Keys()) != 10 {
+		t.Errorf("ERROR: expected 10 keys after applying incremental backup but got %v", root.Keys())
+	}
+
+	// An incremental backup since the last change is empty
+	records, lastChangeID, err := engine.BackupSince(changeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if record.Type != storage.WALNone && record.Type != storage.WALCommitTx {
+			t.Errorf("ERROR: expected no changes since #%d but got %v", changeID, record)
+		}
+	}
+	if lastChangeID < changeID {
+		t.Errorf("ERROR: expected change ID >= #%d but got #%d", changeID, lastChangeID)
+	}
+
+	_, _, err = engine.BackupSince(lastChangeID + 100)
+	if err != db.ErrNoSuchChange {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrNoSuchChange, err)
+	}
+
+	// Vacuum drops changes that are required for an incremental backup
+	err = engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = engine.BackupSince(baseChangeID)
+	if err != db.ErrChangesUnavailable {
+		t.Errorf("ERROR: expected %s but got %v", db.ErrChangesUnavailable, err)
+	}
+}
+
+func createEngine(t *testing.T) db.Engine {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Errorf("ERROR: NewDriver() failed: %s", err)
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatalf("NewEngine failed: %s", err)
+	}
+
 	return engine
 }
 
@@ -1132,3 +1738,134 @@ func checkGetNoNode(t *testing.T, engine db.Engine, key db.Key) {
 		t.Errorf("ERROR: expected node=nil but got %s", node)
 	}
 }
+
+func TestValueLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	open := func(opts ...storage.DriverOption) (db.Engine, storage.Driver) {
+		driver, err := storage.NewDriver(append([]storage.DriverOption{storage.DirectoryOption(dir)}, opts...)...)
+		if err != nil {
+			t.Fatalf("ERROR: NewDriver() failed: %s", err)
+		}
+
+		engine, err := db.NewEngine(db.StorageDriverOption(driver))
+		if err != nil {
+			t.Fatalf("NewEngine failed: %s", err)
+		}
+		return engine, driver
+	}
+
+	const keyCount = 50
+	write := func(engine db.Engine, i int, suffix string) error {
+		return engine.Tx(func(tx db.TX) error {
+			k := db.Key(fmt.Sprintf("key_%d", i))
+			_, e := tx.Set(k, []db.Value{db.Value(fmt.Sprintf("value_%d", i)), db.Value("garbage")})
+			if e != nil {
+				return e
+			}
+			_, e = tx.RemoveValue(k, db.Value("garbage"))
+			if e != nil {
+				return e
+			}
+			_, e = tx.AddUniqueValue(k, db.Value(suffix))
+			return e
+		})
+	}
+	check := func(engine db.Engine, suffix string) {
+		for i := 0; i < keyCount; i++ {
+			k := db.Key(fmt.Sprintf("key_%d", i))
+			expected := []db.Value{db.Value(fmt.Sprintf("value_%d", i)), db.Value(suffix)}
+			err := engine.Tx(func(tx db.TX) error {
+				node, e := tx.Get(k)
+				if e != nil {
+					return e
+				}
+
+				if len(node.Values) != 2 || !node.Values[0].Equal(expected[0]) || !node.Values[1].Equal(expected[1]) {
+					t.Errorf("ERROR: expected db.get(\"%s\").values=%s but got %s", k, expected, node.Values)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Errorf("ERROR: db.get(\"%s\"): %s", k, err)
+			}
+		}
+	}
+
+	// Data written without a value log is moved into it
+	engine, _ := open()
+	for i := 0; i < keyCount; i++ {
+		err := write(engine, i, "v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := engine.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, driver := open(storage.ValueLogOption(1024))
+	check(engine, "v1")
+
+	// Vacuum drops overwritten values, while transactions keep going
+	errors := make(chan error, 1)
+	go func() {
+		for i := 0; i < keyCount; i++ {
+			e := write(engine, i, "v2")
+			if e != nil {
+				errors <- e
+				return
+			}
+		}
+		errors <- nil
+	}()
+
+	for i := 0; i < 5; i++ {
+		err = engine.Vacuum()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = <-errors
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = engine.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(engine, "v2")
+
+	segments, err := driver.ValueLog().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("ERROR: expected 1 value log segment after vacuum but got %d", len(segments))
+	}
+
+	// Every value must survive a restart
+	// Engine is not closed here, otherwise its final snapshot would hide vacuum results
+	engine, _ = open(storage.ValueLogOption(0))
+	check(engine, "v2")
+
+	err = engine.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Snapshot that refers to a value log can't be read without it
+	driver, err = storage.NewDriver(storage.DirectoryOption(dir))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+	_, err = db.NewEngine(db.StorageDriverOption(driver))
+	if err == nil {
+		t.Errorf("ERROR: engine has been restored without a value log")
+	}
+}
@@ -10,12 +10,15 @@ import (
 type transaction struct {
 	Engine       *engine
 	ShouldCommit bool
+	Records      []*storage.WALRecord
+	Undo         *model.Undo
 }
 
 func newTransaction(engine *engine) *transaction {
 	tx := &transaction{
 		Engine:       engine,
 		ShouldCommit: false,
+		Undo:         engine.Model.BeginUndo(),
 	}
 	return tx
 }
@@ -28,18 +31,56 @@ func (t *transaction) Commit() {
 // Close terminates a transaction
 func (t *transaction) Close() error {
 	var err error
-	if t.ShouldCommit {
+	var commitID uint64
+	isCommitted := false
+	isHeld := false
+	if t.ShouldCommit && len(t.Records) > 0 && t.Engine.isPastWriteDeadline() {
+		// Writes might have outlived a leader's lease, so they are dropped
+		err = ErrReadOnly
+		_ = t.Engine.WAL.RollbackTx()
+	} else if t.ShouldCommit {
 		err = t.Engine.WAL.CommitTx()
+		if err != nil {
+			// Transaction has failed to commit, so its records are dropped from WAL
+			_ = t.Engine.WAL.RollbackTx()
+		} else {
+			isCommitted = true
+			if len(t.Records) > 0 {
+				commit := t.Engine.WAL.LastCommit()
+				commitID = commit.ID
+				records := append(t.Records, commit)
+				t.Engine.publish(records)
+
+				// Transaction is applied once replicas acknowledge it (see commitAcked)
+				if t.Engine.holdsCommits() {
+					t.Engine.Pending = append(t.Engine.Pending, records)
+					isHeld = true
+				}
+			}
+		}
 	} else {
 		err = t.Engine.WAL.RollbackTx()
 	}
 
-	if err != nil {
-		return err
+	// Changes have been applied to model as they have been written, so changes of a dropped transaction are undone
+	// Changes of a held transaction are undone as well, they are applied again once it's acknowledged
+	if !isCommitted || isHeld {
+		t.Undo.Restore()
 	}
 
+	// Model lock is released even if WAL has failed, otherwise engine would hang
 	t.Engine.EndTx()
-	return nil
+
+	// Replicas are waited for without model lock, so other transactions keep going
+	// Transaction is visible to subsequent reads already, even if replicas never acknowledge it (see DegradeToError),
+	// unless it's held until they do (see SyncReplicationPolicy.ApplyAfterAck)
+	if commitID != 0 && t.Engine.Sync != nil {
+		err = t.Engine.Sync.wait(commitID)
+		if err == nil && isHeld {
+			t.Engine.commitAcked(commitID)
+		}
+	}
+	return err
 }
 
 // List returns paged list of DB keys (with values)
@@ -52,17 +93,8 @@ func (t *transaction) List(prefix Key, skip uint, limit uint, version uint64) (*
 	}
 
 	// TODO dirty and inefficient implementation
-	array := make([]*Node, 0)
-	for k, n := range t.Engine.Model.NodesMap {
-		if prefix == "" || strings.Index(k, string(prefix)) == 0 {
-			array = append(array, mapNode(n))
-		}
-	}
-
-	cmp := func(i, j int) bool {
-		return strings.Compare(string(array[i].Key), string(array[j].Key)) < 0
-	}
-	sort.Slice(array, cmp)
+	// Node values are loaded for requested page only, since they might be kept within a value log
+	array := t.keys(prefix)
 
 	lowIndex := int(skip)
 	if len(array) < lowIndex {
@@ -74,8 +106,18 @@ func (t *transaction) List(prefix Key, skip uint, limit uint, version uint64) (*
 		count = len(array) - lowIndex
 	}
 
+	keys := array[lowIndex:count]
+	nodes := make([]*Node, len(keys))
+	for i, k := range keys {
+		node, err := t.mapNode(t.Engine.Model.GetNode(k))
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+
 	list := &PagedNodeList{
-		Nodes:      array[lowIndex:count],
+		Nodes:      nodes,
 		Version:    t.Engine.Model.LastChangeID,
 		TotalCount: uint(len(array)),
 	}
@@ -83,6 +125,28 @@ func (t *transaction) List(prefix Key, skip uint, limit uint, version uint64) (*
 	return list, nil
 }
 
+// Keys returns sorted list of DB keys with specified prefix
+func (t *transaction) Keys(prefix Key) []Key {
+	array := t.keys(prefix)
+	keys := make([]Key, len(array))
+	for i, k := range array {
+		keys[i] = Key(k)
+	}
+	return keys
+}
+
+// keys returns sorted keys of model nodes with specified prefix
+func (t *transaction) keys(prefix Key) []string {
+	array := make([]string, 0)
+	for k := range t.Engine.Model.NodesMap {
+		if prefix == "" || strings.Index(k, string(prefix)) == 0 {
+			array = append(array, k)
+		}
+	}
+	sort.Strings(array)
+	return array
+}
+
 // GetVersion returns current data version
 func (t *transaction) GetVersion() uint64 {
 	return t.Engine.Model.LastChangeID
@@ -96,7 +160,7 @@ func (t *transaction) Get(key Key) (*Node, error) {
 		return nil, ErrNoSuchKey
 	}
 
-	return mapNode(node), nil
+	return t.mapNode(node)
 }
 
 // Set sets a node value, rewriting its value if node already exists
@@ -119,19 +183,31 @@ func (t *transaction) Set(key Key, values []Value) (*Node, error) {
 		if err != nil {
 			return nil, err
 		}
-		return mapNode(node), nil
+		return t.mapNode(node)
 	}
 
+	t.Undo.Save(string(key))
 	node := t.Engine.Model.GetOrCreateNode(string(key))
-	changeCount := len(node.Values) + len(values)
+	changeCount := node.Len() + len(values)
 
 	var err error
 	if changeCount == 1 {
 		// Optimistic path for new nodes
 		err = t.write(storage.WALAddValue, node.Key, values[0])
+		if err != nil {
+			return nil, err
+		}
 	} else {
+		var oldValues []Value
+		oldValues, err = t.Engine.Model.Values(node)
+		if err != nil {
+			return nil, err
+		}
+
 		// First, drop all node's values
-		for _, v := range node.Values {
+		// Values are copied, since removed values are dropped from the same slice
+		oldValues = append([]Value(nil), oldValues...)
+		for _, v := range oldValues {
 			err = t.write(storage.WALRemoveValue, node.Key, v)
 			if err != nil {
 				return nil, err
@@ -147,26 +223,28 @@ func (t *transaction) Set(key Key, values []Value) (*Node, error) {
 		}
 	}
 
-	return mapNode(node), nil
+	return t.mapNode(node)
 }
 
 // AddValue defines an "append value" operation
 // If specified node doesn't exists, it will be created
 // A specified value will be added to node even if it already exists
 func (t *transaction) AddValue(key Key, value Value) (*Node, error) {
+	t.Undo.Save(string(key))
 	node := t.Engine.Model.GetOrCreateNode(string(key))
 	err := t.write(storage.WALAddValue, node.Key, value)
 	if err != nil {
 		return nil, err
 	}
 
-	return mapNode(node), nil
+	return t.mapNode(node)
 }
 
 // AddUniqueValue defines an "append value" operation
 // If specified node doesn't exists, it will be created
 // If node already contains the same value and "unique" parameter is set to "true", a ErrDuplicateValue error is returned
 func (t *transaction) AddUniqueValue(key Key, value Value) (*Node, error) {
+	t.Undo.Save(string(key))
 	node := t.Engine.Model.GetOrCreateNode(string(key))
 
 	if node.Contains(value) {
@@ -178,7 +256,7 @@ func (t *transaction) AddUniqueValue(key Key, value Value) (*Node, error) {
 		return nil, err
 	}
 
-	return mapNode(node), nil
+	return t.mapNode(node)
 }
 
 // RemoveValue defines an "remove value" operation
@@ -190,22 +268,24 @@ func (t *transaction) RemoveValue(key Key, value Value) (*Node, error) {
 		return nil, ErrNoSuchKey
 	}
 
-	for _, v := range node.Values {
-		if v.Equal(value) {
-			// If node contained only one value - node should be removed
-			var err error
-			if len(node.Values) == 1 {
-				err = t.write(storage.WALRemoveKey, node.Key, nil)
-			} else {
-				err = t.write(storage.WALRemoveValue, node.Key, value)
-			}
+	contains, err := t.Engine.Model.Contains(node, value)
+	if err != nil {
+		return nil, err
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	if contains {
+		// If node contained only one value - node should be removed
+		if node.Len() == 1 {
+			err = t.write(storage.WALRemoveKey, node.Key, nil)
+		} else {
+			err = t.write(storage.WALRemoveValue, node.Key, value)
+		}
 
-			return mapNode(node), nil
+		if err != nil {
+			return nil, err
 		}
+
+		return t.mapNode(node)
 	}
 
 	return nil, ErrNoSuchValue
@@ -221,35 +301,41 @@ func (t *transaction) RemoveAllValues(key Key, value Value) (*Node, error) {
 		return nil, ErrNoSuchKey
 	}
 
+	values, err := t.Engine.Model.Values(node)
+	if err != nil {
+		return nil, err
+	}
+
 	// Generate change list
+	// Matching values are counted first, since applied changes modify node values
 	count := 0
-	for i := 0; i < len(node.Values); i++ {
-		v := node.Values[i]
+	for _, v := range values {
 		if v.Equal(value) {
-			err := t.write(storage.WALRemoveValue, node.Key, value)
-			if err != nil {
-				return nil, err
-			}
-
-			i--
 			count++
 		}
 	}
 
+	for i := 0; i < count; i++ {
+		err = t.write(storage.WALRemoveValue, node.Key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Return an error when trying to remove a non-existing value
 	if count == 0 {
 		return nil, ErrNoSuchValue
 	}
 
-	if len(node.Values) <= 0 {
+	if node.Len() <= 0 {
 		// If node is empty after RemoveAllValues operation - just drop entire node
-		err := t.write(storage.WALRemoveKey, node.Key, nil)
+		err = t.write(storage.WALRemoveKey, node.Key, nil)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return mapNode(node), nil
+	return t.mapNode(node)
 }
 
 // RemoveKey removes a key completely
@@ -270,6 +356,10 @@ func (t *transaction) RemoveKey(key Key) error {
 
 // write writes and applies one change record
 func (t *transaction) write(recordType storage.WALRecordType, key string, value model.Value) error {
+	if t.Engine.IsReplica || t.Engine.isPastWriteDeadline() {
+		return ErrReadOnly
+	}
+
 	record := &storage.WALRecord{
 		Type:  recordType,
 		Key:   key,
@@ -281,18 +371,27 @@ func (t *transaction) write(recordType storage.WALRecordType, key string, value
 		return err
 	}
 
+	// Node is saved before its first change, so changes of a dropped transaction can be undone (see Close)
+	t.Undo.Save(key)
 	err = t.Engine.Model.Apply(record)
 	if err != nil {
 		return err
 	}
 
+	t.Records = append(t.Records, record)
 	return nil
 }
 
-func mapNode(node *model.Node) *Node {
+// mapNode maps a model node, reading its values from a value log if needed
+func (t *transaction) mapNode(node *model.Node) (*Node, error) {
+	values, err := t.Engine.Model.Values(node)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Node{
 		Key:     Key(node.Key),
 		Version: node.LastChangeID,
-		Values:  node.Values,
-	}
+		Values:  values,
+	}, nil
 }
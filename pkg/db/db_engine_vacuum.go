@@ -0,0 +1,457 @@
+package db
+
+import (
+	"io"
+	"math"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+const (
+	// vacuumCheckPeriod defines how often a background vacuum policy is checked
+	vacuumCheckPeriod = 1 * time.Minute
+
+	// vacuumMaxBackoff is a max delay before retrying a failed background vacuum
+	vacuumMaxBackoff = 1 * time.Hour
+)
+
+// VacuumPolicy defines when a background vacuum routine should run
+// Zero values turn corresponding conditions off
+type VacuumPolicy struct {
+	// MinWALLength is a WAL length (in bytes) that triggers vacuum
+	MinWALLength int64
+
+	// MinWALRatio is a ratio of WAL length to live data length that triggers vacuum
+	// Vacuum is skipped while WAL is compact enough, even if it's larger than MinWALLength
+	MinWALRatio float64
+
+	// MinInterval is a min delay between two vacuum runs
+	MinInterval time.Duration
+
+	// WindowStart is a time of day (as an offset from midnight) when vacuum is allowed to start
+	WindowStart time.Duration
+
+	// WindowEnd is a time of day (as an offset from midnight) when vacuum is not allowed to start anymore
+	// If WindowStart is equal to WindowEnd, vacuum is allowed to start at any time
+	WindowEnd time.Duration
+}
+
+// DefaultVacuumPolicy is a default policy of background vacuum routine
+var DefaultVacuumPolicy = VacuumPolicy{
+	MinWALLength: 64 * 1024 * 1024,
+	MinWALRatio:  2,
+	MinInterval:  1 * time.Hour,
+}
+
+// ShouldVacuum returns true if a vacuum routine should run at specified moment
+func (p VacuumPolicy) ShouldVacuum(walLength, dataLength int64, lastVacuum, now time.Time) bool {
+	// Check min interval between vacuum runs
+	if !lastVacuum.IsZero() && now.Sub(lastVacuum) < p.MinInterval {
+		return false
+	}
+
+	// Check time-of-day window
+	if !p.isInWindow(now) {
+		return false
+	}
+
+	// Check WAL length
+	if walLength < p.MinWALLength {
+		return false
+	}
+
+	// Check WAL to live data ratio
+	if p.MinWALRatio > 0 && dataLength > 0 && float64(walLength)/float64(dataLength) < p.MinWALRatio {
+		return false
+	}
+
+	return true
+}
+
+// isInWindow returns true if specified moment belongs to policy's time-of-day window
+func (p VacuumPolicy) isInWindow(now time.Time) bool {
+	if p.WindowStart == p.WindowEnd {
+		return true
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	timeOfDay := now.Sub(midnight)
+
+	if p.WindowStart < p.WindowEnd {
+		return p.WindowStart <= timeOfDay && timeOfDay < p.WindowEnd
+	}
+
+	// Window wraps around midnight, e.g. 22:00-04:00
+	return p.WindowStart <= timeOfDay || timeOfDay < p.WindowEnd
+}
+
+// Vacuum performs DB maintenance routine
+// Model lock is held only while active WAL segment is being sealed,
+// so transactions keep going while a new snapshot is being written
+func (e *engine) Vacuum() error {
+	e.VacuumLock.Lock()
+	defer e.VacuumLock.Unlock()
+
+	log.Printf("compressing database")
+	startTime := time.Now()
+
+	values := e.Storage.ValueLog()
+	vacuum, valueVacuum, root, lastID, err := e.sealAndRebuild(values != nil)
+	if err != nil {
+		return err
+	}
+
+	// Move live values out of sealed value log segments, so snapshot never refers to them
+	if valueVacuum != nil {
+		err = root.CompactValues(valueVacuum)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write a model snapshot
+	file, err := e.Storage.SnapshotFile().Write()
+	if err != nil {
+		return err
+	}
+	err = root.WriteSnapshot(file)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Drop WAL segments that are covered by snapshot
+	segmentsBefore, err := e.Storage.WALFile().Segments()
+	if err != nil {
+		return err
+	}
+	err = vacuum.End(e.retainedChangeID(lastID))
+	if err != nil {
+		return err
+	}
+	segmentsAfter, err := e.Storage.WALFile().Segments()
+	if err != nil {
+		return err
+	}
+	reclaimed := reclaimedBytes(segmentsBefore, segmentsAfter)
+
+	// Drop value log segments that are not referred anymore
+	// WAL and value log segments are numbered independently, so their lengths are summed separately
+	if valueVacuum != nil {
+		valuesBefore, err := values.Segments()
+		if err != nil {
+			return err
+		}
+		err = e.endValueLogVacuum(root, lastID, valueVacuum)
+		if err != nil {
+			return err
+		}
+		valuesAfter, err := values.Segments()
+		if err != nil {
+			return err
+		}
+
+		reclaimed += reclaimedBytes(valuesBefore, valuesAfter)
+	}
+
+	log.Printf(
+		"database compression completed in %s, %d bytes reclaimed",
+		time.Since(startTime),
+		reclaimed,
+	)
+	return nil
+}
+
+// RetainChanges keeps vacuum routine from dropping WAL records after specified change ID
+func (e *engine) RetainChanges(name string, changeID uint64) {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	if e.Retained == nil {
+		e.Retained = make(map[string]uint64)
+	}
+	e.Retained[name] = changeID
+}
+
+// ReleaseChanges drops a retention of WAL records
+func (e *engine) ReleaseChanges(name string) {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	delete(e.Retained, name)
+}
+
+// retainedChangeID returns ID of the last change WAL might be dropped up to
+func (e *engine) retainedChangeID(lastID uint64) uint64 {
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	changeID := lastID
+	for name, retained := range e.Retained {
+		if retained < changeID {
+			log.Printf("wal is kept after change #%d for %s", retained, name)
+			changeID = retained
+		}
+	}
+	return changeID
+}
+
+// endValueLogVacuum replaces live model references to sealed value log segments and drops these segments
+// Vacuum lock must be held by caller
+func (e *engine) endValueLogVacuum(compacted *model.Root, sealID uint64, values storage.ValueLogVacuum) error {
+	e.ModelLock.Lock()
+	err := e.Model.ReplaceSealedValues(compacted, sealID, values)
+	e.ModelLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return values.End()
+}
+
+// sealAndRebuild seals active WAL segment and builds a consistent model snapshot
+// from previous snapshot and sealed WAL segments
+// If sealValues is true, active value log segment is sealed as well and rebuilt model appends values to a compaction segment
+// It returns ID of the last change snapshot contains: held transactions are left out of it
+// (see SyncReplicationPolicy.ApplyAfterAck), so it might be lower than ID of the last sealed record
+// Model lock is held only while WAL segment is being sealed
+// Vacuum lock must be held by caller
+func (e *engine) sealAndRebuild(sealValues bool) (storage.WALVacuum, storage.ValueLogVacuum, *model.Root, uint64, error) {
+	vacuum, valueVacuum, appliedID, err := e.seal(sealValues)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	values := e.Storage.ValueLog()
+	if valueVacuum != nil {
+		values = valueVacuum
+	}
+
+	// Build a consistent model snapshot from previous snapshot and sealed WAL segments
+	wal, err := vacuum.Read()
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	lastID := vacuum.LastID()
+	if appliedID < lastID {
+		wal = &walPrefixReader{WALReader: wal, lastID: appliedID}
+		lastID = appliedID
+	}
+	root, err := model.Rebuild(e.Storage, wal, values)
+	_ = wal.Close()
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	return vacuum, valueVacuum, root, lastID, nil
+}
+
+// walPrefixReader reads WAL records up to specified change ID
+type walPrefixReader struct {
+	storage.WALReader
+	lastID uint64
+}
+
+// Read read a record from a WAL file. Returns io.EOF once records up to specified change ID have been read
+func (r *walPrefixReader) Read() (*storage.WALRecord, error) {
+	record, err := r.WALReader.Read()
+	if err == nil && record.ID > r.lastID {
+		return nil, io.EOF
+	}
+	return record, err
+}
+
+// seal seals active WAL segment and, optionally, active value log segment at the same moment
+// It also returns ID of the last change that has been applied to model, it's lower than ID of the last sealed record
+// only if there are held transactions (see SyncReplicationPolicy.ApplyAfterAck)
+// Vacuum lock must be held by caller
+func (e *engine) seal(sealValues bool) (storage.WALVacuum, storage.ValueLogVacuum, uint64, error) {
+	var vacuum storage.WALVacuum
+	var valueVacuum storage.ValueLogVacuum
+	appliedID := uint64(math.MaxUint64)
+
+	// Seal doesn't wait for held transactions, since they might wait for a snapshot that a replica needs
+	err := e.tx(false, func(tx TX) error {
+		// Close WAL transaction
+		err := e.WAL.CommitTx()
+		if err != nil {
+			return err
+		}
+
+		vacuum, err = e.Storage.WALFile().BeginVacuum(e.WAL)
+		if err != nil {
+			return err
+		}
+		if len(e.Pending) > 0 {
+			appliedID = e.commitIndex()
+		}
+
+		if sealValues {
+			valueVacuum, err = e.Storage.ValueLog().BeginVacuum()
+			if err != nil {
+				return err
+			}
+		}
+
+		// Write a checkpoint transaction into new WAL segment
+		// This way new segment always contains ID and TxID counters, even if all previous segments are dropped
+		err = e.writeCheckpoint()
+		if err != nil {
+			return err
+		}
+
+		// Start new WAL transaction
+		return e.WAL.BeginTx()
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return vacuum, valueVacuum, appliedID, nil
+}
+
+// reclaimedBytes returns total length of WAL segments that have been dropped
+func reclaimedBytes(before, after []storage.WALSegment) int64 {
+	remaining := make(map[int]bool)
+	for _, segment := range after {
+		remaining[segment.Index] = true
+	}
+
+	var length int64 = 0
+	for _, segment := range before {
+		if !remaining[segment.Index] {
+			length += segment.Length
+		}
+	}
+
+	return length
+}
+
+// writeCheckpoint writes an empty transaction into WAL
+// Replicas never write transactions of their own, since their WAL must keep IDs of primary's one
+// If transactions are held until replicas acknowledge them, so is this one
+func (e *engine) writeCheckpoint() error {
+	if e.IsReplica {
+		return nil
+	}
+
+	err := e.WAL.BeginTx()
+	if err != nil {
+		return err
+	}
+
+	record := &storage.WALRecord{
+		Type: storage.WALNone,
+	}
+	err = e.WAL.Write(record)
+	if err != nil {
+		_ = e.WAL.RollbackTx()
+		return err
+	}
+
+	err = e.WAL.CommitTx()
+	if err != nil {
+		return err
+	}
+
+	records := []*storage.WALRecord{record, e.WAL.LastCommit()}
+	if e.holdsCommits() {
+		e.Pending = append(e.Pending, records)
+	} else {
+		err = e.Model.Apply(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.publish(records)
+	return nil
+}
+
+// runBackgroundVacuum runs Vacuum routine in background
+func (e *engine) runBackgroundVacuum(policy VacuumPolicy) {
+	go func() {
+		var lastVacuum time.Time
+		failures := 0
+		delay := vacuumCheckPeriod
+
+		for {
+			time.Sleep(delay)
+			delay = vacuumCheckPeriod
+
+			shouldVacuum, err := e.shouldVacuum(policy, lastVacuum)
+			if err == nil && shouldVacuum {
+				err = e.Vacuum()
+				if err == nil {
+					lastVacuum = time.Now()
+					failures = 0
+					continue
+				}
+			}
+
+			if err != nil {
+				if err == ErrShutdown {
+					return
+				}
+
+				// Retry with an exponential backoff
+				failures++
+				delay = vacuumBackoff(failures)
+				log.Errorf("background vacuum failed (%d attempts so far), retrying in %s: %s", failures, delay, err)
+			}
+		}
+	}()
+}
+
+// shouldVacuum checks whether vacuum should run according to specified policy
+func (e *engine) shouldVacuum(policy VacuumPolicy, lastVacuum time.Time) (bool, error) {
+	segments, err := e.Storage.WALFile().Segments()
+	if err != nil {
+		return false, err
+	}
+
+	var walLength int64 = 0
+	for _, segment := range segments {
+		walLength += segment.Length
+	}
+
+	e.ModelLock.Lock()
+	defer e.ModelLock.Unlock()
+
+	if e.IsShutDown {
+		return false, ErrShutdown
+	}
+
+	// Live data length is computed only if it's really needed
+	var dataLength int64 = 0
+	if policy.MinWALRatio > 0 && walLength >= policy.MinWALLength {
+		dataLength = e.Model.DataLength()
+	}
+
+	if !policy.ShouldVacuum(walLength, dataLength, lastVacuum, time.Now()) {
+		log.Verbosef("background vacuum skipped: wal is %d bytes, live data is %d bytes", walLength, dataLength)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// vacuumBackoff returns a delay before retrying a background vacuum after specified number of failures
+func vacuumBackoff(failures int) time.Duration {
+	delay := vacuumCheckPeriod
+	for i := 1; i < failures && delay < vacuumMaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > vacuumMaxBackoff {
+		delay = vacuumMaxBackoff
+	}
+
+	return delay
+}
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
 )
 
 // Key is NatanDB node key type
@@ -70,11 +73,32 @@ const (
 
 	// ErrShutdown is returned when engine is already shut down
 	ErrShutdown = Error("shutdown")
+
+	// ErrNoSuchChange is returned when a change with specified ID hasn't been written yet
+	ErrNoSuchChange = Error("no such change")
+
+	// ErrChangesUnavailable is returned when requested changes have been dropped from WAL by vacuum routine
+	ErrChangesUnavailable = Error("changes are no longer available")
+
+	// ErrReadOnly is returned when trying to change data of a replica
+	ErrReadOnly = Error("server is a read-only replica")
+
+	// ErrFeedOverflow is returned when a change feed consumer falls too far behind
+	ErrFeedOverflow = Error("change feed consumer is too slow")
+
+	// ErrReplicationTimeout is returned when a committed transaction hasn't been acknowledged by replicas in time
+	// Transaction is committed locally anyway, but it's not visible until they acknowledge it if it's held (see SyncReplicationPolicy)
+	ErrReplicationTimeout = Error("transaction hasn't been acknowledged by replicas in time")
+
+	// ErrReservedKey is returned when trying to change a key that is reserved for internal use
+	ErrReservedKey = Error("key is reserved")
 )
 
 // Engine is a public interface for NatanDB engine
 type Engine interface {
 	// BeginTx starts new transaction
+	// If primary holds transactions until replicas acknowledge them, it waits for them to be applied first
+	// and returns a ErrReplicationTimeout error if they aren't applied in time (see SyncReplicationPolicy.ApplyAfterAck)
 	BeginTx() (TX, error)
 
 	// Tx executes a function within a transaction
@@ -83,10 +107,90 @@ type Engine interface {
 	// Vacuum performs DB maintenance routine
 	Vacuum() error
 
+	// Backup returns a consistent point-in-time copy of data model
+	// and ID of the last WAL record the copy contains
+	// Transactions keep going while a copy is being built
+	Backup() (*model.Root, uint64, error)
+
+	// BackupSince returns WAL records that have been committed after specified change ID
+	// and ID of the last WAL record at the moment of backup
+	// If some of these records have been dropped by vacuum routine, a ErrChangesUnavailable error is returned
+	BackupSince(changeID uint64) ([]*storage.WALRecord, uint64, error)
+
+	// Subscribe returns a feed of transactions that have been committed after specified change ID
+	// Committed transactions are read from WAL first, then new ones are passed as soon as they are committed
+	// If some of these transactions have been dropped by vacuum routine, a ErrChangesUnavailable error is returned
+	Subscribe(changeID uint64) (ChangeFeed, error)
+
+	// ApplyTx writes a transaction committed by a primary server into WAL and applies it to data model
+	// It's used by replicas only (see ReplicaOption), transactions that have been applied already are skipped
+	// If transactions are held until they are acknowledged, it's applied once primary reports it committed (see SetCommitIndex)
+	ApplyTx(records []*storage.WALRecord) error
+
+	// SetCommitIndex applies held transactions up to specified change ID (see SyncReplicationPolicy.ApplyAfterAck)
+	// It's used by replicas once primary reports that their transactions have been committed
+	SetCommitIndex(changeID uint64) error
+
+	// LastCommitID returns ID of the last committed WAL record
+	// Replica requests transactions after this ID (see Subscribe)
+	LastCommitID() uint64
+
+	// CommitIndex returns ID of the last committed WAL record that has been applied to data model
+	// It differs from LastCommitID while transactions are held until replicas acknowledge them
+	CommitIndex() uint64
+
+	// WaitForCommit blocks until a change with specified ID is committed (or applied by a replica)
+	// Context error is returned if context is done first, ErrShutdown is returned if engine is closed
+	WaitForCommit(ctx context.Context, changeID uint64) error
+
+	// SyncStatus returns a state of synchronous replication (see SyncReplicationOption)
+	SyncStatus() SyncReplicationStatus
+
+	// RetainChanges keeps vacuum routine from dropping WAL records after specified change ID
+	// It's used by change feed consumers that resume after being disconnected (e.g. CDC streams)
+	// Each consumer has a retention of its own, which is identified by its name
+	RetainChanges(name string, changeID uint64)
+
+	// ReleaseChanges drops a retention of WAL records (see RetainChanges)
+	ReleaseChanges(name string)
+
+	// SetReadOnly switches engine between primary and replica modes (see ReplicaOption)
+	// It's used by cluster nodes that change their roles
+	SetReadOnly(readOnly bool)
+
+	// SetWriteDeadline makes engine reject writes and commits with ErrReadOnly after specified time, zero time removes the deadline
+	// It's used by cluster nodes whose right to accept writes expires, e.g. with a lease
+	SetWriteDeadline(deadline time.Time)
+
+	// SetTerm sets a term of cluster leader that is stamped into subsequent commit records
+	SetTerm(term uint64)
+
+	// Install replaces replica's data with a snapshot of primary's data up to specified change ID
+	// It's used when replica's WAL has diverged from primary's one or when primary has dropped changes replica needs
+	// Every change feed is stopped, since feeds can't be continued after data has been replaced
+	Install(root *model.Root, changeID uint64) error
+
 	// Close shuts engine down gracefully
 	Close() error
 }
 
+// ChangeFeed is a feed of committed transactions (see Engine.Subscribe)
+type ChangeFeed interface {
+	// Transactions returns a channel of committed transactions, each one ends with a WALCommitTx record
+	// Channel is closed once feed is closed, engine is shut down or consumer falls too far behind (see Err)
+	Transactions() <-chan []*storage.WALRecord
+
+	// Err returns a reason why the channel has been closed, nil if feed has been closed by consumer
+	Err() error
+
+	// Ack confirms that consumer has persisted transactions up to specified change ID
+	// Consumers that acknowledge transactions are counted as replicas by synchronous replication
+	Ack(changeID uint64)
+
+	// Close stops the feed
+	Close()
+}
+
 // TX is a public interface for NatanDB engine's transaction
 type TX interface {
 	// List returns paged list of DB keys (with values)
@@ -95,6 +199,10 @@ type TX interface {
 	// ErrDataOutOfDate is not returned if version parameter contains zero
 	List(prefix Key, skip uint, limit uint, version uint64) (*PagedNodeList, error)
 
+	// Keys returns sorted list of DB keys with specified prefix (every key if prefix is empty)
+	// Node values are not loaded
+	Keys(prefix Key) []Key
+
 	// GetVersion returns current data version
 	GetVersion() uint64
 
@@ -135,5 +243,6 @@ type TX interface {
 	Commit()
 
 	// Close terminates a transaction
+	// Changes of a transaction that hasn't been committed are undone
 	Close() error
 }
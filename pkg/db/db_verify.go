@@ -0,0 +1,245 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// RepairAction is a way to fix a problem found by Verify
+type RepairAction int
+
+const (
+	// RepairNone means that a problem can't be fixed automatically
+	RepairNone RepairAction = iota
+	// RepairTrimWAL drops every WAL record after the last properly committed transaction
+	RepairTrimWAL
+	// RepairRebuildSnapshot rebuilds a model snapshot from WAL
+	RepairRebuildSnapshot
+	// RepairResetWAL starts a new WAL that continues snapshot's change ID counter
+	RepairResetWAL
+)
+
+// String converts a repair action into its string representation
+func (a RepairAction) String() string {
+	switch a {
+	case RepairNone:
+		return "none"
+	case RepairTrimWAL:
+		return "trim WAL"
+	case RepairRebuildSnapshot:
+		return "rebuild snapshot"
+	case RepairResetWAL:
+		return "reset WAL"
+	default:
+		return fmt.Sprintf("[%d]", int(a))
+	}
+}
+
+// Problem describes a problem found by Verify
+type Problem struct {
+	// Problem source, i.e. WAL segment file name or "snapshot"
+	Source string
+	// Problem description
+	Message string
+	// Action that fixes the problem
+	Repair RepairAction
+}
+
+// String converts a problem into its string representation
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Source, p.Message)
+}
+
+// Verification is a result of data verification
+type Verification struct {
+	// Result of WAL verification
+	WAL *storage.WALVerification
+	// Last change ID of model snapshot
+	SnapshotChangeID uint64
+	// Count of model snapshot nodes
+	SnapshotNodes int
+	// Every problem found
+	Problems []Problem
+}
+
+// nextRepair returns an action that should be performed first to fix found problems
+func (v *Verification) nextRepair() RepairAction {
+	action := RepairNone
+	for _, p := range v.Problems {
+		if p.Repair != RepairNone && (action == RepairNone || p.Repair < action) {
+			action = p.Repair
+		}
+	}
+	return action
+}
+
+// Verify checks WAL, model snapshot and their consistency and reports every problem found
+// Verify doesn't modify data, but driver converts data of older format versions when it's created,
+// unless automatic migration is turned off (see storage.AutoMigrateOption). Engine must not be running on the same data
+func Verify(driver storage.Driver) (*Verification, error) {
+	wal, err := driver.WALFile().Verify()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verification{
+		WAL:      wal,
+		Problems: make([]Problem, 0),
+	}
+
+	for _, p := range wal.Problems {
+		v.Problems = append(v.Problems, Problem{
+			Source:  p.Segment,
+			Message: fmt.Sprintf("at %d: %s", p.Offset, p.Message),
+			Repair:  RepairTrimWAL,
+		})
+	}
+
+	// Snapshot might be rebuilt only if WAL keeps the whole change history
+	rebuild := RepairNone
+	if wal.FirstID == 1 {
+		rebuild = RepairRebuildSnapshot
+	}
+
+	root, err := readSnapshot(driver)
+	if err != nil {
+		v.Problems = append(v.Problems, Problem{
+			Source:  "snapshot",
+			Message: fmt.Sprintf("snapshot is damaged: %s", err),
+			Repair:  rebuild,
+		})
+		return v, nil
+	}
+
+	v.SnapshotChangeID = root.LastChangeID
+	v.SnapshotNodes = len(root.NodesMap)
+
+	for _, key := range root.Keys() {
+		_, err = root.Values(root.NodesMap[key])
+		if err != nil {
+			v.Problems = append(v.Problems, Problem{
+				Source:  "snapshot",
+				Message: fmt.Sprintf("values of key \"%s\" are unreadable: %s", key, err),
+				Repair:  rebuild,
+			})
+		}
+	}
+
+	// New WAL records would get IDs that are already in snapshot, so they would never be replayed
+	if v.SnapshotChangeID > wal.LastCommitID {
+		v.Problems = append(v.Problems, Problem{
+			Source:  "snapshot",
+			Message: fmt.Sprintf("snapshot ends at #%d, while WAL ends at #%d", v.SnapshotChangeID, wal.LastCommitID),
+			Repair:  RepairResetWAL,
+		})
+	}
+
+	// Snapshot's last change is followed by its commit record, then WAL continues
+	if wal.FirstID > v.SnapshotChangeID+2 && !wal.FirstIsCommit {
+		v.Problems = append(v.Problems, Problem{
+			Source:  "snapshot",
+			Message: fmt.Sprintf("snapshot ends at #%d, while WAL starts at #%d, changes in between might be lost", v.SnapshotChangeID, wal.FirstID),
+			Repair:  RepairNone,
+		})
+	}
+
+	return v, nil
+}
+
+// readSnapshot reads a model snapshot sequentially, so that every node is verified
+func readSnapshot(driver storage.Driver) (*model.Root, error) {
+	file, err := driver.SnapshotFile().Read()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return model.ReadSnapshotWithValueLog(file, driver.ValueLog())
+}
+
+// Repair fixes problems found by Verify and returns a list of performed actions along with remaining problems
+// Repair drops damaged data inevitably, so data must be backed up before calling Repair
+// Engine must not be running on the same data
+func Repair(driver storage.Driver) ([]RepairAction, *Verification, error) {
+	actions := make([]RepairAction, 0)
+	for {
+		v, err := Verify(driver)
+		if err != nil {
+			return actions, nil, err
+		}
+
+		action := v.nextRepair()
+		if action == RepairNone {
+			return actions, v, nil
+		}
+		for _, a := range actions {
+			if a == action {
+				return actions, v, fmt.Errorf("unable to repair data: \"%s\" has been performed already", action)
+			}
+		}
+
+		log.Printf("performing \"%s\" repair action", action)
+		switch action {
+		case RepairTrimWAL:
+			err = driver.WALFile().TrimAfter(v.WAL.LastCommitID)
+		case RepairRebuildSnapshot:
+			err = rebuildSnapshot(driver)
+		case RepairResetWAL:
+			err = resetWAL(driver, v)
+		}
+		if err != nil {
+			return actions, v, err
+		}
+
+		actions = append(actions, action)
+	}
+}
+
+// rebuildSnapshot replays the whole WAL and writes its result into a new model snapshot
+func rebuildSnapshot(driver storage.Driver) error {
+	wal, err := driver.WALFile().Read()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = wal.Close()
+	}()
+
+	root := model.New()
+	root.ValueLog = driver.ValueLog()
+	_, err = root.ReplayTransactions(wal, model.RecoveryTarget{})
+	if err != nil {
+		return err
+	}
+
+	file, err := driver.SnapshotFile().Write()
+	if err != nil {
+		return err
+	}
+	err = root.WriteSnapshot(file)
+	if err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Close()
+}
+
+// resetWAL drops WAL and starts a new one that continues snapshot's change ID counter
+// Every committed WAL record is already in snapshot, so nothing is lost
+func resetWAL(driver storage.Driver, v *Verification) error {
+	segments, err := driver.WALFile().Segments()
+	if err != nil {
+		return err
+	}
+
+	segment := 1
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1].Index + 1
+	}
+
+	return driver.WALFile().Reset(segment, v.SnapshotChangeID, v.WAL.LastCommitTxID)
+}
@@ -0,0 +1,210 @@
+package db_test
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestVerifyAndRepair(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	for _, test := range []struct {
+		Name    string
+		Vacuum  bool
+		Damage  func(dir string)
+		Actions []db.RepairAction
+	}{
+		{
+			Name: "no damage",
+		},
+		{
+			Name: "damaged wal tail",
+			Damage: func(dir string) {
+				appendFile(t, filepath.Join(dir, "journal-000001.dat"), []byte{1, 2, 3, 4, 5})
+			},
+			Actions: []db.RepairAction{db.RepairTrimWAL},
+		},
+		{
+			Name:   "damaged wal tail after vacuum",
+			Vacuum: true,
+			Damage: func(dir string) {
+				appendFile(t, filepath.Join(dir, "journal-000002.dat"), []byte{1, 2, 3, 4, 5})
+			},
+			Actions: []db.RepairAction{db.RepairTrimWAL},
+		},
+		{
+			Name: "damaged snapshot",
+			Damage: func(dir string) {
+				appendFile(t, filepath.Join(dir, "snapshot.dat"), []byte{1, 2, 3, 4, 5})
+			},
+			Actions: []db.RepairAction{db.RepairRebuildSnapshot},
+		},
+		{
+			Name: "lost wal",
+			Damage: func(dir string) {
+				removeFile(t, filepath.Join(dir, "journal-000001.dat"))
+			},
+			Actions: []db.RepairAction{db.RepairResetWAL},
+		},
+	} {
+		dir := t.TempDir()
+		writeVerifyTestData(t, dir, test.Vacuum)
+		if test.Damage != nil {
+			test.Damage(dir)
+		}
+
+		driver, err := storage.NewDriver(storage.DirectoryOption(dir))
+		if err != nil {
+			t.Fatalf("ERROR: NewDriver() failed: %s", err)
+		}
+
+		verification, err := db.Verify(driver)
+		if err != nil {
+			t.Errorf("ERROR: %s: Verify() failed: %s", test.Name, err)
+			continue
+		}
+		if len(verification.Problems) == 0 && len(test.Actions) > 0 {
+			t.Errorf("ERROR: %s: no problems found", test.Name)
+		}
+		if len(verification.Problems) > 0 && len(test.Actions) == 0 {
+			t.Errorf("ERROR: %s: unexpected problems found: %v", test.Name, verification.Problems)
+		}
+
+		actions, verification, err := db.Repair(driver)
+		if err != nil {
+			t.Errorf("ERROR: %s: Repair() failed: %s", test.Name, err)
+			continue
+		}
+		if fmt.Sprint(actions) != fmt.Sprint(test.Actions) {
+			t.Errorf("ERROR: %s: performed %v instead of %v", test.Name, actions, test.Actions)
+		}
+		if len(verification.Problems) > 0 {
+			t.Errorf("ERROR: %s: problems remain after repair: %v", test.Name, verification.Problems)
+		}
+
+		// Committed data must survive, while new changes must be durable
+		checkVerifyTestData(t, test.Name, driver)
+	}
+}
+
+func TestVerifyLostChanges(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	writeVerifyTestData(t, dir, true)
+	removeFile(t, filepath.Join(dir, "snapshot.dat"))
+
+	driver, err := storage.NewDriver(storage.DirectoryOption(dir))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	verification, err := db.Verify(driver)
+	if err != nil {
+		t.Fatalf("ERROR: Verify() failed: %s", err)
+	}
+	if len(verification.Problems) != 1 || verification.Problems[0].Repair != db.RepairNone {
+		t.Errorf("ERROR: expected an unrepairable problem but got %v", verification.Problems)
+	}
+}
+
+// writeVerifyTestData writes "key-0".."key-9" keys into a new data directory
+// If vacuum is set, vacuum is run after "key-4" is written
+func writeVerifyTestData(t *testing.T, dir string, vacuum bool) {
+	driver, err := storage.NewDriver(storage.DirectoryOption(dir))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatalf("ERROR: NewEngine() failed: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = engine.Tx(func(tx db.TX) error {
+			_, err := tx.AddValue(db.Key(fmt.Sprintf("key-%d", i)), db.Value("value"))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("ERROR: Tx() failed: %s", err)
+		}
+
+		if vacuum && i == 4 {
+			err = engine.Vacuum()
+			if err != nil {
+				t.Fatalf("ERROR: Vacuum() failed: %s", err)
+			}
+		}
+	}
+
+	err = engine.Close()
+	if err != nil {
+		t.Fatalf("ERROR: Close() failed: %s", err)
+	}
+}
+
+// checkVerifyTestData checks that every key written by writeVerifyTestData exists
+// and that a new change survives a restart
+func checkVerifyTestData(t *testing.T, name string, driver storage.Driver) {
+	for i := 0; i < 2; i++ {
+		engine, err := db.NewEngine(db.StorageDriverOption(driver))
+		if err != nil {
+			t.Errorf("ERROR: %s: NewEngine() failed: %s", name, err)
+			return
+		}
+
+		err = engine.Tx(func(tx db.TX) error {
+			for j := 0; j < 10; j++ {
+				_, err := tx.Get(db.Key(fmt.Sprintf("key-%d", j)))
+				if err != nil {
+					return fmt.Errorf("key-%d: %s", j, err)
+				}
+			}
+
+			if i == 0 {
+				_, err := tx.AddValue("new-key", db.Value("value"))
+				return err
+			}
+			_, err := tx.Get("new-key")
+			return err
+		})
+		if err != nil {
+			t.Errorf("ERROR: %s: %s", name, err)
+		}
+
+		_ = engine.Close()
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func removeFile(t *testing.T, path string) {
+	err := os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,36 @@
+package dbtest
+
+import (
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/db"
+)
+
+// Write adds a value to a key and checks that transaction returns expected error (nil if it should succeed)
+func Write(t *testing.T, engine db.Engine, key db.Key, expected error) {
+	t.Helper()
+
+	err := engine.Tx(func(tx db.TX) error {
+		_, e := tx.AddValue(key, db.Value("value"))
+		return e
+	})
+	if err != expected {
+		t.Errorf("ERROR: write of %s: expected %v but got %v", key, expected, err)
+	}
+}
+
+// CheckKey checks that a key exists or that it doesn't
+func CheckKey(t *testing.T, engine db.Engine, key db.Key, exists bool) {
+	t.Helper()
+
+	err := engine.Tx(func(tx db.TX) error {
+		_, e := tx.Get(key)
+		return e
+	})
+	if exists && err != nil {
+		t.Errorf("ERROR: %s: %s", key, err)
+	}
+	if !exists && err != db.ErrNoSuchKey {
+		t.Errorf("ERROR: %s should not exist (%v)", key, err)
+	}
+}
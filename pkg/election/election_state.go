@@ -0,0 +1,168 @@
+package election
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// stateVersion is current state file schema version
+const stateVersion uint32 = 1
+
+// State is a persistent state of a server that takes part in elections: its term, its vote and terms of its changes
+type State struct {
+	file     storage.StateFile
+	Term     uint64
+	VotedFor string
+	History  History
+}
+
+// LoadState reads server state from a state file
+// Changes that have been committed before server has joined a group belong to term zero
+func LoadState(file storage.StateFile) (*State, error) {
+	s := &State{
+		file:    file,
+		History: History{{Term: 0, After: 0}},
+	}
+
+	data, err := file.Read()
+	if err != nil || data == nil {
+		return s, err
+	}
+
+	r := bytes.NewReader(data)
+	version, err := util.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != stateVersion {
+		return nil, fmt.Errorf("election state file version v%d is not supported (expected v%d)", version, stateVersion)
+	}
+
+	s.Term, err = util.ReadUint64(r)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := util.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	s.VotedFor, err = util.ReadString(r, int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := util.ReadUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("election state file is damaged: no term ranges")
+	}
+	s.History = make(History, count)
+	for i := range s.History {
+		s.History[i].Term, err = util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		s.History[i].After, err = util.ReadUint64(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// save writes server state into a state file
+func (s *State) save() error {
+	buffer := &bytes.Buffer{}
+	_ = util.WriteUint32(buffer, stateVersion)
+	_ = util.WriteUint64(buffer, s.Term)
+	_ = util.WriteUint32(buffer, uint32(len(s.VotedFor)))
+	_ = util.WriteString(buffer, s.VotedFor)
+	_ = util.WriteUint32(buffer, uint32(len(s.History)))
+	for _, r := range s.History {
+		_ = util.WriteUint64(buffer, r.Term)
+		_ = util.WriteUint64(buffer, r.After)
+	}
+
+	err := s.file.Write(buffer.Bytes())
+	if err != nil {
+		log.Errorf("unable to write election state: %s", err)
+	}
+	return err
+}
+
+// SetTerm moves server into a new term, vote of a previous term is dropped
+func (s *State) SetTerm(term uint64, votedFor string) error {
+	s.Term = term
+	s.VotedFor = votedFor
+	return s.save()
+}
+
+// Vote grants a vote of current term to a candidate, the vote is persisted before it's granted
+// Vote is denied if another candidate has got it already, or if candidate's log isn't as up-to-date as server's one
+// (see IsUpToDate), so a new leader always has every change that a majority has
+func (s *State) Vote(candidate string, candidateLastTerm, candidateLastChangeID, lastChangeID uint64) (bool, error) {
+	if s.VotedFor != "" && s.VotedFor != candidate {
+		log.Verbosef("vote for %s at term %d is denied: %s has got it already", candidate, s.Term, s.VotedFor)
+		return false, nil
+	}
+
+	lastTerm := s.History.TermOf(lastChangeID)
+	if !IsUpToDate(candidateLastTerm, candidateLastChangeID, lastTerm, lastChangeID) {
+		log.Verbosef("vote for %s at term %d is denied: its log ends at #%d (term %d) while ours ends at #%d (term %d)",
+			candidate, s.Term, candidateLastChangeID, candidateLastTerm, lastChangeID, lastTerm)
+		return false, nil
+	}
+
+	err := s.SetTerm(s.Term, candidate)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AppendTerm makes sure that changes following lastChangeID belong to specified term
+// It's called before changes of a new term are written, so their term is never lost
+func (s *State) AppendTerm(term, lastChangeID uint64) error {
+	// Ranges of terms whose changes have never been written are dropped
+	n := len(s.History)
+	for n > 1 && s.History[n-1].After >= lastChangeID {
+		n--
+	}
+
+	last := s.History[n-1]
+	if last.Term > term {
+		return fmt.Errorf("change of term %d can't follow changes of term %d", term, last.Term)
+	}
+	if last.Term == term && n == len(s.History) {
+		return nil
+	}
+
+	s.History = s.History[:n]
+	if last.Term != term {
+		s.History = append(s.History, Range{Term: term, After: lastChangeID})
+	}
+	return s.save()
+}
+
+// SetHistory replaces terms of server's changes, e.g. with leader's history once server's log is its prefix
+func (s *State) SetHistory(history History) error {
+	if len(history) == 0 {
+		return fmt.Errorf("history has no term ranges")
+	}
+
+	s.History = append(History(nil), history...)
+	return s.save()
+}
+
+// Reset makes server's log start with a snapshot, changes it contains belong to specified term
+func (s *State) Reset(term uint64) error {
+	s.History = History{{Term: term, After: 0}}
+	return s.save()
+}
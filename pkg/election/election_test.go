@@ -0,0 +1,103 @@
+package election_test
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/election"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestState(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := election.LoadState(driver.StateFile("election.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes 1..10 belong to term zero, changes after them belong to term 2
+	err = s.SetTerm(2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AppendTerm(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AppendTerm(2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := election.History{{Term: 0, After: 0}, {Term: 2, After: 10}}
+	if !reflect.DeepEqual(s.History, expected) {
+		t.Errorf("ERROR: expected history %v but got %v", expected, s.History)
+	}
+	if s.AppendTerm(1, 20) == nil {
+		t.Errorf("ERROR: change of term 1 has followed changes of term 2")
+	}
+
+	// Candidate whose log is behind voter's one doesn't get a vote
+	granted, err := s.Vote("server-1", 0, 15, 15)
+	if err != nil || granted {
+		t.Errorf("ERROR: vote for a stale candidate: granted=%v, err=%v", granted, err)
+	}
+	granted, err = s.Vote("server-2", 2, 12, 15)
+	if err != nil || granted {
+		t.Errorf("ERROR: vote for a shorter log: granted=%v, err=%v", granted, err)
+	}
+	granted, err = s.Vote("server-3", 2, 15, 15)
+	if err != nil || !granted {
+		t.Errorf("ERROR: vote for an up-to-date candidate: granted=%v, err=%v", granted, err)
+	}
+	granted, err = s.Vote("server-4", 3, 20, 15)
+	if err != nil || granted {
+		t.Errorf("ERROR: second vote of a term: granted=%v, err=%v", granted, err)
+	}
+
+	// State survives a restart
+	loaded, err := election.LoadState(driver.StateFile("election.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Term != 2 || loaded.VotedFor != "server-3" || !reflect.DeepEqual(loaded.History, expected) {
+		t.Errorf("ERROR: unexpected state after restart: term=%d, voted for %q, history %v", loaded.Term, loaded.VotedFor, loaded.History)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := election.History{{Term: 0, After: 0}, {Term: 2, After: 10}, {Term: 5, After: 20}}
+
+	terms := map[uint64]uint64{1: 0, 10: 0, 11: 2, 20: 2, 21: 5, 100: 5}
+	for changeID, term := range terms {
+		if h.TermOf(changeID) != term {
+			t.Errorf("ERROR: change #%d: expected term %d but got %d", changeID, term, h.TermOf(changeID))
+		}
+	}
+
+	cases := []struct {
+		changeID, term uint64
+		contains       bool
+	}{
+		{0, 0, true},
+		{10, 0, true},
+		{11, 0, false},
+		{15, 2, true},
+		{15, 3, false},
+		{25, 5, true},
+		{31, 5, false},
+	}
+	for _, c := range cases {
+		if h.Contains(c.changeID, c.term, 30) != c.contains {
+			t.Errorf("ERROR: change #%d (term %d): expected contains=%v", c.changeID, c.term, c.contains)
+		}
+	}
+}
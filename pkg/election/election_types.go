@@ -0,0 +1,59 @@
+package election
+
+import (
+	l "github.com/kapitanov/natandb/pkg/log"
+)
+
+var log = l.New("election")
+
+// Range is a range of changes that have been committed by leader of the same term
+// Changes with IDs above After belong to this term unless they belong to a next range
+type Range struct {
+	Term  uint64
+	After uint64
+}
+
+// History is a list of term ranges, terms only grow within a history
+// Changes are numbered by engine and not by log position, so terms of changes are kept as ranges of change IDs
+type History []Range
+
+// TermOf returns a term of specified change
+func (h History) TermOf(changeID uint64) uint64 {
+	for i := len(h) - 1; i >= 0; i-- {
+		if h[i].After < changeID {
+			return h[i].Term
+		}
+	}
+
+	return 0
+}
+
+// Contains returns true if a log with this history contains specified change, lastChangeID is the last change of such log
+// Changes of a term always form a prefix of what leader of that term has committed,
+// so a log contains a change of a term if it doesn't go beyond log's range of this term.
+// An empty log (zero change ID) is a prefix of every log
+func (h History) Contains(changeID, term, lastChangeID uint64) bool {
+	if changeID == 0 {
+		return true
+	}
+
+	for i, r := range h {
+		if r.Term != term {
+			continue
+		}
+
+		last := lastChangeID
+		if i+1 < len(h) {
+			last = h[i+1].After
+		}
+		return r.After < changeID && changeID <= last
+	}
+
+	return false
+}
+
+// IsUpToDate returns true if a log that ends with specified change is at least as up-to-date as another one
+// A log that ends with a newer term is more up-to-date, logs that end with the same term are compared by their length
+func IsUpToDate(lastTerm, lastChangeID, otherLastTerm, otherLastChangeID uint64) bool {
+	return lastTerm > otherLastTerm || (lastTerm == otherLastTerm && lastChangeID >= otherLastChangeID)
+}
@@ -0,0 +1,589 @@
+package failover
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/election"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+const (
+	// resyncMinBackoff is a delay before downloading a snapshot of primary's data again after a failure
+	resyncMinBackoff = 1 * time.Second
+
+	// resyncMaxBackoff is a max delay before downloading a snapshot of primary's data again after repeated failures
+	resyncMaxBackoff = 30 * time.Second
+)
+
+// Node runs a DB engine as a member of a failover group
+//
+// Every server starts as a read-only replica. Primary sends heartbeats to replicas,
+// and it accepts writes only while its lease is valid: for a lease period since a majority of group has acknowledged a heartbeat.
+// Once replicas haven't heard from primary for a lease period, one of them asks others to promote it
+// with an epoch that is greater than any epoch before. Replicas don't vote while they hear from primary,
+// so a new primary is promoted only after lease of the old one has expired.
+//
+// Epoch is an election term (see election.State), and it's a fencing token: it's stamped into commit records of primary,
+// and servers never go back to an older epoch.
+// Each server keeps epochs of its changes, so a replica that has received changes which new primary doesn't have
+// (e.g. the old primary itself) replaces its data with a snapshot of new primary's data instead of following it
+type Node struct {
+	config        Config
+	engine        db.Engine
+	transport     Transport
+	replicator    Replicator
+	state         *election.State
+	mutex         sync.Mutex
+	role          Role
+	primary       string
+	lastHeartbeat time.Time
+	leaseExpiry   time.Time
+	acks          map[string]time.Time
+	resetTimer    chan struct{}
+	stopLeading   context.CancelFunc
+	following     *following
+	ctx           context.Context
+	cancel        context.CancelFunc
+	done          sync.WaitGroup
+}
+
+// following is a replication from a primary of an epoch
+type following struct {
+	primary string
+	epoch   uint64
+	cancel  context.CancelFunc
+}
+
+// NewNode creates a failover group member
+// Engine is switched into read-only mode until server is promoted
+// Server state is kept within a state file of specified storage driver
+func NewNode(config Config, engine db.Engine, driver storage.Driver, transport Transport, replicator Replicator) (*Node, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := election.LoadState(driver.StateFile(stateFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	engine.SetReadOnly(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		config:     config,
+		engine:     engine,
+		transport:  transport,
+		replicator: replicator,
+		state:      s,
+		role:       Replica,
+		acks:       make(map[string]time.Time),
+		resetTimer: make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	log.Printf("server %s has joined a failover group of %d servers at epoch %d", config.ID, len(config.Group), s.Term)
+	return n, nil
+}
+
+// Start starts election timer
+func (n *Node) Start() {
+	n.done.Add(1)
+	go n.run()
+}
+
+// Close leaves failover group, engine is left in read-only mode
+func (n *Node) Close() error {
+	// Context is cancelled under lock, so no goroutine is started once node is closed
+	n.mutex.Lock()
+	n.stepDown()
+	n.stopFollowing()
+	n.cancel()
+	n.mutex.Unlock()
+
+	n.done.Wait()
+	return nil
+}
+
+// Status returns a state of the server
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	lastChangeID := n.engine.LastCommitID()
+	status := Status{
+		Role:         n.role,
+		Epoch:        n.state.Term,
+		Primary:      n.primary,
+		LastChangeID: lastChangeID,
+		LastEpoch:    n.state.History.TermOf(lastChangeID),
+	}
+	if n.role == Primary {
+		status.LeaseExpiry = n.leaseExpiry
+	}
+	return status
+}
+
+// IsPrimary returns true if this server is a primary
+func (n *Node) IsPrimary() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.role == Primary
+}
+
+// Heartbeat handles a heartbeat of primary
+// Replica follows primary of the latest epoch it has heard of
+func (n *Node) Heartbeat(request *HeartbeatRequest) (*HeartbeatResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	response := &HeartbeatResponse{Epoch: n.state.Term}
+	if request.Epoch < n.state.Term {
+		return response, nil
+	}
+
+	if request.Epoch > n.state.Term {
+		err := n.observeEpoch(request.Epoch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	n.stepDown()
+
+	if n.following == nil || n.following.primary != request.Primary || n.following.epoch != request.Epoch {
+		log.Printf("following primary %s at epoch %d", request.Primary, request.Epoch)
+		n.follow(request.Epoch, request.Primary, request.History)
+	}
+
+	n.primary = request.Primary
+	n.lastHeartbeat = time.Now()
+	n.touch()
+	response.Epoch = request.Epoch
+	response.Accepted = true
+	return response, nil
+}
+
+// RequestVote handles a vote request of a candidate
+func (n *Node) RequestVote(request *VoteRequest) (*VoteResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	response := &VoteResponse{Epoch: n.state.Term}
+	if request.Epoch < n.state.Term {
+		return response, nil
+	}
+
+	// Lease of primary might be still valid, so a server that has lost connection to primary can't depose it
+	if n.role == Primary || time.Since(n.lastHeartbeat) < n.config.Lease {
+		log.Verbosef("vote for %s at epoch %d is denied: primary %s is alive", request.Candidate, request.Epoch, n.primary)
+		return response, nil
+	}
+
+	if request.Epoch > n.state.Term {
+		err := n.observeEpoch(request.Epoch)
+		if err != nil {
+			return nil, err
+		}
+		response.Epoch = request.Epoch
+	}
+
+	// Candidate's data must be at least as up-to-date as voter's one, so the latest changes survive a failover
+	granted, err := n.state.Vote(request.Candidate, request.LastEpoch, request.LastChangeID, n.engine.LastCommitID())
+	if err != nil {
+		return nil, err
+	}
+	if !granted {
+		return response, nil
+	}
+
+	// Voter gives candidate a lease period to take over
+	log.Printf("voted for %s at epoch %d", request.Candidate, request.Epoch)
+	n.lastHeartbeat = time.Now()
+	n.touch()
+	response.Granted = true
+	return response, nil
+}
+
+// observeEpoch moves server into a newer epoch, primary of a previous epoch is forgotten
+// Node lock must be held by caller
+func (n *Node) observeEpoch(epoch uint64) error {
+	n.stepDown()
+	n.primary = ""
+
+	log.Verbosef("moving from epoch %d to epoch %d", n.state.Term, epoch)
+	return n.state.SetTerm(epoch, "")
+}
+
+// stepDown makes primary or candidate a replica, primary stops accepting writes
+// Node lock must be held by caller
+func (n *Node) stepDown() {
+	if n.role == Primary {
+		log.Printf("stepping down at epoch %d", n.state.Term)
+		n.stopLeading()
+		n.stopLeading = nil
+		n.engine.SetReadOnly(true)
+		n.engine.SetWriteDeadline(time.Time{})
+		n.primary = ""
+	}
+	n.role = Replica
+}
+
+// follow starts replicating changes of a primary
+// Node lock must be held by caller
+func (n *Node) follow(epoch uint64, primary string, history election.History) {
+	n.stopFollowing()
+	if n.ctx.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	n.following = &following{primary: primary, epoch: epoch, cancel: cancel}
+	n.done.Add(1)
+	go n.runFollowing(ctx, primary, history)
+}
+
+// stopFollowing stops replicating changes of a primary
+// Node lock must be held by caller
+func (n *Node) stopFollowing() {
+	if n.following == nil {
+		return
+	}
+
+	n.following.cancel()
+	n.following = nil
+	n.replicator.Stop()
+}
+
+// runFollowing makes server follow a primary
+// If server's data isn't a prefix of primary's data, it's replaced with a snapshot of primary's data first
+func (n *Node) runFollowing(ctx context.Context, primary string, history election.History) {
+	defer n.done.Done()
+
+	delay := resyncMinBackoff
+	for {
+		n.mutex.Lock()
+		if ctx.Err() != nil {
+			n.mutex.Unlock()
+			return
+		}
+
+		lastChangeID := n.engine.LastCommitID()
+		// Primary's history doesn't bound its last epoch, since primary keeps committing changes
+		lastEpoch := n.state.History.TermOf(lastChangeID)
+		if history.Contains(lastChangeID, lastEpoch, math.MaxUint64) {
+			err := n.state.SetHistory(history)
+			if err == nil {
+				n.replicator.Follow(primary)
+				n.mutex.Unlock()
+				return
+			}
+			n.mutex.Unlock()
+		} else {
+			n.mutex.Unlock()
+
+			log.Printf("data up to change #%d has diverged from data of primary %s, downloading a snapshot", lastChangeID, primary)
+			err := n.resync(ctx, primary, history)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("unable to resync with primary %s: %s, retrying in %s", primary, err, delay)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		delay *= 2
+		if delay > resyncMaxBackoff {
+			delay = resyncMaxBackoff
+		}
+	}
+}
+
+// resync replaces server's data with a snapshot of primary's data and starts following primary
+func (n *Node) resync(ctx context.Context, primary string, history election.History) error {
+	root, changeID, err := n.replicator.Snapshot(ctx, primary)
+	if err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// Server might have been promoted or might follow another primary already
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	err = n.engine.Install(root, changeID)
+	if err != nil {
+		return err
+	}
+
+	err = n.state.SetHistory(history)
+	if err != nil {
+		return err
+	}
+
+	n.replicator.Follow(primary)
+	return nil
+}
+
+// touch resets election timer
+func (n *Node) touch() {
+	select {
+	case n.resetTimer <- struct{}{}:
+	default:
+	}
+}
+
+// lastChange returns ID and epoch of the last change within server's data
+// Node lock must be held by caller
+func (n *Node) lastChange() (uint64, uint64) {
+	changeID := n.engine.LastCommitID()
+	return changeID, n.state.History.TermOf(changeID)
+}
+
+// run starts an election once replica hasn't heard from primary for a lease period
+func (n *Node) run() {
+	defer n.done.Done()
+
+	for {
+		timeout := n.config.Lease + time.Duration(rand.Int63n(int64(n.config.Lease)))
+		timer := time.NewTimer(timeout)
+
+		select {
+		case <-n.ctx.Done():
+			timer.Stop()
+			return
+
+		case <-n.resetTimer:
+			timer.Stop()
+
+		case <-timer.C:
+			n.mutex.Lock()
+			if n.role != Primary && n.ctx.Err() == nil {
+				n.startElection()
+			}
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// startElection makes server a candidate and asks other servers for their votes
+// Node lock must be held by caller
+func (n *Node) startElection() {
+	epoch := n.state.Term + 1
+	err := n.state.SetTerm(epoch, n.config.ID)
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	n.role = Candidate
+	n.primary = ""
+	lastChangeID, lastEpoch := n.lastChange()
+	log.Printf("starting an election at epoch %d, data ends at #%d (epoch %d)", epoch, lastChangeID, lastEpoch)
+
+	votes := 1
+	if votes >= n.config.Quorum() {
+		n.promote(epoch, start)
+		return
+	}
+
+	request := &VoteRequest{
+		Epoch:        epoch,
+		Candidate:    n.config.ID,
+		LastChangeID: lastChangeID,
+		LastEpoch:    lastEpoch,
+	}
+	for _, server := range n.config.Group {
+		if server == n.config.ID {
+			continue
+		}
+
+		n.done.Add(1)
+		go func(server string) {
+			defer n.done.Done()
+
+			ctx, cancel := context.WithTimeout(n.ctx, n.config.Lease)
+			response, err := n.transport.RequestVote(ctx, server, request)
+			cancel()
+			if err != nil {
+				log.Verbosef("unable to request a vote of %s: %s", server, err)
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if response.Epoch > n.state.Term {
+				_ = n.observeEpoch(response.Epoch)
+				return
+			}
+			if !response.Granted || n.role != Candidate || n.state.Term != epoch {
+				return
+			}
+
+			votes++
+			if votes >= n.config.Quorum() {
+				n.promote(epoch, start)
+			}
+		}(server)
+	}
+}
+
+// promote makes server a primary of specified epoch
+// Voters don't vote for anyone else for a lease period since they have voted, so primary's lease starts with an election
+// Lease expiry is passed to engine as a write deadline, so writes are rejected right after it even if primary hasn't stepped down yet
+// Node lock must be held by caller
+func (n *Node) promote(epoch uint64, start time.Time) {
+	if n.ctx.Err() != nil {
+		return
+	}
+
+	lastChangeID := n.engine.LastCommitID()
+	err := n.state.AppendTerm(epoch, lastChangeID)
+	if err != nil {
+		log.Errorf("unable to promote: %s", err)
+		return
+	}
+
+	n.stopFollowing()
+	n.role = Primary
+	n.primary = n.config.ID
+	n.leaseExpiry = start.Add(n.config.Lease)
+	n.acks = make(map[string]time.Time)
+	n.engine.SetTerm(epoch)
+	n.engine.SetWriteDeadline(n.leaseExpiry)
+	n.engine.SetReadOnly(false)
+	log.Printf("promoted to primary at epoch %d after change #%d", epoch, lastChangeID)
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	n.stopLeading = cancel
+	n.done.Add(1)
+	go n.lead(ctx, epoch)
+}
+
+// lead sends heartbeats to replicas and makes primary step down once its lease expires
+// Engine rejects writes by itself once lease expires (see promote), stepping down might wait for a running transaction
+func (n *Node) lead(ctx context.Context, epoch uint64) {
+	defer n.done.Done()
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	n.sendHeartbeats(ctx, epoch)
+	for {
+		n.mutex.Lock()
+		expiry := n.leaseExpiry
+		n.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(expiry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+
+		case <-ticker.C:
+			timer.Stop()
+			n.sendHeartbeats(ctx, epoch)
+
+		case <-timer.C:
+		}
+
+		n.mutex.Lock()
+		if ctx.Err() == nil && !time.Now().Before(n.leaseExpiry) {
+			log.Errorf("lease has expired: a majority of group hasn't acknowledged heartbeats for %s", n.config.Lease)
+			n.stepDown()
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// sendHeartbeats sends a heartbeat to every replica, primary's lease is renewed once a majority acknowledges it
+func (n *Node) sendHeartbeats(ctx context.Context, epoch uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// Primary might have stepped down already, so its lease isn't renewed
+	if ctx.Err() != nil {
+		return
+	}
+
+	sent := time.Now()
+	request := &HeartbeatRequest{
+		Epoch:   epoch,
+		Primary: n.config.ID,
+		History: append(election.History(nil), n.state.History...),
+	}
+	n.acks[n.config.ID] = sent
+	n.renewLease()
+
+	for _, server := range n.config.Group {
+		if server == n.config.ID {
+			continue
+		}
+
+		n.done.Add(1)
+		go func(server string) {
+			defer n.done.Done()
+
+			requestCtx, cancel := context.WithTimeout(ctx, n.config.HeartbeatInterval)
+			response, err := n.transport.Heartbeat(requestCtx, server, request)
+			cancel()
+			if err != nil {
+				log.Verbosef("unable to send a heartbeat to %s: %s", server, err)
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if response.Epoch > n.state.Term {
+				log.Printf("server %s is at epoch %d", server, response.Epoch)
+				_ = n.observeEpoch(response.Epoch)
+				return
+			}
+			if !response.Accepted || n.role != Primary || n.state.Term != epoch {
+				return
+			}
+
+			if sent.After(n.acks[server]) {
+				n.acks[server] = sent
+			}
+			n.renewLease()
+		}(server)
+	}
+}
+
+// renewLease extends primary's lease up to a lease period since a majority of group has acknowledged a heartbeat
+// An acknowledgement is counted from the moment heartbeat has been sent, since replica can't receive it earlier
+// Node lock must be held by caller
+func (n *Node) renewLease() {
+	acks := make([]time.Time, 0, len(n.acks))
+	for _, ack := range n.acks {
+		acks = append(acks, ack)
+	}
+	if len(acks) < n.config.Quorum() {
+		return
+	}
+
+	sort.Slice(acks, func(i, j int) bool { return acks[i].After(acks[j]) })
+	expiry := acks[n.config.Quorum()-1].Add(n.config.Lease)
+	if expiry.After(n.leaseExpiry) {
+		n.leaseExpiry = expiry
+		n.engine.SetWriteDeadline(expiry)
+	}
+}
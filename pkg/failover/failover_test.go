@@ -0,0 +1,311 @@
+package failover_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/db/dbtest"
+	"github.com/kapitanov/natandb/pkg/failover"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestFailover(t *testing.T) {
+	g := createGroup(t, 3)
+	defer g.Close()
+
+	primary := g.waitForPrimary(t, "")
+	dbtest.Write(t, g.engines[primary], "key-1", nil)
+	g.waitForSync(t)
+	for id, engine := range g.engines {
+		dbtest.CheckKey(t, engine, "key-1", true)
+		if id != primary {
+			dbtest.Write(t, engine, "key-2", db.ErrReadOnly)
+		}
+	}
+
+	// Partitioned primary keeps accepting writes until its lease expires, then replicas promote a new primary
+	g.network.isolate(primary, true)
+	dbtest.Write(t, g.engines[primary], "lost-key", nil)
+	newPrimary := g.waitForPrimary(t, primary)
+	dbtest.Write(t, g.engines[primary], "rejected-key", db.ErrReadOnly)
+	dbtest.Write(t, g.engines[newPrimary], "key-3", nil)
+
+	// New primary stamps its epoch into commit records
+	epoch := g.nodes[newPrimary].Status().Epoch
+	records, _, err := g.engines[newPrimary].BackupSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit := records[len(records)-1]; commit.Type != storage.WALCommitTx || commit.CommitTerm() != epoch {
+		t.Errorf("ERROR: commit record %v is not stamped with epoch %d", commit, epoch)
+	}
+
+	// Old primary drops a change that new primary doesn't have once it rejoins
+	g.network.isolate(primary, false)
+	g.waitForSync(t)
+	for _, engine := range g.engines {
+		dbtest.CheckKey(t, engine, "key-3", true)
+		dbtest.CheckKey(t, engine, "lost-key", false)
+	}
+	if status := g.nodes[primary].Status(); status.Role != failover.Replica || status.Primary != newPrimary || status.Epoch != epoch {
+		t.Errorf("ERROR: old primary has unexpected status %+v", status)
+	}
+}
+
+// group is a set of servers connected by an in-memory network
+type group struct {
+	network *network
+	nodes   map[string]*failover.Node
+	engines map[string]db.Engine
+}
+
+func createGroup(t *testing.T, size int) *group {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	g := &group{
+		network: &network{nodes: make(map[string]*failover.Node), engines: make(map[string]db.Engine), isolated: make(map[string]bool)},
+		nodes:   make(map[string]*failover.Node),
+		engines: make(map[string]db.Engine),
+	}
+
+	servers := make([]string, size)
+	for i := range servers {
+		servers[i] = fmt.Sprintf("server-%d", i+1)
+	}
+
+	for _, id := range servers {
+		driver, err := storage.NewDriver(storage.InMemoryOption())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		engine, err := db.NewEngine(db.StorageDriverOption(driver), db.ReplicaOption())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := failover.Config{
+			ID:                id,
+			Group:             servers,
+			Lease:             200 * time.Millisecond,
+			HeartbeatInterval: 40 * time.Millisecond,
+		}
+		r := &replicator{network: g.network, id: id, engine: engine}
+		node, err := failover.NewNode(config, engine, driver, g.network.transport(id), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g.network.add(id, node, engine)
+		g.nodes[id] = node
+		g.engines[id] = engine
+	}
+
+	for _, node := range g.nodes {
+		node.Start()
+	}
+	return g
+}
+
+// waitForPrimary waits until every connected server follows the same primary, other than specified one
+func (g *group) waitForPrimary(t *testing.T, oldPrimary string) string {
+	timeout := time.After(10 * time.Second)
+	for {
+		primaries := make(map[string]bool)
+		for id, node := range g.nodes {
+			if !g.network.isIsolated(id) {
+				primaries[node.Status().Primary] = true
+			}
+		}
+
+		for primary := range primaries {
+			if len(primaries) == 1 && primary != "" && primary != oldPrimary && g.nodes[primary].IsPrimary() {
+				return primary
+			}
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("ERROR: no primary has been promoted, servers follow %v", primaries)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// waitForSync waits until every server reaches the same change
+func (g *group) waitForSync(t *testing.T) {
+	timeout := time.After(10 * time.Second)
+	for {
+		// Diverged servers might have the same count of changes, so epochs of their last changes are compared too
+		changeIDs := make(map[string]bool)
+		for _, node := range g.nodes {
+			status := node.Status()
+			changeIDs[fmt.Sprintf("#%d (epoch %d)", status.LastChangeID, status.LastEpoch)] = true
+		}
+		if len(changeIDs) == 1 {
+			return
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("ERROR: servers haven't caught up, they are at %v", changeIDs)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (g *group) Close() {
+	for id, node := range g.nodes {
+		_ = node.Close()
+		_ = g.engines[id].Close()
+	}
+}
+
+// network passes requests between servers directly, isolated servers are unreachable
+type network struct {
+	mutex    sync.Mutex
+	nodes    map[string]*failover.Node
+	engines  map[string]db.Engine
+	isolated map[string]bool
+}
+
+func (n *network) add(id string, node *failover.Node, engine db.Engine) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.nodes[id] = node
+	n.engines[id] = engine
+}
+
+func (n *network) isolate(id string, isolated bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.isolated[id] = isolated
+}
+
+func (n *network) isIsolated(id string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.isolated[id]
+}
+
+func (n *network) transport(from string) failover.Transport {
+	return &transport{network: n, from: from}
+}
+
+// connect returns a server if it's reachable from another one
+func (n *network) connect(from, to string) (*failover.Node, db.Engine, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.isolated[from] || n.isolated[to] {
+		return nil, nil, fmt.Errorf("%s is unreachable from %s", to, from)
+	}
+	return n.nodes[to], n.engines[to], nil
+}
+
+type transport struct {
+	network *network
+	from    string
+}
+
+func (t *transport) Heartbeat(ctx context.Context, server string, request *failover.HeartbeatRequest) (*failover.HeartbeatResponse, error) {
+	node, _, err := t.network.connect(t.from, server)
+	if err != nil {
+		return nil, err
+	}
+	return node.Heartbeat(request)
+}
+
+func (t *transport) RequestVote(ctx context.Context, server string, request *failover.VoteRequest) (*failover.VoteResponse, error) {
+	node, _, err := t.network.connect(t.from, server)
+	if err != nil {
+		return nil, err
+	}
+	return node.RequestVote(request)
+}
+
+// replicator applies transactions of primary's engine while primary is reachable
+type replicator struct {
+	network *network
+	id      string
+	engine  db.Engine
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (r *replicator) Snapshot(ctx context.Context, primary string) (*model.Root, uint64, error) {
+	_, engine, err := r.network.connect(r.id, primary)
+	if err != nil {
+		return nil, 0, err
+	}
+	return engine.Backup()
+}
+
+func (r *replicator) Follow(primary string) {
+	r.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		for ctx.Err() == nil {
+			r.replicate(ctx, primary)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}(r.done)
+}
+
+func (r *replicator) replicate(ctx context.Context, primary string) {
+	_, engine, err := r.network.connect(r.id, primary)
+	if err != nil {
+		return
+	}
+
+	feed, err := engine.Subscribe(r.engine.LastCommitID())
+	if err != nil {
+		return
+	}
+	defer feed.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case records, ok := <-feed.Transactions():
+			if !ok || r.network.isIsolated(r.id) || r.network.isIsolated(primary) {
+				return
+			}
+			if r.engine.ApplyTx(records) != nil {
+				return
+			}
+		case <-time.After(10 * time.Millisecond):
+			if r.network.isIsolated(r.id) || r.network.isIsolated(primary) {
+				return
+			}
+		}
+	}
+}
+
+func (r *replicator) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+		<-r.done
+		r.cancel = nil
+	}
+}
@@ -0,0 +1,186 @@
+package failover
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/election"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/model"
+)
+
+var log = l.New("failover")
+
+const (
+	// DefaultLease is a default time primary keeps accepting writes after a majority of group has acknowledged its heartbeat
+	DefaultLease = 5 * time.Second
+
+	// DefaultHeartbeatInterval is a default delay between two heartbeats of primary
+	DefaultHeartbeatInterval = 1 * time.Second
+
+	// stateFileName is a name of a state file that keeps server's epoch, vote and epochs of its changes
+	stateFileName = "failover.dat"
+)
+
+// Config is a configuration of a failover group member
+type Config struct {
+	// ID is an endpoint of this server, it must be listed within Group
+	ID string
+
+	// Group is a list of endpoints of every server of failover group, including this one
+	Group []string
+
+	// Lease is a time primary keeps accepting writes after a majority of group has acknowledged its heartbeat
+	// Replicas don't promote anyone until they haven't heard from primary for this long
+	Lease time.Duration
+
+	// HeartbeatInterval is a delay between two heartbeats of primary
+	HeartbeatInterval time.Duration
+}
+
+// Quorum returns a count of servers that make a majority
+func (c Config) Quorum() int {
+	return len(c.Group)/2 + 1
+}
+
+// validate checks configuration and fills default values
+func (c *Config) validate() error {
+	if c.Lease <= 0 {
+		c.Lease = DefaultLease
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if c.HeartbeatInterval >= c.Lease {
+		return fmt.Errorf("heartbeat interval (%s) must be less than lease (%s)", c.HeartbeatInterval, c.Lease)
+	}
+
+	isListed := false
+	group := make(map[string]bool)
+	for _, server := range c.Group {
+		if group[server] {
+			return fmt.Errorf("server \"%s\" is listed twice", server)
+		}
+		group[server] = true
+		isListed = isListed || server == c.ID
+	}
+	if !isListed {
+		return fmt.Errorf("server \"%s\" is not listed within failover group", c.ID)
+	}
+
+	return nil
+}
+
+// Role is a role of a failover group member
+type Role int
+
+const (
+	// Replica applies transactions of primary, it's read-only
+	Replica Role = iota
+
+	// Candidate is a replica that asks others to promote it
+	Candidate
+
+	// Primary accepts transactions while its lease is valid
+	Primary
+)
+
+func (r Role) String() string {
+	switch r {
+	case Replica:
+		return "replica"
+	case Candidate:
+		return "candidate"
+	case Primary:
+		return "primary"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// Status is a state of a failover group member
+type Status struct {
+	// Role of this server
+	Role Role
+
+	// Current epoch
+	Epoch uint64
+
+	// Endpoint of current primary, empty if primary is unknown
+	Primary string
+
+	// Time primary's lease expires at (primary only)
+	LeaseExpiry time.Time
+
+	// ID of the last committed change
+	LastChangeID uint64
+
+	// Epoch of the last committed change
+	LastEpoch uint64
+}
+
+// HeartbeatRequest is sent by primary to renew its lease
+type HeartbeatRequest struct {
+	// Primary's epoch
+	Epoch uint64
+
+	// Primary's endpoint
+	Primary string
+
+	// Epochs of changes within primary's data
+	// Replica follows primary only if its data is a prefix of primary's one, otherwise it downloads a snapshot
+	History election.History
+}
+
+// HeartbeatResponse is a reply to HeartbeatRequest
+type HeartbeatResponse struct {
+	// Current epoch of replica, for primary to step down if it's stale
+	Epoch uint64
+
+	// True if replica follows primary
+	Accepted bool
+}
+
+// VoteRequest is sent by a candidate to gather votes
+type VoteRequest struct {
+	// Candidate's epoch
+	Epoch uint64
+
+	// Candidate's endpoint
+	Candidate string
+
+	// ID and epoch of the last change within candidate's data
+	LastChangeID uint64
+	LastEpoch    uint64
+}
+
+// VoteResponse is a reply to VoteRequest
+type VoteResponse struct {
+	// Current epoch of voter, for candidate to update itself
+	Epoch uint64
+
+	// True if vote has been granted
+	Granted bool
+}
+
+// Transport sends requests to other group members
+type Transport interface {
+	// Heartbeat renews primary's lease
+	Heartbeat(ctx context.Context, server string, request *HeartbeatRequest) (*HeartbeatResponse, error)
+
+	// RequestVote asks a server for its vote
+	RequestVote(ctx context.Context, server string, request *VoteRequest) (*VoteResponse, error)
+}
+
+// Replicator copies data of primary to this server
+type Replicator interface {
+	// Snapshot downloads a snapshot of primary's data and returns it with ID of the last change it contains
+	Snapshot(ctx context.Context, primary string) (*model.Root, uint64, error)
+
+	// Follow starts applying transactions of primary, replication from previous primary is stopped
+	Follow(primary string)
+
+	// Stop stops replication
+	Stop()
+}
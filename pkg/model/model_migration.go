@@ -0,0 +1,126 @@
+package model
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// SnapshotVersion returns schema version of a model snapshot, zero if snapshot is empty
+func SnapshotVersion(file storage.SnapshotFile) (uint32, error) {
+	r, err := file.Read()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	version, err := util.ReadUint32(r)
+	if err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// SnapshotMigration returns a step that converts model snapshot into specified schema version
+// Zero version stands for current schema version, while older v2 and v3 are supported for a downgrade
+// It returns nil if snapshot is empty or has specified schema version already
+func SnapshotMigration(driver storage.Driver, version uint32) (*storage.Migration, error) {
+	if version == 0 {
+		version = schemaVersionIndexed
+	}
+
+	switch version {
+	case schemaVersion, schemaVersionIndexed:
+	case schemaVersionRefs:
+		if driver.ValueLog() == nil {
+			return nil, fmt.Errorf("schema v%d refers to a value log, which is not enabled", version)
+		}
+	default:
+		return nil, fmt.Errorf("schema v%d is not supported (expected v%d..v%d)", version, schemaVersion, schemaVersionIndexed)
+	}
+
+	current, err := SnapshotVersion(driver.SnapshotFile())
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 || current == version {
+		return nil, nil
+	}
+
+	var description string
+	switch version {
+	case schemaVersionIndexed:
+		description = "rewrite snapshot with an index"
+	case schemaVersionRefs:
+		description = "rewrite snapshot without an index, values are kept in value log"
+	default:
+		description = "rewrite snapshot without an index, values are kept in snapshot"
+	}
+
+	return &storage.Migration{
+		Path:        driver.SnapshotFile().Path(),
+		FromVersion: current,
+		ToVersion:   version,
+		Description: description,
+		Run: func() error {
+			return convertSnapshot(driver, current, version)
+		},
+	}, nil
+}
+
+// convertSnapshot rewrites model snapshot in specified schema version
+// Original snapshot is copied into a backup file first
+func convertSnapshot(driver storage.Driver, from, to uint32) error {
+	model, _, err := loadSnapshot(driver.SnapshotFile(), driver.ValueLog())
+	if err != nil {
+		return err
+	}
+
+	// Snapshots that refer to a value log must never refer to values that are not stored yet
+	if model.ValueLog != nil && to != schemaVersion {
+		err = model.moveToValueLog()
+		if err == nil {
+			err = model.ValueLog.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = driver.SnapshotFile().Backup(from)
+	if err != nil {
+		return err
+	}
+
+	file, err := driver.SnapshotFile().Write()
+	if err != nil {
+		return err
+	}
+
+	switch to {
+	case schemaVersionIndexed:
+		err = model.writeIndexedSnapshot(file, model.ValueLog != nil)
+	default:
+		err = model.writeSnapshot(file, to)
+	}
+	if err != nil {
+		file.Abort()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("snapshot has been converted from v%d into v%d", from, to)
+	return nil
+}
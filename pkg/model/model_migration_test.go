@@ -0,0 +1,114 @@
+package model
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	l "log"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestSnapshotMigration(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	driver, err := storage.NewDriver(storage.DirectoryOption(t.TempDir()))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	expected := New()
+	expected.GetOrCreateNode("key-1").Values = []Value{Value("a"), Value("b")}
+	expected.GetOrCreateNode("key-2").Values = []Value{Value("c")}
+	expected.LastChangeID = 3
+
+	file, err := driver.SnapshotFile().Write()
+	if err != nil {
+		t.Fatalf("ERROR: Write() failed: %s", err)
+	}
+	err = expected.ExportSnapshot(file)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		t.Fatalf("ERROR: ExportSnapshot() failed: %s", err)
+	}
+
+	// Planning a migration changes nothing
+	migration, err := SnapshotMigration(driver, 0)
+	if err != nil {
+		t.Fatalf("ERROR: SnapshotMigration() failed: %s", err)
+	}
+	if migration == nil || migration.FromVersion != schemaVersion || migration.ToVersion != schemaVersionIndexed {
+		t.Errorf("ERROR: unexpected migration %v", migration)
+	}
+	checkSnapshotVersion(t, driver, schemaVersion)
+
+	for _, version := range []uint32{schemaVersionV1, schemaVersionRefs, schemaVersionIndexed + 1} {
+		_, err = SnapshotMigration(driver, version)
+		if err == nil {
+			t.Errorf("ERROR: migration into v%d should fail", version)
+		}
+	}
+
+	// Older snapshots are upgraded on startup
+	actual, err := Restore(driver, nil)
+	if err != nil {
+		t.Fatalf("ERROR: Restore() failed: %s", err)
+	}
+	checkSnapshotVersion(t, driver, schemaVersionIndexed)
+	checkSnapshotNodes(t, actual, expected)
+	checkSnapshotBackup(t, driver, schemaVersion)
+
+	// Snapshot might be downgraded, so it's readable by an older version
+	migration, err = SnapshotMigration(driver, schemaVersion)
+	if err != nil {
+		t.Fatalf("ERROR: SnapshotMigration() failed: %s", err)
+	}
+	err = migration.Run()
+	if err != nil {
+		t.Fatalf("ERROR: Run() failed: %s", err)
+	}
+	checkSnapshotVersion(t, driver, schemaVersion)
+	checkSnapshotBackup(t, driver, schemaVersionIndexed)
+
+	actual, _, err = loadSnapshot(driver.SnapshotFile(), nil)
+	if err != nil {
+		t.Fatalf("ERROR: loadSnapshot() failed: %s", err)
+	}
+	checkSnapshotNodes(t, actual, expected)
+
+	migration, err = SnapshotMigration(driver, schemaVersion)
+	if err != nil || migration != nil {
+		t.Errorf("ERROR: unexpected migration %v (%v)", migration, err)
+	}
+}
+
+func checkSnapshotVersion(t *testing.T, driver storage.Driver, expected uint32) {
+	version, err := SnapshotVersion(driver.SnapshotFile())
+	if err != nil {
+		t.Fatalf("ERROR: SnapshotVersion() failed: %s", err)
+	}
+	if version != expected {
+		t.Errorf("ERROR: snapshot has v%d instead of v%d", version, expected)
+	}
+}
+
+func checkSnapshotBackup(t *testing.T, driver storage.Driver, version uint32) {
+	_, err := os.Stat(storage.MigrationBackupPath(driver.SnapshotFile().Path(), version))
+	if err != nil {
+		t.Errorf("ERROR: snapshot v%d has not been backed up: %s", version, err)
+	}
+}
+
+func checkSnapshotNodes(t *testing.T, actual, expected *Root) {
+	if actual.LastChangeID != expected.LastChangeID || len(actual.NodesMap) != len(expected.NodesMap) {
+		t.Errorf("ERROR: model #%d with %d nodes != model #%d with %d nodes", actual.LastChangeID, len(actual.NodesMap), expected.LastChangeID, len(expected.NodesMap))
+	}
+	for key, node := range expected.NodesMap {
+		if other := actual.GetNode(key); other == nil || other.String() != node.String() {
+			t.Errorf("ERROR: node %s != %s", other, node)
+		}
+	}
+}
@@ -29,14 +29,27 @@ type Node struct {
 	// ID of last change applied to node
 	LastChangeID uint64
 	// Node values
+	// It's empty if node values are kept within a value log
 	Values []Value
+	// References to node values within a value log
+	// It's empty unless value log is enabled
+	Refs []storage.ValueRef
 }
 
 func (n *Node) String() string {
+	if len(n.Refs) > 0 {
+		return fmt.Sprintf("{ $%d, \"%s\" %d refs }", n.LastChangeID, n.Key, len(n.Refs))
+	}
 	return fmt.Sprintf("{ $%d, \"%s\" %s }", n.LastChangeID, n.Key, n.Values)
 }
 
+// Len returns count of node values
+func (n *Node) Len() int {
+	return len(n.Values) + len(n.Refs)
+}
+
 // Contains returns true if node contains specified value
+// Node values must not be kept within a value log, see Root.Contains
 func (n *Node) Contains(value Value) bool {
 	for i := range n.Values {
 		if n.Values[i].Equal(value) {
@@ -48,7 +61,8 @@ func (n *Node) Contains(value Value) bool {
 }
 
 // Apply applied a write-ahead log record to a data model node
-func (n *Node) apply(record *storage.WALRecord) error {
+// If value log is specified, values are appended to it and node keeps references only
+func (n *Node) apply(record *storage.WALRecord, values storage.ValueLog) error {
 	if record.ID <= n.LastChangeID {
 		return nil
 	}
@@ -60,11 +74,34 @@ func (n *Node) apply(record *storage.WALRecord) error {
 		return nil
 	case storage.WALRemoveKey:
 		n.Values = n.Values[0:0]
+		n.Refs = nil
 		break
 	case storage.WALAddValue:
-		n.Values = append(n.Values, record.Value)
+		if values == nil {
+			n.Values = append(n.Values, record.Value)
+			break
+		}
+
+		err := n.moveToValueLog(values)
+		if err != nil {
+			return err
+		}
+
+		ref, err := values.Append(record.Value)
+		if err != nil {
+			return err
+		}
+		n.Refs = append(n.Refs, ref)
 		break
 	case storage.WALRemoveValue:
+		if len(n.Refs) > 0 {
+			_, err := n.removeRef(record.Value, values)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
 		n.removeValue(record.Value)
 		break
 	default:
@@ -97,3 +134,61 @@ func (n *Node) removeValue(value Value) bool {
 
 	return false
 }
+
+// findRef returns an index of a value reference that matches specified value, or -1 if there's none
+func (n *Node) findRef(value Value, values storage.ValueLog) (int, error) {
+	checksum := storage.ValueChecksum(value)
+	for i, ref := range n.Refs {
+		if ref.Length != uint32(len(value)) || ref.Checksum != checksum {
+			continue
+		}
+
+		// Checksums might collide, so values are compared as well
+		v, err := values.Read(ref)
+		if err != nil {
+			return -1, err
+		}
+
+		if Value(v).Equal(value) {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// removeRef removes a value reference from a node
+func (n *Node) removeRef(value Value, values storage.ValueLog) (bool, error) {
+	if values == nil {
+		return false, errNoValueLog
+	}
+
+	i, err := n.findRef(value, values)
+	if err != nil || i < 0 {
+		return false, err
+	}
+
+	n.Refs = append(n.Refs[:i], n.Refs[i+1:]...)
+	return true, nil
+}
+
+// moveToValueLog appends node values to a value log and replaces them with references
+func (n *Node) moveToValueLog(values storage.ValueLog) error {
+	if len(n.Values) == 0 {
+		return nil
+	}
+
+	refs := make([]storage.ValueRef, 0, len(n.Refs)+len(n.Values))
+	refs = append(refs, n.Refs...)
+	for _, value := range n.Values {
+		ref, err := values.Append(value)
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+	}
+
+	n.Refs = refs
+	n.Values = nil
+	return nil
+}
@@ -3,6 +3,7 @@ package model
 import (
 	"fmt"
 	"io"
+	"runtime"
 
 	"github.com/kapitanov/natandb/pkg/storage"
 	"github.com/kapitanov/natandb/pkg/util"
@@ -21,6 +22,10 @@ import (
 // | N | variable | Nodes[N-1]             |
 // +---+----------+------------------------+
 //
+// Schema v1 keeps nodes as is, while schema v2 keeps them within compressed blocks (see model_persist_blocks.go)
+// Schema v3 is the same as v2, but node values are replaced with references to a value log (see below)
+// Schema v4 keeps nodes sorted by their keys and has an index (see model_persist_index.go)
+//
 // Where each node has the following format:
 //
 // +-----+---------+-----------------------+
@@ -38,30 +43,51 @@ import (
 // | N-1 | 4 bytes | len(Node.Values[N-1]) |
 // | N   | N bytes | Node.Values[N-1]      |
 // +-----+---------+-----------------------+
+//
+// Within schema v3, each value is replaced with a value reference:
+//
+// +-----+---------+-----------------------+
+// | #   | Length  | Field                 |
+// +-----+---------+-----------------------+
+// | 1   | 4 bytes | Value log segment     |
+// | 2   | 8 bytes | Offset within segment |
+// | 3   | 4 bytes | Value length          |
+// | 4   | 4 bytes | Value checksum        |
+// +-----+---------+-----------------------+
 
 const (
-	schemaVersion uint32 = 1
+	schemaVersion     uint32 = 2
+	schemaVersionV1   uint32 = 1
+	schemaVersionRefs uint32 = 3
+
+	// maxPreallocatedValueCount is a max length of node value array that is allocated before reading
+	maxPreallocatedValueCount = 1024
 )
 
 // Restore restores a data model from persistent storage and syncs it with WAL log
-func Restore(driver storage.Driver) (*Root, error) {
+// If progress is specified, it's updated while write-ahead log is being replayed
+func Restore(driver storage.Driver, progress *ReplayProgress) (*Root, error) {
 	log.Printf("restoring model state")
 
-	// Load a snapshot from a persistent storage
-	snapshot, err := driver.SnapshotFile().Read()
+	segments, err := driver.WALFile().Segments()
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		_ = snapshot.Close()
-	}()
+	if progress == nil {
+		progress = NewReplayProgress()
+	}
+	totalBytes := int64(0)
+	for _, segment := range segments {
+		totalBytes += segment.Length
+	}
+	progress.begin(totalBytes)
 
-	model, err := ReadSnapshot(snapshot)
+	version, err := SnapshotVersion(driver.SnapshotFile())
 	if err != nil {
 		return nil, err
 	}
 
-	// Then replay write-ahead log to restore model's actual state
+	// Replay write-ahead log to restore model's actual state
 	wal, err := driver.WALFile().Read()
 	if err != nil {
 		return nil, err
@@ -70,24 +96,39 @@ func Restore(driver storage.Driver) (*Root, error) {
 		_ = wal.Close()
 	}()
 
-	lastChangeID := model.LastChangeID
-	err = model.replayWriteAheadLog(wal)
+	model, lastChangeID, hasRefs, err := rebuild(driver, wal, driver.ValueLog(), progress)
 	if err != nil {
 		return nil, err
 	}
 
 	// If model stage was not in sync with write-ahead log,
+	// or snapshot values have been moved into a value log,
+	// or snapshot has an older schema version,
 	// then new model snapshot should be created
-	if lastChangeID != model.LastChangeID {
+	migrated := model.ValueLog != nil && !hasRefs && len(model.NodesMap) > 0
+	upgraded := version != 0 && version != schemaVersionIndexed
+	if lastChangeID != model.LastChangeID || migrated || upgraded {
+		// Snapshot of an older schema version is kept, so it might be used for a downgrade
+		if upgraded {
+			_, err = driver.SnapshotFile().Backup(version)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("upgrading snapshot from v%d into v%d", version, schemaVersionIndexed)
+		}
+
 		file, err := driver.SnapshotFile().Write()
 		if err != nil {
 			return nil, err
 		}
-		defer func() {
-			_ = file.Close()
-		}()
 
 		err = model.WriteSnapshot(file)
+		if err != nil {
+			file.Abort()
+			return nil, err
+		}
+
+		err = file.Close()
 		if err != nil {
 			return nil, err
 		}
@@ -96,47 +137,156 @@ func Restore(driver storage.Driver) (*Root, error) {
 	return model, nil
 }
 
+// Rebuild restores a data model from a snapshot file and replays specified write-ahead log on top of it
+// Unlike Restore, it never writes anything back to persistent storage except for a value log
+// If value log is specified, new values are appended to it instead of driver's one
+func Rebuild(driver storage.Driver, wal storage.WALReader, values storage.ValueLog) (*Root, error) {
+	model, _, _, err := rebuild(driver, wal, values, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return model, nil
+}
+
+// rebuild restores a data model from a snapshot file and replays specified write-ahead log on top of it
+// It returns restored model, model snapshot's last change ID and whether snapshot refers to a value log
+func rebuild(driver storage.Driver, wal storage.WALReader, values storage.ValueLog, progress *ReplayProgress) (*Root, uint64, bool, error) {
+	// Load a snapshot from a persistent storage
+	model, hasRefs, err := loadSnapshot(driver.SnapshotFile(), values)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	// Values of snapshots that don't refer to a value log are moved into it
+	if values != nil {
+		err = model.moveToValueLog()
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+
+	// Then replay write-ahead log to restore model's actual state
+	lastChangeID := model.LastChangeID
+	err = model.replayWriteAheadLog(wal, progress, runtime.GOMAXPROCS(0))
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return model, lastChangeID, hasRefs, nil
+}
+
+// loadSnapshot restores a data model from a snapshot file
+// Indexed snapshots are loaded in parallel, while older ones are read sequentially
+// It returns restored model and whether snapshot refers to a value log
+func loadSnapshot(file storage.SnapshotFile, values storage.ValueLog) (*Root, bool, error) {
+	mapping, err := file.Map()
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		_ = mapping.Close()
+	}()
+
+	snapshot, err := OpenSnapshot(mapping, mapping.Size(), values)
+	if err == ErrSnapshotNotIndexed {
+		return readSnapshot(io.NewSectionReader(mapping, 0, mapping.Size()), values)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	model, err := snapshot.Load(runtime.GOMAXPROCS(0))
+	if err != nil {
+		return nil, false, err
+	}
+
+	return model, snapshot.hasRefs, nil
+}
+
 // ReadSnapshot restores model snapshot from its binary form
+// Snapshots that refer to a value log can't be read, see ReadSnapshotWithValueLog
 func ReadSnapshot(file io.Reader) (*Root, error) {
+	model, _, err := readSnapshot(file, nil)
+	return model, err
+}
+
+// ReadSnapshotWithValueLog restores model snapshot from its binary form
+// Restored model reads its values from specified value log,
+// while values of snapshots that don't refer to a value log are kept in memory
+func ReadSnapshotWithValueLog(file io.Reader, values storage.ValueLog) (*Root, error) {
+	model, _, err := readSnapshot(file, values)
+	return model, err
+}
+
+// readSnapshot restores model snapshot from its binary form sequentially
+// It returns restored model and whether snapshot refers to a value log
+func readSnapshot(file io.Reader, values storage.ValueLog) (*Root, bool, error) {
 	model := New()
+	model.ValueLog = values
 
 	log.Verbosef("reading data snapshot")
+	hasRefs := false
 	if file != nil {
+		file = &countingReader{r: file}
+
 		// First, read a schema version
 		version, err := util.ReadUint32(file)
 		if err != nil {
 			if err == io.EOF {
 				// File is empty, which should not produce any errors
-				return model, nil
+				return model, false, nil
 			}
-			return nil, err
+			return nil, false, err
 		}
 
-		// Check schema version (no migration support so far)
-		if version != schemaVersion {
-			return nil, fmt.Errorf("incompatible schema: #%d", version)
+		// Check schema version (v1 snapshots are still readable)
+		switch version {
+		case schemaVersionV1, schemaVersion, schemaVersionIndexed:
+		case schemaVersionRefs:
+			hasRefs = true
+		default:
+			return nil, false, fmt.Errorf("incompatible schema: #%d", version)
 		}
 
 		// Second, read a last change ID
 		model.LastChangeID, err = util.ReadUint64(file)
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+
+		// Indexed snapshots have flags, while their index is not needed for a sequential read
+		if version == schemaVersionIndexed {
+			flags, err := util.ReadUint8(file)
+			if err != nil {
+				return nil, false, err
+			}
+			hasRefs = flags&snapshotFlagRefs != 0
+		}
+
+		if hasRefs && values == nil {
+			return nil, false, fmt.Errorf("snapshot refers to a value log, which is not enabled")
+		}
+
+		nodes := file
+		if version != schemaVersionV1 {
+			nodes = newBlockReader(file)
 		}
 
 		// Then, read node snapshots until we see an EOF
 		for {
-			node, err := readNodeFromSnapshot(file)
+			node, err := readNodeFromSnapshot(nodes, hasRefs)
 			if err != nil {
 				if err == io.EOF {
 					break
 				}
 
-				return nil, err
+				return nil, false, err
 			}
 
 			existingNode := model.GetNode(node.Key)
 			if existingNode != nil {
-				return nil, fmt.Errorf("malformed snapshot: duplicate key \"%s\"", node.Key)
+				return nil, false, fmt.Errorf("malformed snapshot: duplicate key \"%s\"", node.Key)
 			}
 
 			model.NodesMap[node.Key] = node
@@ -145,18 +295,48 @@ func ReadSnapshot(file io.Reader) (*Root, error) {
 			}
 		}
 
+		// Index is not needed for a sequential read, but it's verified anyway
+		if version == schemaVersionIndexed {
+			err = verifySnapshotIndex(file, len(model.NodesMap))
+			if err != nil {
+				return nil, false, err
+			}
+		}
+
 		log.Verbosef("restored %d nodes from snapshot", len(model.NodesMap))
 	}
 
-	return model, nil
+	return model, hasRefs, nil
 }
 
 // WriteSnapshot writes model snapshot into its binary form
+// If model keeps its values within a value log, snapshot contains references to them
 func (m *Root) WriteSnapshot(file io.Writer) error {
+	if m.ValueLog == nil {
+		return m.writeIndexedSnapshot(file, false)
+	}
+
+	// Snapshot must never refer to values that are not stored yet
+	err := m.ValueLog.Sync()
+	if err != nil {
+		return err
+	}
+
+	return m.writeIndexedSnapshot(file, true)
+}
+
+// ExportSnapshot writes model snapshot into its binary form
+// Unlike WriteSnapshot, snapshot always contains values themselves, so it's readable without a value log
+func (m *Root) ExportSnapshot(file io.Writer) error {
+	return m.writeSnapshot(file, schemaVersion)
+}
+
+// writeSnapshot writes model snapshot of specified schema version into its binary form
+func (m *Root) writeSnapshot(file io.Writer, version uint32) error {
 	log.Verbosef("writing data snapshot")
 
 	// First, write a schema version
-	err := util.WriteUint32(file, schemaVersion)
+	err := util.WriteUint32(file, version)
 	if err != nil {
 		return err
 	}
@@ -167,20 +347,53 @@ func (m *Root) WriteSnapshot(file io.Writer) error {
 		return err
 	}
 
-	// Then, write node snapshots sequentially
+	// Then, write node snapshots sequentially into compressed blocks
+	blocks := newBlockWriter(file)
 	for _, node := range m.NodesMap {
-		err = node.writeSnapshot(file)
+		if version == schemaVersionRefs {
+			err = m.writeNodeRefs(blocks, node)
+		} else {
+			err = m.writeNodeValues(blocks, node)
+		}
 		if err != nil {
 			return err
 		}
 	}
 
+	err = blocks.Close()
+	if err != nil {
+		return err
+	}
+
 	log.Verbosef("data snapshot has been written")
 	return nil
 }
 
+// DataLength returns an approximate length of model data in bytes
+// It's equal to a length of model's uncompressed (v1) snapshot
+func (m *Root) DataLength() int64 {
+	// Schema version and last change ID
+	var length int64 = 4 + 8
+
+	for _, node := range m.NodesMap {
+		// Last change ID, key and value count
+		length += 8 + 4 + int64(len(node.Key)) + 4
+
+		for _, value := range node.Values {
+			length += 4 + int64(len(value))
+		}
+
+		for _, ref := range node.Refs {
+			length += 4 + int64(ref.Length)
+		}
+	}
+
+	return length
+}
+
 // readNodeFromSnapshot restores a model node from its binary form
-func readNodeFromSnapshot(file io.Reader) (*Node, error) {
+// If hasRefs is true, node values are replaced with value references
+func readNodeFromSnapshot(file io.Reader, hasRefs bool) (*Node, error) {
 	// Node last change ID
 	lastChangeID, err := util.ReadUint64(file)
 	if err != nil {
@@ -209,7 +422,27 @@ func readNodeFromSnapshot(file io.Reader) (*Node, error) {
 	}
 
 	// Value array
-	values := make([]Value, valueCount)
+	// Value count might be read from damaged data, so large arrays are grown as values are read
+	capacity := valueCount
+	if capacity > maxPreallocatedValueCount {
+		capacity = maxPreallocatedValueCount
+	}
+
+	if hasRefs {
+		refs, err := readRefsFromSnapshot(file, int(valueCount), int(capacity))
+		if err != nil {
+			return nil, err
+		}
+
+		node := &Node{
+			Key:          key,
+			LastChangeID: lastChangeID,
+			Refs:         refs,
+		}
+		return node, nil
+	}
+
+	values := make([]Value, 0, capacity)
 	for i := 0; i < int(valueCount); i++ {
 		// Value[i] length
 		valueLength, err := util.ReadUint32(file)
@@ -223,7 +456,7 @@ func readNodeFromSnapshot(file io.Reader) (*Node, error) {
 			return nil, fmt.Errorf("failed to read node snapshot %d-th value: %s", i, err)
 		}
 
-		values[i] = value
+		values = append(values, value)
 	}
 
 	node := &Node{
@@ -234,34 +467,100 @@ func readNodeFromSnapshot(file io.Reader) (*Node, error) {
 	return node, nil
 }
 
-// writeSnapshot writes model node snapshot into its binary form
-func (n *Node) writeSnapshot(file io.Writer) error {
-	// Node last change ID
-	err := util.WriteUint64(file, n.LastChangeID)
-	if err != nil {
-		return err
+// readRefsFromSnapshot restores node value references from their binary form
+func readRefsFromSnapshot(file io.Reader, count, capacity int) ([]storage.ValueRef, error) {
+	refs := make([]storage.ValueRef, 0, capacity)
+	for i := 0; i < count; i++ {
+		var ref storage.ValueRef
+		var err error
+
+		ref.Segment, err = util.ReadUint32(file)
+		if err == nil {
+			ref.Offset, err = util.ReadUint64(file)
+		}
+		if err == nil {
+			ref.Length, err = util.ReadUint32(file)
+		}
+		if err == nil {
+			ref.Checksum, err = util.ReadUint32(file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read node snapshot %d-th value reference: %s", i, err)
+		}
+
+		refs = append(refs, ref)
 	}
 
-	// Key length
-	err = util.WriteUint32(file, uint32(len(n.Key)))
+	return refs, nil
+}
+
+// writeNodeValues writes model node snapshot into its binary form, reading its values from a value log if needed
+func (m *Root) writeNodeValues(file io.Writer, node *Node) error {
+	if len(node.Refs) == 0 {
+		return node.writeSnapshot(file, node.Values)
+	}
+
+	values, err := m.Values(node)
 	if err != nil {
 		return err
 	}
 
-	// Key value
-	err = util.WriteString(file, n.Key)
+	return node.writeSnapshot(file, values)
+}
+
+// writeNodeRefs writes model node snapshot into its binary form, replacing its values with value references
+// Values that are kept in memory are appended to a value log first
+func (m *Root) writeNodeRefs(file io.Writer, node *Node) error {
+	refs := node.Refs
+	if len(node.Values) > 0 {
+		refs = append([]storage.ValueRef{}, refs...)
+		for _, value := range node.Values {
+			ref, err := m.ValueLog.Append(value)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+		}
+
+		err := m.ValueLog.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := node.writeHeader(file, len(refs))
 	if err != nil {
 		return err
 	}
 
-	// Value array length
-	err = util.WriteUint32(file, uint32(len(n.Values)))
+	for _, ref := range refs {
+		err = util.WriteUint32(file, ref.Segment)
+		if err == nil {
+			err = util.WriteUint64(file, ref.Offset)
+		}
+		if err == nil {
+			err = util.WriteUint32(file, ref.Length)
+		}
+		if err == nil {
+			err = util.WriteUint32(file, ref.Checksum)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSnapshot writes model node snapshot with specified values into its binary form
+func (n *Node) writeSnapshot(file io.Writer, values []Value) error {
+	err := n.writeHeader(file, len(values))
 	if err != nil {
 		return err
 	}
 
 	// Value array
-	for _, value := range n.Values {
+	for _, value := range values {
 		// Value[i] length
 		err = util.WriteUint32(file, uint32(len(value)))
 		if err != nil {
@@ -278,6 +577,30 @@ func (n *Node) writeSnapshot(file io.Writer) error {
 	return nil
 }
 
+// writeHeader writes model node last change ID, key and value count into their binary form
+func (n *Node) writeHeader(file io.Writer, valueCount int) error {
+	// Node last change ID
+	err := util.WriteUint64(file, n.LastChangeID)
+	if err != nil {
+		return err
+	}
+
+	// Key length
+	err = util.WriteUint32(file, uint32(len(n.Key)))
+	if err != nil {
+		return err
+	}
+
+	// Key value
+	err = util.WriteString(file, n.Key)
+	if err != nil {
+		return err
+	}
+
+	// Value array length
+	return util.WriteUint32(file, uint32(valueCount))
+}
+
 // WriteToWAL writes model snapshot into WAL
 func (m *Root) WriteToWAL(wal storage.WALWriter) error {
 	log.Verbosef("writing wal data snapshot")
@@ -289,7 +612,12 @@ func (m *Root) WriteToWAL(wal storage.WALWriter) error {
 
 	// Write node snapshots sequentially
 	for _, node := range m.NodesMap {
-		err = node.writeSnapshotToWAL(wal)
+		values, err := m.Values(node)
+		if err != nil {
+			return err
+		}
+
+		err = node.writeSnapshotToWAL(wal, values)
 		if err != nil {
 			return err
 		}
@@ -304,7 +632,7 @@ func (m *Root) WriteToWAL(wal storage.WALWriter) error {
 }
 
 // writeSnapshotToWAL writes model node snapshot into WAL
-func (n *Node) writeSnapshotToWAL(wal storage.WALWriter) error {
+func (n *Node) writeSnapshotToWAL(wal storage.WALWriter, values []Value) error {
 	// First we need to drop key entirely
 	// Otherwise reloading model from snapshot and WAL will re-add existing values
 	record := &storage.WALRecord{
@@ -317,7 +645,7 @@ func (n *Node) writeSnapshotToWAL(wal storage.WALWriter) error {
 	}
 
 	// Then - to add all values to this key
-	for _, value := range n.Values {
+	for _, value := range values {
 		record := &storage.WALRecord{
 			Key:   n.Key,
 			Value: value,
@@ -0,0 +1,243 @@
+package model
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/snappy"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// Snapshot v2 keeps node data within a sequence of compressed blocks:
+//
+// +---+----------+---------------------------+
+// | # | Length   | Field                     |
+// +---+----------+---------------------------+
+// | 1 | 1 byte   | Block codec               |
+// | 2 | 4 bytes  | Length of raw data        |
+// | 3 | 4 bytes  | Length of stored data     |
+// | 4 | 4 bytes  | CRC-32C of raw data       |
+// | 5 | N bytes  | Stored data               |
+// +---+----------+---------------------------+
+//
+// Raw data of all blocks is a sequence of nodes in v1 format,
+// a single node might span multiple blocks.
+// Sequence of blocks is terminated by a block with no data,
+// so a snapshot that is truncated at a block boundary is detected.
+
+const (
+	// blockCodecNone marks a block whose data is stored as is
+	blockCodecNone uint8 = 0
+	// blockCodecSnappy marks a block whose data is compressed with snappy
+	blockCodecSnappy uint8 = 1
+
+	// snapshotBlockSize is a max length of raw data within a snapshot block
+	snapshotBlockSize = 64 * 1024
+)
+
+var blockChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockWriter splits written data into compressed blocks
+type blockWriter struct {
+	w      io.Writer
+	buffer []byte
+}
+
+func newBlockWriter(w io.Writer) *blockWriter {
+	return &blockWriter{
+		w:      w,
+		buffer: make([]byte, 0, snapshotBlockSize),
+	}
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		length := snapshotBlockSize - len(b.buffer)
+		if length > len(p)-n {
+			length = len(p) - n
+		}
+
+		b.buffer = append(b.buffer, p[n:n+length]...)
+		n += length
+
+		if len(b.buffer) == snapshotBlockSize {
+			err := b.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// buffered returns length of data that hasn't been written yet
+func (b *blockWriter) buffered() int {
+	return len(b.buffer)
+}
+
+// Close writes buffered data and a terminating block
+// It doesn't close an underlying writer
+func (b *blockWriter) Close() error {
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+
+	return b.writeBlock(blockCodecNone, nil, 0, 0)
+}
+
+// flush writes buffered data as a single block
+// Data is stored as is if it can't be compressed
+func (b *blockWriter) flush() error {
+	if len(b.buffer) == 0 {
+		return nil
+	}
+
+	checksum := crc32.Checksum(b.buffer, blockChecksumTable)
+	compressed := snappy.Encode(nil, b.buffer)
+
+	var err error
+	if len(compressed) < len(b.buffer) {
+		err = b.writeBlock(blockCodecSnappy, compressed, len(b.buffer), checksum)
+	} else {
+		err = b.writeBlock(blockCodecNone, b.buffer, len(b.buffer), checksum)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.buffer = b.buffer[:0]
+	return nil
+}
+
+func (b *blockWriter) writeBlock(codec uint8, data []byte, rawLength int, checksum uint32) error {
+	err := util.WriteUint8(b.w, codec)
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint32(b.w, uint32(rawLength))
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint32(b.w, uint32(len(data)))
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint32(b.w, checksum)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteBytes(b.w, data)
+}
+
+// blockReader reads data from a sequence of compressed blocks
+type blockReader struct {
+	r      io.Reader
+	buffer []byte
+	index  int
+	isLast bool
+}
+
+func newBlockReader(r io.Reader) *blockReader {
+	return &blockReader{r: r}
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for len(b.buffer) == 0 {
+		if b.isLast {
+			return 0, io.EOF
+		}
+
+		err := b.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, b.buffer)
+	b.buffer = b.buffer[n:]
+	return n, nil
+}
+
+// next reads, decompresses and verifies the next block
+func (b *blockReader) next() error {
+	codec, err := util.ReadUint8(b.r)
+	if err != nil {
+		return b.malformed(err)
+	}
+
+	rawLength, err := util.ReadUint32(b.r)
+	if err != nil {
+		return b.malformed(err)
+	}
+
+	storedLength, err := util.ReadUint32(b.r)
+	if err != nil {
+		return b.malformed(err)
+	}
+
+	checksum, err := util.ReadUint32(b.r)
+	if err != nil {
+		return b.malformed(err)
+	}
+
+	// Lengths are checked before reading, so damaged data never causes a large allocation
+	if rawLength > snapshotBlockSize || storedLength > uint32(snappy.MaxEncodedLen(snapshotBlockSize)) {
+		return fmt.Errorf("malformed snapshot: block #%d is too large", b.index)
+	}
+
+	if rawLength == 0 {
+		if codec != blockCodecNone || storedLength != 0 || checksum != 0 {
+			return fmt.Errorf("malformed snapshot: block #%d is empty", b.index)
+		}
+
+		b.isLast = true
+		return nil
+	}
+
+	data, err := util.ReadBytes(b.r, int(storedLength))
+	if err != nil {
+		return b.malformed(err)
+	}
+
+	switch codec {
+	case blockCodecNone:
+	case blockCodecSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil || n != int(rawLength) {
+			return fmt.Errorf("malformed snapshot: block #%d can't be decompressed", b.index)
+		}
+
+		data, err = snappy.Decode(nil, data)
+		if err != nil {
+			return fmt.Errorf("malformed snapshot: block #%d can't be decompressed: %s", b.index, err)
+		}
+	default:
+		return fmt.Errorf("malformed snapshot: block #%d has unknown codec %d", b.index, codec)
+	}
+
+	if len(data) != int(rawLength) || crc32.Checksum(data, blockChecksumTable) != checksum {
+		return fmt.Errorf("malformed snapshot: block #%d checksum mismatch", b.index)
+	}
+
+	b.buffer = data
+	b.index++
+	return nil
+}
+
+func (b *blockReader) malformed(err error) error {
+	if err == io.EOF {
+		// Blocks end with a terminating block only
+		err = io.ErrUnexpectedEOF
+	}
+
+	return fmt.Errorf("malformed snapshot: failed to read block #%d: %s", b.index, err)
+}
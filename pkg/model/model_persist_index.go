@@ -0,0 +1,503 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// Snapshot v4 keeps nodes sorted by their keys and has an index, so it might be read partially:
+//
+// +---+----------+------------------------------------+
+// | # | Length   | Field                              |
+// +---+----------+------------------------------------+
+// | 1 | 4 bytes  | Schema version                     |
+// | 2 | 8 bytes  | Model's last change ID             |
+// | 3 | 1 byte   | Flags                              |
+// | 4 | variable | Node blocks                        |
+// | 5 | variable | Index blocks                       |
+// | 6 | 8 bytes  | Offset of index blocks             |
+// | 7 | 8 bytes  | Node count                         |
+// | 8 | 4 bytes  | Magic ("NIDX")                     |
+// +---+----------+------------------------------------+
+//
+// Node blocks are the same as in v2 (or v3 if flags have snapshotFlagRefs bit set),
+// but every few blocks a node starts at a block boundary - this is where a chunk starts.
+// Index blocks contain a sequence of chunk descriptors:
+//
+// +---+----------+------------------------------------+
+// | # | Length   | Field                              |
+// +---+----------+------------------------------------+
+// | 1 | 4 bytes  | Chunk count                        |
+// | 2 | 4 bytes  | len(Key of the first chunk node)   |
+// | 3 | N bytes  | Key of the first chunk node        |
+// | 4 | 8 bytes  | Offset of the first chunk block    |
+// | 5 | 4 bytes  | Count of chunk nodes               |
+// |   | ...      | ...                                |
+// +---+----------+------------------------------------+
+//
+// Each chunk is decoded independently, so single keys are looked up without reading the whole snapshot
+// and snapshot is loaded in parallel.
+
+const (
+	schemaVersionIndexed uint32 = 4
+
+	// snapshotFlagRefs marks a snapshot whose node values are replaced with value references
+	snapshotFlagRefs uint8 = 0x01
+
+	// snapshotFooterMagic is "NIDX" in little endian
+	snapshotFooterMagic uint32 = 0x5844494e
+
+	// snapshotHeaderLength is a length of indexed snapshot header
+	snapshotHeaderLength = 4 + 8 + 1
+	// snapshotFooterLength is a length of indexed snapshot footer
+	snapshotFooterLength = 8 + 8 + 4
+
+	// snapshotChunkSize is a min length of raw node data within a single chunk
+	snapshotChunkSize = snapshotBlockSize / 2
+)
+
+// ErrSnapshotNotIndexed is returned when a snapshot has no index, so it can only be read sequentially
+const ErrSnapshotNotIndexed = Error("snapshot has no index")
+
+// snapshotChunk describes a chunk of indexed snapshot
+type snapshotChunk struct {
+	firstKey  string
+	offset    int64
+	nodeCount uint32
+}
+
+// Snapshot is an indexed model snapshot that is read on demand
+type Snapshot struct {
+	r            io.ReaderAt
+	indexOffset  int64
+	lastChangeID uint64
+	hasRefs      bool
+	nodeCount    uint64
+	chunks       []snapshotChunk
+	values       storage.ValueLog
+}
+
+// OpenSnapshot reads an index of a model snapshot
+// Node values are read from specified value log, if snapshot refers to it
+// If snapshot has no index, a ErrSnapshotNotIndexed error is returned, use ReadSnapshot instead
+func OpenSnapshot(r io.ReaderAt, size int64, values storage.ValueLog) (*Snapshot, error) {
+	if size == 0 {
+		// Snapshot is empty, which should not produce any errors
+		return &Snapshot{r: r, values: values}, nil
+	}
+
+	header := io.NewSectionReader(r, 0, size)
+	version, err := util.ReadUint32(header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snapshot: %s", err)
+	}
+	if version != schemaVersionIndexed {
+		return nil, ErrSnapshotNotIndexed
+	}
+
+	s := &Snapshot{r: r, values: values}
+	s.lastChangeID, err = util.ReadUint64(header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snapshot: %s", err)
+	}
+
+	flags, err := util.ReadUint8(header)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snapshot: %s", err)
+	}
+	s.hasRefs = flags&snapshotFlagRefs != 0
+	if s.hasRefs && values == nil {
+		return nil, fmt.Errorf("snapshot refers to a value log, which is not enabled")
+	}
+
+	// Footer
+	if size < snapshotHeaderLength+snapshotFooterLength {
+		return nil, fmt.Errorf("malformed snapshot: no footer")
+	}
+	footer := io.NewSectionReader(r, size-snapshotFooterLength, snapshotFooterLength)
+	indexOffset, err := util.ReadUint64(footer)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snapshot: %s", err)
+	}
+	s.nodeCount, err = util.ReadUint64(footer)
+	if err != nil {
+		return nil, fmt.Errorf("malformed snapshot: %s", err)
+	}
+	magic, err := util.ReadUint32(footer)
+	if err != nil || magic != snapshotFooterMagic {
+		return nil, fmt.Errorf("malformed snapshot: no footer")
+	}
+	if indexOffset < snapshotHeaderLength || indexOffset > uint64(size-snapshotFooterLength) {
+		return nil, fmt.Errorf("malformed snapshot: index is out of bounds")
+	}
+	s.indexOffset = int64(indexOffset)
+
+	// Index
+	err = s.readIndex(newBlockReader(io.NewSectionReader(r, s.indexOffset, size-snapshotFooterLength-s.indexOffset)))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Verbosef("opened snapshot index of %d nodes within %d chunks", s.nodeCount, len(s.chunks))
+	return s, nil
+}
+
+// readIndex reads and verifies chunk descriptors
+func (s *Snapshot) readIndex(r io.Reader) error {
+	count, err := util.ReadUint32(r)
+	if err != nil {
+		return fmt.Errorf("malformed snapshot index: %s", err)
+	}
+
+	capacity := count
+	if capacity > maxPreallocatedValueCount {
+		capacity = maxPreallocatedValueCount
+	}
+	s.chunks = make([]snapshotChunk, 0, capacity)
+
+	var nodeCount uint64
+	for i := 0; i < int(count); i++ {
+		keyLength, err := util.ReadUint32(r)
+		if err != nil {
+			return fmt.Errorf("malformed snapshot index: %s", err)
+		}
+
+		key, err := util.ReadString(r, int(keyLength))
+		if err != nil {
+			return fmt.Errorf("malformed snapshot index: %s", err)
+		}
+
+		offset, err := util.ReadUint64(r)
+		if err != nil {
+			return fmt.Errorf("malformed snapshot index: %s", err)
+		}
+
+		chunkNodeCount, err := util.ReadUint32(r)
+		if err != nil {
+			return fmt.Errorf("malformed snapshot index: %s", err)
+		}
+
+		// Chunks must be sorted by their keys and offsets
+		if offset < snapshotHeaderLength || offset >= uint64(s.indexOffset) || chunkNodeCount == 0 {
+			return fmt.Errorf("malformed snapshot index: chunk #%d is out of bounds", i)
+		}
+		if i > 0 {
+			previous := s.chunks[i-1]
+			if key <= previous.firstKey || int64(offset) <= previous.offset {
+				return fmt.Errorf("malformed snapshot index: chunk #%d is out of order", i)
+			}
+		}
+
+		s.chunks = append(s.chunks, snapshotChunk{key, int64(offset), chunkNodeCount})
+		nodeCount += uint64(chunkNodeCount)
+	}
+
+	if nodeCount != s.nodeCount {
+		return fmt.Errorf("malformed snapshot index: expected %d nodes but got %d", s.nodeCount, nodeCount)
+	}
+
+	// Index blocks end with a terminating block
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+// LastChangeID returns model's last change ID
+func (s *Snapshot) LastChangeID() uint64 {
+	return s.lastChangeID
+}
+
+// Len returns count of snapshot nodes
+func (s *Snapshot) Len() int {
+	return int(s.nodeCount)
+}
+
+// Get reads a single node by its key, or returns nil if there's no such node
+// Only a chunk that might contain the node is read
+func (s *Snapshot) Get(key string) (*Node, error) {
+	i := sort.Search(len(s.chunks), func(i int) bool {
+		return s.chunks[i].firstKey > key
+	}) - 1
+	if i < 0 {
+		return nil, nil
+	}
+
+	nodes, err := s.readChunk(i)
+	if err != nil {
+		return nil, err
+	}
+
+	j := sort.Search(len(nodes), func(j int) bool {
+		return nodes[j].Key >= key
+	})
+	if j < len(nodes) && nodes[j].Key == key {
+		return nodes[j], nil
+	}
+
+	return nil, nil
+}
+
+// Values returns node values, reading them from a value log if needed
+func (s *Snapshot) Values(node *Node) ([]Value, error) {
+	return readValues(node, s.values)
+}
+
+// Load reads the whole snapshot, decoding up to specified count of chunks in parallel
+func (s *Snapshot) Load(parallelism int) (*Root, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	chunks := make([][]*Node, len(s.chunks))
+	errors := make([]error, len(s.chunks))
+
+	indices := make(chan int)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < parallelism && w < len(s.chunks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				chunks[i], errors[i] = s.readChunk(i)
+			}
+		}()
+	}
+
+	for i := range s.chunks {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	model := New()
+	model.ValueLog = s.values
+	model.LastChangeID = s.lastChangeID
+	model.NodesMap = make(map[string]*Node, s.nodeCount)
+
+	lastKey := ""
+	for i, nodes := range chunks {
+		if errors[i] != nil {
+			return nil, errors[i]
+		}
+
+		// Chunk keys are verified to be sorted, so only a boundary between chunks is checked
+		if i > 0 && nodes[0].Key <= lastKey {
+			return nil, fmt.Errorf("malformed snapshot: chunk #%d is out of order", i)
+		}
+		lastKey = nodes[len(nodes)-1].Key
+
+		for _, node := range nodes {
+			model.NodesMap[node.Key] = node
+			if model.LastChangeID < node.LastChangeID {
+				model.LastChangeID = node.LastChangeID
+			}
+		}
+	}
+
+	log.Verbosef("restored %d nodes from snapshot", len(model.NodesMap))
+	return model, nil
+}
+
+// readChunk decodes nodes of a single chunk
+func (s *Snapshot) readChunk(i int) ([]*Node, error) {
+	chunk := s.chunks[i]
+	r := newBlockReader(io.NewSectionReader(s.r, chunk.offset, s.indexOffset-chunk.offset))
+
+	capacity := chunk.nodeCount
+	if capacity > maxPreallocatedValueCount {
+		capacity = maxPreallocatedValueCount
+	}
+	nodes := make([]*Node, 0, capacity)
+
+	for j := 0; j < int(chunk.nodeCount); j++ {
+		node, err := readNodeFromSnapshot(r, s.hasRefs)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("malformed snapshot: chunk #%d: %s", i, err)
+		}
+
+		if j == 0 && node.Key != chunk.firstKey {
+			return nil, fmt.Errorf("malformed snapshot: chunk #%d doesn't match its index", i)
+		}
+		if j > 0 && node.Key <= nodes[j-1].Key {
+			return nil, fmt.Errorf("malformed snapshot: chunk #%d is out of order", i)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// writeIndexedSnapshot writes model snapshot with nodes sorted by their keys and an index
+// If hasRefs is true, node values are replaced with value references
+func (m *Root) writeIndexedSnapshot(file io.Writer, hasRefs bool) error {
+	log.Verbosef("writing data snapshot")
+	w := &countingWriter{w: file}
+
+	// Header
+	err := util.WriteUint32(w, schemaVersionIndexed)
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint64(w, m.LastChangeID)
+	if err != nil {
+		return err
+	}
+
+	flags := uint8(0)
+	if hasRefs {
+		flags |= snapshotFlagRefs
+	}
+	err = util.WriteUint8(w, flags)
+	if err != nil {
+		return err
+	}
+
+	// Nodes, sorted by their keys
+	chunks := make([]snapshotChunk, 0)
+	blocks := newBlockWriter(w)
+	for _, key := range m.Keys() {
+		// A chunk starts once a node starts at a block boundary
+		if blocks.buffered() == 0 {
+			chunks = append(chunks, snapshotChunk{firstKey: key, offset: w.n})
+		}
+		chunks[len(chunks)-1].nodeCount++
+
+		node := m.NodesMap[key]
+		if hasRefs {
+			err = m.writeNodeRefs(blocks, node)
+		} else {
+			err = m.writeNodeValues(blocks, node)
+		}
+		if err != nil {
+			return err
+		}
+
+		if blocks.buffered() >= snapshotChunkSize {
+			err = blocks.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = blocks.Close()
+	if err != nil {
+		return err
+	}
+
+	// Index
+	indexOffset := w.n
+	blocks = newBlockWriter(w)
+	err = util.WriteUint32(blocks, uint32(len(chunks)))
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range chunks {
+		err = util.WriteUint32(blocks, uint32(len(chunk.firstKey)))
+		if err == nil {
+			err = util.WriteString(blocks, chunk.firstKey)
+		}
+		if err == nil {
+			err = util.WriteUint64(blocks, uint64(chunk.offset))
+		}
+		if err == nil {
+			err = util.WriteUint32(blocks, chunk.nodeCount)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err = blocks.Close()
+	if err != nil {
+		return err
+	}
+
+	// Footer
+	err = util.WriteUint64(w, uint64(indexOffset))
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint64(w, uint64(len(m.NodesMap)))
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint32(w, snapshotFooterMagic)
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("data snapshot has been written")
+	return nil
+}
+
+// verifySnapshotIndex reads and verifies index and footer of a snapshot that is being read sequentially
+// Reader must be a countingReader positioned right after node blocks
+func verifySnapshotIndex(file io.Reader, nodeCount int) error {
+	indexOffset := file.(*countingReader).n
+
+	_, err := io.Copy(io.Discard, newBlockReader(file))
+	if err != nil {
+		return fmt.Errorf("malformed snapshot index: %s", err)
+	}
+
+	offset, err := util.ReadUint64(file)
+	if err != nil {
+		return fmt.Errorf("malformed snapshot: no footer")
+	}
+	count, err := util.ReadUint64(file)
+	if err != nil {
+		return fmt.Errorf("malformed snapshot: no footer")
+	}
+	magic, err := util.ReadUint32(file)
+	if err != nil || magic != snapshotFooterMagic {
+		return fmt.Errorf("malformed snapshot: no footer")
+	}
+
+	if int64(offset) != indexOffset || count != uint64(nodeCount) {
+		return fmt.Errorf("malformed snapshot: footer doesn't match snapshot")
+	}
+
+	_, err = util.ReadUint8(file)
+	if err != io.EOF {
+		return fmt.Errorf("malformed snapshot: unexpected data after footer")
+	}
+
+	return nil
+}
+
+// countingReader counts bytes that have been read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts bytes that have been written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
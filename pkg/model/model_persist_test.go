@@ -7,6 +7,8 @@ import (
 	"testing"
 
 	l "log"
+
+	"github.com/kapitanov/natandb/pkg/util"
 )
 
 func TestRestoreModelFromEmptyFile(t *testing.T) {
@@ -74,14 +76,47 @@ func testModelStorage(t *testing.T, input *Root) {
 		return
 	}
 
-	buffer := w.Bytes()
-	r := bytes.NewBuffer(buffer)
-	output, err := ReadSnapshot(r)
+	v1 := writeSnapshotV1(input)
+	if input.DataLength() != int64(len(v1)) {
+		t.Errorf("ERROR: DataLength(): %d != %d", input.DataLength(), len(v1))
+		return
+	}
+
+	v2 := bytes.NewBuffer(make([]byte, 0))
+	err = input.ExportSnapshot(v2)
 	if err != nil {
-		t.Errorf("ERROR: ReadSnapshot(): %s", err)
+		t.Errorf("ERROR: ExportSnapshot(): %s", err)
 		return
 	}
 
+	// Current, v2 and v1 snapshots must be readable
+	for _, buffer := range [][]byte{w.Bytes(), v2.Bytes(), v1} {
+		output, err := ReadSnapshot(bytes.NewBuffer(buffer))
+		if err != nil {
+			t.Errorf("ERROR: ReadSnapshot(): %s", err)
+			return
+		}
+
+		checkModelsEqual(t, input, output)
+	}
+
+	// Current snapshot must be readable via its index as well
+	snapshot, err := OpenSnapshot(bytes.NewReader(w.Bytes()), int64(w.Len()), nil)
+	if err != nil {
+		t.Errorf("ERROR: OpenSnapshot(): %s", err)
+		return
+	}
+
+	output, err := snapshot.Load(4)
+	if err != nil {
+		t.Errorf("ERROR: Load(): %s", err)
+		return
+	}
+
+	checkModelsEqual(t, input, output)
+}
+
+func checkModelsEqual(t *testing.T, input, output *Root) {
 	// len(Nodes)
 	if len(input.NodesMap) != len(output.NodesMap) {
 		t.Errorf("ERROR: len(Nodes): %d != %d", len(input.NodesMap), len(output.NodesMap))
@@ -146,3 +181,155 @@ func testModelStorage(t *testing.T, input *Root) {
 		}
 	}
 }
+
+func TestCompressedModelStorage(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	// JSON-like values span multiple blocks and are compressed well
+	root := New()
+	for i := 0; i < 2000; i++ {
+		node := root.GetOrCreateNode(fmt.Sprintf("user/%d", i))
+		node.Values = []Value{Value(fmt.Sprintf(`{"id": %d, "name": "User #%d", "email": "user%d@example.com", "active": true}`, i, i, i))}
+	}
+
+	w := bytes.NewBuffer(make([]byte, 0))
+	err := root.WriteSnapshot(w)
+	if err != nil {
+		t.Fatalf("ERROR: WriteSnapshot(): %s", err)
+	}
+
+	if int64(w.Len()) > root.DataLength()/2 {
+		t.Errorf("ERROR: snapshot of %d bytes is compressed into %d bytes only", root.DataLength(), w.Len())
+	}
+
+	output, err := ReadSnapshot(bytes.NewBuffer(w.Bytes()))
+	if err != nil {
+		t.Fatalf("ERROR: ReadSnapshot(): %s", err)
+	}
+	checkModelsEqual(t, root, output)
+}
+
+func TestIndexedModelStorage(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	// Nodes span multiple chunks, some of them span multiple blocks
+	root := New()
+	for i := 0; i < 5000; i++ {
+		node := root.GetOrCreateNode(fmt.Sprintf("key_%05d", i))
+		node.Values = []Value{Value(fmt.Sprintf("value_%d", i))}
+		if i%1000 == 0 {
+			node.Values = append(node.Values, bytes.Repeat([]byte{byte(i)}, 3*snapshotBlockSize))
+		}
+		node.LastChangeID = uint64(i)
+		root.LastChangeID = node.LastChangeID
+	}
+
+	w := bytes.NewBuffer(make([]byte, 0))
+	err := root.WriteSnapshot(w)
+	if err != nil {
+		t.Fatalf("ERROR: WriteSnapshot(): %s", err)
+	}
+
+	snapshot, err := OpenSnapshot(bytes.NewReader(w.Bytes()), int64(w.Len()), nil)
+	if err != nil {
+		t.Fatalf("ERROR: OpenSnapshot(): %s", err)
+	}
+	if snapshot.Len() != len(root.NodesMap) || len(snapshot.chunks) < 2 {
+		t.Errorf("ERROR: expected %d nodes within multiple chunks but got %d nodes within %d chunks", len(root.NodesMap), snapshot.Len(), len(snapshot.chunks))
+	}
+
+	for _, key := range []string{"key_00000", "key_01000", "key_01001", "key_02500", "key_04999"} {
+		node, err := snapshot.Get(key)
+		if err != nil {
+			t.Fatalf("ERROR: Get(\"%s\"): %s", key, err)
+		}
+		if node == nil || node.LastChangeID != root.GetNode(key).LastChangeID || len(node.Values) != len(root.GetNode(key).Values) {
+			t.Errorf("ERROR: Get(\"%s\"): unexpected node %v", key, node)
+		}
+	}
+
+	for _, key := range []string{"", "key", "key_00000_", "key_05000", "zzz"} {
+		node, err := snapshot.Get(key)
+		if err != nil || node != nil {
+			t.Errorf("ERROR: Get(\"%s\"): expected no node but got %v (%v)", key, node, err)
+		}
+	}
+
+	for _, parallelism := range []int{1, 8} {
+		output, err := snapshot.Load(parallelism)
+		if err != nil {
+			t.Fatalf("ERROR: Load(): %s", err)
+		}
+		checkModelsEqual(t, root, output)
+	}
+
+	// Snapshot without an index is not opened
+	v2 := bytes.NewBuffer(make([]byte, 0))
+	err = root.ExportSnapshot(v2)
+	if err != nil {
+		t.Fatalf("ERROR: ExportSnapshot(): %s", err)
+	}
+	_, err = OpenSnapshot(bytes.NewReader(v2.Bytes()), int64(v2.Len()), nil)
+	if err != ErrSnapshotNotIndexed {
+		t.Errorf("ERROR: expected %s but got %v", ErrSnapshotNotIndexed, err)
+	}
+
+	// Damaged index or footer is detected
+	snapshotBytes := w.Bytes()
+	for _, offset := range []int{len(snapshotBytes) - 1, len(snapshotBytes) - 10, len(snapshotBytes) - 30} {
+		corrupted := append([]byte{}, snapshotBytes...)
+		corrupted[offset] ^= 0xFF
+
+		_, err = OpenSnapshot(bytes.NewReader(corrupted), int64(len(corrupted)), nil)
+		if err == nil {
+			t.Errorf("ERROR: snapshot with a corrupted byte at offset %d has been opened successfully", offset)
+		}
+	}
+}
+
+func TestCorruptedModelStorage(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	root := New()
+	for i := 0; i < 10; i++ {
+		node := root.GetOrCreateNode(fmt.Sprintf("key_%d", i))
+		node.Values = []Value{Value("value"), Value("value")}
+	}
+
+	w := bytes.NewBuffer(make([]byte, 0))
+	err := root.WriteSnapshot(w)
+	if err != nil {
+		t.Fatalf("ERROR: WriteSnapshot(): %s", err)
+	}
+	snapshot := w.Bytes()
+
+	// Schema version and last change ID are not covered by block checksums
+	for offset := 4 + 8; offset < len(snapshot); offset++ {
+		corrupted := append([]byte{}, snapshot...)
+		corrupted[offset] ^= 0xFF
+
+		_, err = ReadSnapshot(bytes.NewBuffer(corrupted))
+		if err == nil {
+			t.Errorf("ERROR: snapshot with a corrupted byte at offset %d has been read successfully", offset)
+		}
+	}
+
+	for length := 4 + 8; length < len(snapshot); length++ {
+		_, err = ReadSnapshot(bytes.NewBuffer(snapshot[:length]))
+		if err == nil {
+			t.Errorf("ERROR: snapshot truncated to %d bytes has been read successfully", length)
+		}
+	}
+}
+
+// writeSnapshotV1 writes model snapshot in uncompressed v1 format
+func writeSnapshotV1(root *Root) []byte {
+	w := bytes.NewBuffer(make([]byte, 0))
+	_ = util.WriteUint32(w, schemaVersionV1)
+	_ = util.WriteUint64(w, root.LastChangeID)
+	for _, node := range root.NodesMap {
+		_ = node.writeSnapshot(w, node.Values)
+	}
+
+	return w.Bytes()
+}
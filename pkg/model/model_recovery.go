@@ -0,0 +1,105 @@
+package model
+
+import (
+	"io"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// RecoveryTarget defines a point in time a data model is recovered to
+type RecoveryTarget struct {
+	// ID of the last change to recover, zero value means no limit
+	ChangeID uint64
+	// Max commit time of transactions to recover, zero value means no limit
+	Time time.Time
+}
+
+// includes checks if a transaction is within recovery target
+func (t RecoveryTarget) includes(records []*storage.WALRecord, commit *storage.WALRecord) bool {
+	if t.ChangeID != 0 {
+		for _, record := range records {
+			if record.ID > t.ChangeID {
+				return false
+			}
+		}
+	}
+
+	if !t.Time.IsZero() {
+		// Commit records written by previous versions have no commit time
+		commitTime := commit.CommitTime()
+		if !commitTime.IsZero() && commitTime.After(t.Time) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Recover restores a data model from a snapshot and replays write-ahead log up to specified target
+// Transactions are replayed as a whole, i.e. a transaction that crosses the target is dropped entirely
+// It returns recovered model and the last replayed commit record (nil if no transactions have been replayed)
+func Recover(snapshot io.Reader, wal storage.WALReader, target RecoveryTarget) (*Root, *storage.WALRecord, error) {
+	model, err := ReadSnapshot(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lastCommit, err := model.ReplayTransactions(wal, target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return model, lastCommit, nil
+}
+
+// ReplayTransactions replays write-ahead log on top of a data model up to specified target
+// Transactions are replayed as a whole, changes that are already in model are skipped
+// It returns the last replayed commit record (nil if no transactions have been replayed)
+func (m *Root) ReplayTransactions(wal storage.WALReader, target RecoveryTarget) (*storage.WALRecord, error) {
+	minID := m.LastChangeID
+	txCount := 0
+	pending := make([]*storage.WALRecord, 0)
+	var lastCommit *storage.WALRecord
+	for {
+		record, err := wal.Read()
+		if err != nil {
+			if err == io.EOF {
+				if len(pending) > 0 {
+					log.Printf("dropped incomplete transaction [%d..%d]", pending[0].ID, pending[len(pending)-1].ID)
+				}
+				break
+			}
+			return nil, err
+		}
+
+		// Changes that are already in model are skipped
+		if record.ID <= minID {
+			continue
+		}
+
+		if record.Type != storage.WALCommitTx {
+			pending = append(pending, record)
+			continue
+		}
+
+		if !target.includes(pending, record) {
+			log.Printf("recovery target reached at change #%d", record.ID)
+			break
+		}
+
+		for _, r := range pending {
+			err = m.Apply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pending = pending[:0]
+		lastCommit = record
+		txCount++
+	}
+
+	log.Printf("recovered %d transactions, last change is #%d", txCount, m.LastChangeID)
+	return lastCommit, nil
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	l "log"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// sliceWALReader is a WAL reader that reads records from a slice
+type sliceWALReader struct {
+	records []*storage.WALRecord
+}
+
+func (r *sliceWALReader) Read() (*storage.WALRecord, error) {
+	if len(r.records) == 0 {
+		return nil, io.EOF
+	}
+
+	record := r.records[0]
+	r.records = r.records[1:]
+	return record, nil
+}
+
+func (r *sliceWALReader) Close() error {
+	return nil
+}
+
+// recoveryTestWAL returns a WAL with three transactions committed at t0+1s, t0+2s and t0+3s:
+//
+//	tx #1: add "a"=1 (#1), commit (#2)
+//	tx #2: add "b"=2 (#3), add "b"=3 (#4), commit (#5)
+//	tx #3: remove "a" (#6), commit (#7)
+func recoveryTestWAL(t0 time.Time) *sliceWALReader {
+	commit := func(id, txID uint64, seconds int) *storage.WALRecord {
+		record := &storage.WALRecord{ID: id, TxID: txID, Type: storage.WALCommitTx, Value: make([]byte, 8)}
+		ts := uint64(t0.Add(time.Duration(seconds) * time.Second).UnixNano())
+		for i := 0; i < 8; i++ {
+			record.Value[i] = byte(ts >> (8 * i))
+		}
+		return record
+	}
+
+	return &sliceWALReader{
+		records: []*storage.WALRecord{
+			{ID: 1, TxID: 1, Type: storage.WALAddValue, Key: "a", Value: Value("1")},
+			commit(2, 1, 1),
+			{ID: 3, TxID: 2, Type: storage.WALAddValue, Key: "b", Value: Value("2")},
+			{ID: 4, TxID: 2, Type: storage.WALAddValue, Key: "b", Value: Value("3")},
+			commit(5, 2, 2),
+			{ID: 6, TxID: 3, Type: storage.WALRemoveKey, Key: "a"},
+			commit(7, 3, 3),
+		},
+	}
+}
+
+func TestRecoverToChangeID(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	t0 := time.Now()
+	tests := []struct {
+		changeID     uint64
+		keys         []string
+		lastCommitID uint64
+	}{
+		{0, []string{"b"}, 7},
+		{1, []string{"a"}, 2},
+		{3, []string{"a"}, 2},
+		{4, []string{"a", "b"}, 5},
+		{6, []string{"b"}, 7},
+	}
+
+	for _, test := range tests {
+		root, lastCommit, err := Recover(nil, recoveryTestWAL(t0), RecoveryTarget{ChangeID: test.changeID})
+		if err != nil {
+			t.Fatalf("ERROR: Recover(): %s", err)
+		}
+
+		checkRecoveredKeys(t, root, test.keys)
+		if lastCommit == nil || lastCommit.ID != test.lastCommitID {
+			t.Errorf("ERROR: change #%d: expected last commit #%d but got %v", test.changeID, test.lastCommitID, lastCommit)
+		}
+	}
+}
+
+func TestRecoverToTime(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	t0 := time.Now()
+
+	root, lastCommit, err := Recover(nil, recoveryTestWAL(t0), RecoveryTarget{Time: t0})
+	if err != nil {
+		t.Fatalf("ERROR: Recover(): %s", err)
+	}
+	checkRecoveredKeys(t, root, []string{})
+	if lastCommit != nil {
+		t.Errorf("ERROR: expected no commits but got %v", lastCommit)
+	}
+
+	root, lastCommit, err = Recover(nil, recoveryTestWAL(t0), RecoveryTarget{Time: t0.Add(2500 * time.Millisecond)})
+	if err != nil {
+		t.Fatalf("ERROR: Recover(): %s", err)
+	}
+	checkRecoveredKeys(t, root, []string{"a", "b"})
+	if lastCommit == nil || lastCommit.ID != 5 {
+		t.Errorf("ERROR: expected last commit #5 but got %v", lastCommit)
+	}
+}
+
+func checkRecoveredKeys(t *testing.T, root *Root, keys []string) {
+	actual := root.Keys()
+	if len(actual) != len(keys) {
+		t.Errorf("ERROR: expected keys %v but got %v", keys, actual)
+		return
+	}
+
+	for i := range keys {
+		if actual[i] != keys[i] {
+			t.Errorf("ERROR: expected keys %v but got %v", keys, actual)
+			return
+		}
+	}
+}
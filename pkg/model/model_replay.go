@@ -0,0 +1,378 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+const (
+	// replayBatchSize is a count of WAL records that are handed over to replay workers at once
+	replayBatchSize = 1024
+
+	// replayLogInterval is an interval between replay progress log messages
+	replayLogInterval = 5 * time.Second
+)
+
+// ReplayProgress tracks progress of write-ahead log replay on startup
+// Its status might be read concurrently while WAL is being replayed
+type ReplayProgress struct {
+	mutex      sync.Mutex
+	startTime  time.Time
+	records    uint64
+	bytes      int64
+	totalBytes int64
+	isDone     bool
+}
+
+// ReplayStatus describes progress of write-ahead log replay
+type ReplayStatus struct {
+	// Count of replayed WAL records
+	Records uint64
+	// Length of replayed WAL data
+	Bytes int64
+	// Total length of WAL data, zero if unknown
+	TotalBytes int64
+	// Time since replay has been started
+	Elapsed time.Duration
+	// Estimated time until replay is completed, zero if unknown
+	ETA time.Duration
+	// True if replay is completed
+	IsDone bool
+}
+
+// NewReplayProgress creates new instance of ReplayProgress
+func NewReplayProgress() *ReplayProgress {
+	return &ReplayProgress{startTime: time.Now()}
+}
+
+// Status returns current replay status
+func (p *ReplayProgress) Status() ReplayStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	status := ReplayStatus{
+		Records:    p.records,
+		Bytes:      p.bytes,
+		TotalBytes: p.totalBytes,
+		Elapsed:    time.Since(p.startTime),
+		IsDone:     p.isDone,
+	}
+
+	if !status.IsDone && status.Bytes > 0 && status.TotalBytes > status.Bytes {
+		remaining := float64(status.TotalBytes-status.Bytes) / float64(status.Bytes)
+		status.ETA = time.Duration(float64(status.Elapsed) * remaining)
+	}
+
+	return status
+}
+
+// begin resets replay progress
+func (p *ReplayProgress) begin(totalBytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.startTime = time.Now()
+	p.records = 0
+	p.bytes = 0
+	p.totalBytes = totalBytes
+	p.isDone = false
+}
+
+// update sets count of replayed records and length of replayed WAL data
+func (p *ReplayProgress) update(records uint64, bytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.records = records
+	p.bytes = bytes
+	if p.totalBytes > 0 && p.bytes > p.totalBytes {
+		p.totalBytes = p.bytes
+	}
+}
+
+// end marks replay as completed
+func (p *ReplayProgress) end() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.isDone = true
+}
+
+// String converts replay status into its string representation
+func (s ReplayStatus) String() string {
+	if s.TotalBytes <= 0 {
+		return fmt.Sprintf("%d records, %d bytes in %s", s.Records, s.Bytes, s.Elapsed.Round(time.Millisecond))
+	}
+
+	percent := float64(s.Bytes) * 100 / float64(s.TotalBytes)
+	str := fmt.Sprintf(
+		"%d records, %d of %d bytes (%.1f%%) in %s",
+		s.Records,
+		s.Bytes,
+		s.TotalBytes,
+		percent,
+		s.Elapsed.Round(time.Millisecond),
+	)
+	if s.ETA > 0 {
+		str += fmt.Sprintf(", ETA %s", s.ETA.Round(time.Second))
+	}
+	return str
+}
+
+// replayWriteAheadLog syncs data model with write-ahead log
+// If parallelism is greater than one, committed transactions are applied by a pool of workers
+// Nodes are partitioned by their key hashes, so changes of each node are applied in WAL order
+func (m *Root) replayWriteAheadLog(wal storage.WALReader, progress *ReplayProgress, parallelism int) error {
+	if progress == nil {
+		progress = NewReplayProgress()
+	}
+
+	counter, _ := wal.(storage.WALProgress)
+	bytesRead := func() int64 {
+		if counter == nil {
+			return 0
+		}
+		return counter.BytesRead()
+	}
+
+	var workers *replayWorkers
+	if parallelism > 1 {
+		workers = newReplayWorkers(m.ValueLog, parallelism)
+	}
+
+	firstID := m.LastChangeID
+	minID := m.LastChangeID
+	records := uint64(0)
+	lastLogTime := time.Now()
+
+	err := func() error {
+		for {
+			record, err := wal.Read()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+
+			if minID < record.ID {
+				minID = record.ID
+
+				if workers != nil {
+					err = m.dispatch(record, workers)
+				} else {
+					err = m.Apply(record)
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			records++
+			if records%replayBatchSize == 0 {
+				progress.update(records, bytesRead())
+				if time.Since(lastLogTime) >= replayLogInterval {
+					log.Printf("replaying journal: %s", progress.Status())
+					lastLogTime = time.Now()
+				}
+			}
+		}
+	}()
+
+	if workers != nil {
+		workerErr := workers.close()
+		if err == nil {
+			err = workerErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	progress.update(records, bytesRead())
+	progress.end()
+	log.Verbosef("replayed journal [%d..%d]: %s", firstID, m.LastChangeID, progress.Status())
+	return nil
+}
+
+// dispatch applies changes of a write-ahead log record to a nodes map
+// and hands the record over to a replay worker that applies it to the node itself
+func (m *Root) dispatch(record *storage.WALRecord, workers *replayWorkers) error {
+	if record.ID <= m.LastChangeID {
+		log.Errorf("change #%d is already applied to model", record.ID)
+		return ErrChangeAlreadyApplied
+	}
+
+	if record.Key != "" {
+		switch record.Type {
+		case storage.WALNone:
+			break
+
+		case storage.WALCommitTx:
+			break
+
+		case storage.WALAddValue:
+			workers.push(m.GetOrCreateNode(record.Key), record)
+			break
+
+		case storage.WALRemoveValue:
+			node := m.GetNode(record.Key)
+			if node != nil {
+				workers.push(node, record)
+			} else {
+				if log.IsEnabled(l.Verbose) {
+					log.Verbosef("node \"%s\" is not found while applying wal record: #%d", record.Key, record.ID)
+				}
+			}
+			break
+
+		case storage.WALRemoveKey:
+			node := m.GetNode(record.Key)
+			if node != nil {
+				// Node is dropped from map right away, while its values are cleared by a worker
+				workers.push(node, record)
+				delete(m.NodesMap, record.Key)
+			} else {
+				if log.IsEnabled(l.Verbose) {
+					log.Verbosef("node \"%s\" is not found while applying wal record: #%d", record.Key, record.ID)
+				}
+			}
+			break
+
+		default:
+			log.Errorf("unknown wal record type: %d", record.Type)
+			return fmt.Errorf("unknown wal record type: %d", record.Type)
+		}
+	}
+
+	if record.Type != storage.WALCommitTx {
+		m.LastChangeID = record.ID
+		return nil
+	}
+
+	// Transaction is committed, so its changes might be handed over to workers
+	return workers.commit()
+}
+
+// replayItem is a write-ahead log record that is applied to a node by a replay worker
+type replayItem struct {
+	node   *Node
+	record *storage.WALRecord
+}
+
+// replayWorkers is a pool of goroutines that apply write-ahead log records to nodes
+// Each worker owns a partition of nodes, so a node is never modified concurrently
+type replayWorkers struct {
+	values  storage.ValueLog
+	queues  []chan []replayItem
+	batches [][]replayItem
+	count   int
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	err     error
+}
+
+// newReplayWorkers creates and starts a pool of replay workers
+func newReplayWorkers(values storage.ValueLog, count int) *replayWorkers {
+	w := &replayWorkers{
+		values:  values,
+		queues:  make([]chan []replayItem, count),
+		batches: make([][]replayItem, count),
+	}
+
+	for i := range w.queues {
+		w.queues[i] = make(chan []replayItem, 4)
+		w.wg.Add(1)
+		go w.run(w.queues[i])
+	}
+
+	return w
+}
+
+// push adds a record to a batch of its node's partition
+func (w *replayWorkers) push(node *Node, record *storage.WALRecord) {
+	i := partitionOf(node.Key, len(w.batches))
+	w.batches[i] = append(w.batches[i], replayItem{node: node, record: record})
+	w.count++
+}
+
+// commit hands pending batches over to workers if they are large enough
+// Batches are flushed at transaction boundaries only
+func (w *replayWorkers) commit() error {
+	if w.count < replayBatchSize {
+		return nil
+	}
+
+	w.flush()
+	return w.error()
+}
+
+// flush hands pending batches over to workers
+func (w *replayWorkers) flush() {
+	for i, batch := range w.batches {
+		if len(batch) > 0 {
+			w.queues[i] <- batch
+			w.batches[i] = nil
+		}
+	}
+	w.count = 0
+}
+
+// close flushes pending batches, waits for workers to complete and returns the first error (if any)
+func (w *replayWorkers) close() error {
+	w.flush()
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+	return w.error()
+}
+
+// run applies batches of records until queue is closed
+func (w *replayWorkers) run(queue chan []replayItem) {
+	defer w.wg.Done()
+
+	for batch := range queue {
+		if w.error() != nil {
+			// Remaining batches are drained, since replay has failed anyway
+			continue
+		}
+
+		for _, item := range batch {
+			err := item.node.apply(item.record, w.values)
+			if err != nil {
+				w.fail(err)
+				break
+			}
+		}
+	}
+}
+
+func (w *replayWorkers) error() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+func (w *replayWorkers) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// partitionOf returns a partition of specified key (FNV-1a hash)
+func partitionOf(key string, count int) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(count))
+}
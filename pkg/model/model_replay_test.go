@@ -0,0 +1,116 @@
+package model
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	l "log"
+
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// replayTestWAL returns a WAL with random transactions over a small set of keys
+func replayTestWAL(txCount int) []*storage.WALRecord {
+	random := rand.New(rand.NewSource(1))
+	records := make([]*storage.WALRecord, 0)
+	id := uint64(0)
+	for txID := uint64(1); txID <= uint64(txCount); txID++ {
+		for i := random.Intn(5); i >= 0; i-- {
+			id++
+			record := &storage.WALRecord{
+				ID:    id,
+				TxID:  txID,
+				Key:   fmt.Sprintf("key-%d", random.Intn(50)),
+				Value: Value(fmt.Sprintf("value-%d", random.Intn(10))),
+			}
+			switch n := random.Intn(10); {
+			case n < 6:
+				record.Type = storage.WALAddValue
+			case n < 9:
+				record.Type = storage.WALRemoveValue
+			default:
+				record.Type = storage.WALRemoveKey
+				record.Value = nil
+			}
+			records = append(records, record)
+		}
+
+		id++
+		records = append(records, &storage.WALRecord{ID: id, TxID: txID, Type: storage.WALCommitTx})
+	}
+
+	return records
+}
+
+func TestParallelReplay(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	records := replayTestWAL(5000)
+
+	expected := New()
+	err := expected.replayWriteAheadLog(&sliceWALReader{records: records}, nil, 1)
+	if err != nil {
+		t.Fatalf("ERROR: sequential replay failed: %s", err)
+	}
+
+	for _, parallelism := range []int{2, 4, 16} {
+		progress := NewReplayProgress()
+		actual := New()
+		err = actual.replayWriteAheadLog(&sliceWALReader{records: records}, progress, parallelism)
+		if err != nil {
+			t.Errorf("ERROR: replay with %d workers failed: %s", parallelism, err)
+			continue
+		}
+
+		if actual.LastChangeID != expected.LastChangeID {
+			t.Errorf("ERROR: replay with %d workers: last change #%d != #%d", parallelism, actual.LastChangeID, expected.LastChangeID)
+		}
+		if len(actual.NodesMap) != len(expected.NodesMap) {
+			t.Errorf("ERROR: replay with %d workers: %d nodes != %d nodes", parallelism, len(actual.NodesMap), len(expected.NodesMap))
+		}
+		for key, node := range expected.NodesMap {
+			if other := actual.GetNode(key); other == nil || other.String() != node.String() {
+				t.Errorf("ERROR: replay with %d workers: node %s != %s", parallelism, other, node)
+			}
+		}
+
+		status := progress.Status()
+		if !status.IsDone || status.Records != uint64(len(records)) {
+			t.Errorf("ERROR: replay with %d workers: unexpected progress %s", parallelism, status)
+		}
+	}
+}
+
+func TestParallelReplayFailure(t *testing.T) {
+	l.SetOutput(io.Discard)
+
+	records := replayTestWAL(100)
+	records = append(records, &storage.WALRecord{ID: records[len(records)-1].ID + 1, Key: "key", Type: 0x7f})
+
+	err := New().replayWriteAheadLog(&sliceWALReader{records: records}, nil, 4)
+	if err == nil {
+		t.Errorf("ERROR: replay of unknown record should fail")
+	}
+}
+
+func TestReplayProgressStatus(t *testing.T) {
+	progress := NewReplayProgress()
+	progress.begin(1000)
+	progress.update(10, 250)
+
+	status := progress.Status()
+	if status.Records != 10 || status.Bytes != 250 || status.TotalBytes != 1000 || status.IsDone {
+		t.Errorf("ERROR: unexpected progress %s", status)
+	}
+	if status.Elapsed > 0 && status.ETA < status.Elapsed*2 {
+		t.Errorf("ERROR: ETA %s is too short for 25%% in %s", status.ETA, status.Elapsed)
+	}
+
+	progress.end()
+	status = progress.Status()
+	if !status.IsDone || status.ETA != 0 {
+		t.Errorf("ERROR: unexpected progress %s", status)
+	}
+}
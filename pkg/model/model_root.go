@@ -2,7 +2,6 @@ package model
 
 import (
 	"fmt"
-	"io"
 	"sort"
 
 	l "github.com/kapitanov/natandb/pkg/log"
@@ -33,6 +32,9 @@ type Root struct {
 	LastChangeID uint64
 	// Map of nodes
 	NodesMap map[string]*Node
+	// Value log that keeps node values
+	// If it's nil, node values are kept in memory
+	ValueLog storage.ValueLog
 }
 
 // New creates new instance of Root
@@ -86,33 +88,6 @@ func (m *Root) GetOrCreateNode(key string) *Node {
 	return node
 }
 
-// replayWriteAheadLog syncs data model with write-ahead log
-func (m *Root) replayWriteAheadLog(wal storage.WALReader) error {
-	minID := m.LastChangeID
-
-	for {
-		record, err := wal.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-
-		if minID < record.ID {
-			minID = record.ID
-
-			err = m.Apply(record)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	log.Verbosef("replayed journal [%d..%d]", minID, m.LastChangeID)
-	return nil
-}
-
 // Apply applied a write-ahead log record to a data model
 func (m *Root) Apply(record *storage.WALRecord) error {
 	if record.ID <= m.LastChangeID {
@@ -133,7 +108,7 @@ func (m *Root) Apply(record *storage.WALRecord) error {
 
 		case storage.WALAddValue:
 			node := m.GetOrCreateNode(record.Key)
-			err := node.apply(record)
+			err := node.apply(record, m.ValueLog)
 			if err != nil {
 				return err
 			}
@@ -142,7 +117,7 @@ func (m *Root) Apply(record *storage.WALRecord) error {
 		case storage.WALRemoveValue:
 			node := m.GetNode(record.Key)
 			if node != nil {
-				err := node.apply(record)
+				err := node.apply(record, m.ValueLog)
 				if err != nil {
 					return err
 				}
@@ -156,7 +131,7 @@ func (m *Root) Apply(record *storage.WALRecord) error {
 		case storage.WALRemoveKey:
 			node := m.GetNode(record.Key)
 			if node != nil {
-				err := node.apply(record)
+				err := node.apply(record, m.ValueLog)
 				if err != nil {
 					return err
 				}
@@ -185,3 +160,57 @@ func (m *Root) Apply(record *storage.WALRecord) error {
 
 	return nil
 }
+
+// Undo keeps nodes as they have been before a transaction has changed them, so transaction's changes can be undone
+type Undo struct {
+	root         *Root
+	lastChangeID uint64
+	nodes        map[string]*Node
+}
+
+// BeginUndo starts tracking changes of a transaction (see Undo)
+func (m *Root) BeginUndo() *Undo {
+	return &Undo{
+		root:         m,
+		lastChangeID: m.LastChangeID,
+		nodes:        make(map[string]*Node),
+	}
+}
+
+// Save remembers a node before it's changed, only the first call for each key has an effect
+func (u *Undo) Save(key string) {
+	if _, exists := u.nodes[key]; exists {
+		return
+	}
+
+	node := u.root.GetNode(key)
+	if node == nil {
+		u.nodes[key] = nil
+		return
+	}
+
+	// Node values are changed in place, so they are copied
+	values := make([]Value, len(node.Values))
+	copy(values, node.Values)
+	u.nodes[key] = &Node{
+		Key:          node.Key,
+		LastChangeID: node.LastChangeID,
+		Values:       values,
+		Refs:         append([]storage.ValueRef(nil), node.Refs...),
+	}
+}
+
+// Restore brings every saved node back, nodes that haven't existed before transaction are dropped
+// Values that transaction has appended to a value log are left there, vacuum drops them later
+func (u *Undo) Restore() {
+	for key, node := range u.nodes {
+		if node == nil {
+			delete(u.root.NodesMap, key)
+		} else {
+			u.root.NodesMap[key] = node
+		}
+	}
+
+	u.root.LastChangeID = u.lastChangeID
+	u.nodes = make(map[string]*Node)
+}
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+const (
+	// errNoValueLog is returned when a node refers to a value log that is not available
+	errNoValueLog = Error("node values are kept within a value log that is not enabled")
+)
+
+// Values returns node values, reading them from a value log if needed
+func (m *Root) Values(node *Node) ([]Value, error) {
+	return readValues(node, m.ValueLog)
+}
+
+// readValues returns node values, reading them from a value log if needed
+func readValues(node *Node, values storage.ValueLog) ([]Value, error) {
+	if len(node.Refs) == 0 {
+		return node.Values, nil
+	}
+
+	if values == nil {
+		return nil, errNoValueLog
+	}
+
+	result := make([]Value, len(node.Refs))
+	for i, ref := range node.Refs {
+		value, err := values.Read(ref)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = value
+	}
+
+	return result, nil
+}
+
+// Contains returns true if node contains specified value
+func (m *Root) Contains(node *Node, value Value) (bool, error) {
+	if len(node.Refs) == 0 {
+		return node.Contains(value), nil
+	}
+
+	if m.ValueLog == nil {
+		return false, errNoValueLog
+	}
+
+	i, err := node.findRef(value, m.ValueLog)
+	if err != nil {
+		return false, err
+	}
+
+	return i >= 0, nil
+}
+
+// moveToValueLog appends every value that is kept in memory to model's value log
+func (m *Root) moveToValueLog() error {
+	for _, node := range m.NodesMap {
+		err := node.moveToValueLog(m.ValueLog)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CompactValues moves every value that belongs to a sealed value log segment into a compaction segment
+// Model must be built on top of specified value log vacuum (see Rebuild)
+func (m *Root) CompactValues(values storage.ValueLogVacuum) error {
+	count := 0
+	for _, node := range m.NodesMap {
+		for i, ref := range node.Refs {
+			if !values.IsSealed(ref) {
+				continue
+			}
+
+			value, err := values.Read(ref)
+			if err != nil {
+				return err
+			}
+
+			node.Refs[i], err = values.Append(value)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	log.Verbosef("%d values have been compacted", count)
+	return nil
+}
+
+// ReplaceSealedValues replaces every reference to a sealed value log segment
+// Nodes that haven't been changed since sealID take references from compacted model,
+// while values of other nodes are appended to model's value log once again
+// Compacted model must be built from the same changes up to sealID (see CompactValues)
+func (m *Root) ReplaceSealedValues(compacted *Root, sealID uint64, values storage.ValueLogVacuum) error {
+	if m.ValueLog == nil {
+		return errNoValueLog
+	}
+
+	count := 0
+	for key, node := range m.NodesMap {
+		if !hasSealedRefs(node, values) {
+			continue
+		}
+
+		compactedNode := compacted.GetNode(key)
+		if node.LastChangeID <= sealID && compactedNode != nil && len(compactedNode.Refs) == len(node.Refs) {
+			node.Refs = append([]storage.ValueRef{}, compactedNode.Refs...)
+			continue
+		}
+
+		for i, ref := range node.Refs {
+			if !values.IsSealed(ref) {
+				continue
+			}
+
+			value, err := m.ValueLog.Read(ref)
+			if err != nil {
+				return err
+			}
+
+			node.Refs[i], err = m.ValueLog.Append(value)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	if count > 0 {
+		log.Verbosef("%d values of changed nodes have been moved out of sealed segments", count)
+	}
+	return nil
+}
+
+// hasSealedRefs returns true if node refers to a sealed value log segment
+func hasSealedRefs(node *Node, values storage.ValueLogVacuum) bool {
+	for _, ref := range node.Refs {
+		if values.IsSealed(ref) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,9 +2,11 @@ package proto
 
 import (
 	"context"
+	"sync/atomic"
 
 	l "github.com/kapitanov/natandb/pkg/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 var clientLog = l.New("client")
@@ -17,11 +19,21 @@ type Client interface {
 }
 
 type clientImpl struct {
-	connection *grpc.ClientConn
+	connection clientConnection
 	client     ServiceClient
+	session    *session
+}
+
+// clientConnection is a connection (or a pool of connections) to a remote service
+type clientConnection interface {
+	grpc.ClientConnInterface
+	Target() string
+	Close() error
 }
 
 // NewClient creates new client and connects it to specified remote service
+// Client is a read-your-writes session: reads wait until server (e.g. a replica) has applied every change
+// that client has written or read before (see GetRequest.MinVersion)
 func NewClient(address string) (Client, error) {
 	clientLog.Printf("connecting to %s...", address)
 	connection, err := grpc.Dial(address, grpc.WithInsecure())
@@ -35,14 +47,79 @@ func NewClient(address string) (Client, error) {
 	c := clientImpl{
 		connection: connection,
 		client:     client,
+		session:    &session{},
 	}
 	return &c, nil
 }
 
+// newPooledClient creates new client that spreads requests over specified count of connections to remote service
+// It's shared by many clients, so it doesn't track a read-your-writes session of its own
+func newPooledClient(address string, size int, opts ...grpc.DialOption) (Client, error) {
+	clientLog.Printf("connecting to %s (%d connections)...", address, size)
+	pool := &connectionGroup{connections: make([]*grpc.ClientConn, 0, size)}
+	for i := 0; i < size; i++ {
+		connection, err := grpc.Dial(address, append([]grpc.DialOption{grpc.WithInsecure()}, opts...)...)
+		if err != nil {
+			clientLog.Printf("unable to connect. %s", err)
+			_ = pool.Close()
+			return nil, err
+		}
+		pool.connections = append(pool.connections, connection)
+	}
+
+	clientLog.Printf("connected to %s", address)
+	c := clientImpl{
+		connection: pool,
+		client:     NewServiceClient(pool),
+	}
+	return &c, nil
+}
+
+// connectionGroup sends requests over a group of connections to the same remote service in round-robin order
+type connectionGroup struct {
+	connections []*grpc.ClientConn
+	next        uint32
+}
+
+func (g *connectionGroup) pick() *grpc.ClientConn {
+	i := atomic.AddUint32(&g.next, 1)
+	return g.connections[int(i)%len(g.connections)]
+}
+
+func (g *connectionGroup) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	return g.pick().Invoke(ctx, method, args, reply, opts...)
+}
+
+func (g *connectionGroup) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return g.pick().NewStream(ctx, desc, method, opts...)
+}
+
+func (g *connectionGroup) Target() string {
+	return g.connections[0].Target()
+}
+
+func (g *connectionGroup) Close() error {
+	var lastErr error
+	for _, connection := range g.connections {
+		err := connection.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 // List returns paged list of DB keys (with values)
 // Optionally list might be filtered by key prefix
 func (c *clientImpl) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*PagedNodeList, error) {
-	return c.client.List(ctx, in, opts...)
+	request := &ListRequest{
+		Prefix:     in.Prefix,
+		Skip:       in.Skip,
+		Limit:      in.Limit,
+		Version:    in.Version,
+		MinVersion: c.session.minVersion(in.MinVersion),
+	}
+	return c.client.List(ctx, request, opts...)
 }
 
 // Version returns current data version
@@ -53,13 +130,14 @@ func (c *clientImpl) Version(ctx context.Context, in *None, opts ...grpc.CallOpt
 // Get gets a node value by its key
 // If specified node doesn't exist, a ErrNoSuchKey error is returned
 func (c *clientImpl) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Node, error) {
-	return c.client.Get(ctx, in, opts...)
+	request := &GetRequest{Key: in.Key, MinVersion: c.session.minVersion(in.MinVersion)}
+	return c.session.observeNode(c.client.Get(ctx, request, opts...))
 }
 
 // Set sets a node value, rewriting its value if node already exists
 // If specified node doesn't exists, it will be created
 func (c *clientImpl) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*Node, error) {
-	return c.client.Set(ctx, in, opts...)
+	return c.session.observeNode(c.client.Set(ctx, in, opts...))
 }
 
 // Add defines an "append value" operation
@@ -67,7 +145,7 @@ func (c *clientImpl) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallO
 // A specified value will be added to node even if it already exists
 // If node already contains the same value and "unique" parameter is set to "true", a ErrDuplicateValue error is returned
 func (c *clientImpl) Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*Node, error) {
-	return c.client.Add(ctx, in, opts...)
+	return c.session.observeNode(c.client.Add(ctx, in, opts...))
 }
 
 // Remove defines an "remove value" operation
@@ -76,13 +154,57 @@ func (c *clientImpl) Add(ctx context.Context, in *AddRequest, opts ...grpc.CallO
 // If node contains specified value multiple times, all values are removed
 // (unless a "all" parameter is set to "false"
 func (c *clientImpl) Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*Node, error) {
-	return c.client.Remove(ctx, in, opts...)
+	return c.session.observeNode(c.client.Remove(ctx, in, opts...))
 }
 
 // Delete removes a key completely
 // If specified node doesn't exist, a ErrNoSuchKey error is returned
 func (c *clientImpl) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*None, error) {
-	return c.client.Delete(ctx, in, opts...)
+	var header metadata.MD
+	response, err := c.client.Delete(ctx, in, append(opts, grpc.Header(&header))...)
+	if err == nil {
+		c.session.observeHeader(header)
+	}
+	return response, err
+}
+
+// Backup streams a consistent point-in-time backup archive
+// If "since_change_id" is set, an incremental backup of changes after specified one is streamed
+// Transactions keep going while a backup is being taken
+func (c *clientImpl) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (Service_BackupClient, error) {
+	return c.client.Backup(ctx, in, opts...)
+}
+
+// Health returns server state
+// While server is starting, it reports write-ahead log replay progress and rejects any other requests
+func (c *clientImpl) Health(ctx context.Context, in *None, opts ...grpc.CallOption) (*HealthStatus, error) {
+	return c.client.Health(ctx, in, opts...)
+}
+
+// Replicate streams transactions that have been committed after specified change ID, it's used by replicas
+// Committed transactions are read from WAL first, then new ones are streamed as soon as they are committed
+// Heartbeat messages without records are streamed while there are no new transactions
+// Replica sends the first request to start streaming, then it acknowledges every transaction it has persisted
+func (c *clientImpl) Replicate(ctx context.Context, opts ...grpc.CallOption) (Service_ReplicateClient, error) {
+	return c.client.Replicate(ctx, opts...)
+}
+
+// UpdateClusterMap makes server serve a shard of a sharded cluster
+// Requests for keys of other shards are rejected with an ABORTED error, server's cluster map is returned within its trailer
+// Map version is a fencing token: server never goes back to an older map
+// Once response is returned, every write that server has accepted under previous map is committed
+func (c *clientImpl) UpdateClusterMap(ctx context.Context, in *ClusterMapUpdate, opts ...grpc.CallOption) (*ClusterMapUpdateResponse, error) {
+	return c.client.UpdateClusterMap(ctx, in, opts...)
+}
+
+// Import writes nodes and changes copied from another shard, their keys aren't checked against cluster map
+func (c *clientImpl) Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*None, error) {
+	return c.client.Import(ctx, in, opts...)
+}
+
+// DropForeignKeys removes every key that doesn't belong to server's shard
+func (c *clientImpl) DropForeignKeys(ctx context.Context, in *None, opts ...grpc.CallOption) (*DroppedKeys, error) {
+	return c.client.DropForeignKeys(ctx, in, opts...)
 }
 
 // Close shuts down client connection
@@ -0,0 +1,235 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+)
+
+// ClusterMap assigns keys to shards, each shard is served by a separate NatanDB server (or cluster)
+//
+// A key belongs to a shard whose key range contains it. Keys that don't belong to any key range
+// are assigned by their hash (see KeyHash). If no shard has any ranges, hash space is split evenly.
+//
+// Cluster map file is a JSON document:
+//
+//	{
+//	  "version": 1,
+//	  "shards": [
+//	    { "name": "users", "endpoint": "10.0.0.1:18081", "keys": [{ "from": "user/", "to": "user0" }] },
+//	    { "name": "a", "endpoint": "10.0.0.2:18081", "hashes": [{ "from": 0, "to": 2147483647 }] },
+//	    { "name": "b", "endpoint": "10.0.0.3:18081", "hashes": [{ "from": 2147483648, "to": 4294967295 }] }
+//	  ]
+//	}
+type ClusterMap struct {
+	// Map version, it's increased every time a range of keys moves to another shard
+	// Shards never go back to an older map, so a version acts as a fencing token
+	Version uint64 `json:"version"`
+
+	// Shards of the cluster
+	Shards []*Shard `json:"shards"`
+}
+
+// Shard is a part of keyspace served by a single server
+type Shard struct {
+	// Shard name (endpoint is used if not set)
+	Name string `json:"name,omitempty"`
+
+	// Server endpoint
+	Endpoint string `json:"endpoint"`
+
+	// Ranges of key hashes that shard owns
+	Hashes []HashRange `json:"hashes,omitempty"`
+
+	// Ranges of keys that shard owns
+	Keys []KeyRange `json:"keys,omitempty"`
+}
+
+// HashRange is a range of key hashes [From, To]
+type HashRange struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+}
+
+// Contains returns true if range contains specified hash
+func (r HashRange) Contains(hash uint32) bool {
+	return r.From <= hash && hash <= r.To
+}
+
+// KeyRange is a range of keys [From, To), an empty To stands for "no upper bound"
+type KeyRange struct {
+	From string `json:"from"`
+	To   string `json:"to,omitempty"`
+}
+
+// Contains returns true if range contains specified key
+func (r KeyRange) Contains(key string) bool {
+	return r.From <= key && (r.To == "" || key < r.To)
+}
+
+// overlaps returns true if two key ranges have common keys
+func (r KeyRange) overlaps(other KeyRange) bool {
+	return (r.To == "" || other.From < r.To) && (other.To == "" || r.From < other.To)
+}
+
+// LoadClusterMap reads a cluster map file
+func LoadClusterMap(path string) (*ClusterMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ClusterMap{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cluster map \"%s\": %s", path, err)
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("malformed cluster map \"%s\": %s", path, err)
+	}
+
+	return m, nil
+}
+
+// Validate checks that shard ranges don't overlap and fills default values
+func (m *ClusterMap) Validate() error {
+	if len(m.Shards) == 0 {
+		return fmt.Errorf("cluster map has no shards")
+	}
+
+	hasRanges := false
+	names := make(map[string]bool)
+	for _, shard := range m.Shards {
+		if shard.Endpoint == "" {
+			return fmt.Errorf("shard \"%s\" has no endpoint", shard.Name)
+		}
+		if shard.Name == "" {
+			shard.Name = shard.Endpoint
+		}
+		if names[shard.Name] {
+			return fmt.Errorf("shard \"%s\" is listed twice", shard.Name)
+		}
+		names[shard.Name] = true
+
+		for _, r := range shard.Hashes {
+			if r.From > r.To {
+				return fmt.Errorf("shard \"%s\" has an empty hash range [%d, %d]", shard.Name, r.From, r.To)
+			}
+		}
+		for _, r := range shard.Keys {
+			if r.To != "" && r.From >= r.To {
+				return fmt.Errorf("shard \"%s\" has an empty key range [\"%s\", \"%s\")", shard.Name, r.From, r.To)
+			}
+		}
+		hasRanges = hasRanges || len(shard.Hashes) > 0 || len(shard.Keys) > 0
+	}
+
+	if !hasRanges {
+		m.splitHashes()
+		return nil
+	}
+
+	// Hash ranges are sorted to find overlaps
+	hashes := make([]ownedHashRange, 0)
+	keys := make([]ownedKeyRange, 0)
+	for _, shard := range m.Shards {
+		for _, r := range shard.Hashes {
+			hashes = append(hashes, ownedHashRange{HashRange: r, shard: shard.Name})
+		}
+		for _, r := range shard.Keys {
+			keys = append(keys, ownedKeyRange{KeyRange: r, shard: shard.Name})
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i].From < hashes[j].From })
+	for i := 1; i < len(hashes); i++ {
+		if hashes[i].From <= hashes[i-1].To {
+			return fmt.Errorf("hash ranges of shards \"%s\" and \"%s\" overlap", hashes[i-1].shard, hashes[i].shard)
+		}
+	}
+
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			if keys[i].overlaps(keys[j].KeyRange) {
+				return fmt.Errorf("key ranges of shards \"%s\" and \"%s\" overlap", keys[i].shard, keys[j].shard)
+			}
+		}
+	}
+
+	return nil
+}
+
+type ownedHashRange struct {
+	HashRange
+	shard string
+}
+
+type ownedKeyRange struct {
+	KeyRange
+	shard string
+}
+
+// splitHashes splits hash space evenly between shards
+func (m *ClusterMap) splitHashes() {
+	size := (uint64(math.MaxUint32) + 1) / uint64(len(m.Shards))
+	for i, shard := range m.Shards {
+		r := HashRange{From: uint32(uint64(i) * size), To: uint32(uint64(i+1)*size - 1)}
+		if i == len(m.Shards)-1 {
+			r.To = math.MaxUint32
+		}
+		shard.Hashes = []HashRange{r}
+	}
+}
+
+// Has returns true if map contains a shard with specified name
+func (m *ClusterMap) Has(name string) bool {
+	for _, shard := range m.Shards {
+		if shard.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lookup returns a shard that owns specified key
+func (m *ClusterMap) Lookup(key string) (*Shard, error) {
+	for _, shard := range m.Shards {
+		for _, r := range shard.Keys {
+			if r.Contains(key) {
+				return shard, nil
+			}
+		}
+	}
+
+	hash := KeyHash(key)
+	for _, shard := range m.Shards {
+		for _, r := range shard.Hashes {
+			if r.Contains(hash) {
+				return shard, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("key \"%s\" (hash %d) doesn't belong to any shard", key, hash)
+}
+
+// KeyHash returns a hash of a key that is used to assign it to a shard
+// FNV-1a hash is mixed by MurmurHash3 finalizer, so similar keys spread over the whole hash space
+func KeyHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	hash := h.Sum32()
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
@@ -0,0 +1,131 @@
+package proto_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/proto"
+)
+
+func TestClusterMapLookup(t *testing.T) {
+	m := &proto.ClusterMap{
+		Shards: []*proto.Shard{
+			{Name: "users", Endpoint: "a", Keys: []proto.KeyRange{{From: "user/", To: "user0"}}},
+			{Name: "low", Endpoint: "b", Hashes: []proto.HashRange{{From: 0, To: 1<<31 - 1}}},
+			{Name: "high", Endpoint: "c", Hashes: []proto.HashRange{{From: 1 << 31, To: 1<<32 - 1}}},
+		},
+	}
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shard, err := m.Lookup("user/1")
+	if err != nil || shard.Name != "users" {
+		t.Errorf("ERROR: \"user/1\" has been assigned to %v (%v)", shard, err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		shard, err = m.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "low"
+		if proto.KeyHash(key) >= 1<<31 {
+			expected = "high"
+		}
+		if shard.Name != expected {
+			t.Errorf("ERROR: \"%s\" has been assigned to %s instead of %s", key, shard.Name, expected)
+		}
+	}
+}
+
+func TestClusterMapSplitsHashes(t *testing.T) {
+	m := &proto.ClusterMap{
+		Shards: []*proto.Shard{{Endpoint: "a"}, {Endpoint: "b"}, {Endpoint: "c"}},
+	}
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		shard, err := m.Lookup(fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[shard.Name]++
+	}
+
+	for _, shard := range m.Shards {
+		if counts[shard.Name] == 0 {
+			t.Errorf("ERROR: shard %s owns no keys", shard.Name)
+		}
+	}
+}
+
+func TestClusterMapOverlaps(t *testing.T) {
+	maps := []*proto.ClusterMap{
+		{Shards: []*proto.Shard{
+			{Endpoint: "a", Hashes: []proto.HashRange{{From: 0, To: 100}}},
+			{Endpoint: "b", Hashes: []proto.HashRange{{From: 100, To: 200}}},
+		}},
+		{Shards: []*proto.Shard{
+			{Endpoint: "a", Keys: []proto.KeyRange{{From: "a", To: "c"}}},
+			{Endpoint: "b", Keys: []proto.KeyRange{{From: "b"}}},
+		}},
+		{Shards: []*proto.Shard{
+			{Endpoint: "a", Hashes: []proto.HashRange{{From: 0, To: 100}}},
+			{Endpoint: "a", Hashes: []proto.HashRange{{From: 101, To: 200}}},
+		}},
+	}
+
+	for i, m := range maps {
+		if m.Validate() == nil {
+			t.Errorf("ERROR: map #%d is expected to be invalid", i)
+		}
+	}
+}
+
+func TestClusterMapMove(t *testing.T) {
+	m := &proto.ClusterMap{
+		Version: 1,
+		Shards:  []*proto.Shard{{Name: "a", Endpoint: "a"}, {Name: "b", Endpoint: "b"}},
+	}
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := m.Move(proto.RangeMove{Target: "b", Hashes: &proto.HashRange{From: 1000, To: 1<<31 + 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Version != 2 {
+		t.Errorf("ERROR: moved map has version %d instead of 2", next.Version)
+	}
+
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		shard, err := next.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "a"
+		if hash := proto.KeyHash(key); hash >= 1000 {
+			expected = "b"
+		}
+		if shard.Name != expected {
+			t.Errorf("ERROR: \"%s\" has been assigned to %s instead of %s", key, shard.Name, expected)
+		}
+	}
+
+	_, err = next.Move(proto.RangeMove{Target: "c", Keys: &proto.KeyRange{From: "a", To: "b"}})
+	if err == nil {
+		t.Errorf("ERROR: keys have been moved to an unknown shard")
+	}
+}
@@ -0,0 +1,101 @@
+package proto
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// changeIDHeader contains ID of a change that server has committed for a write without a node version (e.g. Delete)
+const changeIDHeader = "x-natandb-change-id"
+
+// minVersionTimeout is a max time a read waits for server to apply a change it requires (see GetRequest.MinVersion)
+const minVersionTimeout = 1 * time.Second
+
+// waitForVersion waits until engine applies a change with specified ID
+// UNAVAILABLE error is returned on timeout, so client might retry request or send it to another server
+func waitForVersion(ctx context.Context, engine db.Engine, version uint64) error {
+	if version == 0 {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, minVersionTimeout)
+	defer cancel()
+
+	err := engine.WaitForCommit(waitCtx, version)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() == nil && err == context.DeadlineExceeded {
+		return status.Errorf(codes.Unavailable, "change #%d hasn't been applied yet (server is at #%d)", version, engine.LastCommitID())
+	}
+	return mapServerError(err)
+}
+
+// forwardChangeID passes a change ID from an upstream response header to a response of current request
+func forwardChangeID(ctx context.Context, header metadata.MD) {
+	if values := header.Get(changeIDHeader); len(values) > 0 {
+		_ = grpc.SetHeader(ctx, metadata.Pairs(changeIDHeader, values[0]))
+	}
+}
+
+// session is a read-your-writes token: the highest change ID that client has written or read
+// A nil session tracks nothing
+type session struct {
+	mutex   sync.Mutex
+	version uint64
+}
+
+// observe raises session token to specified change ID
+func (s *session) observe(version uint64) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if version > s.version {
+		s.version = version
+	}
+}
+
+// observeHeader raises session token to a change ID from a response header
+func (s *session) observeHeader(header metadata.MD) {
+	if values := header.Get(changeIDHeader); len(values) > 0 {
+		version, err := strconv.ParseUint(values[0], 10, 64)
+		if err == nil {
+			s.observe(version)
+		}
+	}
+}
+
+// observeNode raises session token to a version of a node that server has returned
+func (s *session) observeNode(node *Node, err error) (*Node, error) {
+	if err == nil {
+		s.observe(node.Version)
+	}
+	return node, err
+}
+
+// minVersion returns a min change ID that a read requires, client's own one is used if it's higher
+func (s *session) minVersion(version uint64) uint64 {
+	if s == nil {
+		return version
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.version > version {
+		return s.version
+	}
+	return version
+}
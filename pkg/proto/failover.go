@@ -0,0 +1,413 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/backup"
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/election"
+	"github.com/kapitanov/natandb/pkg/failover"
+	"github.com/kapitanov/natandb/pkg/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// failoverClientTimeout is a max time a request waits for a new primary, unless its context has a deadline
+	failoverClientTimeout = 30 * time.Second
+
+	// failoverClientMinBackoff is a delay before a request is retried after primary has been lost
+	failoverClientMinBackoff = 100 * time.Millisecond
+
+	// failoverClientMaxBackoff is a max delay before a request is retried after primary has been lost
+	failoverClientMaxBackoff = 1 * time.Second
+
+	// failoverHealthTimeout is a max time a server of a failover group has to respond to a health check
+	failoverHealthTimeout = 1 * time.Second
+)
+
+// FailoverTransport sends requests of a failover group member to other members via GRPC
+type FailoverTransport struct {
+	pool *connectionPool
+}
+
+// NewFailoverTransport creates a GRPC transport for failover group members
+func NewFailoverTransport() *FailoverTransport {
+	return &FailoverTransport{pool: newConnectionPool()}
+}
+
+// Close closes connections to other members
+func (t *FailoverTransport) Close() error {
+	return t.pool.Close()
+}
+
+// Heartbeat renews primary's lease
+func (t *FailoverTransport) Heartbeat(ctx context.Context, server string, request *failover.HeartbeatRequest) (*failover.HeartbeatResponse, error) {
+	client, err := t.client(server)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]*EpochRange, len(request.History))
+	for i, r := range request.History {
+		history[i] = &EpochRange{Epoch: r.Term, After: r.After}
+	}
+
+	response, err := client.FailoverHeartbeat(ctx, &FailoverHeartbeatRequest{
+		Epoch:   request.Epoch,
+		Primary: request.Primary,
+		History: history,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &failover.HeartbeatResponse{Epoch: response.Epoch, Accepted: response.Accepted}, nil
+}
+
+// RequestVote asks a server for its vote
+func (t *FailoverTransport) RequestVote(ctx context.Context, server string, request *failover.VoteRequest) (*failover.VoteResponse, error) {
+	client, err := t.client(server)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.FailoverVote(ctx, &FailoverVoteRequest{
+		Epoch:        request.Epoch,
+		Candidate:    request.Candidate,
+		LastChangeId: request.LastChangeID,
+		LastEpoch:    request.LastEpoch,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &failover.VoteResponse{Epoch: response.Epoch, Granted: response.Granted}, nil
+}
+
+func (t *FailoverTransport) client(server string) (FailoverClient, error) {
+	connection, err := t.pool.get(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFailoverClient(connection), nil
+}
+
+// FailoverReplicator replicates data of failover group's primary into a server engine
+// Server reports replication state of its current replica
+type FailoverReplicator struct {
+	engine  db.Engine
+	server  Server
+	replica *Replica
+}
+
+// NewFailoverReplicator creates a replicator for a server engine
+func NewFailoverReplicator(engine db.Engine, server Server) *FailoverReplicator {
+	return &FailoverReplicator{engine: engine, server: server}
+}
+
+// Snapshot downloads a full backup of primary and returns its snapshot with ID of the last change it contains
+func (r *FailoverReplicator) Snapshot(ctx context.Context, primary string) (*model.Root, uint64, error) {
+	client, err := NewClient(primary)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	stream, err := client.Backup(ctx, &BackupRequest{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b, err := backup.Read(&backupStreamReader{stream: stream})
+	if err != nil {
+		return nil, 0, err
+	}
+	if b.Manifest.Kind != backup.KindFull {
+		return nil, 0, fmt.Errorf("primary has sent %s instead of a full backup", b.Manifest)
+	}
+
+	return backup.Restore([]*backup.Backup{b})
+}
+
+// Follow starts applying transactions of primary, replication from previous primary is stopped
+func (r *FailoverReplicator) Follow(primary string) {
+	r.Stop()
+
+	replica, err := NewReplica(r.engine, primary)
+	if err != nil {
+		// Connections are established lazily, so it's unlikely to happen
+		replicaLog.Errorf("unable to connect to primary server %s: %s", primary, err)
+		return
+	}
+
+	r.replica = replica
+	r.server.SetReplica(replica)
+	replica.Start()
+}
+
+// Stop stops replication
+func (r *FailoverReplicator) Stop() {
+	if r.replica == nil {
+		return
+	}
+
+	r.server.SetReplica(nil)
+	err := r.replica.Close()
+	if err != nil {
+		replicaLog.Errorf("unable to stop replication: %s", err)
+	}
+	r.replica = nil
+}
+
+// SetFailover makes server act as a failover group member
+func (s *serverImpl) SetFailover(node *failover.Node) {
+	s.mutex.Lock()
+	s.failover = node
+	s.mutex.Unlock()
+}
+
+// getFailover returns a failover group member or an error if server isn't a member
+func (s *serverImpl) getFailover() (*failover.Node, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.failover == nil {
+		return nil, status.Error(codes.Unavailable, "server is not a failover group member")
+	}
+	return s.failover, nil
+}
+
+// FailoverHeartbeat is sent by primary server to renew its lease
+func (s *serverImpl) FailoverHeartbeat(ctx context.Context, request *FailoverHeartbeatRequest) (*FailoverHeartbeatResponse, error) {
+	node, err := s.getFailover()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make(election.History, len(request.History))
+	for i, r := range request.History {
+		history[i] = election.Range{Term: r.Epoch, After: r.After}
+	}
+
+	response, err := node.Heartbeat(&failover.HeartbeatRequest{
+		Epoch:   request.Epoch,
+		Primary: request.Primary,
+		History: history,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &FailoverHeartbeatResponse{Epoch: response.Epoch, Accepted: response.Accepted}, nil
+}
+
+// FailoverVote asks a replica to vote for its promotion
+func (s *serverImpl) FailoverVote(ctx context.Context, request *FailoverVoteRequest) (*FailoverVoteResponse, error) {
+	node, err := s.getFailover()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := node.RequestVote(&failover.VoteRequest{
+		Epoch:        request.Epoch,
+		Candidate:    request.Candidate,
+		LastChangeID: request.LastChangeId,
+		LastEpoch:    request.LastEpoch,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &FailoverVoteResponse{Epoch: response.Epoch, Granted: response.Granted}, nil
+}
+
+// failoverStatus returns a state of a failover group member
+func failoverStatus(node *failover.Node) *FailoverStatus {
+	status := node.Status()
+	response := &FailoverStatus{
+		Role:    status.Role.String(),
+		Epoch:   status.Epoch,
+		Primary: status.Primary,
+	}
+	if remaining := time.Until(status.LeaseExpiry); status.Role == failover.Primary && remaining > 0 {
+		response.LeaseRemainingMs = uint64(remaining.Milliseconds())
+	}
+	return response
+}
+
+// NewFailoverGroupClient creates new client that sends requests to primary server of a failover group
+// Primary is discovered via health checks of seed servers, and it's discovered again once it's lost,
+// requests that primary hasn't served are retried. Writes that have failed in transit aren't retried, since they might have been committed
+func NewFailoverGroupClient(seeds []string) (Client, error) {
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no seed servers are specified")
+	}
+
+	connection := &failoverConnection{seeds: seeds, pool: newConnectionPool()}
+	c := clientImpl{
+		connection: connection,
+		client:     NewServiceClient(connection),
+		session:    &session{},
+	}
+	return &c, nil
+}
+
+// failoverConnection sends requests to primary server of a failover group
+type failoverConnection struct {
+	seeds   []string
+	pool    *connectionPool
+	mutex   sync.Mutex
+	primary string
+}
+
+func (c *failoverConnection) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	_, isWrite := forwardedMethods[method]
+	start := time.Now()
+	delay := failoverClientMinBackoff
+	for {
+		primary, connection, err := c.connect(ctx)
+		if err == nil {
+			err = connection.Invoke(ctx, method, args, reply, opts...)
+			if err == nil {
+				return nil
+			}
+
+			// Primary has stepped down or it's unreachable
+			s := status.Convert(err)
+			isReadOnly := s.Code() == codes.FailedPrecondition && s.Message() == db.ErrReadOnly.String()
+			if !isReadOnly && s.Code() != codes.Unavailable {
+				return err
+			}
+			c.forget(primary)
+			if isWrite && !isReadOnly {
+				return err
+			}
+		}
+
+		if _, ok := ctx.Deadline(); !ok && time.Since(start) > failoverClientTimeout {
+			return err
+		}
+
+		clientLog.Verbosef("%s has failed: %s, retrying in %s", method, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		delay *= 2
+		if delay > failoverClientMaxBackoff {
+			delay = failoverClientMaxBackoff
+		}
+	}
+}
+
+func (c *failoverConnection) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	_, connection, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return connection.NewStream(ctx, desc, method, opts...)
+}
+
+func (c *failoverConnection) Target() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.primary != "" {
+		return c.primary
+	}
+	return strings.Join(c.seeds, ",")
+}
+
+func (c *failoverConnection) Close() error {
+	return c.pool.Close()
+}
+
+// connect returns a connection to current primary, primary is discovered if it's unknown
+func (c *failoverConnection) connect(ctx context.Context) (string, *grpc.ClientConn, error) {
+	c.mutex.Lock()
+	primary := c.primary
+	c.mutex.Unlock()
+
+	if primary == "" {
+		var err error
+		primary, err = c.discover(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+
+		c.mutex.Lock()
+		c.primary = primary
+		c.mutex.Unlock()
+		clientLog.Printf("primary server is %s", primary)
+	}
+
+	connection, err := c.pool.get(primary)
+	if err != nil {
+		return "", nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return primary, connection, nil
+}
+
+// forget makes client discover primary again
+func (c *failoverConnection) forget(primary string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.primary == primary {
+		clientLog.Printf("primary server %s has been lost", primary)
+		c.primary = ""
+	}
+}
+
+// discover checks health of seed servers and returns primary of the latest epoch
+// Servers that replicas follow are checked too, so primary doesn't have to be a seed server
+func (c *failoverConnection) discover(ctx context.Context) (string, error) {
+	var primary string
+	var epoch uint64
+	isChecked := make(map[string]bool)
+	endpoints := append([]string(nil), c.seeds...)
+	for len(endpoints) > 0 {
+		endpoint := endpoints[0]
+		endpoints = endpoints[1:]
+		if isChecked[endpoint] {
+			continue
+		}
+		isChecked[endpoint] = true
+
+		connection, err := c.pool.get(endpoint)
+		if err != nil {
+			continue
+		}
+
+		healthCtx, cancel := context.WithTimeout(ctx, failoverHealthTimeout)
+		health, err := NewServiceClient(connection).Health(healthCtx, &None{})
+		cancel()
+		if err != nil || health.Failover == nil {
+			continue
+		}
+
+		if health.Failover.Role == failover.Primary.String() && (primary == "" || health.Failover.Epoch > epoch) {
+			primary, epoch = endpoint, health.Failover.Epoch
+		}
+		if health.Failover.Primary != "" {
+			endpoints = append(endpoints, health.Failover.Primary)
+		}
+	}
+
+	if primary == "" {
+		return "", status.Error(codes.Unavailable, "failover group has no primary")
+	}
+	return primary, nil
+}
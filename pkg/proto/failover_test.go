@@ -0,0 +1,124 @@
+package proto_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/failover"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/proto"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestFailoverGroupClient(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	group := []string{freeEndpoint(t), freeEndpoint(t), freeEndpoint(t)}
+	stops := make(map[string]func())
+	for _, endpoint := range group {
+		stops[endpoint] = startFailover(t, endpoint, group)
+	}
+
+	client, err := proto.NewFailoverGroupClient(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// Client waits until a primary is promoted
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err = client.Add(ctx, &proto.AddRequest{Key: "key", Value: []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health, err := client.Health(ctx, &proto.None{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Failover == nil || health.Failover.Role != failover.Primary.String() {
+		t.Fatalf("ERROR: unexpected failover status %v", health.Failover)
+	}
+	primary := health.Failover.Primary
+	epoch := health.Failover.Epoch
+
+	// Client discovers a new primary once the old one is gone
+	stops[primary]()
+	for {
+		_, err = client.Add(ctx, &proto.AddRequest{Key: "key", Value: []byte("2")})
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("ERROR: no primary has been promoted: %s", err)
+		}
+	}
+
+	health, err = client.Health(ctx, &proto.None{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.Failover.Primary == primary || health.Failover.Epoch <= epoch {
+		t.Errorf("ERROR: unexpected failover status %v", health.Failover)
+	}
+
+	node, err := client.Get(ctx, &proto.GetRequest{Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Values) != 2 {
+		t.Errorf("ERROR: \"key\" has values %q", node.Values)
+	}
+}
+
+// startFailover starts a server of a failover group and returns a function that stops it
+func startFailover(t *testing.T, endpoint string, group []string) func() {
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver), db.ReplicaOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := proto.NewServer(engine, endpoint)
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := failover.Config{
+		ID:                endpoint,
+		Group:             group,
+		Lease:             300 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+	}
+	transport := proto.NewFailoverTransport()
+	node, err := failover.NewNode(config, engine, driver, transport, proto.NewFailoverReplicator(engine, server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetFailover(node)
+	node.Start()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			_ = node.Close()
+			_ = transport.Close()
+			_ = server.Close()
+			_ = engine.Close()
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
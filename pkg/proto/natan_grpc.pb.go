@@ -43,6 +43,27 @@ type ServiceClient interface {
 	// Delete removes a key completely
 	// If specified node doesn't exist, a ErrNoSuchKey error is returned
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*None, error)
+	// Backup streams a consistent point-in-time backup archive
+	// If "since_change_id" is set, an incremental backup of changes after specified one is streamed
+	// Transactions keep going while a backup is being taken
+	Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (Service_BackupClient, error)
+	// Health returns server state
+	// While server is starting, it reports write-ahead log replay progress and rejects any other requests
+	Health(ctx context.Context, in *None, opts ...grpc.CallOption) (*HealthStatus, error)
+	// Replicate streams transactions that have been committed after specified change ID, it's used by replicas
+	// Committed transactions are read from WAL first, then new ones are streamed as soon as they are committed
+	// Heartbeat messages without records are streamed while there are no new transactions
+	// Replica sends the first request to start streaming, then it acknowledges every transaction it has persisted
+	Replicate(ctx context.Context, opts ...grpc.CallOption) (Service_ReplicateClient, error)
+	// UpdateClusterMap makes server serve a shard of a sharded cluster
+	// Requests for keys of other shards are rejected with an ABORTED error, server's cluster map is returned within its trailer
+	// Map version is a fencing token: server never goes back to an older map
+	// Once response is returned, every write that server has accepted under previous map is committed
+	UpdateClusterMap(ctx context.Context, in *ClusterMapUpdate, opts ...grpc.CallOption) (*ClusterMapUpdateResponse, error)
+	// Import writes nodes and changes copied from another shard, their keys aren't checked against cluster map
+	Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*None, error)
+	// DropForeignKeys removes every key that doesn't belong to server's shard
+	DropForeignKeys(ctx context.Context, in *None, opts ...grpc.CallOption) (*DroppedKeys, error)
 }
 
 type serviceClient struct {
@@ -116,6 +137,105 @@ func (c *serviceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...g
 	return out, nil
 }
 
+func (c *serviceClient) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (Service_BackupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[0], "/Service/Backup", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceBackupClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Service_BackupClient interface {
+	Recv() (*BackupChunk, error)
+	grpc.ClientStream
+}
+
+type serviceBackupClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceBackupClient) Recv() (*BackupChunk, error) {
+	m := new(BackupChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) Health(ctx context.Context, in *None, opts ...grpc.CallOption) (*HealthStatus, error) {
+	out := new(HealthStatus)
+	err := c.cc.Invoke(ctx, "/Service/Health", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (Service_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Service_ServiceDesc.Streams[1], "/Service/Replicate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &serviceReplicateClient{stream}
+	return x, nil
+}
+
+type Service_ReplicateClient interface {
+	Send(*ReplicateRequest) error
+	Recv() (*ReplicatedTx, error)
+	grpc.ClientStream
+}
+
+type serviceReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *serviceReplicateClient) Send(m *ReplicateRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *serviceReplicateClient) Recv() (*ReplicatedTx, error) {
+	m := new(ReplicatedTx)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *serviceClient) UpdateClusterMap(ctx context.Context, in *ClusterMapUpdate, opts ...grpc.CallOption) (*ClusterMapUpdateResponse, error) {
+	out := new(ClusterMapUpdateResponse)
+	err := c.cc.Invoke(ctx, "/Service/UpdateClusterMap", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*None, error) {
+	out := new(None)
+	err := c.cc.Invoke(ctx, "/Service/Import", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *serviceClient) DropForeignKeys(ctx context.Context, in *None, opts ...grpc.CallOption) (*DroppedKeys, error) {
+	out := new(DroppedKeys)
+	err := c.cc.Invoke(ctx, "/Service/DropForeignKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ServiceServer is the server API for Service service.
 // All implementations must embed UnimplementedServiceServer
 // for forward compatibility
@@ -145,6 +265,27 @@ type ServiceServer interface {
 	// Delete removes a key completely
 	// If specified node doesn't exist, a ErrNoSuchKey error is returned
 	Delete(context.Context, *DeleteRequest) (*None, error)
+	// Backup streams a consistent point-in-time backup archive
+	// If "since_change_id" is set, an incremental backup of changes after specified one is streamed
+	// Transactions keep going while a backup is being taken
+	Backup(*BackupRequest, Service_BackupServer) error
+	// Health returns server state
+	// While server is starting, it reports write-ahead log replay progress and rejects any other requests
+	Health(context.Context, *None) (*HealthStatus, error)
+	// Replicate streams transactions that have been committed after specified change ID, it's used by replicas
+	// Committed transactions are read from WAL first, then new ones are streamed as soon as they are committed
+	// Heartbeat messages without records are streamed while there are no new transactions
+	// Replica sends the first request to start streaming, then it acknowledges every transaction it has persisted
+	Replicate(Service_ReplicateServer) error
+	// UpdateClusterMap makes server serve a shard of a sharded cluster
+	// Requests for keys of other shards are rejected with an ABORTED error, server's cluster map is returned within its trailer
+	// Map version is a fencing token: server never goes back to an older map
+	// Once response is returned, every write that server has accepted under previous map is committed
+	UpdateClusterMap(context.Context, *ClusterMapUpdate) (*ClusterMapUpdateResponse, error)
+	// Import writes nodes and changes copied from another shard, their keys aren't checked against cluster map
+	Import(context.Context, *ImportRequest) (*None, error)
+	// DropForeignKeys removes every key that doesn't belong to server's shard
+	DropForeignKeys(context.Context, *None) (*DroppedKeys, error)
 	mustEmbedUnimplementedServiceServer()
 }
 
@@ -173,6 +314,24 @@ func (UnimplementedServiceServer) Remove(context.Context, *RemoveRequest) (*Node
 func (UnimplementedServiceServer) Delete(context.Context, *DeleteRequest) (*None, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
 }
+func (UnimplementedServiceServer) Backup(*BackupRequest, Service_BackupServer) error {
+	return status.Errorf(codes.Unimplemented, "method Backup not implemented")
+}
+func (UnimplementedServiceServer) Health(context.Context, *None) (*HealthStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Health not implemented")
+}
+func (UnimplementedServiceServer) Replicate(Service_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedServiceServer) UpdateClusterMap(context.Context, *ClusterMapUpdate) (*ClusterMapUpdateResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateClusterMap not implemented")
+}
+func (UnimplementedServiceServer) Import(context.Context, *ImportRequest) (*None, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Import not implemented")
+}
+func (UnimplementedServiceServer) DropForeignKeys(context.Context, *None) (*DroppedKeys, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DropForeignKeys not implemented")
+}
 func (UnimplementedServiceServer) mustEmbedUnimplementedServiceServer() {}
 
 // UnsafeServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -312,6 +471,125 @@ func _Service_Delete_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Service_Backup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BackupRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ServiceServer).Backup(m, &serviceBackupServer{stream})
+}
+
+type Service_BackupServer interface {
+	Send(*BackupChunk) error
+	grpc.ServerStream
+}
+
+type serviceBackupServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceBackupServer) Send(m *BackupChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Service_Health_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(None)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Service/Health",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).Health(ctx, req.(*None))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ServiceServer).Replicate(&serviceReplicateServer{stream})
+}
+
+type Service_ReplicateServer interface {
+	Send(*ReplicatedTx) error
+	Recv() (*ReplicateRequest, error)
+	grpc.ServerStream
+}
+
+type serviceReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *serviceReplicateServer) Send(m *ReplicatedTx) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *serviceReplicateServer) Recv() (*ReplicateRequest, error) {
+	m := new(ReplicateRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Service_UpdateClusterMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterMapUpdate)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).UpdateClusterMap(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Service/UpdateClusterMap",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).UpdateClusterMap(ctx, req.(*ClusterMapUpdate))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_Import_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).Import(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Service/Import",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).Import(ctx, req.(*ImportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Service_DropForeignKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(None)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ServiceServer).DropForeignKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Service/DropForeignKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ServiceServer).DropForeignKeys(ctx, req.(*None))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Service_ServiceDesc is the grpc.ServiceDesc for Service service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -347,6 +625,361 @@ var Service_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Delete",
 			Handler:    _Service_Delete_Handler,
 		},
+		{
+			MethodName: "Health",
+			Handler:    _Service_Health_Handler,
+		},
+		{
+			MethodName: "UpdateClusterMap",
+			Handler:    _Service_UpdateClusterMap_Handler,
+		},
+		{
+			MethodName: "Import",
+			Handler:    _Service_Import_Handler,
+		},
+		{
+			MethodName: "DropForeignKeys",
+			Handler:    _Service_DropForeignKeys_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Backup",
+			Handler:       _Service_Backup_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Replicate",
+			Handler:       _Service_Replicate_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "natan.proto",
+}
+
+// RaftClient is the client API for Raft service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RaftClient interface {
+	// RequestVote asks a node for its vote
+	RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error)
+	// AppendEntries replicates transactions to a node, it's used as a heartbeat too
+	AppendEntries(ctx context.Context, in *AppendEntriesRequest, opts ...grpc.CallOption) (*AppendEntriesResponse, error)
+	// InstallSnapshot replaces node's data with a snapshot of leader's data
+	// The first chunk contains a header only, subsequent chunks contain a full backup archive
+	InstallSnapshot(ctx context.Context, opts ...grpc.CallOption) (Raft_InstallSnapshotClient, error)
+}
+
+type raftClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRaftClient(cc grpc.ClientConnInterface) RaftClient {
+	return &raftClient{cc}
+}
+
+func (c *raftClient) RequestVote(ctx context.Context, in *VoteRequest, opts ...grpc.CallOption) (*VoteResponse, error) {
+	out := new(VoteResponse)
+	err := c.cc.Invoke(ctx, "/Raft/RequestVote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftClient) AppendEntries(ctx context.Context, in *AppendEntriesRequest, opts ...grpc.CallOption) (*AppendEntriesResponse, error) {
+	out := new(AppendEntriesResponse)
+	err := c.cc.Invoke(ctx, "/Raft/AppendEntries", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *raftClient) InstallSnapshot(ctx context.Context, opts ...grpc.CallOption) (Raft_InstallSnapshotClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Raft_ServiceDesc.Streams[0], "/Raft/InstallSnapshot", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &raftInstallSnapshotClient{stream}
+	return x, nil
+}
+
+type Raft_InstallSnapshotClient interface {
+	Send(*SnapshotChunk) error
+	CloseAndRecv() (*AppendEntriesResponse, error)
+	grpc.ClientStream
+}
+
+type raftInstallSnapshotClient struct {
+	grpc.ClientStream
+}
+
+func (x *raftInstallSnapshotClient) Send(m *SnapshotChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *raftInstallSnapshotClient) CloseAndRecv() (*AppendEntriesResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(AppendEntriesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RaftServer is the server API for Raft service.
+// All implementations must embed UnimplementedRaftServer
+// for forward compatibility
+type RaftServer interface {
+	// RequestVote asks a node for its vote
+	RequestVote(context.Context, *VoteRequest) (*VoteResponse, error)
+	// AppendEntries replicates transactions to a node, it's used as a heartbeat too
+	AppendEntries(context.Context, *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	// InstallSnapshot replaces node's data with a snapshot of leader's data
+	// The first chunk contains a header only, subsequent chunks contain a full backup archive
+	InstallSnapshot(Raft_InstallSnapshotServer) error
+	mustEmbedUnimplementedRaftServer()
+}
+
+// UnimplementedRaftServer must be embedded to have forward compatible implementations.
+type UnimplementedRaftServer struct {
+}
+
+func (UnimplementedRaftServer) RequestVote(context.Context, *VoteRequest) (*VoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestVote not implemented")
+}
+func (UnimplementedRaftServer) AppendEntries(context.Context, *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AppendEntries not implemented")
+}
+func (UnimplementedRaftServer) InstallSnapshot(Raft_InstallSnapshotServer) error {
+	return status.Errorf(codes.Unimplemented, "method InstallSnapshot not implemented")
+}
+func (UnimplementedRaftServer) mustEmbedUnimplementedRaftServer() {}
+
+// UnsafeRaftServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RaftServer will
+// result in compilation errors.
+type UnsafeRaftServer interface {
+	mustEmbedUnimplementedRaftServer()
+}
+
+func RegisterRaftServer(s grpc.ServiceRegistrar, srv RaftServer) {
+	s.RegisterService(&Raft_ServiceDesc, srv)
+}
+
+func _Raft_RequestVote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftServer).RequestVote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Raft/RequestVote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftServer).RequestVote(ctx, req.(*VoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Raft_AppendEntries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendEntriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RaftServer).AppendEntries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Raft/AppendEntries",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RaftServer).AppendEntries(ctx, req.(*AppendEntriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Raft_InstallSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RaftServer).InstallSnapshot(&raftInstallSnapshotServer{stream})
+}
+
+type Raft_InstallSnapshotServer interface {
+	SendAndClose(*AppendEntriesResponse) error
+	Recv() (*SnapshotChunk, error)
+	grpc.ServerStream
+}
+
+type raftInstallSnapshotServer struct {
+	grpc.ServerStream
+}
+
+func (x *raftInstallSnapshotServer) SendAndClose(m *AppendEntriesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *raftInstallSnapshotServer) Recv() (*SnapshotChunk, error) {
+	m := new(SnapshotChunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Raft_ServiceDesc is the grpc.ServiceDesc for Raft service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Raft_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "Raft",
+	HandlerType: (*RaftServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RequestVote",
+			Handler:    _Raft_RequestVote_Handler,
+		},
+		{
+			MethodName: "AppendEntries",
+			Handler:    _Raft_AppendEntries_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "InstallSnapshot",
+			Handler:       _Raft_InstallSnapshot_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "natan.proto",
+}
+
+// FailoverClient is the client API for Failover service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FailoverClient interface {
+	// FailoverHeartbeat is sent by primary server to renew its lease
+	FailoverHeartbeat(ctx context.Context, in *FailoverHeartbeatRequest, opts ...grpc.CallOption) (*FailoverHeartbeatResponse, error)
+	// FailoverVote asks a replica to vote for its promotion
+	FailoverVote(ctx context.Context, in *FailoverVoteRequest, opts ...grpc.CallOption) (*FailoverVoteResponse, error)
+}
+
+type failoverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFailoverClient(cc grpc.ClientConnInterface) FailoverClient {
+	return &failoverClient{cc}
+}
+
+func (c *failoverClient) FailoverHeartbeat(ctx context.Context, in *FailoverHeartbeatRequest, opts ...grpc.CallOption) (*FailoverHeartbeatResponse, error) {
+	out := new(FailoverHeartbeatResponse)
+	err := c.cc.Invoke(ctx, "/Failover/FailoverHeartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *failoverClient) FailoverVote(ctx context.Context, in *FailoverVoteRequest, opts ...grpc.CallOption) (*FailoverVoteResponse, error) {
+	out := new(FailoverVoteResponse)
+	err := c.cc.Invoke(ctx, "/Failover/FailoverVote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FailoverServer is the server API for Failover service.
+// All implementations must embed UnimplementedFailoverServer
+// for forward compatibility
+type FailoverServer interface {
+	// FailoverHeartbeat is sent by primary server to renew its lease
+	FailoverHeartbeat(context.Context, *FailoverHeartbeatRequest) (*FailoverHeartbeatResponse, error)
+	// FailoverVote asks a replica to vote for its promotion
+	FailoverVote(context.Context, *FailoverVoteRequest) (*FailoverVoteResponse, error)
+	mustEmbedUnimplementedFailoverServer()
+}
+
+// UnimplementedFailoverServer must be embedded to have forward compatible implementations.
+type UnimplementedFailoverServer struct {
+}
+
+func (UnimplementedFailoverServer) FailoverHeartbeat(context.Context, *FailoverHeartbeatRequest) (*FailoverHeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FailoverHeartbeat not implemented")
+}
+func (UnimplementedFailoverServer) FailoverVote(context.Context, *FailoverVoteRequest) (*FailoverVoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FailoverVote not implemented")
+}
+func (UnimplementedFailoverServer) mustEmbedUnimplementedFailoverServer() {}
+
+// UnsafeFailoverServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FailoverServer will
+// result in compilation errors.
+type UnsafeFailoverServer interface {
+	mustEmbedUnimplementedFailoverServer()
+}
+
+func RegisterFailoverServer(s grpc.ServiceRegistrar, srv FailoverServer) {
+	s.RegisterService(&Failover_ServiceDesc, srv)
+}
+
+func _Failover_FailoverHeartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FailoverHeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FailoverServer).FailoverHeartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Failover/FailoverHeartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FailoverServer).FailoverHeartbeat(ctx, req.(*FailoverHeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Failover_FailoverVote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FailoverVoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FailoverServer).FailoverVote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Failover/FailoverVote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FailoverServer).FailoverVote(ctx, req.(*FailoverVoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Failover_ServiceDesc is the grpc.ServiceDesc for Failover service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Failover_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "Failover",
+	HandlerType: (*FailoverServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "FailoverHeartbeat",
+			Handler:    _Failover_FailoverHeartbeat_Handler,
+		},
+		{
+			MethodName: "FailoverVote",
+			Handler:    _Failover_FailoverVote_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "natan.proto",
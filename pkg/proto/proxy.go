@@ -0,0 +1,561 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var proxyLog = log.New("proxy")
+
+const (
+	// DefaultProxyPoolSize is a default count of connections to each upstream server
+	DefaultProxyPoolSize = 4
+
+	// DefaultProxyHealthCheckInterval is a default interval between upstream health checks
+	DefaultProxyHealthCheckInterval = 2 * time.Second
+)
+
+// ProxyConfig defines proxy server parameters
+type ProxyConfig struct {
+	// Endpoint to listen
+	Endpoint string
+
+	// Endpoint of primary server (or a cluster node), writes are sent to it
+	Primary string
+
+	// Endpoints of replicas, reads are spread over healthy replicas (primary server is used if there are none)
+	Replicas []string
+
+	// Cluster map of a sharded cluster, used instead of Primary and Replicas
+	ClusterMap *ClusterMap
+
+	// Count of connections to each upstream server
+	PoolSize int
+
+	// Interval between upstream health checks
+	HealthCheckInterval time.Duration
+
+	// Endpoint of HTTP server that exposes "/metrics" and "/health" (disabled if not set)
+	MetricsEndpoint string
+}
+
+// Proxy is a server that accepts the same GRPC API as NatanDB server and sends requests to upstream servers
+// Many short-lived clients share a small pool of upstream connections
+// Reads are sent to replicas, writes are sent to primary server, or requests are routed by a cluster map
+type Proxy struct {
+	config    ProxyConfig
+	server    *grpc.Server
+	health    *health.Server
+	metrics   *proxyMetrics
+	mutex     sync.RWMutex
+	upstreams []*upstream
+	primary   *upstream
+	replicas  []*upstream
+	sharded   Client
+	next      uint32
+	listener  net.Listener
+	http      *http.Server
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// upstream is a server that proxy sends requests to
+type upstream struct {
+	client Client
+	mutex  sync.Mutex
+	status *UpstreamStatus
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.status.Healthy
+}
+
+func (u *upstream) getStatus() *UpstreamStatus {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return &UpstreamStatus{
+		Endpoint:     u.status.Endpoint,
+		Role:         u.status.Role,
+		Healthy:      u.status.Healthy,
+		LastChangeId: u.status.LastChangeId,
+		Error:        u.status.Error,
+	}
+}
+
+func (p *Proxy) mustEmbedUnimplementedServiceServer() {
+	panic("implement me")
+}
+
+// NewProxy creates new proxy server instance
+func NewProxy(config ProxyConfig) (*Proxy, error) {
+	if (config.Primary == "") == (config.ClusterMap == nil) {
+		return nil, fmt.Errorf("either primary server or cluster map must be specified")
+	}
+	if config.ClusterMap != nil && len(config.Replicas) > 0 {
+		return nil, fmt.Errorf("replicas can't be combined with a cluster map")
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = DefaultProxyPoolSize
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = DefaultProxyHealthCheckInterval
+	}
+
+	metrics := newProxyMetrics()
+	p := &Proxy{
+		config:  config,
+		health:  health.NewServer(),
+		metrics: metrics,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	p.server = grpc.NewServer(
+		grpc.UnaryInterceptor(metrics.unaryInterceptor),
+		grpc.StreamInterceptor(metrics.streamInterceptor),
+	)
+
+	err := p.connectAll()
+	if err != nil {
+		p.closeUpstreams()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// connectAll connects to every upstream server
+func (p *Proxy) connectAll() error {
+	if p.config.ClusterMap != nil {
+		// Shards that appear after rebalancing are connected on demand
+		sharded, err := newShardedClient(p.config.ClusterMap, func(endpoint string) (Client, error) {
+			u, err := p.connect(endpoint, "shard")
+			if err != nil {
+				return nil, err
+			}
+			return u.client, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		p.sharded = sharded
+		return nil
+	}
+
+	primary, err := p.connect(p.config.Primary, "primary")
+	if err != nil {
+		return err
+	}
+	p.primary = primary
+
+	for _, endpoint := range p.config.Replicas {
+		replica, err := p.connect(endpoint, "replica")
+		if err != nil {
+			return err
+		}
+		p.replicas = append(p.replicas, replica)
+	}
+
+	return nil
+}
+
+// connect creates a pool of connections to an upstream server
+// Upstream server is considered healthy until the first health check
+func (p *Proxy) connect(endpoint, role string) (*upstream, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, u := range p.upstreams {
+		if u.status.Endpoint == endpoint {
+			return u, nil
+		}
+	}
+
+	client, err := newPooledClient(endpoint, p.config.PoolSize, grpc.WithUnaryInterceptor(p.metrics.upstreamInterceptor(endpoint)))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &upstream{
+		client: client,
+		status: &UpstreamStatus{Endpoint: endpoint, Role: role, Healthy: true},
+	}
+	p.upstreams = append(p.upstreams, u)
+	return u, nil
+}
+
+// getUpstreams returns every upstream server
+func (p *Proxy) getUpstreams() []*upstream {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return append([]*upstream(nil), p.upstreams...)
+}
+
+// Start checks upstream servers and starts serving requests
+func (p *Proxy) Start() error {
+	proxyLog.Verbosef("starting proxy")
+	p.checkAll()
+
+	RegisterServiceServer(p.server, p)
+	grpc_health_v1.RegisterHealthServer(p.server, p.health)
+
+	listener, err := net.Listen("tcp", p.config.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	if p.config.MetricsEndpoint != "" {
+		metricsListener, err := net.Listen("tcp", p.config.MetricsEndpoint)
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", p.serveMetrics)
+		mux.HandleFunc("/health", p.serveHealth)
+		p.http = &http.Server{Handler: mux}
+		go func() {
+			_ = p.http.Serve(metricsListener)
+		}()
+		proxyLog.Printf("metrics are exposed at \"http://%s/metrics\"", p.config.MetricsEndpoint)
+	}
+
+	go func() {
+		_ = p.server.Serve(listener)
+	}()
+	go p.run()
+
+	proxyLog.Printf("proxy is running at \"tcp://%s\"", p.config.Endpoint)
+	p.listener = listener
+	return nil
+}
+
+// Endpoint returns an endpoint proxy is listening at
+func (p *Proxy) Endpoint() string {
+	if p.listener != nil {
+		return p.listener.Addr().String()
+	}
+	return p.config.Endpoint
+}
+
+// Close shuts proxy down
+func (p *Proxy) Close() error {
+	proxyLog.Verbosef("shutting down")
+	p.health.Shutdown()
+
+	close(p.stop)
+	if p.listener != nil {
+		<-p.done
+	}
+
+	p.server.GracefulStop()
+	if p.http != nil {
+		_ = p.http.Close()
+	}
+
+	// Sharded client shares connections of upstream servers, so it isn't closed separately
+	p.closeUpstreams()
+	proxyLog.Verbosef("shutdown completed")
+	return nil
+}
+
+func (p *Proxy) closeUpstreams() {
+	for _, u := range p.getUpstreams() {
+		_ = u.client.Close()
+	}
+}
+
+// run checks upstream servers periodically until proxy is closed
+func (p *Proxy) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkAll()
+		}
+	}
+}
+
+// checkAll requests health of every upstream server
+func (p *Proxy) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range p.getUpstreams() {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			p.check(u)
+		}(u)
+	}
+	wg.Wait()
+
+	if p.state() == HealthStatus_SERVING {
+		p.health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	} else {
+		p.health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+}
+
+// check requests health of an upstream server
+// Server is healthy if it responds in time and has completed its startup
+func (p *Proxy) check(u *upstream) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthCheckInterval)
+	defer cancel()
+
+	response, err := u.client.Health(ctx, &None{})
+	if err == nil && response.State != HealthStatus_SERVING {
+		err = fmt.Errorf("server is %s", response.State)
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if err != nil {
+		if u.status.Healthy {
+			proxyLog.Errorf("%s %s is unhealthy: %s", u.status.Role, u.status.Endpoint, err)
+		}
+		u.status.Healthy = false
+		u.status.Error = err.Error()
+		return
+	}
+
+	if !u.status.Healthy {
+		proxyLog.Printf("%s %s is healthy again", u.status.Role, u.status.Endpoint)
+	}
+	u.status.Healthy = true
+	u.status.Error = ""
+	u.status.LastChangeId = response.LastChangeId
+}
+
+// state returns SERVING if proxy can send writes to every server that accepts them
+func (p *Proxy) state() HealthStatus_State {
+	for _, u := range p.getUpstreams() {
+		if u.status.Role != "replica" && !u.isHealthy() {
+			return HealthStatus_DEGRADED
+		}
+	}
+
+	return HealthStatus_SERVING
+}
+
+// writer returns a client that receives writes
+func (p *Proxy) writer() Client {
+	if p.sharded != nil {
+		return p.sharded
+	}
+
+	return p.primary.client
+}
+
+// readers returns clients to send a read request to, in order of preference
+// Healthy replicas are tried first in round-robin order, then primary server
+func (p *Proxy) readers() []Client {
+	if p.sharded != nil {
+		return []Client{p.sharded}
+	}
+
+	n := len(p.replicas)
+	clients := make([]Client, 0, n+1)
+	start := int(atomic.AddUint32(&p.next, 1))
+	for i := 0; i < n; i++ {
+		replica := p.replicas[(start+i)%n]
+		if replica.isHealthy() {
+			clients = append(clients, replica.client)
+		}
+	}
+
+	return append(clients, p.primary.client)
+}
+
+// read sends a read request to the next server if a server is unavailable
+// A replica that hasn't caught up with request's MinVersion in time is unavailable as well
+func (p *Proxy) read(call func(client Client) error) error {
+	var err error
+	for _, client := range p.readers() {
+		err = call(client)
+		if status.Code(err) != codes.Unavailable {
+			return err
+		}
+		proxyLog.Verbosef("retrying read on the next server: %s", err)
+	}
+
+	return err
+}
+
+// List returns paged list of DB keys (with values)
+// Optionally list might be filtered by key prefix
+func (p *Proxy) List(ctx context.Context, request *ListRequest) (*PagedNodeList, error) {
+	var response *PagedNodeList
+	err := p.read(func(client Client) error {
+		var err error
+		response, err = client.List(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+// Version returns current data version
+func (p *Proxy) Version(ctx context.Context, request *None) (*DBVersion, error) {
+	var response *DBVersion
+	err := p.read(func(client Client) error {
+		var err error
+		response, err = client.Version(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+// Get gets a node value by its key
+// If specified node doesn't exist, a ErrNoSuchKey error is returned
+func (p *Proxy) Get(ctx context.Context, request *GetRequest) (*Node, error) {
+	var response *Node
+	err := p.read(func(client Client) error {
+		var err error
+		response, err = client.Get(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+// Set sets a node value, rewriting its value if node already exists
+// If specified node doesn't exists, it will be created
+func (p *Proxy) Set(ctx context.Context, request *SetRequest) (*Node, error) {
+	return p.writer().Set(ctx, request)
+}
+
+// Add defines an "append value" operation
+// If specified node doesn't exists, it will be created
+// A specified value will be added to node even if it already exists
+// If node already contains the same value and "unique" parameter is set to "true", a ErrDuplicateValue error is returned
+func (p *Proxy) Add(ctx context.Context, request *AddRequest) (*Node, error) {
+	return p.writer().Add(ctx, request)
+}
+
+// Remove defines an "remove value" operation
+// If specified node doesn't exist, a ErrNoSuchKey error is returned
+// If specified value doesn't exist within a node, a ErrNoSuchValue error is returned
+// If node contains specified value multiple times, all values are removed
+// (unless a "all" parameter is set to "false"
+func (p *Proxy) Remove(ctx context.Context, request *RemoveRequest) (*Node, error) {
+	return p.writer().Remove(ctx, request)
+}
+
+// Delete removes a key completely
+// If specified node doesn't exist, a ErrNoSuchKey error is returned
+func (p *Proxy) Delete(ctx context.Context, request *DeleteRequest) (*None, error) {
+	var header metadata.MD
+	response, err := p.writer().Delete(ctx, request, grpc.Header(&header))
+	if err != nil {
+		return nil, err
+	}
+
+	forwardChangeID(ctx, header)
+	return response, nil
+}
+
+// Backup streams a backup archive of primary server
+func (p *Proxy) Backup(request *BackupRequest, stream Service_BackupServer) error {
+	backup, err := p.writer().Backup(stream.Context(), request)
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := backup.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = stream.Send(chunk)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Health returns proxy state and state of every upstream server
+// Proxy is DEGRADED if it can't reach a server that accepts writes, unhealthy replicas are skipped
+func (p *Proxy) Health(ctx context.Context, request *None) (*HealthStatus, error) {
+	response := &HealthStatus{
+		State: p.state(),
+		Proxy: &ProxyStatus{},
+	}
+
+	for _, u := range p.getUpstreams() {
+		s := u.getStatus()
+		response.Proxy.Upstreams = append(response.Proxy.Upstreams, s)
+		if u == p.primary {
+			response.LastChangeId = s.LastChangeId
+		}
+	}
+
+	return response, nil
+}
+
+// Replicate isn't supported, replicas must connect to primary server directly
+func (p *Proxy) Replicate(stream Service_ReplicateServer) error {
+	return status.Error(codes.Unimplemented, "replicas must connect to primary server directly")
+}
+
+// UpdateClusterMap isn't supported, cluster map must be sent to shards directly
+func (p *Proxy) UpdateClusterMap(ctx context.Context, request *ClusterMapUpdate) (*ClusterMapUpdateResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "cluster map must be sent to shards directly")
+}
+
+// Import isn't supported, nodes must be imported into a shard directly
+func (p *Proxy) Import(ctx context.Context, request *ImportRequest) (*None, error) {
+	return nil, status.Error(codes.Unimplemented, "nodes must be imported into a shard directly")
+}
+
+// DropForeignKeys isn't supported, request must be sent to a shard directly
+func (p *Proxy) DropForeignKeys(ctx context.Context, request *None) (*DroppedKeys, error) {
+	return nil, status.Error(codes.Unimplemented, "keys of other shards must be dropped by a shard directly")
+}
+
+// serveMetrics writes proxy metrics in Prometheus text format
+func (p *Proxy) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	upstreams := make([]*UpstreamStatus, 0)
+	for _, u := range p.getUpstreams() {
+		upstreams = append(upstreams, u.getStatus())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.metrics.write(w, upstreams)
+}
+
+// serveHealth responds with 200 if proxy is SERVING and with 503 otherwise
+func (p *Proxy) serveHealth(w http.ResponseWriter, r *http.Request) {
+	state := p.state()
+	if state != HealthStatus_SERVING {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = fmt.Fprintln(w, state)
+}
@@ -0,0 +1,153 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// proxyMetrics collects request statistics of a proxy server
+type proxyMetrics struct {
+	mutex    sync.Mutex
+	requests map[requestKey]*requestStats
+	upstream map[requestKey]*requestStats
+	inflight int64
+}
+
+// requestKey is a set of metric labels, Endpoint is set for upstream requests only
+type requestKey struct {
+	Endpoint string
+	Method   string
+	Code     string
+}
+
+type requestStats struct {
+	count   uint64
+	seconds float64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests: make(map[requestKey]*requestStats),
+		upstream: make(map[requestKey]*requestStats),
+	}
+}
+
+func (m *proxyMetrics) observe(stats map[requestKey]*requestStats, key requestKey, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := stats[key]
+	if !ok {
+		s = &requestStats{}
+		stats[key] = s
+	}
+	s.count++
+	s.seconds += duration.Seconds()
+}
+
+// unaryInterceptor is a GRPC interceptor that measures requests served by proxy
+func (m *proxyMetrics) unaryInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	atomic.AddInt64(&m.inflight, 1)
+	defer atomic.AddInt64(&m.inflight, -1)
+
+	started := time.Now()
+	response, err := handler(ctx, request)
+	m.observe(m.requests, requestKey{Method: info.FullMethod, Code: status.Code(err).String()}, time.Since(started))
+	return response, err
+}
+
+// streamInterceptor is a GRPC interceptor that measures streaming requests served by proxy
+func (m *proxyMetrics) streamInterceptor(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	atomic.AddInt64(&m.inflight, 1)
+	defer atomic.AddInt64(&m.inflight, -1)
+
+	started := time.Now()
+	err := handler(server, stream)
+	m.observe(m.requests, requestKey{Method: info.FullMethod, Code: status.Code(err).String()}, time.Since(started))
+	return err
+}
+
+// upstreamInterceptor returns a GRPC client interceptor that measures requests sent to an upstream server
+func (m *proxyMetrics) upstreamInterceptor(endpoint string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, request, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		started := time.Now()
+		err := invoker(ctx, method, request, reply, cc, opts...)
+		m.observe(m.upstream, requestKey{Endpoint: endpoint, Method: method, Code: status.Code(err).String()}, time.Since(started))
+		return err
+	}
+}
+
+// write writes metrics in Prometheus text format
+func (m *proxyMetrics) write(w io.Writer, upstreams []*UpstreamStatus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP natandb_proxy_inflight_requests Count of requests that are being served\n")
+	fmt.Fprintf(w, "# TYPE natandb_proxy_inflight_requests gauge\n")
+	fmt.Fprintf(w, "natandb_proxy_inflight_requests %d\n", atomic.LoadInt64(&m.inflight))
+
+	writeRequestStats(w, "natandb_proxy", "requests served by proxy", m.requests)
+	writeRequestStats(w, "natandb_proxy_upstream", "requests sent to upstream servers", m.upstream)
+
+	fmt.Fprintf(w, "# HELP natandb_proxy_upstream_up Whether upstream server has responded to the last health check\n")
+	fmt.Fprintf(w, "# TYPE natandb_proxy_upstream_up gauge\n")
+	for _, u := range upstreams {
+		up := 0
+		if u.Healthy {
+			up = 1
+		}
+		fmt.Fprintf(w, "natandb_proxy_upstream_up{upstream=%q,role=%q} %d\n", u.Endpoint, u.Role, up)
+	}
+
+	fmt.Fprintf(w, "# HELP natandb_proxy_upstream_last_change_id ID of the last change committed by upstream server\n")
+	fmt.Fprintf(w, "# TYPE natandb_proxy_upstream_last_change_id gauge\n")
+	for _, u := range upstreams {
+		fmt.Fprintf(w, "natandb_proxy_upstream_last_change_id{upstream=%q,role=%q} %d\n", u.Endpoint, u.Role, u.LastChangeId)
+	}
+}
+
+// writeRequestStats writes a request counter and a request duration summary with specified name prefix
+func writeRequestStats(w io.Writer, prefix, help string, stats map[requestKey]*requestStats) {
+	keys := make([]requestKey, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Endpoint != keys[j].Endpoint {
+			return keys[i].Endpoint < keys[j].Endpoint
+		}
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Code < keys[j].Code
+	})
+
+	fmt.Fprintf(w, "# HELP %s_requests_total Count of %s\n", prefix, help)
+	fmt.Fprintf(w, "# TYPE %s_requests_total counter\n", prefix)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s_requests_total{%s} %d\n", prefix, key.labels(), stats[key].count)
+	}
+
+	fmt.Fprintf(w, "# HELP %s_request_duration_seconds Time spent on %s\n", prefix, help)
+	fmt.Fprintf(w, "# TYPE %s_request_duration_seconds summary\n", prefix)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s_request_duration_seconds_sum{%s} %g\n", prefix, key.labels(), stats[key].seconds)
+		fmt.Fprintf(w, "%s_request_duration_seconds_count{%s} %d\n", prefix, key.labels(), stats[key].count)
+	}
+}
+
+func (k requestKey) labels() string {
+	labels := fmt.Sprintf("method=%q,code=%q", k.Method, k.Code)
+	if k.Endpoint != "" {
+		labels = fmt.Sprintf("upstream=%q,%s", k.Endpoint, labels)
+	}
+	return labels
+}
@@ -0,0 +1,202 @@
+package proto_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/proto"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProxy(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	primary := startServer(t).endpoint
+	deadReplica := freeEndpoint(t)
+
+	proxy, err := proto.NewProxy(proto.ProxyConfig{
+		Endpoint: freeEndpoint(t),
+		Primary:  primary,
+		Replicas: []string{deadReplica},
+		PoolSize: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proxy.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proxy.Close() }()
+
+	ctx := context.Background()
+	_, err = proxy.Set(ctx, &proto.SetRequest{Key: "key", Values: [][]byte{[]byte("value")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unhealthy replica is skipped
+	node, err := proxy.Get(ctx, &proto.GetRequest{Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Values) != 1 || string(node.Values[0]) != "value" {
+		t.Errorf("ERROR: \"key\" has values %q", node.Values)
+	}
+
+	health, err := proxy.Health(ctx, &proto.None{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if health.State != proto.HealthStatus_SERVING {
+		t.Errorf("ERROR: proxy is %s", health.State)
+	}
+	for _, upstream := range health.Proxy.Upstreams {
+		if upstream.Healthy != (upstream.Endpoint == primary) {
+			t.Errorf("ERROR: %s %s has healthy=%v", upstream.Role, upstream.Endpoint, upstream.Healthy)
+		}
+	}
+
+	err = proxy.Replicate(nil)
+	if err == nil {
+		t.Errorf("ERROR: replication has been accepted by proxy")
+	}
+}
+
+func TestProxyReadYourWrites(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	primary := startServer(t).endpoint
+	replica := startServer(t, db.ReplicaOption())
+
+	proxy, err := proto.NewProxy(proto.ProxyConfig{
+		Endpoint: freeEndpoint(t),
+		Primary:  primary,
+		Replicas: []string{replica.endpoint},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proxy.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = proxy.Close() }()
+
+	client, err := proto.NewClient(proxy.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	r, err := proto.NewReplica(replica.engine, primary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+
+	ctx := context.Background()
+	_, err = client.Set(ctx, &proto.SetRequest{Key: "key", Values: [][]byte{[]byte("value")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replica starts replication after a write, so a read waits until it catches up
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		r.Start()
+	}()
+	_, err = client.Get(ctx, &proto.GetRequest{Key: "key"})
+	if err != nil {
+		t.Errorf("ERROR: unable to read \"key\" after write: %s", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, err = client.Set(ctx, &proto.SetRequest{Key: key, Values: [][]byte{[]byte("value")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Get(ctx, &proto.GetRequest{Key: key})
+		if err != nil {
+			t.Errorf("ERROR: unable to read \"%s\" after write: %s", key, err)
+		}
+
+		_, err = client.Delete(ctx, &proto.DeleteRequest{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Get(ctx, &proto.GetRequest{Key: key})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("ERROR: \"%s\" is read after delete (%v)", key, err)
+		}
+	}
+
+	// Replica that doesn't catch up in time rejects a read with a retryable error
+	_, err = proto.NewServiceClient(dial(t, replica.endpoint)).Get(ctx, &proto.GetRequest{Key: "key", MinVersion: 1 << 40})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("ERROR: expected UNAVAILABLE but got %v", err)
+	}
+}
+
+type testServer struct {
+	endpoint string
+	engine   db.Engine
+}
+
+func startServer(t *testing.T, options ...db.Option) *testServer {
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(append([]db.Option{db.StorageDriverOption(driver)}, options...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = engine.Close() })
+
+	endpoint := freeEndpoint(t)
+	server := proto.NewServer(engine, endpoint)
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	return &testServer{endpoint: endpoint, engine: engine}
+}
+
+func dial(t *testing.T, endpoint string) *grpc.ClientConn {
+	connection, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = connection.Close() })
+
+	return connection
+}
+
+func freeEndpoint(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	return listener.Addr().String()
+}
@@ -0,0 +1,390 @@
+package proto
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kapitanov/natandb/pkg/backup"
+	"github.com/kapitanov/natandb/pkg/raft"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// forwardedHeader marks a request that has been forwarded to leader, such request is never forwarded again
+const forwardedHeader = "x-natandb-forwarded"
+
+// forwardedMethods are write methods that cluster followers forward to leader, with factories of their replies
+var forwardedMethods = map[string]func() interface{}{
+	"/Service/Set":    func() interface{} { return &Node{} },
+	"/Service/Add":    func() interface{} { return &Node{} },
+	"/Service/Remove": func() interface{} { return &Node{} },
+	"/Service/Delete": func() interface{} { return &None{} },
+}
+
+// connectionPool keeps a single connection to each cluster node
+type connectionPool struct {
+	mutex       sync.Mutex
+	connections map[string]*grpc.ClientConn
+}
+
+func newConnectionPool() *connectionPool {
+	return &connectionPool{connections: make(map[string]*grpc.ClientConn)}
+}
+
+// get returns a connection to specified node, connection is established lazily
+func (p *connectionPool) get(endpoint string) (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if connection, ok := p.connections[endpoint]; ok {
+		return connection, nil
+	}
+
+	connection, err := grpc.Dial(endpoint, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
+	p.connections[endpoint] = connection
+	return connection, nil
+}
+
+// Close closes every connection
+func (p *connectionPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for endpoint, connection := range p.connections {
+		_ = connection.Close()
+		delete(p.connections, endpoint)
+	}
+	return nil
+}
+
+// RaftTransport sends requests of a cluster node to other nodes via GRPC
+type RaftTransport struct {
+	pool *connectionPool
+}
+
+// NewRaftTransport creates a GRPC transport for cluster nodes
+func NewRaftTransport() *RaftTransport {
+	return &RaftTransport{pool: newConnectionPool()}
+}
+
+// Close closes connections to other nodes
+func (t *RaftTransport) Close() error {
+	return t.pool.Close()
+}
+
+// RequestVote asks a node for its vote
+func (t *RaftTransport) RequestVote(ctx context.Context, peer string, request *raft.VoteRequest) (*raft.VoteResponse, error) {
+	client, err := t.client(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.RequestVote(ctx, &VoteRequest{
+		Term:      request.Term,
+		Candidate: request.Candidate,
+		LastIndex: request.LastIndex,
+		LastTerm:  request.LastTerm,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &raft.VoteResponse{Term: response.Term, Granted: response.Granted}, nil
+}
+
+// AppendEntries replicates transactions to a node
+func (t *RaftTransport) AppendEntries(ctx context.Context, peer string, request *raft.AppendRequest) (*raft.AppendResponse, error) {
+	client, err := t.client(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := make([]*Transaction, len(request.Transactions))
+	for i, records := range request.Transactions {
+		transactions[i] = &Transaction{Records: serverMapRecords(records)}
+	}
+
+	response, err := client.AppendEntries(ctx, &AppendEntriesRequest{
+		Term:         request.Term,
+		Leader:       request.Leader,
+		PrevIndex:    request.PrevIndex,
+		PrevTerm:     request.PrevTerm,
+		Transactions: transactions,
+		CommitIndex:  request.CommitIndex,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mapAppendResponse(response), nil
+}
+
+// InstallSnapshot replaces node's data with a snapshot
+// Snapshot is streamed as a full backup archive
+func (t *RaftTransport) InstallSnapshot(ctx context.Context, peer string, request *raft.SnapshotRequest) (*raft.AppendResponse, error) {
+	client, err := t.client(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := client.InstallSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(&SnapshotChunk{Header: &SnapshotHeader{
+		Term:      request.Term,
+		Leader:    request.Leader,
+		LastIndex: request.LastIndex,
+		LastTerm:  request.LastTerm,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriterSize(&snapshotStreamWriter{stream: stream}, backupChunkSize)
+	_, err = backup.WriteFull(writer, request.Root, request.LastIndex)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := stream.CloseAndRecv()
+	if err != nil {
+		return nil, err
+	}
+
+	return mapAppendResponse(response), nil
+}
+
+func (t *RaftTransport) client(peer string) (RaftClient, error) {
+	connection, err := t.pool.get(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRaftClient(connection), nil
+}
+
+// SetCluster makes server act as a cluster node
+// Server serves requests of other nodes and forwards writes to leader
+func (s *serverImpl) SetCluster(node *raft.Node) {
+	s.mutex.Lock()
+	s.cluster = node
+	s.mutex.Unlock()
+}
+
+// getCluster returns a cluster node or an error if server isn't a cluster node
+func (s *serverImpl) getCluster() (*raft.Node, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.cluster == nil {
+		return nil, status.Error(codes.Unavailable, "server is not a cluster node")
+	}
+	return s.cluster, nil
+}
+
+// RequestVote asks a node for its vote
+func (s *serverImpl) RequestVote(ctx context.Context, request *VoteRequest) (*VoteResponse, error) {
+	node, err := s.getCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := node.RequestVote(&raft.VoteRequest{
+		Term:      request.Term,
+		Candidate: request.Candidate,
+		LastIndex: request.LastIndex,
+		LastTerm:  request.LastTerm,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &VoteResponse{Term: response.Term, Granted: response.Granted}, nil
+}
+
+// AppendEntries replicates transactions to a node, it's used as a heartbeat too
+func (s *serverImpl) AppendEntries(ctx context.Context, request *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	node, err := s.getCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := make([][]*storage.WALRecord, len(request.Transactions))
+	for i, transaction := range request.Transactions {
+		if len(transaction.Records) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "transaction has no records")
+		}
+		transactions[i] = mapRecords(transaction.Records)
+	}
+
+	response, err := node.AppendEntries(&raft.AppendRequest{
+		Term:         request.Term,
+		Leader:       request.Leader,
+		PrevIndex:    request.PrevIndex,
+		PrevTerm:     request.PrevTerm,
+		Transactions: transactions,
+		CommitIndex:  request.CommitIndex,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return serverMapAppendResponse(response), nil
+}
+
+// InstallSnapshot replaces node's data with a snapshot of leader's data
+// The first chunk contains a header only, subsequent chunks contain a full backup archive
+func (s *serverImpl) InstallSnapshot(stream Raft_InstallSnapshotServer) error {
+	node, err := s.getCluster()
+	if err != nil {
+		return err
+	}
+
+	chunk, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := chunk.Header
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "snapshot header is missing")
+	}
+
+	b, err := backup.Read(&snapshotStreamReader{stream: stream})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if b.Manifest.Kind != backup.KindFull || b.Manifest.ChangeID != header.LastIndex {
+		return status.Error(codes.InvalidArgument, fmt.Sprintf("snapshot doesn't match its header: %s", b.Manifest))
+	}
+
+	response, err := node.InstallSnapshot(&raft.SnapshotRequest{
+		Term:      header.Term,
+		Leader:    header.Leader,
+		LastIndex: header.LastIndex,
+		LastTerm:  header.LastTerm,
+		Root:      b.Snapshot,
+	})
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return stream.SendAndClose(serverMapAppendResponse(response))
+}
+
+// forwardWrites is a GRPC interceptor that forwards writes received by a cluster follower to leader
+// If cluster has no leader at the moment, an Unavailable error is returned
+func (s *serverImpl) forwardWrites(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	newReply, ok := forwardedMethods[info.FullMethod]
+	if !ok {
+		return handler(ctx, request)
+	}
+
+	s.mutex.RLock()
+	node := s.cluster
+	s.mutex.RUnlock()
+	if node == nil || node.IsLeader() {
+		return handler(ctx, request)
+	}
+
+	// Leader might have changed while request has been forwarded
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedHeader)) > 0 {
+		return nil, status.Error(codes.Unavailable, raft.ErrNotLeader.Error())
+	}
+
+	leader, err := node.Leader()
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	connection, err := s.forwarding.get(leader)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	serverLog.Verbosef("forwarding %s to leader %s", info.FullMethod, leader)
+	reply := newReply()
+	var header metadata.MD
+	err = connection.Invoke(metadata.AppendToOutgoingContext(ctx, forwardedHeader, s.endpoint), info.FullMethod, request, reply, grpc.Header(&header))
+	if err != nil {
+		return nil, err
+	}
+
+	forwardChangeID(ctx, header)
+	return reply, nil
+}
+
+// snapshotStreamWriter sends written data as a stream of snapshot chunks
+type snapshotStreamWriter struct {
+	stream Raft_InstallSnapshotClient
+}
+
+func (w *snapshotStreamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		length := len(p) - n
+		if length > backupChunkSize {
+			length = backupChunkSize
+		}
+
+		err := w.stream.Send(&SnapshotChunk{Data: p[n : n+length]})
+		if err != nil {
+			return n, err
+		}
+
+		n += length
+	}
+
+	return n, nil
+}
+
+// snapshotStreamReader reads data of a stream of snapshot chunks
+type snapshotStreamReader struct {
+	stream Raft_InstallSnapshotServer
+	buffer []byte
+}
+
+func (r *snapshotStreamReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buffer = chunk.Data
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+func mapAppendResponse(response *AppendEntriesResponse) *raft.AppendResponse {
+	return &raft.AppendResponse{
+		Term:      response.Term,
+		Success:   response.Success,
+		LastIndex: response.LastIndex,
+		LastTerm:  response.LastTerm,
+	}
+}
+
+func serverMapAppendResponse(response *raft.AppendResponse) *AppendEntriesResponse {
+	return &AppendEntriesResponse{
+		Term:      response.Term,
+		Success:   response.Success,
+		LastIndex: response.LastIndex,
+		LastTerm:  response.LastTerm,
+	}
+}
@@ -0,0 +1,508 @@
+package proto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/backup"
+	"github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+var shardLog = log.New("shard")
+
+// importBatchSize is a max count of nodes that are imported into target shard within a single request
+const importBatchSize = 100
+
+// RangeMove is a range of keys that moves to another shard, either Hashes or Keys must be set
+type RangeMove struct {
+	// Name of a shard that receives keys
+	Target string
+
+	// Range of key hashes to move
+	Hashes *HashRange
+
+	// Range of keys to move
+	Keys *KeyRange
+}
+
+func (m RangeMove) String() string {
+	if m.Hashes != nil {
+		return fmt.Sprintf("hashes [%d, %d] to shard \"%s\"", m.Hashes.From, m.Hashes.To, m.Target)
+	}
+	if m.Keys != nil {
+		return fmt.Sprintf("keys [\"%s\", \"%s\") to shard \"%s\"", m.Keys.From, m.Keys.To, m.Target)
+	}
+	return fmt.Sprintf("nothing to shard \"%s\"", m.Target)
+}
+
+// subtract returns parts of a hash range that don't belong to another one
+func (r HashRange) subtract(other HashRange) []HashRange {
+	if other.To < r.From || r.To < other.From {
+		return []HashRange{r}
+	}
+
+	result := make([]HashRange, 0, 2)
+	if r.From < other.From {
+		result = append(result, HashRange{From: r.From, To: other.From - 1})
+	}
+	if other.To < r.To {
+		result = append(result, HashRange{From: other.To + 1, To: r.To})
+	}
+	return result
+}
+
+// subtract returns parts of a key range that don't belong to another one
+func (r KeyRange) subtract(other KeyRange) []KeyRange {
+	if !r.overlaps(other) {
+		return []KeyRange{r}
+	}
+
+	result := make([]KeyRange, 0, 2)
+	if r.From < other.From {
+		result = append(result, KeyRange{From: r.From, To: other.From})
+	}
+	if other.To != "" && (r.To == "" || other.To < r.To) {
+		result = append(result, KeyRange{From: other.To, To: r.To})
+	}
+	return result
+}
+
+// Move returns a next version of cluster map where specified range belongs to target shard
+func (m *ClusterMap) Move(move RangeMove) (*ClusterMap, error) {
+	if (move.Hashes == nil) == (move.Keys == nil) {
+		return nil, fmt.Errorf("either a hash range or a key range must be moved")
+	}
+	if !m.Has(move.Target) {
+		return nil, fmt.Errorf("cluster map has no shard \"%s\"", move.Target)
+	}
+
+	next := &ClusterMap{
+		Version: m.Version + 1,
+		Shards:  make([]*Shard, len(m.Shards)),
+	}
+	for i, shard := range m.Shards {
+		s := &Shard{
+			Name:     shard.Name,
+			Endpoint: shard.Endpoint,
+			Hashes:   make([]HashRange, 0, len(shard.Hashes)),
+			Keys:     make([]KeyRange, 0, len(shard.Keys)),
+		}
+
+		for _, r := range shard.Hashes {
+			if move.Hashes != nil {
+				s.Hashes = append(s.Hashes, r.subtract(*move.Hashes)...)
+			} else {
+				s.Hashes = append(s.Hashes, r)
+			}
+		}
+		for _, r := range shard.Keys {
+			if move.Keys != nil {
+				s.Keys = append(s.Keys, r.subtract(*move.Keys)...)
+			} else {
+				s.Keys = append(s.Keys, r)
+			}
+		}
+
+		if s.Name == move.Target {
+			if move.Hashes != nil {
+				s.Hashes = append(s.Hashes, *move.Hashes)
+			} else {
+				s.Keys = append(s.Keys, *move.Keys)
+			}
+		}
+		next.Shards[i] = s
+	}
+
+	err := next.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// sources returns shards that might lose keys when specified range moves
+// A moving hash range is owned by shards whose hash ranges overlap with it,
+// while keys of a moving key range might belong to any shard
+func (m *ClusterMap) sources(move RangeMove) []*Shard {
+	result := make([]*Shard, 0)
+	for _, shard := range m.Shards {
+		if shard.Name == move.Target {
+			continue
+		}
+
+		isSource := move.Keys != nil
+		for _, r := range shard.Hashes {
+			isSource = isSource || (r.From <= move.Hashes.To && move.Hashes.From <= r.To)
+		}
+		if isSource {
+			result = append(result, shard)
+		}
+	}
+
+	return result
+}
+
+// MoveRange moves a range of keys to another shard while shards keep serving requests
+// It returns a next version of cluster map which has been applied to every shard
+//
+// Every shard receives current cluster map first, then target shard drops keys it doesn't own
+// (they might be left by an interrupted move). Moving keys are copied from a full backup of each source shard,
+// then changes committed after backup are streamed from source shards and applied to target shard.
+// Meanwhile, source shards receive the next cluster map and stop serving moving keys.
+// Since a shard applies new map only after writes accepted under previous map are committed,
+// map version fences such writes: target applies changes up to the fence, then receives the next map too.
+// Finally, source shards drop keys they don't own anymore.
+// Clients that send requests for moving keys while target is catching up receive an UNAVAILABLE error.
+// If copy fails once source shards have received the next map, moving range is given back to them (see rollbackMove),
+// restored cluster map is returned along with an error then
+func MoveRange(ctx context.Context, m *ClusterMap, move RangeMove) (*ClusterMap, error) {
+	next, err := m.Move(move)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make(map[string]Client)
+	defer func() {
+		for _, client := range clients {
+			_ = client.Close()
+		}
+	}()
+	for _, shard := range m.Shards {
+		client, err := NewClient(shard.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		clients[shard.Name] = client
+	}
+
+	shardLog.Printf("moving %s, cluster map v%d -> v%d", move, m.Version, next.Version)
+	for _, shard := range m.Shards {
+		_, err = updateClusterMap(ctx, clients[shard.Name], m, shard.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply cluster map v%d to shard \"%s\": %s", m.Version, shard.Name, err)
+		}
+	}
+
+	target := clients[move.Target]
+	dropped, err := target.DropForeignKeys(ctx, &None{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to clean up shard \"%s\": %s", move.Target, err)
+	}
+	if dropped.Count > 0 {
+		shardLog.Printf("%d key(s) of other shards have been dropped from shard \"%s\"", dropped.Count, move.Target)
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	copies := make([]*rangeCopy, 0)
+	for _, shard := range m.sources(move) {
+		source := shard.Name
+		c := &rangeCopy{
+			source: source,
+			client: clients[source],
+			target: target,
+			moves: func(key string) bool {
+				from, err := m.Lookup(key)
+				if err != nil || from.Name != source {
+					return false
+				}
+				to, err := next.Lookup(key)
+				return err == nil && to.Name == move.Target
+			},
+			done: make(chan struct{}),
+		}
+
+		err = c.copySnapshot(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to copy keys of shard \"%s\": %s", shard.Name, err)
+		}
+
+		copies = append(copies, c)
+		go c.stream(streamCtx)
+	}
+
+	// Source shards stop accepting writes for moving keys
+	for _, c := range copies {
+		response, err := updateClusterMap(ctx, c.client, next, c.source)
+		if err != nil {
+			cancel()
+			err = fmt.Errorf("unable to apply cluster map v%d to shard \"%s\": %s", next.Version, c.source, err)
+			return rollbackMove(clients, m, next, move, err)
+		}
+		c.setFence(response.LastChangeId)
+	}
+
+	for _, c := range copies {
+		err = c.wait(ctx)
+		if err != nil {
+			cancel()
+			err = fmt.Errorf("unable to stream changes of shard \"%s\": %s", c.source, err)
+			return rollbackMove(clients, m, next, move, err)
+		}
+	}
+
+	for _, shard := range next.Shards {
+		_, err = updateClusterMap(ctx, clients[shard.Name], next, shard.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to apply cluster map v%d to shard \"%s\": %s", next.Version, shard.Name, err)
+		}
+	}
+
+	for _, c := range copies {
+		dropped, err := c.client.DropForeignKeys(ctx, &None{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to drop moved keys from shard \"%s\": %s", c.source, err)
+		}
+		shardLog.Printf("%d key(s) have been moved from shard \"%s\"", dropped.Count, c.source)
+	}
+
+	shardLog.Printf("%s has been moved, cluster map is at v%d", move, next.Version)
+	return next, nil
+}
+
+// rollbackTimeout is a max duration of giving a moving range back to source shards
+const rollbackTimeout = 30 * time.Second
+
+// rollbackMove gives a moving range back to source shards once some of them have stopped serving it,
+// but target shard hasn't started yet, so none of shards has accepted writes for moving keys since then.
+// Shards never go back to an older map, so previous ranges are restored with a next map version,
+// which is returned along with an error unless it hasn't been applied to every shard.
+// Keys that have been copied into target shard are dropped by a next move
+func rollbackMove(clients map[string]Client, m, next *ClusterMap, move RangeMove, cause error) (*ClusterMap, error) {
+	// Move might be interrupted, so map is restored regardless of caller's context
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	restored := &ClusterMap{
+		Version: next.Version + 1,
+		Shards:  make([]*Shard, len(m.Shards)),
+	}
+	for i, shard := range m.Shards {
+		s := *shard
+		restored.Shards[i] = &s
+	}
+
+	for _, shard := range restored.Shards {
+		_, err := updateClusterMap(ctx, clients[shard.Name], restored, shard.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s (cluster map v%d has been applied to source shards already, "+
+				"and cluster map v%d that restores previous ranges can't be applied to shard \"%s\": %s)",
+				cause, next.Version, restored.Version, shard.Name, err)
+		}
+	}
+
+	shardLog.Printf("%s has been rolled back, cluster map is at v%d", move, restored.Version)
+	return restored, fmt.Errorf("%s (previous ranges have been restored with cluster map v%d)", cause, restored.Version)
+}
+
+// ApplyClusterMap sends cluster map to every shard
+func ApplyClusterMap(ctx context.Context, m *ClusterMap) error {
+	for _, shard := range m.Shards {
+		client, err := NewClient(shard.Endpoint)
+		if err != nil {
+			return err
+		}
+
+		_, err = updateClusterMap(ctx, client, m, shard.Name)
+		_ = client.Close()
+		if err != nil {
+			return fmt.Errorf("unable to apply cluster map v%d to shard \"%s\": %s", m.Version, shard.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func updateClusterMap(ctx context.Context, client Client, m *ClusterMap, shard string) (*ClusterMapUpdateResponse, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.UpdateClusterMap(ctx, &ClusterMapUpdate{ClusterMap: data, Shard: shard})
+}
+
+// rangeCopy copies moving keys of a single source shard into target shard
+type rangeCopy struct {
+	source   string
+	client   Client
+	target   Client
+	moves    func(key string) bool
+	mutex    sync.Mutex
+	changeID uint64
+	fence    uint64
+	isFenced bool
+	err      error
+	done     chan struct{}
+}
+
+// copySnapshot copies moving keys from a full backup of source shard
+func (c *rangeCopy) copySnapshot(ctx context.Context) error {
+	stream, err := c.client.Backup(ctx, &BackupRequest{})
+	if err != nil {
+		return err
+	}
+
+	b, err := backup.Read(&backupStreamReader{stream: stream})
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]*Node, 0, importBatchSize)
+	count := 0
+	for _, key := range b.Snapshot.Keys() {
+		node := b.Snapshot.GetNode(key)
+		if !c.moves(key) || len(node.Values) == 0 {
+			continue
+		}
+
+		values := make([][]byte, len(node.Values))
+		for i := range node.Values {
+			values[i] = node.Values[i]
+		}
+		nodes = append(nodes, &Node{Key: key, Values: values})
+		if len(nodes) == importBatchSize {
+			_, err = c.target.Import(ctx, &ImportRequest{Nodes: nodes})
+			if err != nil {
+				return err
+			}
+			count += len(nodes)
+			nodes = nodes[:0]
+		}
+	}
+
+	if len(nodes) > 0 {
+		_, err = c.target.Import(ctx, &ImportRequest{Nodes: nodes})
+		if err != nil {
+			return err
+		}
+		count += len(nodes)
+	}
+
+	c.changeID = b.Manifest.ChangeID
+	shardLog.Printf("%d key(s) have been copied from shard \"%s\" up to change #%d", count, c.source, c.changeID)
+	return nil
+}
+
+// stream applies changes of moving keys that source shard commits after its backup, until fence is reached
+func (c *rangeCopy) stream(ctx context.Context) {
+	defer close(c.done)
+
+	err := c.replicate(ctx)
+	c.mutex.Lock()
+	c.err = err
+	c.mutex.Unlock()
+}
+
+func (c *rangeCopy) replicate(ctx context.Context) error {
+	stream, err := c.client.Replicate(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = stream.Send(&ReplicateRequest{SinceChangeId: c.changeID})
+	if err != nil {
+		return err
+	}
+
+	for {
+		if c.isDone() {
+			return nil
+		}
+
+		message, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("source shard has closed replication stream")
+			}
+			return err
+		}
+		if len(message.Records) == 0 {
+			continue
+		}
+
+		records := make([]*WALRecord, 0)
+		for _, record := range message.Records {
+			isChange := record.Type == uint32(storage.WALAddValue) ||
+				record.Type == uint32(storage.WALRemoveValue) ||
+				record.Type == uint32(storage.WALRemoveKey)
+			if isChange && c.moves(record.Key) {
+				records = append(records, record)
+			}
+		}
+
+		// Transaction is applied as a whole, so target never contains a part of it
+		if len(records) > 0 {
+			_, err = c.target.Import(ctx, &ImportRequest{Records: records})
+			if err != nil {
+				return err
+			}
+		}
+
+		c.mutex.Lock()
+		c.changeID = message.Records[len(message.Records)-1].Id
+		c.mutex.Unlock()
+
+		err = stream.Send(&ReplicateRequest{AckedChangeId: c.changeID})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// setFence sets ID of the last change source shard has committed under previous cluster map
+func (c *rangeCopy) setFence(changeID uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.fence = changeID
+	c.isFenced = true
+}
+
+// isDone returns true if every change up to the fence has been applied
+func (c *rangeCopy) isDone() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.isFenced && c.changeID >= c.fence
+}
+
+// wait waits until every change up to the fence has been applied
+func (c *rangeCopy) wait(ctx context.Context) error {
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err
+}
+
+// backupStreamReader reads data of a backup stream
+type backupStreamReader struct {
+	stream Service_BackupClient
+	buffer []byte
+}
+
+func (r *backupStreamReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buffer = chunk.Data
+	}
+
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
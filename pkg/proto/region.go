@@ -0,0 +1,214 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/region"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var regionLog = log.New("region")
+
+// Region replicates changes between a region engine and its peer regions (see region.Engine)
+// It streams transactions committed by every peer and applies them to region engine
+// Every region must replicate from every other one
+type Region struct {
+	engine *region.Engine
+	peers  []*regionPeer
+}
+
+// regionPeer replicates changes from a single peer region
+type regionPeer struct {
+	engine   *region.Engine
+	endpoint string
+	client   Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mutex    sync.Mutex
+	status   *RegionPeerStatus
+}
+
+// NewRegion creates a replication between a region engine and servers of peer regions
+func NewRegion(engine *region.Engine, peers []string) (*Region, error) {
+	r := &Region{engine: engine}
+	for _, endpoint := range peers {
+		client, err := NewClient(endpoint)
+		if err != nil {
+			for _, peer := range r.peers {
+				_ = peer.client.Close()
+			}
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.peers = append(r.peers, &regionPeer{
+			engine:   engine,
+			endpoint: endpoint,
+			client:   client,
+			ctx:      ctx,
+			cancel:   cancel,
+			done:     make(chan struct{}),
+			status:   &RegionPeerStatus{Endpoint: endpoint},
+		})
+	}
+
+	return r, nil
+}
+
+// Start starts replication in background
+// Region keeps reconnecting to its peers until Close() is called
+func (r *Region) Start() {
+	for _, peer := range r.peers {
+		go peer.run()
+	}
+}
+
+// Status returns replication state
+func (r *Region) Status() *RegionStatus {
+	response := &RegionStatus{
+		Origin:   r.engine.Origin(),
+		Strategy: string(r.engine.Strategy()),
+		Peers:    make([]*RegionPeerStatus, len(r.peers)),
+	}
+
+	for i, peer := range r.peers {
+		peer.mutex.Lock()
+		response.Peers[i] = &RegionPeerStatus{
+			Endpoint:        peer.status.Endpoint,
+			Origin:          peer.status.Origin,
+			Connected:       peer.status.Connected,
+			AppliedChangeId: peer.status.AppliedChangeId,
+			PeerChangeId:    peer.status.PeerChangeId,
+			Error:           peer.status.Error,
+		}
+		peer.mutex.Unlock()
+	}
+
+	return response
+}
+
+// Close stops replication
+func (r *Region) Close() error {
+	for _, peer := range r.peers {
+		peer.cancel()
+	}
+
+	for _, peer := range r.peers {
+		<-peer.done
+		_ = peer.client.Close()
+	}
+	return nil
+}
+
+// run keeps replicating changes until region is closed
+func (p *regionPeer) run() {
+	defer close(p.done)
+
+	delay := replicaMinBackoff
+	for {
+		isConnected, err := p.replicate()
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		if isConnected {
+			delay = replicaMinBackoff
+		}
+		if status.Code(err) == codes.OutOfRange {
+			err = fmt.Errorf("%s, peer region must keep its WAL until it's replicated (see --wal-archive)", err)
+		}
+
+		p.mutex.Lock()
+		p.status.Connected = false
+		p.status.Error = err.Error()
+		p.mutex.Unlock()
+
+		regionLog.Errorf("replication from %s has failed: %s, reconnecting in %s", p.endpoint, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			return
+		}
+
+		delay *= 2
+		if delay > replicaMaxBackoff {
+			delay = replicaMaxBackoff
+		}
+	}
+}
+
+// replicate streams transactions from peer region until stream fails
+// It returns true if it has connected to peer region successfully
+func (p *regionPeer) replicate() (bool, error) {
+	health, err := p.client.Health(p.ctx, &None{})
+	if err != nil {
+		return false, err
+	}
+	if health.Region == nil {
+		return false, fmt.Errorf("server doesn't accept writes as a region")
+	}
+	if health.Region.Strategy != string(p.engine.Strategy()) {
+		return false, fmt.Errorf("peer region resolves conflicts with \"%s\" strategy", health.Region.Strategy)
+	}
+	if health.Region.Origin == p.engine.Origin() {
+		return false, fmt.Errorf("peer region has the same ID \"%s\"", health.Region.Origin)
+	}
+
+	origin := health.Region.Origin
+	changeID, err := p.engine.Checkpoint(origin)
+	if err != nil {
+		return false, err
+	}
+
+	stream, err := p.client.Replicate(p.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = stream.Send(&ReplicateRequest{SinceChangeId: changeID})
+	if err != nil {
+		return false, err
+	}
+
+	isConnected := false
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("peer region has closed replication stream")
+			}
+			return isConnected, err
+		}
+
+		if !isConnected {
+			isConnected = true
+			regionLog.Printf("replicating from region \"%s\" at %s after change #%d", origin, p.endpoint, changeID)
+		}
+
+		if len(message.Records) > 0 {
+			records := mapRecords(message.Records)
+			applied, err := p.engine.Apply(origin, records)
+			if err != nil {
+				return isConnected, err
+			}
+			if applied {
+				changeID = records[len(records)-1].ID
+			}
+		}
+
+		p.mutex.Lock()
+		p.status.Origin = origin
+		p.status.Connected = true
+		p.status.Error = ""
+		p.status.AppliedChangeId = changeID
+		p.status.PeerChangeId = message.LastChangeId
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,101 @@
+package proto_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/proto"
+	"github.com/kapitanov/natandb/pkg/region"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestRegion(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	eu := freeEndpoint(t)
+	us := freeEndpoint(t)
+	startRegion(t, "eu", eu, us)
+	startRegion(t, "us", us, eu)
+
+	// Both regions accept writes, values added concurrently are merged
+	ctx := context.Background()
+	for _, endpoint := range []string{eu, us} {
+		_, err := proto.NewServiceClient(dial(t, endpoint)).Add(ctx, &proto.AddRequest{Key: "key", Value: []byte(endpoint)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, endpoint := range []string{eu, us} {
+		client := proto.NewServiceClient(dial(t, endpoint))
+
+		var node *proto.Node
+		var err error
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			node, err = client.Get(ctx, &proto.GetRequest{Key: "key"})
+			if err == nil && len(node.Values) == 2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil || len(node.Values) != 2 {
+			t.Errorf("ERROR: \"key\" has values %v in %s (%v)", node.GetValues(), endpoint, err)
+		}
+
+		list, err := client.List(ctx, &proto.ListRequest{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.TotalCount != 1 {
+			t.Errorf("ERROR: %d keys are listed in %s", list.TotalCount, endpoint)
+		}
+
+		health, err := client.Health(ctx, &proto.None{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if health.Region == nil || len(health.Region.Peers) != 1 || !health.Region.Peers[0].Connected {
+			t.Errorf("ERROR: unexpected region status %v in %s", health.Region, endpoint)
+		}
+	}
+}
+
+func startRegion(t *testing.T, origin, endpoint string, peers ...string) {
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = engine.Close() })
+
+	e, err := region.NewEngine(engine, origin, region.AddWins)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := proto.NewServer(e, endpoint)
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	r, err := proto.NewRegion(e, peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetRegion(r)
+	r.Start()
+	t.Cleanup(func() { _ = r.Close() })
+}
@@ -0,0 +1,195 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var replicaLog = log.New("replica")
+
+const (
+	// replicaMinBackoff is a delay before reconnecting to primary server after a failure
+	replicaMinBackoff = 1 * time.Second
+
+	// replicaMaxBackoff is a max delay before reconnecting to primary server after repeated failures
+	replicaMaxBackoff = 30 * time.Second
+)
+
+// Replica keeps data of a replica engine (see db.ReplicaOption) in sync with a primary server
+// It streams transactions committed by primary server and applies them to replica engine
+type Replica struct {
+	engine  db.Engine
+	primary string
+	client  Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mutex   sync.Mutex
+	status  *ReplicaStatus
+}
+
+// NewReplica creates a replica of specified primary server
+// Engine must contain data of the same primary server, e.g. a full backup of it
+func NewReplica(engine db.Engine, primary string) (*Replica, error) {
+	client, err := NewClient(primary)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Replica{
+		engine:  engine,
+		primary: primary,
+		client:  client,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		status:  &ReplicaStatus{Primary: primary},
+	}, nil
+}
+
+// Start starts replication in background
+// Replica keeps reconnecting to primary server until Close() is called
+func (r *Replica) Start() {
+	go r.run()
+}
+
+// Status returns replication state
+func (r *Replica) Status() *ReplicaStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return &ReplicaStatus{
+		Primary:         r.status.Primary,
+		Connected:       r.status.Connected,
+		PrimaryChangeId: r.status.PrimaryChangeId,
+		Lag:             r.status.Lag,
+		Error:           r.status.Error,
+	}
+}
+
+// Close stops replication
+func (r *Replica) Close() error {
+	r.cancel()
+	<-r.done
+	return r.client.Close()
+}
+
+// run keeps replicating changes until replica is closed
+func (r *Replica) run() {
+	defer close(r.done)
+
+	delay := replicaMinBackoff
+	for {
+		isConnected, err := r.replicate()
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		if isConnected {
+			delay = replicaMinBackoff
+		}
+		if status.Code(err) == codes.OutOfRange {
+			err = fmt.Errorf("%s, replica must be bootstrapped again from an empty data directory", err)
+		}
+
+		r.mutex.Lock()
+		r.status.Connected = false
+		r.status.Error = err.Error()
+		r.mutex.Unlock()
+
+		replicaLog.Errorf("replication from %s has failed: %s, reconnecting in %s", r.primary, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return
+		}
+
+		delay *= 2
+		if delay > replicaMaxBackoff {
+			delay = replicaMaxBackoff
+		}
+	}
+}
+
+// replicate streams transactions from primary server until stream fails
+// It returns true if replica has connected to primary server successfully
+func (r *Replica) replicate() (bool, error) {
+	changeID := r.engine.LastCommitID()
+	stream, err := r.client.Replicate(r.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = stream.Send(&ReplicateRequest{SinceChangeId: changeID})
+	if err != nil {
+		return false, err
+	}
+
+	isConnected := false
+	for {
+		message, err := stream.Recv()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("primary server has closed replication stream")
+			}
+			return isConnected, err
+		}
+
+		if !isConnected {
+			isConnected = true
+			replicaLog.Printf("replicating from %s after change #%d", r.primary, changeID)
+		}
+
+		if len(message.Records) > 0 {
+			err = r.engine.ApplyTx(mapRecords(message.Records))
+			if err != nil {
+				return isConnected, err
+			}
+		}
+
+		// Transaction is persisted by ApplyTx, so primary might acknowledge its commit
+		lastChangeID := r.engine.LastCommitID()
+		if lastChangeID > changeID {
+			changeID = lastChangeID
+			err = stream.Send(&ReplicateRequest{AckedChangeId: changeID})
+			if err != nil {
+				return isConnected, err
+			}
+		}
+
+		r.mutex.Lock()
+		r.status.Connected = true
+		r.status.Error = ""
+		r.status.PrimaryChangeId = message.LastChangeId
+		r.status.Lag = 0
+		if message.LastChangeId > lastChangeID {
+			r.status.Lag = message.LastChangeId - lastChangeID
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func mapRecords(records []*WALRecord) []*storage.WALRecord {
+	result := make([]*storage.WALRecord, len(records))
+	for i, record := range records {
+		result[i] = &storage.WALRecord{
+			ID:    record.Id,
+			TxID:  record.TxId,
+			Type:  storage.WALRecordType(record.Type),
+			Key:   record.Key,
+			Value: record.Value,
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,67 @@
+package proto_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestReplicateAck(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	primary := startServer(t, db.SyncReplicationOption(db.SyncReplicationPolicy{
+		Replicas:    1,
+		Timeout:     200 * time.Millisecond,
+		Degradation: db.DegradeToError,
+	}))
+	client := proto.NewServiceClient(dial(t, primary.endpoint))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Replicate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&proto.ReplicateRequest{SinceChangeId: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replica acks changes it hasn't got, but they aren't counted
+	// Acks are read asynchronously, so server is given time to read this one before a change is sent
+	err = stream.Send(&proto.ReplicateRequest{AckedChangeId: 1 << 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	_, err = client.Set(context.Background(), &proto.SetRequest{Key: "key-1", Values: [][]byte{[]byte("value")}})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("ERROR: expected DEADLINE_EXCEEDED but got %v", err)
+	}
+
+	// Changes that have been sent to replica are counted once replica acks them
+	go func() {
+		for {
+			message, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			if n := len(message.Records); n > 0 {
+				_ = stream.Send(&proto.ReplicateRequest{AckedChangeId: message.Records[n-1].Id})
+			}
+		}
+	}()
+	_, err = client.Set(context.Background(), &proto.SetRequest{Key: "key-2", Values: [][]byte{[]byte("value")}})
+	if err != nil {
+		t.Errorf("ERROR: commit has failed: %s", err)
+	}
+}
@@ -1,13 +1,27 @@
 package proto
 
 import (
+	"bufio"
 	"context"
+	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/kapitanov/natandb/pkg/backup"
 	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/failover"
 	"github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/raft"
+	"github.com/kapitanov/natandb/pkg/storage"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -17,37 +31,91 @@ var serverLog = log.New("server")
 type Server interface {
 	// Start starts serer
 	Start() error
+	// Ready switches a starting server into serving state (see NewStartingServer)
+	Ready(engine db.Engine)
+	// SetReplica makes server report replication state of a replica
+	SetReplica(replica *Replica)
+	// SetRegion makes server report replication state between regions
+	SetRegion(region *Region)
+	// SetCluster makes server act as a cluster node
+	// Server serves requests of other nodes and forwards writes to leader
+	SetCluster(node *raft.Node)
+	// SetFailover makes server act as a failover group member
+	SetFailover(node *failover.Node)
+	// EnableSharding makes server keep its cluster map within specified state file (see UpdateClusterMap)
+	// Server serves every key until it receives a cluster map
+	EnableSharding(file storage.StateFile) error
 	// Close shuts server down
 	Close() error
 }
 
 type serverImpl struct {
-	server   *grpc.Server
-	engine   db.Engine
-	endpoint string
-	listener net.Listener
+	server     *grpc.Server
+	health     *health.Server
+	mutex      sync.RWMutex
+	engine     db.Engine
+	progress   *model.ReplayProgress
+	replica    *Replica
+	region     *Region
+	cluster    *raft.Node
+	failover   *failover.Node
+	forwarding *connectionPool
+	shardMutex sync.RWMutex
+	shard      *shardState
+	shardFile  storage.StateFile
+	endpoint   string
+	listener   net.Listener
+	done       chan struct{}
 }
 
 func (s *serverImpl) mustEmbedUnimplementedServiceServer() {
 	panic("implement me")
 }
 
+func (s *serverImpl) mustEmbedUnimplementedRaftServer() {
+	panic("implement me")
+}
+
+func (s *serverImpl) mustEmbedUnimplementedFailoverServer() {
+	panic("implement me")
+}
+
 // NewServer creates new server instance
 func NewServer(engine db.Engine, endpoint string) Server {
-	server := grpc.NewServer()
+	return newServer(engine, nil, endpoint)
+}
+
+// NewStartingServer creates new server instance that is started before DB engine is initialized
+// Until Ready() is called, server reports specified WAL replay progress and rejects any other requests
+func NewStartingServer(progress *model.ReplayProgress, endpoint string) Server {
+	return newServer(nil, progress, endpoint)
+}
 
-	return &serverImpl{
-		server:   server,
-		engine:   engine,
-		endpoint: endpoint,
-		listener: nil,
+func newServer(engine db.Engine, progress *model.ReplayProgress, endpoint string) Server {
+	s := &serverImpl{
+		health:     health.NewServer(),
+		engine:     engine,
+		progress:   progress,
+		forwarding: newConnectionPool(),
+		endpoint:   endpoint,
+		listener:   nil,
+		done:       make(chan struct{}),
 	}
+	s.server = grpc.NewServer(grpc.ChainUnaryInterceptor(s.checkShard, s.forwardWrites))
+
+	if engine == nil {
+		s.health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+	return s
 }
 
 // Start starts serer
 func (s *serverImpl) Start() error {
 	serverLog.Verbosef("starting server")
 	RegisterServiceServer(s.server, s)
+	RegisterRaftServer(s.server, s)
+	RegisterFailoverServer(s.server, s)
+	grpc_health_v1.RegisterHealthServer(s.server, s.health)
 
 	listener, err := net.Listen("tcp", s.endpoint)
 	if err != nil {
@@ -63,10 +131,50 @@ func (s *serverImpl) Start() error {
 	return nil
 }
 
+// Ready switches a starting server into serving state (see NewStartingServer)
+func (s *serverImpl) Ready(engine db.Engine) {
+	s.mutex.Lock()
+	s.engine = engine
+	s.mutex.Unlock()
+
+	s.health.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	serverLog.Printf("server is ready")
+}
+
+// SetReplica makes server report replication state of a replica
+func (s *serverImpl) SetReplica(replica *Replica) {
+	s.mutex.Lock()
+	s.replica = replica
+	s.mutex.Unlock()
+}
+
+// SetRegion makes server report replication state between regions
+func (s *serverImpl) SetRegion(region *Region) {
+	s.mutex.Lock()
+	s.region = region
+	s.mutex.Unlock()
+}
+
+// getEngine returns DB engine or an error if server is still starting
+func (s *serverImpl) getEngine() (db.Engine, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.engine == nil {
+		return nil, status.Error(codes.Unavailable, "server is starting")
+	}
+	return s.engine, nil
+}
+
 // Close shuts server down
 func (s *serverImpl) Close() error {
 	serverLog.Verbosef("shutting down")
+	s.health.Shutdown()
+
+	// Replication streams never end on their own
+	close(s.done)
 	s.server.GracefulStop()
+	_ = s.forwarding.Close()
 	serverLog.Verbosef("shutdown completed")
 	return nil
 }
@@ -75,8 +183,26 @@ func (s *serverImpl) Close() error {
 // Optionally list might be filtered by key prefix
 func (s *serverImpl) List(context context.Context, request *ListRequest) (*PagedNodeList, error) {
 	var response PagedNodeList
-	err := s.engine.Tx(func(tx db.TX) error {
-		list, err := tx.List(db.Key(request.Prefix), uint(request.Skip), uint(request.Limit), request.Version)
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = waitForVersion(context, engine, request.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shard doesn't list keys that have been copied from other shards or haven't been dropped after moving to other shards
+	shard := s.getShard()
+	err = engine.Tx(func(tx db.TX) error {
+		var list *db.PagedNodeList
+		var err error
+		if shard != nil {
+			list, err = listOwned(tx, shard, request)
+		} else {
+			list, err = tx.List(db.Key(request.Prefix), uint(request.Skip), uint(request.Limit), request.Version)
+		}
 		if err != nil {
 			return err
 		}
@@ -103,7 +229,12 @@ func (s *serverImpl) List(context context.Context, request *ListRequest) (*Paged
 // Version returns current data version
 func (s *serverImpl) Version(context context.Context, request *None) (*DBVersion, error) {
 	var response DBVersion
-	err := s.engine.Tx(func(tx db.TX) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
 		version := tx.GetVersion()
 		response = DBVersion{
 			Version: version,
@@ -122,7 +253,17 @@ func (s *serverImpl) Version(context context.Context, request *None) (*DBVersion
 // If specified node doesn't exist, a ErrNoSuchKey error is returned
 func (s *serverImpl) Get(context context.Context, request *GetRequest) (*Node, error) {
 	var response *Node
-	err := s.engine.Tx(func(tx db.TX) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = waitForVersion(context, engine, request.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
 		node, err := tx.Get(db.Key(request.Key))
 		if err != nil {
 			return err
@@ -143,7 +284,12 @@ func (s *serverImpl) Get(context context.Context, request *GetRequest) (*Node, e
 // If specified node doesn't exists, it will be created
 func (s *serverImpl) Set(context context.Context, request *SetRequest) (*Node, error) {
 	var response *Node
-	err := s.engine.Tx(func(tx db.TX) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
 		values := make([]db.Value, len(request.Values))
 		for i := range request.Values {
 			values[i] = request.Values[i]
@@ -171,7 +317,12 @@ func (s *serverImpl) Set(context context.Context, request *SetRequest) (*Node, e
 // If node already contains the same value and "unique" parameter is set to "true", a ErrDuplicateValue error is returned
 func (s *serverImpl) Add(context context.Context, request *AddRequest) (*Node, error) {
 	var response *Node
-	err := s.engine.Tx(func(tx db.TX) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
 		var node *db.Node
 		var err error
 
@@ -203,7 +354,12 @@ func (s *serverImpl) Add(context context.Context, request *AddRequest) (*Node, e
 // (unless a "all" parameter is set to "false"
 func (s *serverImpl) Remove(context context.Context, request *RemoveRequest) (*Node, error) {
 	var response *Node
-	err := s.engine.Tx(func(tx db.TX) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
 		var node *db.Node
 		var err error
 
@@ -232,7 +388,12 @@ func (s *serverImpl) Remove(context context.Context, request *RemoveRequest) (*N
 // If specified node doesn't exist, a ErrNoSuchKey error is returned
 func (s *serverImpl) Delete(context context.Context, request *DeleteRequest) (*None, error) {
 	var response *None
-	err := s.engine.Tx(func(tx db.TX) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
 		err := tx.RemoveKey(db.Key(request.Key))
 		if err != nil {
 			return err
@@ -246,9 +407,246 @@ func (s *serverImpl) Delete(context context.Context, request *DeleteRequest) (*N
 		return nil, mapServerError(err)
 	}
 
+	// Deleted key has no version, so client gets a change ID to read its own write
+	_ = grpc.SetHeader(context, metadata.Pairs(changeIDHeader, strconv.FormatUint(engine.LastCommitID(), 10)))
 	return response, nil
 }
 
+// Backup streams a consistent point-in-time backup archive
+// If "since_change_id" is set, an incremental backup of changes after specified one is streamed
+// Transactions keep going while a backup is being taken
+func (s *serverImpl) Backup(request *BackupRequest, stream Service_BackupServer) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return err
+	}
+
+	var write func(w io.Writer) (*backup.Manifest, error)
+	if request.SinceChangeId == 0 {
+		root, changeID, err := engine.Backup()
+		if err != nil {
+			return mapServerError(err)
+		}
+
+		write = func(w io.Writer) (*backup.Manifest, error) {
+			return backup.WriteFull(w, root, changeID)
+		}
+	} else {
+		records, changeID, err := engine.BackupSince(request.SinceChangeId)
+		if err != nil {
+			return mapServerError(err)
+		}
+
+		write = func(w io.Writer) (*backup.Manifest, error) {
+			return backup.WriteIncremental(w, records, request.SinceChangeId, changeID)
+		}
+	}
+
+	writer := bufio.NewWriterSize(&backupStreamWriter{stream: stream}, backupChunkSize)
+	manifest, err := write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		serverLog.Errorf("unable to stream backup: %s", err)
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	serverLog.Printf("backup %s has been streamed", manifest)
+	return nil
+}
+
+// Health returns server state
+// While server is starting, it reports write-ahead log replay progress and rejects any other requests
+func (s *serverImpl) Health(context context.Context, request *None) (*HealthStatus, error) {
+	if engine, err := s.getEngine(); err == nil {
+		response := &HealthStatus{
+			State:        HealthStatus_SERVING,
+			LastChangeId: engine.LastCommitID(),
+		}
+
+		s.mutex.RLock()
+		replica := s.replica
+		region := s.region
+		cluster := s.cluster
+		failoverNode := s.failover
+		s.mutex.RUnlock()
+		if replica != nil {
+			response.Replica = replica.Status()
+		}
+		if region != nil {
+			response.Region = region.Status()
+		}
+
+		if cluster != nil {
+			status := cluster.Status()
+			response.Cluster = &ClusterStatus{
+				Role:   status.Role.String(),
+				Term:   status.Term,
+				Leader: status.Leader,
+			}
+		}
+
+		if failoverNode != nil {
+			response.Failover = failoverStatus(failoverNode)
+		}
+
+		if shard := s.getShard(); shard != nil {
+			response.Shard = &ShardStatus{Name: shard.Shard, MapVersion: shard.Map.Version}
+		}
+
+		// Only cluster leader and failover group's primary wait for other servers
+		if sync := engine.SyncStatus(); sync.Required > 0 && (cluster == nil || cluster.IsLeader()) && (failoverNode == nil || failoverNode.IsPrimary()) {
+			response.SyncReplication = &SyncReplicationStatus{
+				Required:  uint32(sync.Required),
+				Connected: uint32(sync.Connected),
+				Degraded:  sync.IsDegraded,
+			}
+		}
+		return response, nil
+	}
+
+	response := &HealthStatus{State: HealthStatus_STARTING}
+	if s.progress != nil {
+		replay := s.progress.Status()
+		response.ReplayedRecords = replay.Records
+		response.ReplayedBytes = uint64(replay.Bytes)
+		response.TotalBytes = uint64(replay.TotalBytes)
+		response.EtaMs = uint64(replay.ETA.Milliseconds())
+	}
+	return response, nil
+}
+
+// replicationHeartbeatInterval is a max delay between two messages of a replication stream
+const replicationHeartbeatInterval = 1 * time.Second
+
+// Replicate streams transactions that have been committed after specified change ID, it's used by replicas
+// Committed transactions are read from WAL first, then new ones are streamed as soon as they are committed
+// Heartbeat messages without records are streamed while there are no new transactions
+// Replica sends the first request to start streaming, then it acknowledges every transaction it has persisted
+func (s *serverImpl) Replicate(stream Service_ReplicateServer) error {
+	engine, err := s.getEngine()
+	if err != nil {
+		return err
+	}
+
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	feed, err := engine.Subscribe(request.SinceChangeId)
+	if err != nil {
+		return mapServerError(err)
+	}
+	defer feed.Close()
+
+	// Replica has persisted every change it has requested to start after, unless it claims changes that don't exist yet
+	// Acks are capped by the last change that has been sent to the stream, so a replica can't ack what it hasn't got
+	sentChangeID := request.SinceChangeId
+	if last := engine.LastCommitID(); sentChangeID > last {
+		sentChangeID = last
+	}
+	feed.Ack(sentChangeID)
+	go func() {
+		for {
+			ack, err := stream.Recv()
+			if err != nil {
+				return
+			}
+
+			changeID := ack.AckedChangeId
+			if last := atomic.LoadUint64(&sentChangeID); changeID > last {
+				changeID = last
+			}
+			feed.Ack(changeID)
+		}
+	}()
+
+	serverLog.Printf("replica has connected, streaming changes after #%d", request.SinceChangeId)
+	heartbeat := time.NewTicker(replicationHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		message := &ReplicatedTx{}
+		select {
+		case records, ok := <-feed.Transactions():
+			if !ok {
+				if err = feed.Err(); err != nil {
+					return mapServerError(err)
+				}
+				return nil
+			}
+			message.Records = serverMapRecords(records)
+
+		case <-heartbeat.C:
+
+		case <-stream.Context().Done():
+			serverLog.Printf("replica has disconnected")
+			return nil
+
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+
+		message.LastChangeId = engine.LastCommitID()
+		err = stream.Send(message)
+		if err != nil {
+			serverLog.Errorf("unable to stream changes: %s", err)
+			return err
+		}
+
+		if n := len(message.Records); n > 0 {
+			atomic.StoreUint64(&sentChangeID, message.Records[n-1].Id)
+		}
+	}
+}
+
+// backupChunkSize is a max length of backup stream message
+const backupChunkSize = 64 * 1024
+
+// backupStreamWriter sends written data as a stream of backup chunks
+type backupStreamWriter struct {
+	stream Service_BackupServer
+}
+
+func (w *backupStreamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		length := len(p) - n
+		if length > backupChunkSize {
+			length = backupChunkSize
+		}
+
+		err := w.stream.Send(&BackupChunk{Data: p[n : n+length]})
+		if err != nil {
+			return n, err
+		}
+
+		n += length
+	}
+
+	return n, nil
+}
+
+func serverMapRecords(records []*storage.WALRecord) []*WALRecord {
+	result := make([]*WALRecord, len(records))
+	for i, record := range records {
+		result[i] = &WALRecord{
+			Id:    record.ID,
+			TxId:  record.TxID,
+			Type:  uint32(record.Type),
+			Key:   record.Key,
+			Value: record.Value,
+		}
+	}
+
+	return result
+}
+
 func serverMapNode(node *db.Node) *Node {
 	values := make([][]byte, len(node.Values))
 	for i := range node.Values {
@@ -262,6 +660,8 @@ func serverMapNode(node *db.Node) *Node {
 	}
 }
 
+// mapServerError maps an engine error to GRPC error
+// Errors that aren't known to clients (e.g. I/O errors) are reported as internal ones
 func mapServerError(err error) error {
 	switch err {
 	case context.Canceled:
@@ -281,9 +681,23 @@ func mapServerError(err error) error {
 			return status.Error(codes.FailedPrecondition, e.String())
 		case db.ErrNoSuchValue:
 			return status.Error(codes.InvalidArgument, e.String())
+		case db.ErrShutdown:
+			return status.Error(codes.Unavailable, e.String())
+		case db.ErrNoSuchChange:
+			return status.Error(codes.InvalidArgument, e.String())
+		case db.ErrChangesUnavailable:
+			return status.Error(codes.OutOfRange, e.String())
+		case db.ErrReadOnly:
+			return status.Error(codes.FailedPrecondition, e.String())
+		case db.ErrFeedOverflow:
+			return status.Error(codes.ResourceExhausted, e.String())
+		case db.ErrReplicationTimeout:
+			// Like any deadline error, it means that transaction might have been committed
+			return status.Error(codes.DeadlineExceeded, e.String())
+		case db.ErrReservedKey:
+			return status.Error(codes.InvalidArgument, e.String())
 		}
 	}
 
-	panic(err)
-	return err
+	return status.Error(codes.Internal, err.Error())
 }
@@ -0,0 +1,304 @@
+package proto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// mapVersionHeader contains a version of cluster map that client has routed request with
+	mapVersionHeader = "x-natandb-map-version"
+
+	// clusterMapTrailer contains server's cluster map if request has been sent to a wrong shard
+	clusterMapTrailer = "x-natandb-cluster-map"
+)
+
+// keyedMethods are methods that are served only by a shard which owns requested key
+var keyedMethods = map[string]bool{
+	"/Service/Get":    true,
+	"/Service/Set":    true,
+	"/Service/Add":    true,
+	"/Service/Remove": true,
+	"/Service/Delete": true,
+}
+
+// shardState is a shard of a sharded cluster that server serves
+type shardState struct {
+	Shard string      `json:"shard"`
+	Map   *ClusterMap `json:"map"`
+}
+
+// owns returns true if shard owns specified key
+func (s *shardState) owns(key string) bool {
+	shard, err := s.Map.Lookup(key)
+	return err == nil && shard.Name == s.Shard
+}
+
+// EnableSharding makes server keep its cluster map within specified state file (see UpdateClusterMap)
+// Server serves every key until it receives a cluster map
+func (s *serverImpl) EnableSharding(file storage.StateFile) error {
+	data, err := file.Read()
+	if err != nil {
+		return err
+	}
+
+	var state *shardState
+	if data != nil {
+		state = &shardState{}
+		err = json.Unmarshal(data, state)
+		if err == nil {
+			err = state.Map.Validate()
+		}
+		if err != nil {
+			return fmt.Errorf("malformed shard state: %s", err)
+		}
+		serverLog.Printf("serving shard \"%s\" of cluster map v%d", state.Shard, state.Map.Version)
+	}
+
+	s.shardMutex.Lock()
+	defer s.shardMutex.Unlock()
+
+	s.shardFile = file
+	s.shard = state
+	return nil
+}
+
+// getShard returns a shard that server serves, nil if server serves every key
+func (s *serverImpl) getShard() *shardState {
+	s.shardMutex.RLock()
+	defer s.shardMutex.RUnlock()
+
+	return s.shard
+}
+
+// checkShard is a GRPC interceptor that rejects requests for keys of other shards
+// Writes hold shard lock until they are committed, so a cluster map update fences them (see UpdateClusterMap)
+func (s *serverImpl) checkShard(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !keyedMethods[info.FullMethod] {
+		return handler(ctx, request)
+	}
+
+	s.shardMutex.RLock()
+	defer s.shardMutex.RUnlock()
+
+	shard := s.shard
+	key := request.(interface{ GetKey() string }).GetKey()
+	if shard == nil || shard.owns(key) {
+		return handler(ctx, request)
+	}
+
+	// Client that has a newer map has to wait until this server receives it too
+	if version := requestMapVersion(ctx); version > shard.Map.Version {
+		return nil, status.Errorf(codes.Unavailable, "cluster map v%d is not applied yet (server has v%d)", version, shard.Map.Version)
+	}
+
+	data, err := json.Marshal(shard.Map)
+	if err == nil {
+		_ = grpc.SetTrailer(ctx, metadata.Pairs(clusterMapTrailer, string(data)))
+	}
+
+	owner := "no shard"
+	if o, err := shard.Map.Lookup(key); err == nil {
+		owner = fmt.Sprintf("shard \"%s\" (%s)", o.Name, o.Endpoint)
+	}
+	return nil, status.Errorf(codes.Aborted, "stale cluster map: key \"%s\" belongs to %s since cluster map v%d", key, owner, shard.Map.Version)
+}
+
+// requestMapVersion returns a version of cluster map that client has routed request with, zero if it's unknown
+func requestMapVersion(ctx context.Context) uint64 {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return 0
+	}
+
+	values := md.Get(mapVersionHeader)
+	if len(values) == 0 {
+		return 0
+	}
+
+	version, _ := strconv.ParseUint(values[0], 10, 64)
+	return version
+}
+
+// UpdateClusterMap makes server serve a shard of a sharded cluster
+// Requests for keys of other shards are rejected with an ABORTED error, server's cluster map is returned within its trailer
+// Map version is a fencing token: server never goes back to an older map
+// Once response is returned, every write that server has accepted under previous map is committed
+func (s *serverImpl) UpdateClusterMap(ctx context.Context, request *ClusterMapUpdate) (*ClusterMapUpdateResponse, error) {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ClusterMap{}
+	err = json.Unmarshal(request.ClusterMap, m)
+	if err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "malformed cluster map: %s", err)
+	}
+	if !m.Has(request.Shard) {
+		return nil, status.Errorf(codes.InvalidArgument, "cluster map has no shard \"%s\"", request.Shard)
+	}
+
+	// Writes that have been accepted under previous map are completed once lock is acquired
+	s.shardMutex.Lock()
+	defer s.shardMutex.Unlock()
+
+	if s.shardFile == nil {
+		return nil, status.Error(codes.FailedPrecondition, "sharding is not enabled")
+	}
+	if s.shard != nil && (m.Version < s.shard.Map.Version || (m.Version == s.shard.Map.Version && request.Shard != s.shard.Shard)) {
+		return nil, status.Errorf(codes.FailedPrecondition, "server has cluster map v%d already", s.shard.Map.Version)
+	}
+
+	state := &shardState{Shard: request.Shard, Map: m}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	err = s.shardFile.Write(data)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	s.shard = state
+	serverLog.Printf("serving shard \"%s\" of cluster map v%d", state.Shard, m.Version)
+	return &ClusterMapUpdateResponse{LastChangeId: engine.LastCommitID()}, nil
+}
+
+// Import writes nodes and changes copied from another shard, their keys aren't checked against cluster map
+func (s *serverImpl) Import(ctx context.Context, request *ImportRequest) (*None, error) {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	err = engine.Tx(func(tx db.TX) error {
+		for _, node := range request.Nodes {
+			values := make([]db.Value, len(node.Values))
+			for i := range node.Values {
+				values[i] = node.Values[i]
+			}
+
+			_, err := tx.Set(db.Key(node.Key), values)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Removals are idempotent: removing the last value removes a key, so a key might be gone
+		// before a record that removes it is applied
+		for _, record := range request.Records {
+			var err error
+			key := db.Key(record.Key)
+			switch storage.WALRecordType(record.Type) {
+			case storage.WALAddValue:
+				_, err = tx.AddValue(key, record.Value)
+			case storage.WALRemoveValue:
+				_, err = tx.RemoveValue(key, record.Value)
+				if err == db.ErrNoSuchKey || err == db.ErrNoSuchValue {
+					err = nil
+				}
+			case storage.WALRemoveKey:
+				err = tx.RemoveKey(key)
+				if err == db.ErrNoSuchKey {
+					err = nil
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, mapServerError(err)
+	}
+
+	return &None{}, nil
+}
+
+// DropForeignKeys removes every key that doesn't belong to server's shard
+func (s *serverImpl) DropForeignKeys(ctx context.Context, request *None) (*DroppedKeys, error) {
+	engine, err := s.getEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	shard := s.getShard()
+	if shard == nil {
+		return &DroppedKeys{}, nil
+	}
+
+	count := 0
+	err = engine.Tx(func(tx db.TX) error {
+		for _, key := range tx.Keys("") {
+			if shard.owns(string(key)) {
+				continue
+			}
+
+			err := tx.RemoveKey(key)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, mapServerError(err)
+	}
+
+	serverLog.Printf("%d key(s) of other shards have been dropped", count)
+	return &DroppedKeys{Count: uint32(count)}, nil
+}
+
+// listOwned returns a page of nodes that belong to server's shard
+// Keys are filtered while they are being iterated, node values are loaded for requested page only
+func listOwned(tx db.TX, shard *shardState, request *ListRequest) (*db.PagedNodeList, error) {
+	if request.Version != 0 && request.Version != tx.GetVersion() {
+		return nil, db.ErrDataOutOfDate
+	}
+
+	owned := make([]db.Key, 0)
+	for _, key := range tx.Keys(db.Key(request.Prefix)) {
+		if shard.owns(string(key)) {
+			owned = append(owned, key)
+		}
+	}
+
+	list := &db.PagedNodeList{
+		Version:    tx.GetVersion(),
+		TotalCount: uint(len(owned)),
+	}
+	if int(request.Skip) < len(owned) {
+		owned = owned[request.Skip:]
+	} else {
+		owned = owned[:0]
+	}
+	if len(owned) > int(request.Limit) {
+		owned = owned[:request.Limit]
+	}
+
+	list.Nodes = make([]*db.Node, len(owned))
+	for i, key := range owned {
+		node, err := tx.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		list.Nodes[i] = node
+	}
+	return list, nil
+}
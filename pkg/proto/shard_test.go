@@ -0,0 +1,266 @@
+package proto_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/db/dbtest"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/proto"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestImport(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	server := startShard(t)
+	client := proto.NewServiceClient(dial(t, server.endpoint))
+	ctx := context.Background()
+
+	_, err := client.Import(ctx, &proto.ImportRequest{Nodes: []*proto.Node{
+		{Key: "key-1", Values: [][]byte{[]byte("a")}},
+		{Key: "key-2", Values: [][]byte{[]byte("a"), []byte("b")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Removal of the last value removes a key, so a next removal of this key is a no-op
+	_, err = client.Import(ctx, &proto.ImportRequest{Records: []*proto.WALRecord{
+		{Type: uint32(storage.WALRemoveValue), Key: "key-1", Value: []byte("a")},
+		{Type: uint32(storage.WALRemoveKey), Key: "key-1"},
+		{Type: uint32(storage.WALRemoveValue), Key: "key-2", Value: []byte("a")},
+		{Type: uint32(storage.WALAddValue), Key: "key-3", Value: []byte("c")},
+		{Type: uint32(storage.WALRemoveKey), Key: "key-4"},
+	}})
+	if err != nil {
+		t.Errorf("ERROR: import has failed: %s", err)
+	}
+
+	dbtest.CheckKey(t, server.engine, "key-1", false)
+	checkValues(t, client, "key-2", "b")
+	checkValues(t, client, "key-3", "c")
+	dbtest.CheckKey(t, server.engine, "key-4", false)
+}
+
+func TestStaleClusterMap(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	m, shards := startShards(t, 2)
+	key := keyOf(t, m, "shard-1", 0)
+
+	// Server redirects a client to a shard that owns requested key
+	var trailer metadata.MD
+	client := proto.NewServiceClient(dial(t, shards["shard-0"].endpoint))
+	_, err := client.Get(context.Background(), &proto.GetRequest{Key: key}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ERROR: expected ABORTED but got %v", err)
+	}
+	values := trailer.Get("x-natandb-cluster-map")
+	if len(values) != 1 {
+		t.Fatalf("ERROR: response has no cluster map")
+	}
+	returned := &proto.ClusterMap{}
+	err = json.Unmarshal([]byte(values[0]), returned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := returned.Lookup(key)
+	if err != nil || returned.Version != m.Version || owner.Name != "shard-1" {
+		t.Errorf("ERROR: cluster map v%d maps \"%s\" to %v (%v)", returned.Version, key, owner, err)
+	}
+
+	// Client that has a newer map waits until server gets it too
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-natandb-map-version", fmt.Sprint(m.Version+1))
+	_, err = client.Get(ctx, &proto.GetRequest{Key: key})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("ERROR: expected UNAVAILABLE but got %v", err)
+	}
+}
+
+func TestMoveRange(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	m, shards := startShards(t, 2)
+	clients := map[string]proto.ServiceClient{
+		"shard-0": proto.NewServiceClient(dial(t, shards["shard-0"].endpoint)),
+		"shard-1": proto.NewServiceClient(dial(t, shards["shard-1"].endpoint)),
+	}
+
+	ctx := context.Background()
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		owner, err := m.Lookup(keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = clients[owner.Name].Set(ctx, &proto.SetRequest{Key: keys[i], Values: [][]byte{[]byte(keys[i])}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Upper half of the second shard moves to the first one, while a moving key keeps changing
+	move := proto.RangeMove{Target: "shard-0", Hashes: &proto.HashRange{From: 3 << 30, To: 1<<32 - 1}}
+	hot := keyOf(t, m, "shard-1", 3<<30)
+	last := make(chan string)
+	stop := make(chan struct{})
+	go func() {
+		value := ""
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				last <- value
+				return
+			default:
+			}
+
+			// Removal of the only value removes a key
+			v := fmt.Sprintf("value-%d", i)
+			_, err := clients["shard-1"].Set(ctx, &proto.SetRequest{Key: hot, Values: [][]byte{[]byte(v)}})
+			if err == nil {
+				value = v
+				_, err = clients["shard-1"].Remove(ctx, &proto.RemoveRequest{Key: hot, Value: []byte(v)})
+				if err == nil {
+					value = ""
+				}
+			}
+			if err != nil {
+				<-stop
+				last <- value
+				return
+			}
+		}
+	}()
+
+	next, err := proto.MoveRange(ctx, m, move)
+	close(stop)
+	expected := <-last
+	if err != nil {
+		t.Fatalf("ERROR: move has failed: %s", err)
+	}
+	if next.Version != m.Version+1 {
+		t.Errorf("ERROR: expected cluster map v%d but got v%d", m.Version+1, next.Version)
+	}
+
+	for _, key := range append(keys, hot) {
+		owner, err := next.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, shard := range shards {
+			exists := name == owner.Name && (key != hot || expected != "")
+			dbtest.CheckKey(t, shard.engine, db.Key(key), exists)
+		}
+
+		if from, _ := m.Lookup(key); from.Name != owner.Name && proto.KeyHash(key) < 3<<30 {
+			t.Errorf("ERROR: \"%s\" has moved from %s to %s", key, from.Name, owner.Name)
+		}
+	}
+	if expected != "" {
+		checkValues(t, clients["shard-0"], hot, expected)
+	}
+
+	// Clients that have an old map are redirected to a new owner
+	_, err = clients["shard-1"].Get(ctx, &proto.GetRequest{Key: hot})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ERROR: expected ABORTED but got %v", err)
+	}
+}
+
+// startShards starts sharded servers and applies a cluster map that splits hashes evenly between them
+func startShards(t *testing.T, count int) (*proto.ClusterMap, map[string]*testServer) {
+	m := &proto.ClusterMap{Version: 1}
+	shards := make(map[string]*testServer)
+	for i := 0; i < count; i++ {
+		server := startShard(t)
+		name := fmt.Sprintf("shard-%d", i)
+		shards[name] = server
+		m.Shards = append(m.Shards, &proto.Shard{Name: name, Endpoint: server.endpoint})
+	}
+
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proto.ApplyClusterMap(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, shards
+}
+
+// startShard starts a server that keeps its cluster map
+func startShard(t *testing.T) *testServer {
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = engine.Close() })
+
+	endpoint := freeEndpoint(t)
+	server := proto.NewServer(engine, endpoint)
+	err = server.EnableSharding(driver.StateFile("shard.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	return &testServer{endpoint: endpoint, engine: engine}
+}
+
+// keyOf returns a key that belongs to specified shard and whose hash isn't below specified one
+func keyOf(t *testing.T, m *proto.ClusterMap, shard string, minHash uint32) string {
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-of-%s-%d", shard, i)
+		owner, err := m.Lookup(key)
+		if err == nil && owner.Name == shard && proto.KeyHash(key) >= minHash {
+			return key
+		}
+	}
+
+	t.Fatalf("ERROR: no key belongs to %s", shard)
+	return ""
+}
+
+// checkValues checks that a key has specified values
+func checkValues(t *testing.T, client proto.ServiceClient, key string, values ...string) {
+	t.Helper()
+
+	node, err := client.Get(context.Background(), &proto.GetRequest{Key: key})
+	if err != nil {
+		t.Errorf("ERROR: %s: %s", key, err)
+		return
+	}
+
+	actual := make([]string, len(node.Values))
+	for i := range node.Values {
+		actual[i] = string(node.Values[i])
+	}
+	if fmt.Sprint(actual) != fmt.Sprint(values) {
+		t.Errorf("ERROR: %s has values %q instead of %q", key, actual, values)
+	}
+}
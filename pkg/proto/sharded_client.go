@@ -0,0 +1,325 @@
+package proto
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxRedirects is a max count of attempts to route a request with a refreshed cluster map
+const maxRedirects = 3
+
+// shardedClient routes requests to shards of a cluster map
+type shardedClient struct {
+	mutex      sync.Mutex
+	clusterMap *ClusterMap
+	clients    map[string]Client
+	sessions   map[string]*session
+	dial       func(endpoint string) (Client, error)
+}
+
+// NewShardedClient creates a client that sends each request to a shard which owns its key
+// List requests are sent to every shard, their results are merged in key order
+// Requests that aren't bound to a key (e.g. Backup or Health) must be sent to a single shard
+// Each shard has its own change IDs, so client keeps a read-your-writes session per shard (MinVersion of requests is ignored)
+// If a shard reports that client's cluster map is stale, client switches to shard's map and retries request
+func NewShardedClient(clusterMap *ClusterMap) (Client, error) {
+	return newShardedClient(clusterMap, NewClient)
+}
+
+// newShardedClient creates a routing client that connects to shards with specified function
+func newShardedClient(clusterMap *ClusterMap, dial func(endpoint string) (Client, error)) (Client, error) {
+	c := &shardedClient{
+		clusterMap: clusterMap,
+		clients:    make(map[string]Client),
+		sessions:   make(map[string]*session),
+		dial:       dial,
+	}
+
+	for _, shard := range clusterMap.Shards {
+		_, _, err := c.connect(shard)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// connect returns a client and a read-your-writes session of specified shard, a new connection is established if needed
+func (c *shardedClient) connect(shard *Shard) (Client, *session, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if client, ok := c.clients[shard.Endpoint]; ok {
+		return client, c.sessions[shard.Endpoint], nil
+	}
+
+	client, err := c.dial(shard.Endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &session{}
+	c.clients[shard.Endpoint] = client
+	c.sessions[shard.Endpoint] = s
+	return client, s, nil
+}
+
+// getMap returns current cluster map
+func (c *shardedClient) getMap() *ClusterMap {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.clusterMap
+}
+
+// refreshMap switches client to a cluster map that server has returned within a trailer
+// It returns false if trailer contains no map or the map isn't newer than client's one
+func (c *shardedClient) refreshMap(trailer metadata.MD) bool {
+	values := trailer.Get(clusterMapTrailer)
+	if len(values) == 0 {
+		return false
+	}
+
+	m := &ClusterMap{}
+	err := json.Unmarshal([]byte(values[0]), m)
+	if err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		clientLog.Errorf("shard has returned a malformed cluster map: %s", err)
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if m.Version <= c.clusterMap.Version {
+		return false
+	}
+
+	clientLog.Printf("cluster map v%d is stale, switching to v%d", c.clusterMap.Version, m.Version)
+	c.clusterMap = m
+	return true
+}
+
+// withMapVersion attaches a version of cluster map to outgoing request
+func withMapVersion(ctx context.Context, m *ClusterMap) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, mapVersionHeader, strconv.FormatUint(m.Version, 10))
+}
+
+// route sends a request to a shard that owns specified key
+// Request is sent again if shard has rejected it due to a stale cluster map
+func (c *shardedClient) route(ctx context.Context, key string, opts []grpc.CallOption, call func(Client, *session, context.Context, []grpc.CallOption) error) error {
+	for i := 0; ; i++ {
+		m := c.getMap()
+		shard, err := m.Lookup(key)
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		client, s, err := c.connect(shard)
+		if err != nil {
+			return err
+		}
+
+		var trailer metadata.MD
+		err = call(client, s, withMapVersion(ctx, m), append(opts, grpc.Trailer(&trailer)))
+		if status.Code(err) != codes.Aborted || i >= maxRedirects || !c.refreshMap(trailer) {
+			return err
+		}
+	}
+}
+
+// List returns paged list of DB keys (with values)
+// Every shard is asked for a first "skip+limit" keys, then their lists are merged
+// Concurrency tokens aren't supported since each shard has its own data version
+func (c *shardedClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*PagedNodeList, error) {
+	if in.Version != 0 {
+		return nil, status.Error(codes.InvalidArgument, "concurrency token can't be used with a sharded cluster")
+	}
+
+	m := c.getMap()
+	ctx = withMapVersion(ctx, m)
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var lastErr error
+	response := &PagedNodeList{Nodes: make([]*Node, 0)}
+	for _, shard := range m.Shards {
+		client, s, err := c.connect(shard)
+		if err != nil {
+			return nil, err
+		}
+
+		request := &ListRequest{
+			Prefix:     in.Prefix,
+			Skip:       0,
+			Limit:      in.Skip + in.Limit,
+			MinVersion: s.minVersion(0),
+		}
+
+		wg.Add(1)
+		go func(client Client) {
+			defer wg.Done()
+
+			list, err := client.List(ctx, request, opts...)
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				lastErr = err
+				return
+			}
+			response.Nodes = append(response.Nodes, list.Nodes...)
+			response.TotalCount += list.TotalCount
+		}(client)
+	}
+	wg.Wait()
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	sort.Slice(response.Nodes, func(i, j int) bool { return response.Nodes[i].Key < response.Nodes[j].Key })
+	if int(in.Skip) >= len(response.Nodes) {
+		response.Nodes = response.Nodes[:0]
+	} else {
+		response.Nodes = response.Nodes[in.Skip:]
+	}
+	if len(response.Nodes) > int(in.Limit) {
+		response.Nodes = response.Nodes[:in.Limit]
+	}
+
+	return response, nil
+}
+
+// Version isn't supported since each shard has its own data version
+func (c *shardedClient) Version(ctx context.Context, in *None, opts ...grpc.CallOption) (*DBVersion, error) {
+	return nil, status.Error(codes.Unimplemented, "data version must be requested from a single shard")
+}
+
+// Get gets a node value by its key
+// If specified node doesn't exist, a ErrNoSuchKey error is returned
+func (c *shardedClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Node, error) {
+	var response *Node
+	err := c.route(ctx, in.Key, opts, func(client Client, s *session, ctx context.Context, opts []grpc.CallOption) error {
+		var err error
+		request := &GetRequest{Key: in.Key, MinVersion: s.minVersion(0)}
+		response, err = s.observeNode(client.Get(ctx, request, opts...))
+		return err
+	})
+	return response, err
+}
+
+// Set sets a node value, rewriting its value if node already exists
+// If specified node doesn't exists, it will be created
+func (c *shardedClient) Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*Node, error) {
+	var response *Node
+	err := c.route(ctx, in.Key, opts, func(client Client, s *session, ctx context.Context, opts []grpc.CallOption) error {
+		var err error
+		response, err = s.observeNode(client.Set(ctx, in, opts...))
+		return err
+	})
+	return response, err
+}
+
+// Add defines an "append value" operation
+// If specified node doesn't exists, it will be created
+// A specified value will be added to node even if it already exists
+// If node already contains the same value and "unique" parameter is set to "true", a ErrDuplicateValue error is returned
+func (c *shardedClient) Add(ctx context.Context, in *AddRequest, opts ...grpc.CallOption) (*Node, error) {
+	var response *Node
+	err := c.route(ctx, in.Key, opts, func(client Client, s *session, ctx context.Context, opts []grpc.CallOption) error {
+		var err error
+		response, err = s.observeNode(client.Add(ctx, in, opts...))
+		return err
+	})
+	return response, err
+}
+
+// Remove defines an "remove value" operation
+// If specified node doesn't exist, a ErrNoSuchKey error is returned
+// If specified value doesn't exist within a node, a ErrNoSuchValue error is returned
+// If node contains specified value multiple times, all values are removed
+// (unless a "all" parameter is set to "false"
+func (c *shardedClient) Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*Node, error) {
+	var response *Node
+	err := c.route(ctx, in.Key, opts, func(client Client, s *session, ctx context.Context, opts []grpc.CallOption) error {
+		var err error
+		response, err = s.observeNode(client.Remove(ctx, in, opts...))
+		return err
+	})
+	return response, err
+}
+
+// Delete removes a key completely
+// If specified node doesn't exist, a ErrNoSuchKey error is returned
+func (c *shardedClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*None, error) {
+	var response *None
+	err := c.route(ctx, in.Key, opts, func(client Client, s *session, ctx context.Context, opts []grpc.CallOption) error {
+		var err error
+		var header metadata.MD
+		response, err = client.Delete(ctx, in, append(opts, grpc.Header(&header))...)
+		if err == nil {
+			s.observeHeader(header)
+		}
+		return err
+	})
+	return response, err
+}
+
+// Backup isn't supported, each shard is backed up separately
+func (c *shardedClient) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (Service_BackupClient, error) {
+	return nil, status.Error(codes.Unimplemented, "backup must be requested from a single shard")
+}
+
+// Health isn't supported, each shard reports its own state
+func (c *shardedClient) Health(ctx context.Context, in *None, opts ...grpc.CallOption) (*HealthStatus, error) {
+	return nil, status.Error(codes.Unimplemented, "health must be requested from a single shard")
+}
+
+// Replicate isn't supported, each shard is replicated separately
+func (c *shardedClient) Replicate(ctx context.Context, opts ...grpc.CallOption) (Service_ReplicateClient, error) {
+	return nil, status.Error(codes.Unimplemented, "replication must be requested from a single shard")
+}
+
+// UpdateClusterMap isn't supported, cluster map is sent to each shard separately (see MoveRange)
+func (c *shardedClient) UpdateClusterMap(ctx context.Context, in *ClusterMapUpdate, opts ...grpc.CallOption) (*ClusterMapUpdateResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "cluster map must be sent to a single shard")
+}
+
+// Import isn't supported, nodes are imported into a single shard
+func (c *shardedClient) Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*None, error) {
+	return nil, status.Error(codes.Unimplemented, "nodes must be imported into a single shard")
+}
+
+// DropForeignKeys isn't supported, each shard drops keys of other shards separately
+func (c *shardedClient) DropForeignKeys(ctx context.Context, in *None, opts ...grpc.CallOption) (*DroppedKeys, error) {
+	return nil, status.Error(codes.Unimplemented, "keys of other shards must be dropped by a single shard")
+}
+
+// Close shuts down connections to every shard
+func (c *shardedClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var lastErr error
+	for _, client := range c.clients {
+		err := client.Close()
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
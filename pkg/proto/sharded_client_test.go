@@ -0,0 +1,140 @@
+package proto_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/db/dbtest"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/proto"
+)
+
+func TestShardedClient(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	m, shards := startInterleavedShards(t)
+	client, err := proto.NewShardedClient(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// Each key is written to a shard that owns it
+	ctx := context.Background()
+	keys := []string{"a1", "a2", "b1", "b2", "c1", "c2", "d1", "d2"}
+	for _, key := range keys {
+		_, err = client.Set(ctx, &proto.SetRequest{Key: key, Values: [][]byte{[]byte(key)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys {
+		owner, err := m.Lookup(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, shard := range shards {
+			dbtest.CheckKey(t, shard.engine, db.Key(key), name == owner.Name)
+		}
+		checkValues(t, client, key, key)
+	}
+
+	// Pages span keys of both shards
+	cases := []struct {
+		skip, limit uint32
+		expected    []string
+	}{
+		{0, 3, []string{"a1", "a2", "b1"}},
+		{1, 4, []string{"a2", "b1", "b2", "c1"}},
+		{3, 3, []string{"b2", "c1", "c2"}},
+		{6, 5, []string{"d1", "d2"}},
+		{8, 5, []string{}},
+	}
+	for _, c := range cases {
+		list, err := client.List(ctx, &proto.ListRequest{Skip: c.skip, Limit: c.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.TotalCount != uint32(len(keys)) {
+			t.Errorf("ERROR: skip=%d, limit=%d: expected %d keys in total but got %d", c.skip, c.limit, len(keys), list.TotalCount)
+		}
+		actual := make([]string, len(list.Nodes))
+		for i, node := range list.Nodes {
+			actual[i] = node.Key
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(c.expected) {
+			t.Errorf("ERROR: skip=%d, limit=%d: expected %v but got %v", c.skip, c.limit, c.expected, actual)
+		}
+	}
+
+	list, err := client.List(ctx, &proto.ListRequest{Prefix: "c", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalCount != 2 || len(list.Nodes) != 2 || list.Nodes[0].Key != "c1" || list.Nodes[1].Key != "c2" {
+		t.Errorf("ERROR: unexpected list of \"c\" keys: %v", list)
+	}
+}
+
+func TestShardedClientStaleMap(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	m, shards := startInterleavedShards(t)
+	client, err := proto.NewShardedClient(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// Keys of range "c" move to the second shard, while client still has previous map
+	next, err := m.Move(proto.RangeMove{Target: "shard-1", Keys: &proto.KeyRange{From: "c", To: "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proto.ApplyClusterMap(context.Background(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Client is redirected by the first shard and retries with its map
+	_, err = client.Set(context.Background(), &proto.SetRequest{Key: "c1", Values: [][]byte{[]byte("c1")}})
+	if err != nil {
+		t.Fatalf("ERROR: write with a stale map has failed: %s", err)
+	}
+	dbtest.CheckKey(t, shards["shard-0"].engine, "c1", false)
+	dbtest.CheckKey(t, shards["shard-1"].engine, "c1", true)
+	checkValues(t, client, "c1", "c1")
+}
+
+// startInterleavedShards starts two sharded servers whose key ranges interleave:
+// keys starting with "a" and "c" belong to the first one, keys starting with "b" and "d" belong to the second one
+func startInterleavedShards(t *testing.T) (*proto.ClusterMap, map[string]*testServer) {
+	shards := map[string]*testServer{
+		"shard-0": startShard(t),
+		"shard-1": startShard(t),
+	}
+	m := &proto.ClusterMap{
+		Version: 1,
+		Shards: []*proto.Shard{
+			{Name: "shard-0", Endpoint: shards["shard-0"].endpoint, Keys: []proto.KeyRange{{From: "a", To: "b"}, {From: "c", To: "d"}}},
+			{Name: "shard-1", Endpoint: shards["shard-1"].endpoint, Keys: []proto.KeyRange{{From: "b", To: "c"}, {From: "d", To: "e"}}},
+		},
+	}
+
+	err := m.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = proto.ApplyClusterMap(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m, shards
+}
@@ -0,0 +1,460 @@
+package raft
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/election"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// Node runs a DB engine as a member of a Raft group
+//
+// The replicated log is engine's WAL: each committed WAL transaction is a log entry identified by ID of its commit record,
+// and leader's term is stamped into commit records. Only leader accepts transactions.
+// Leader appends a transaction to its log, replicates it and applies it to data model only once a majority of nodes
+// has persisted it (see db.SyncReplicationPolicy.ApplyAfterAck), then its commit is acknowledged.
+// If it never reaches a majority, commit fails with a db.ErrReplicationTimeout error and transaction is never visible,
+// a new leader that lacks it makes old one install a snapshot. Like in Raft, leader counts only transactions of its own term,
+// transactions of previous terms are committed along with them, so a new leader writes an empty transaction first.
+// Leader passes its commit index to followers, they apply transactions up to it.
+// A follower whose log has diverged from leader's one installs a snapshot of leader's committed data,
+// the same way a follower does when leader has dropped transactions it needs
+// (WAL segments are dropped by vacuum once they are covered by a snapshot).
+// Transactions are replayed from WAL on restart whether they have been committed or not,
+// so a node that restarts with transactions which haven't reached a majority might serve them until it installs a snapshot
+type Node struct {
+	config       Config
+	engine       db.Engine
+	transport    Transport
+	state        *election.State
+	mutex        sync.Mutex
+	role         Role
+	leader       string
+	lastContact  map[string]time.Time
+	resetTimer   chan struct{}
+	stopLeading  context.CancelFunc
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         sync.WaitGroup
+	leaderChange chan struct{}
+}
+
+// NewNode creates a cluster node
+// Engine is switched into read-only mode until node is elected as leader
+// Node state is kept within a state file of specified storage driver
+func NewNode(config Config, engine db.Engine, driver storage.Driver, transport Transport) (*Node, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := election.LoadState(driver.StateFile(stateFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	engine.SetReadOnly(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Node{
+		config:       config,
+		engine:       engine,
+		transport:    transport,
+		state:        s,
+		role:         Follower,
+		lastContact:  make(map[string]time.Time),
+		resetTimer:   make(chan struct{}, 1),
+		ctx:          ctx,
+		cancel:       cancel,
+		leaderChange: make(chan struct{}),
+	}
+
+	log.Printf("node %s has joined a cluster of %d nodes at term %d", config.ID, len(config.Peers), s.Term)
+	return n, nil
+}
+
+// Start starts election timer
+func (n *Node) Start() {
+	n.done.Add(1)
+	go n.run()
+}
+
+// Close leaves cluster, engine is left in read-only mode
+func (n *Node) Close() error {
+	n.mutex.Lock()
+	n.becomeFollower()
+	n.mutex.Unlock()
+
+	n.cancel()
+	n.done.Wait()
+	return nil
+}
+
+// Status returns a state of the node
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	lastIndex, lastTerm := n.lastEntry()
+	return Status{
+		Role:        n.role,
+		Term:        n.state.Term,
+		Leader:      n.leader,
+		LastIndex:   lastIndex,
+		LastTerm:    lastTerm,
+		CommitIndex: n.engine.CommitIndex(),
+	}
+}
+
+// Leader returns an endpoint of current leader
+// If there's no leader at the moment, a ErrNoLeader error is returned
+func (n *Node) Leader() (string, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.leader == "" {
+		return "", ErrNoLeader
+	}
+	return n.leader, nil
+}
+
+// IsLeader returns true if this node is a leader
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.role == Leader
+}
+
+// LeaderChanged returns a channel that is closed once leader changes
+func (n *Node) LeaderChanged() <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.leaderChange
+}
+
+// RequestVote handles a vote request of a candidate
+func (n *Node) RequestVote(request *VoteRequest) (*VoteResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if request.Term > n.state.Term {
+		err := n.observeTerm(request.Term, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response := &VoteResponse{Term: n.state.Term}
+	if request.Term < n.state.Term {
+		return response, nil
+	}
+
+	// Candidate's log must be at least as up-to-date as voter's one, so a leader always has every committed transaction
+	granted, err := n.state.Vote(request.Candidate, request.LastTerm, request.LastIndex, n.engine.LastCommitID())
+	if err != nil {
+		return nil, err
+	}
+	if !granted {
+		return response, nil
+	}
+
+	log.Printf("voted for %s at term %d", request.Candidate, request.Term)
+	n.touch()
+	response.Granted = true
+	return response, nil
+}
+
+// AppendEntries handles transactions replicated by leader
+// Transactions are accepted only if follower's log ends with the transaction they follow
+func (n *Node) AppendEntries(request *AppendRequest) (*AppendResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	response, err := n.acceptLeader(request.Term, request.Leader)
+	if err != nil || !response.Success {
+		return response, err
+	}
+
+	if request.PrevIndex != response.LastIndex || request.PrevTerm != response.LastTerm {
+		log.Verbosef("transactions after #%d (term %d) are rejected: log ends at #%d (term %d)",
+			request.PrevIndex, request.PrevTerm, response.LastIndex, response.LastTerm)
+		response.Success = false
+		return response, nil
+	}
+
+	for _, records := range request.Transactions {
+		commit := records[len(records)-1]
+		term := commit.CommitTerm()
+
+		// Term is recorded before transaction is written, so term of a written transaction is never lost
+		err = n.state.AppendTerm(term, response.LastIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		err = n.engine.ApplyTx(records)
+		if err != nil {
+			log.Errorf("unable to apply tx #%d: %s", commit.TxID, err)
+			return nil, err
+		}
+
+		response.LastIndex, response.LastTerm = commit.ID, term
+	}
+
+	// Follower's log matches leader's one up to its end, so leader's commit index applies to it
+	commitIndex := request.CommitIndex
+	if commitIndex > response.LastIndex {
+		commitIndex = response.LastIndex
+	}
+	err = n.engine.SetCommitIndex(commitIndex)
+	if err != nil {
+		log.Errorf("unable to apply transactions up to #%d: %s", commitIndex, err)
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// InstallSnapshot replaces node's data with a snapshot of leader's data
+func (n *Node) InstallSnapshot(request *SnapshotRequest) (*AppendResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	response, err := n.acceptLeader(request.Term, request.Leader)
+	if err != nil || !response.Success {
+		return response, err
+	}
+
+	log.Printf("installing a snapshot of %s up to #%d (term %d)", request.Leader, request.LastIndex, request.LastTerm)
+	err = n.engine.Install(request.Root, request.LastIndex)
+	if err != nil {
+		log.Errorf("unable to install a snapshot: %s", err)
+		return nil, err
+	}
+
+	err = n.state.Reset(request.LastTerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Installing a large snapshot might take longer than election timeout
+	n.touch()
+	response.LastIndex, response.LastTerm = n.lastEntry()
+	return response, nil
+}
+
+// acceptLeader checks a term of a request sent by leader and makes node follow that leader
+// Response is successful unless request belongs to a stale term
+// Node lock must be held by caller
+func (n *Node) acceptLeader(term uint64, leader string) (*AppendResponse, error) {
+	response := &AppendResponse{Term: n.state.Term}
+	response.LastIndex, response.LastTerm = n.lastEntry()
+	if term < n.state.Term {
+		return response, nil
+	}
+
+	if n.leader != leader {
+		log.Printf("following leader %s at term %d", leader, term)
+	}
+	err := n.observeTerm(term, leader)
+	if err != nil {
+		return nil, err
+	}
+	response.Term = term
+
+	n.touch()
+	response.Success = true
+	return response, nil
+}
+
+// observeTerm makes node follow a term that is not older than its own one
+// Node lock must be held by caller
+func (n *Node) observeTerm(term uint64, leader string) error {
+	n.becomeFollower()
+	n.setLeader(leader)
+	if term == n.state.Term {
+		return nil
+	}
+
+	log.Verbosef("moving from term %d to term %d", n.state.Term, term)
+	return n.state.SetTerm(term, "")
+}
+
+// becomeFollower stops leading if node is a leader
+// Node lock must be held by caller
+func (n *Node) becomeFollower() {
+	if n.role == Leader {
+		log.Printf("stepping down at term %d", n.state.Term)
+		n.stopLeading()
+		n.stopLeading = nil
+		n.engine.SetReadOnly(true)
+	}
+	n.role = Follower
+}
+
+// setLeader remembers current leader and notifies those who wait for leader change
+// Node lock must be held by caller
+func (n *Node) setLeader(leader string) {
+	if n.leader == leader {
+		return
+	}
+
+	n.leader = leader
+	close(n.leaderChange)
+	n.leaderChange = make(chan struct{})
+}
+
+// touch resets election timer
+func (n *Node) touch() {
+	select {
+	case n.resetTimer <- struct{}{}:
+	default:
+	}
+}
+
+// lastEntry returns ID and term of the last transaction within node's log
+// Node lock must be held by caller
+func (n *Node) lastEntry() (uint64, uint64) {
+	index := n.engine.LastCommitID()
+	return index, n.state.History.TermOf(index)
+}
+
+// run runs elections once leader is lost, it also makes leader step down once it loses a majority
+func (n *Node) run() {
+	defer n.done.Done()
+
+	for {
+		timeout := n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+		timer := time.NewTimer(timeout)
+
+		select {
+		case <-n.ctx.Done():
+			timer.Stop()
+			return
+
+		case <-n.resetTimer:
+			timer.Stop()
+
+		case <-timer.C:
+			n.mutex.Lock()
+			if n.role == Leader {
+				n.checkQuorum()
+			} else {
+				n.startElection()
+			}
+			n.mutex.Unlock()
+		}
+	}
+}
+
+// checkQuorum makes leader step down if it hasn't heard from a majority of nodes for an election timeout
+// This way clients of a partitioned leader find a new leader instead of waiting for commits that never complete
+// Node lock must be held by caller
+func (n *Node) checkQuorum() {
+	count := 1
+	for _, peer := range n.config.Peers {
+		if peer != n.config.ID && time.Since(n.lastContact[peer]) < n.config.ElectionTimeout {
+			count++
+		}
+	}
+
+	if count < n.config.Quorum() {
+		log.Errorf("only %d of %d nodes are reachable, leader is stepping down", count, len(n.config.Peers))
+		n.becomeFollower()
+		n.setLeader("")
+	}
+}
+
+// startElection makes node a candidate and asks other nodes for their votes
+// Node lock must be held by caller
+func (n *Node) startElection() {
+	term := n.state.Term + 1
+	err := n.state.SetTerm(term, n.config.ID)
+	if err != nil {
+		return
+	}
+
+	n.role = Candidate
+	n.setLeader("")
+	lastIndex, lastTerm := n.lastEntry()
+	log.Printf("starting an election at term %d, log ends at #%d (term %d)", term, lastIndex, lastTerm)
+
+	votes := 1
+	if votes >= n.config.Quorum() {
+		n.becomeLeader(term)
+		return
+	}
+
+	request := &VoteRequest{
+		Term:      term,
+		Candidate: n.config.ID,
+		LastIndex: lastIndex,
+		LastTerm:  lastTerm,
+	}
+	for _, peer := range n.config.Peers {
+		if peer == n.config.ID {
+			continue
+		}
+
+		go func(peer string) {
+			ctx, cancel := context.WithTimeout(n.ctx, n.config.ElectionTimeout)
+			response, err := n.transport.RequestVote(ctx, peer, request)
+			cancel()
+			if err != nil {
+				log.Verbosef("unable to request a vote of %s: %s", peer, err)
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if response.Term > n.state.Term {
+				_ = n.observeTerm(response.Term, "")
+				return
+			}
+			if !response.Granted || n.role != Candidate || n.state.Term != term {
+				return
+			}
+
+			votes++
+			if votes >= n.config.Quorum() {
+				n.becomeLeader(term)
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader makes node a leader of specified term and starts replicating its log to followers
+// Node lock must be held by caller
+func (n *Node) becomeLeader(term uint64) {
+	lastIndex, _ := n.lastEntry()
+	err := n.state.AppendTerm(term, lastIndex)
+	if err != nil {
+		log.Errorf("unable to start leading: %s", err)
+		return
+	}
+
+	log.Printf("elected as leader at term %d", term)
+	n.role = Leader
+	n.setLeader(n.config.ID)
+	n.engine.SetTerm(term)
+	n.engine.SetReadOnly(false)
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	n.stopLeading = cancel
+	for _, peer := range n.config.Peers {
+		if peer == n.config.ID {
+			continue
+		}
+
+		// Leader has just heard from every node that has voted, others get an election timeout to respond
+		n.lastContact[peer] = time.Now()
+		n.done.Add(1)
+		go n.replicate(ctx, peer, term)
+	}
+}
@@ -0,0 +1,226 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+// maxBatchSize is a max count of transactions sent to a follower within a single request
+const maxBatchSize = 64
+
+// replication sends leader's transactions to a single follower
+type replication struct {
+	node      *Node
+	peer      string
+	term      uint64
+	feed      db.ChangeFeed
+	isMatched bool
+	prevIndex uint64
+	prevTerm  uint64
+}
+
+// replicate sends leader's transactions to a follower until leadership is lost
+// Follower is probed with a heartbeat first, so leader learns where follower's log ends
+func (n *Node) replicate(ctx context.Context, peer string, term uint64) {
+	defer n.done.Done()
+
+	r := &replication{node: n, peer: peer, term: term}
+	n.mutex.Lock()
+	r.prevIndex, r.prevTerm = n.lastEntry()
+	n.mutex.Unlock()
+	defer r.closeFeed()
+
+	for ctx.Err() == nil {
+		err := r.step(ctx)
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Transactions that have been read from feed might be lost, so feed is started over
+		log.Verbosef("unable to replicate to %s: %s", peer, err)
+		r.closeFeed()
+		select {
+		case <-time.After(n.config.HeartbeatInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// step sends a single batch of transactions (or a heartbeat) to follower
+func (r *replication) step(ctx context.Context) error {
+	n := r.node
+	if r.isMatched && r.feed == nil {
+		feed, err := n.engine.Subscribe(r.prevIndex)
+		if err == db.ErrChangesUnavailable {
+			return r.sendSnapshot(ctx)
+		}
+		if err != nil {
+			return err
+		}
+
+		r.feed = feed
+		r.feed.Ack(r.prevIndex)
+	}
+
+	transactions, err := r.nextBatch(ctx)
+	if err != nil {
+		return err
+	}
+
+	request := &AppendRequest{
+		Term:         r.term,
+		Leader:       n.config.ID,
+		PrevIndex:    r.prevIndex,
+		PrevTerm:     r.prevTerm,
+		Transactions: transactions,
+		CommitIndex:  n.engine.CommitIndex(),
+	}
+	requestCtx, cancel := context.WithTimeout(ctx, n.config.ElectionTimeout)
+	response, err := n.transport.AppendEntries(requestCtx, r.peer, request)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if !r.observe(response.Term) {
+		return nil
+	}
+
+	if response.Success {
+		r.prevIndex, r.prevTerm = response.LastIndex, response.LastTerm
+		r.isMatched = true
+		if r.feed != nil {
+			r.feed.Ack(r.prevIndex)
+		}
+		return nil
+	}
+
+	// Follower's log doesn't end where leader has expected, so replication starts over from its actual end
+	// If leader's log doesn't contain follower's last transaction, follower has diverged and needs a snapshot
+	r.closeFeed()
+	n.mutex.Lock()
+	lastIndex, _ := n.lastEntry()
+	contains := n.state.History.Contains(response.LastIndex, response.LastTerm, lastIndex)
+	n.mutex.Unlock()
+
+	if contains {
+		log.Verbosef("follower %s has a log up to #%d (term %d)", r.peer, response.LastIndex, response.LastTerm)
+		r.prevIndex, r.prevTerm = response.LastIndex, response.LastTerm
+		r.isMatched = true
+		return nil
+	}
+
+	log.Printf("follower %s has diverged at #%d (term %d)", r.peer, response.LastIndex, response.LastTerm)
+	return r.sendSnapshot(ctx)
+}
+
+// nextBatch waits for committed transactions, an empty batch is returned once heartbeat interval expires
+// Follower is probed right away if leader doesn't know where its log ends yet
+func (r *replication) nextBatch(ctx context.Context) ([][]*storage.WALRecord, error) {
+	if r.feed == nil {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(r.node.config.HeartbeatInterval)
+	defer timer.Stop()
+
+	transactions := make([][]*storage.WALRecord, 0)
+	select {
+	case records, ok := <-r.feed.Transactions():
+		if !ok {
+			return nil, fmt.Errorf("change feed has been stopped: %v", r.feed.Err())
+		}
+		transactions = append(transactions, records)
+
+	case <-timer.C:
+		return nil, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// Transactions that have been committed already are sent together
+	for len(transactions) < maxBatchSize {
+		select {
+		case records, ok := <-r.feed.Transactions():
+			if !ok {
+				return transactions, nil
+			}
+			transactions = append(transactions, records)
+		default:
+			return transactions, nil
+		}
+	}
+
+	return transactions, nil
+}
+
+// sendSnapshot replaces follower's data with a snapshot of leader's data
+func (r *replication) sendSnapshot(ctx context.Context) error {
+	n := r.node
+	r.closeFeed()
+
+	root, changeID, err := n.engine.Backup()
+	if err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	term := n.state.History.TermOf(changeID)
+	n.mutex.Unlock()
+
+	log.Printf("sending a snapshot up to #%d (term %d) to %s", changeID, term, r.peer)
+	request := &SnapshotRequest{
+		Term:      r.term,
+		Leader:    n.config.ID,
+		LastIndex: changeID,
+		LastTerm:  term,
+		Root:      root,
+	}
+	response, err := n.transport.InstallSnapshot(ctx, r.peer, request)
+	if err != nil {
+		return err
+	}
+	if !r.observe(response.Term) {
+		return nil
+	}
+	if !response.Success {
+		return fmt.Errorf("snapshot has been rejected")
+	}
+
+	r.prevIndex, r.prevTerm = response.LastIndex, response.LastTerm
+	r.isMatched = true
+	return nil
+}
+
+// observe records a response of follower
+// It returns false if follower has a newer term, in this case leader steps down
+func (r *replication) observe(term uint64) bool {
+	n := r.node
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.lastContact[r.peer] = time.Now()
+	if term > n.state.Term {
+		log.Printf("follower %s has a newer term %d", r.peer, term)
+		_ = n.observeTerm(term, "")
+		return false
+	}
+
+	return n.role == Leader && n.state.Term == r.term
+}
+
+// closeFeed stops change feed, follower stops counting as a replica until feed is started over
+func (r *replication) closeFeed() {
+	if r.feed != nil {
+		r.feed.Close()
+		r.feed = nil
+	}
+}
@@ -0,0 +1,334 @@
+package raft_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	"github.com/kapitanov/natandb/pkg/db/dbtest"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/raft"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestCluster(t *testing.T) {
+	c := createCluster(t, 3)
+	defer c.Close()
+
+	leader := c.waitForLeader(t, "")
+	dbtest.Write(t, c.engines[leader], "key-1", nil)
+	c.waitForSync(t)
+	for _, engine := range c.engines {
+		dbtest.CheckKey(t, engine, "key-1", true)
+	}
+
+	// Followers reject writes
+	for id, engine := range c.engines {
+		if id != leader {
+			dbtest.Write(t, engine, "key-2", db.ErrReadOnly)
+		}
+	}
+
+	// Partitioned leader can't commit, while the rest of cluster elects a new leader
+	c.network.isolate(leader, true)
+	dbtest.Write(t, c.engines[leader], "lost-key", db.ErrReplicationTimeout)
+	newLeader := c.waitForLeader(t, leader)
+	dbtest.Write(t, c.engines[newLeader], "key-3", nil)
+
+	// Old leader drops a transaction that hasn't been committed once it rejoins
+	c.network.isolate(leader, false)
+	c.waitForSync(t)
+	for _, engine := range c.engines {
+		dbtest.CheckKey(t, engine, "key-3", true)
+		dbtest.CheckKey(t, engine, "lost-key", false)
+	}
+	if status := c.nodes[leader].Status(); status.Role != raft.Follower || status.Leader != newLeader {
+		t.Errorf("ERROR: old leader has unexpected status %+v", status)
+	}
+}
+
+func TestPartitionedLeader(t *testing.T) {
+	c := createCluster(t, 3)
+	defer c.Close()
+
+	leader := c.waitForLeader(t, "")
+	engine := c.engines[leader]
+	dbtest.Write(t, engine, "key-1", nil)
+	c.waitForSync(t)
+	lastIndex := engine.LastCommitID()
+
+	// Partitioned leader appends a transaction to its log, but it doesn't apply it without a majority
+	c.network.isolate(leader, true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dbtest.Write(t, engine, "lost-key", db.ErrReplicationTimeout)
+	}()
+	waitFor(t, "lost-key is written", func() bool { return engine.LastCommitID() > lastIndex })
+
+	// Reads either wait for the transaction or don't see it
+	err := engine.Tx(func(tx db.TX) error {
+		_, e := tx.Get("lost-key")
+		return e
+	})
+	if err != db.ErrNoSuchKey && err != db.ErrReplicationTimeout {
+		t.Errorf("ERROR: lost-key is visible on partitioned leader (%v)", err)
+	}
+	<-done
+
+	waitFor(t, "partitioned leader steps down", func() bool { return !c.nodes[leader].IsLeader() })
+	dbtest.CheckKey(t, engine, "key-1", true)
+	dbtest.CheckKey(t, engine, "lost-key", false)
+	if engine.CommitIndex() != lastIndex {
+		t.Errorf("ERROR: transactions have been applied up to #%d, while #%d is the last committed one", engine.CommitIndex(), lastIndex)
+	}
+
+	// Majority doesn't have it either
+	c.waitForLeader(t, leader)
+	for id := range c.engines {
+		if id != leader {
+			dbtest.CheckKey(t, c.engines[id], "lost-key", false)
+		}
+	}
+}
+
+func TestClusterVacuum(t *testing.T) {
+	c := createCluster(t, 3)
+	defer c.Close()
+
+	leader := c.waitForLeader(t, "")
+	var follower string
+	for id := range c.engines {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+
+	// Follower that has fallen behind a vacuum gets a snapshot
+	c.network.isolate(follower, true)
+	for i := 0; i < 10; i++ {
+		dbtest.Write(t, c.engines[leader], db.Key(fmt.Sprintf("key-%d", i)), nil)
+	}
+	err := c.engines[leader].Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.engines[leader].Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.network.isolate(follower, false)
+	c.waitForSync(t)
+	for i := 0; i < 10; i++ {
+		dbtest.CheckKey(t, c.engines[follower], db.Key(fmt.Sprintf("key-%d", i)), true)
+	}
+}
+
+// cluster is a set of nodes connected by an in-memory network
+type cluster struct {
+	network *network
+	nodes   map[string]*raft.Node
+	engines map[string]db.Engine
+}
+
+func createCluster(t *testing.T, size int) *cluster {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	c := &cluster{
+		network: &network{nodes: make(map[string]*raft.Node), isolated: make(map[string]bool)},
+		nodes:   make(map[string]*raft.Node),
+		engines: make(map[string]db.Engine),
+	}
+
+	peers := make([]string, size)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("node-%d", i+1)
+	}
+
+	for _, id := range peers {
+		driver, err := storage.NewDriver(storage.InMemoryOption())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		engine, err := db.NewEngine(
+			db.StorageDriverOption(driver),
+			db.ReplicaOption(),
+			db.SyncReplicationOption(db.SyncReplicationPolicy{
+				Replicas:      size / 2,
+				Timeout:       500 * time.Millisecond,
+				Degradation:   db.DegradeToError,
+				ApplyAfterAck: true,
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := raft.Config{
+			ID:                id,
+			Peers:             peers,
+			ElectionTimeout:   200 * time.Millisecond,
+			HeartbeatInterval: 40 * time.Millisecond,
+		}
+		node, err := raft.NewNode(config, engine, driver, c.network.transport(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.network.add(id, node)
+		c.nodes[id] = node
+		c.engines[id] = engine
+	}
+
+	for _, node := range c.nodes {
+		node.Start()
+	}
+	return c
+}
+
+// waitForLeader waits until every connected node follows the same leader, other than specified one
+func (c *cluster) waitForLeader(t *testing.T, oldLeader string) string {
+	timeout := time.After(10 * time.Second)
+	for {
+		leaders := make(map[string]bool)
+		for id, node := range c.nodes {
+			if !c.network.isIsolated(id) {
+				leaders[node.Status().Leader] = true
+			}
+		}
+
+		for leader := range leaders {
+			if len(leaders) == 1 && leader != "" && leader != oldLeader && c.nodes[leader].IsLeader() {
+				return leader
+			}
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("ERROR: no leader has been elected, nodes follow %v", leaders)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// waitForSync waits until every node reaches and applies the same transaction
+func (c *cluster) waitForSync(t *testing.T) {
+	timeout := time.After(10 * time.Second)
+	for {
+		// Diverged logs might end at the same index, so their terms are compared too
+		indices := make(map[string]bool)
+		for _, node := range c.nodes {
+			status := node.Status()
+			indices[fmt.Sprintf("#%d (term %d, applied #%d)", status.LastIndex, status.LastTerm, status.CommitIndex)] = true
+		}
+		if len(indices) == 1 {
+			return
+		}
+
+		select {
+		case <-timeout:
+			t.Fatalf("ERROR: nodes haven't caught up, they are at %v", indices)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// waitFor waits until a condition is met
+func waitFor(t *testing.T, what string, condition func() bool) {
+	timeout := time.After(10 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("ERROR: timed out waiting until %s", what)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (c *cluster) Close() {
+	for id, node := range c.nodes {
+		_ = node.Close()
+		_ = c.engines[id].Close()
+	}
+}
+
+// network passes requests between nodes directly, isolated nodes are unreachable
+type network struct {
+	mutex    sync.Mutex
+	nodes    map[string]*raft.Node
+	isolated map[string]bool
+}
+
+func (n *network) add(id string, node *raft.Node) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.nodes[id] = node
+}
+
+func (n *network) isolate(id string, isolated bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.isolated[id] = isolated
+}
+
+func (n *network) isIsolated(id string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.isolated[id]
+}
+
+func (n *network) transport(from string) raft.Transport {
+	return &transport{network: n, from: from}
+}
+
+// connect returns a node if it's reachable from another one
+func (n *network) connect(from, to string) (*raft.Node, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.isolated[from] || n.isolated[to] {
+		return nil, fmt.Errorf("%s is unreachable from %s", to, from)
+	}
+	return n.nodes[to], nil
+}
+
+type transport struct {
+	network *network
+	from    string
+}
+
+func (t *transport) RequestVote(ctx context.Context, peer string, request *raft.VoteRequest) (*raft.VoteResponse, error) {
+	node, err := t.network.connect(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.RequestVote(request)
+}
+
+func (t *transport) AppendEntries(ctx context.Context, peer string, request *raft.AppendRequest) (*raft.AppendResponse, error) {
+	node, err := t.network.connect(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.AppendEntries(request)
+}
+
+func (t *transport) InstallSnapshot(ctx context.Context, peer string, request *raft.SnapshotRequest) (*raft.AppendResponse, error) {
+	node, err := t.network.connect(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return node.InstallSnapshot(request)
+}
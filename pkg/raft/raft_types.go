@@ -0,0 +1,221 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/model"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+var log = l.New("raft")
+
+const (
+	// DefaultElectionTimeout is a default min delay before a follower that hasn't heard from leader starts an election
+	DefaultElectionTimeout = 1 * time.Second
+
+	// DefaultHeartbeatInterval is a default max delay between two messages from leader to a follower
+	DefaultHeartbeatInterval = 200 * time.Millisecond
+
+	// stateFileName is a name of a state file that keeps node's term, vote and terms of its transactions
+	stateFileName = "raft.dat"
+)
+
+// Error is a lightweight error type
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+const (
+	// ErrNotLeader is returned when a request that only leader can serve is sent to another node
+	ErrNotLeader = Error("node is not a cluster leader")
+
+	// ErrNoLeader is returned when cluster has no elected leader at the moment
+	ErrNoLeader = Error("cluster has no leader")
+)
+
+// Config is a configuration of a cluster node
+type Config struct {
+	// ID is an endpoint of this node, it must be listed within Peers
+	ID string
+
+	// Peers is a list of endpoints of every cluster node, including this one
+	Peers []string
+
+	// ElectionTimeout is a min delay before a follower that hasn't heard from leader starts an election
+	// Actual delay is randomized within [ElectionTimeout, 2*ElectionTimeout)
+	// Leader steps down if it hasn't heard from a majority of nodes for this long
+	ElectionTimeout time.Duration
+
+	// HeartbeatInterval is a max delay between two messages from leader to a follower
+	HeartbeatInterval time.Duration
+}
+
+// Quorum returns a count of nodes that make a majority
+func (c Config) Quorum() int {
+	return len(c.Peers)/2 + 1
+}
+
+// validate checks configuration and fills default values
+func (c *Config) validate() error {
+	if c.ElectionTimeout <= 0 {
+		c.ElectionTimeout = DefaultElectionTimeout
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if c.HeartbeatInterval >= c.ElectionTimeout {
+		return fmt.Errorf("heartbeat interval (%s) must be less than election timeout (%s)", c.HeartbeatInterval, c.ElectionTimeout)
+	}
+
+	isListed := false
+	peers := make(map[string]bool)
+	for _, peer := range c.Peers {
+		if peers[peer] {
+			return fmt.Errorf("node \"%s\" is listed twice", peer)
+		}
+		peers[peer] = true
+		isListed = isListed || peer == c.ID
+	}
+	if !isListed {
+		return fmt.Errorf("node \"%s\" is not listed within cluster nodes", c.ID)
+	}
+
+	return nil
+}
+
+// Role is a role of a cluster node
+type Role int
+
+const (
+	// Follower applies transactions of leader, it's read-only
+	Follower Role = iota
+
+	// Candidate is a follower that runs an election
+	Candidate
+
+	// Leader accepts transactions and replicates them to followers
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	default:
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+}
+
+// Status is a state of a cluster node
+type Status struct {
+	// Role of this node
+	Role Role
+
+	// Current term
+	Term uint64
+
+	// Endpoint of current leader, empty if leader is unknown
+	Leader string
+
+	// ID of the last transaction within node's log
+	LastIndex uint64
+
+	// Term of the last transaction within node's log
+	LastTerm uint64
+
+	// ID of the last transaction that node has applied to its data
+	CommitIndex uint64
+}
+
+// VoteRequest is sent by a candidate to gather votes
+type VoteRequest struct {
+	// Candidate's term
+	Term uint64
+
+	// Candidate's endpoint
+	Candidate string
+
+	// ID and term of the last transaction within candidate's log
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+// VoteResponse is a reply to VoteRequest
+type VoteResponse struct {
+	// Current term of voter, for candidate to update itself
+	Term uint64
+
+	// True if vote has been granted
+	Granted bool
+}
+
+// AppendRequest is sent by leader to replicate transactions, it's used as a heartbeat too
+type AppendRequest struct {
+	// Leader's term
+	Term uint64
+
+	// Leader's endpoint
+	Leader string
+
+	// ID and term of the transaction that new transactions follow
+	// It must be the last transaction within follower's log
+	PrevIndex uint64
+	PrevTerm  uint64
+
+	// New transactions, each one ends with a WALCommitTx record (empty for heartbeats)
+	Transactions [][]*storage.WALRecord
+
+	// ID of the last transaction that a majority of nodes has persisted, follower applies transactions up to it
+	CommitIndex uint64
+}
+
+// AppendResponse is a reply to AppendRequest and SnapshotRequest
+type AppendResponse struct {
+	// Current term of follower, for leader to update itself
+	Term uint64
+
+	// True if follower's log has matched and transactions have been appended
+	Success bool
+
+	// ID and term of the last transaction within follower's log
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+// SnapshotRequest is sent by leader to replace follower's data with its snapshot
+// It's sent when follower's log has diverged from leader's one or when leader has dropped transactions follower needs
+type SnapshotRequest struct {
+	// Leader's term
+	Term uint64
+
+	// Leader's endpoint
+	Leader string
+
+	// ID and term of the last transaction that snapshot contains
+	LastIndex uint64
+	LastTerm  uint64
+
+	// Data snapshot
+	Root *model.Root
+}
+
+// Transport sends requests to other cluster nodes
+type Transport interface {
+	// RequestVote asks a node for its vote
+	RequestVote(ctx context.Context, peer string, request *VoteRequest) (*VoteResponse, error)
+
+	// AppendEntries replicates transactions to a node
+	AppendEntries(ctx context.Context, peer string, request *AppendRequest) (*AppendResponse, error)
+
+	// InstallSnapshot replaces node's data with a snapshot
+	InstallSnapshot(ctx context.Context, peer string, request *SnapshotRequest) (*AppendResponse, error)
+}
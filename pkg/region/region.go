@@ -0,0 +1,541 @@
+package region
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+var log = l.New("region")
+
+// Strategy defines how conflicting changes of a key made in different regions are resolved
+type Strategy string
+
+const (
+	// LastWriterWins keeps a value of the latest write by hybrid logical clock
+	// Every write replicates the whole value of a key
+	LastWriterWins Strategy = "lww"
+
+	// AddWins treats values of a key as an observed-remove set
+	// A removal drops only the values it has observed, so a concurrent addition survives it
+	AddWins Strategy = "add-wins"
+)
+
+// ParseStrategy parses a conflict resolution strategy
+func ParseStrategy(str string) (Strategy, error) {
+	switch Strategy(str) {
+	case LastWriterWins, AddWins:
+		return Strategy(str), nil
+	default:
+		return "", fmt.Errorf("unknown conflict resolution strategy \"%s\"", str)
+	}
+}
+
+// ReservedPrefix is a prefix of keys that keep replication state
+// These keys are hidden from clients and can't be changed by them
+const ReservedPrefix = "\x00"
+
+const (
+	configKey    = ReservedPrefix + "region/config"
+	txKey        = ReservedPrefix + "region/tx"
+	keyPrefix    = ReservedPrefix + "region/key/"
+	originPrefix = ReservedPrefix + "region/origin/"
+)
+
+// IsReserved returns true if a key is reserved for replication state
+func IsReserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
+// Tag identifies a single value added to a key (see AddWins)
+type Tag struct {
+	// Region where value has been added
+	Origin string `json:"o"`
+
+	// Clock of the region at the moment value has been added
+	HLC uint64 `json:"h"`
+}
+
+// config is a region configuration data has been written with
+type config struct {
+	Origin   string   `json:"origin"`
+	Strategy Strategy `json:"strategy"`
+}
+
+// keyState is a replication state of a key
+type keyState struct {
+	// Clock and region of the last write (LastWriterWins only), they are kept for deleted keys too
+	HLC    uint64 `json:"hlc,omitempty"`
+	Origin string `json:"origin,omitempty"`
+
+	// Tags of key values, in the same order (AddWins only)
+	Tags []Tag `json:"tags,omitempty"`
+
+	// Tags of values that have been removed before their additions have arrived (AddWins only)
+	Removed []Tag `json:"removed,omitempty"`
+}
+
+// originState is a replication state of a peer region
+type originState struct {
+	// ID of the last applied change of peer's WAL
+	ChangeID uint64 `json:"change_id"`
+
+	// Clock of the last applied transaction
+	HLC uint64 `json:"hlc"`
+}
+
+// delta describes changes of a transaction that has been committed locally
+// It's written into WAL as a value of a reserved key, so peers receive it together with the transaction
+type delta struct {
+	Origin  string    `json:"origin"`
+	HLC     uint64    `json:"hlc"`
+	Changes []*change `json:"changes"`
+}
+
+// change describes changes of a single key
+type change struct {
+	Key string `json:"key"`
+
+	// LastWriterWins: new values of the key (empty if key has been deleted)
+	// AddWins: values that have been added
+	Values [][]byte `json:"values,omitempty"`
+
+	// Tags of added values (AddWins only)
+	Tags []Tag `json:"tags,omitempty"`
+
+	// Tags of removed values (AddWins only)
+	Removed []Tag `json:"removed,omitempty"`
+}
+
+// clock is a hybrid logical clock
+// Upper 48 bits contain physical time in milliseconds, lower 16 bits contain a logical counter
+type clock struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+// now returns a new timestamp that is greater than any timestamp returned or observed before
+func (c *clock) now() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	physical := uint64(time.Now().UnixNano()/int64(time.Millisecond)) << 16
+	if physical > c.last {
+		c.last = physical
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// observe moves clock past a timestamp received from another region
+func (c *clock) observe(ts uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+// Engine is a DB engine that accepts writes in several regions
+// Every local transaction is stamped with region ID and hybrid logical clock,
+// peers apply it with Apply() and resolve conflicts per key with a configured strategy
+// Data must be empty when engine is used for the first time, since existing data isn't replicated
+type Engine struct {
+	db.Engine
+	origin   string
+	strategy Strategy
+	clock    *clock
+}
+
+// NewEngine wraps an engine to accept writes in a region with specified ID
+// Every region must use the same strategy, region ID and strategy can't be changed later
+func NewEngine(engine db.Engine, origin string, strategy Strategy) (*Engine, error) {
+	if origin == "" || IsReserved(origin) {
+		return nil, fmt.Errorf("malformed region ID \"%s\"", origin)
+	}
+
+	e := &Engine{
+		Engine:   engine,
+		origin:   origin,
+		strategy: strategy,
+		clock:    &clock{},
+	}
+
+	err := engine.Tx(func(tx db.TX) error {
+		c := &config{}
+		ok, err := readJSON(tx, configKey, c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			c = &config{Origin: origin, Strategy: strategy}
+			return writeJSON(tx, configKey, c)
+		}
+		if c.Origin != origin || c.Strategy != strategy {
+			return fmt.Errorf("data belongs to region \"%s\" with \"%s\" strategy", c.Origin, c.Strategy)
+		}
+
+		// Clock never goes back, even if physical time does
+		d := &delta{}
+		_, err = readJSON(tx, txKey, d)
+		if err != nil {
+			return err
+		}
+		e.clock.observe(d.HLC)
+
+		nodes, err := listAll(tx, originPrefix)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			s := &originState{}
+			err = unmarshalNode(node, s)
+			if err != nil {
+				return err
+			}
+			e.clock.observe(s.HLC)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("accepting writes as region \"%s\", conflicts are resolved with \"%s\" strategy", origin, strategy)
+	return e, nil
+}
+
+// Origin returns region ID
+func (e *Engine) Origin() string {
+	return e.origin
+}
+
+// Strategy returns conflict resolution strategy
+func (e *Engine) Strategy() Strategy {
+	return e.strategy
+}
+
+// BeginTx starts new transaction
+// Transaction hides reserved keys and stamps its changes once it's committed
+func (e *Engine) BeginTx() (db.TX, error) {
+	tx, err := e.Engine.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+
+	return newTransaction(e, tx), nil
+}
+
+// Tx executes a function within a transaction
+func (e *Engine) Tx(fn func(tx db.TX) error) error {
+	tx, err := e.BeginTx()
+	if err != nil {
+		return err
+	}
+	isClosed := false
+	defer func() {
+		if !isClosed {
+			_ = tx.Close()
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	tx.Commit()
+	isClosed = true
+	return tx.Close()
+}
+
+// Checkpoint returns ID of the last applied change of a peer region
+// Peer's transactions should be requested after this ID (see db.Engine.Subscribe)
+func (e *Engine) Checkpoint(peer string) (uint64, error) {
+	s := &originState{}
+	err := e.Engine.Tx(func(tx db.TX) error {
+		_, err := readJSON(tx, originPrefix+peer, s)
+		return err
+	})
+	return s.ChangeID, err
+}
+
+// Apply applies a transaction committed by a peer region
+// Only transactions that have been committed by the peer itself are applied,
+// the rest (e.g. transactions it has received from other regions) are skipped, so every region must replicate from every other one
+// Transactions that have been applied already are skipped too, it returns true if transaction has been applied
+func (e *Engine) Apply(peer string, records []*storage.WALRecord) (bool, error) {
+	d, err := readDelta(records)
+	if err != nil || d == nil || d.Origin != peer {
+		return false, err
+	}
+
+	applied := false
+	err = e.Engine.Tx(func(tx db.TX) error {
+		s := &originState{}
+		_, err := readJSON(tx, originPrefix+peer, s)
+		if err != nil {
+			return err
+		}
+		if d.HLC <= s.HLC {
+			return nil
+		}
+
+		e.clock.observe(d.HLC)
+		r := &resolver{engine: e, tx: tx, origins: map[string]uint64{peer: s.HLC}}
+		for _, c := range d.Changes {
+			if IsReserved(c.Key) {
+				continue
+			}
+
+			switch e.strategy {
+			case LastWriterWins:
+				err = r.applyLastWriterWins(d, c)
+			case AddWins:
+				err = r.applyAddWins(c)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		s.ChangeID = records[len(records)-1].ID
+		s.HLC = d.HLC
+		applied = true
+		return writeJSON(tx, originPrefix+peer, s)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if applied {
+		log.Verbosef("transaction #%d of region \"%s\" has been applied", records[len(records)-1].ID, peer)
+	}
+	return applied, nil
+}
+
+// readDelta extracts changes of a transaction, nil is returned for transactions that haven't been stamped
+func readDelta(records []*storage.WALRecord) (*delta, error) {
+	for _, record := range records {
+		if record.Type == storage.WALAddValue && record.Key == txKey {
+			d := &delta{}
+			err := json.Unmarshal(record.Value, d)
+			if err != nil {
+				return nil, fmt.Errorf("malformed transaction #%d: %s", record.ID, err)
+			}
+			return d, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// resolver applies changes of a peer region, resolving conflicts with local changes
+type resolver struct {
+	engine  *Engine
+	tx      db.TX
+	origins map[string]uint64
+}
+
+// applyLastWriterWins replaces a value of a key unless it has been written later
+// Writes with the same clock are ordered by region ID
+func (r *resolver) applyLastWriterWins(d *delta, c *change) error {
+	s := &keyState{}
+	_, err := readJSON(r.tx, keyPrefix+c.Key, s)
+	if err != nil {
+		return err
+	}
+
+	if d.HLC < s.HLC || d.HLC == s.HLC && d.Origin <= s.Origin {
+		return nil
+	}
+
+	_, err = r.tx.Set(db.Key(c.Key), toValues(c.Values))
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(r.tx, keyPrefix+c.Key, &keyState{HLC: d.HLC, Origin: d.Origin})
+}
+
+// applyAddWins removes values with observed tags and adds new values
+func (r *resolver) applyAddWins(c *change) error {
+	values, err := getValues(r.tx, c.Key)
+	if err != nil {
+		return err
+	}
+
+	s := &keyState{}
+	_, err = readJSON(r.tx, keyPrefix+c.Key, s)
+	if err != nil {
+		return err
+	}
+	tags := s.tags(len(values))
+
+	for _, tag := range c.Removed {
+		if i := indexOf(tags, tag); i >= 0 {
+			values = append(values[:i], values[i+1:]...)
+			tags = append(tags[:i], tags[i+1:]...)
+			continue
+		}
+
+		// Removal has arrived before addition, so addition is dropped once it arrives
+		isAdded, err := r.isAdded(tag)
+		if err != nil {
+			return err
+		}
+		if !isAdded && indexOf(s.Removed, tag) < 0 {
+			s.Removed = append(s.Removed, tag)
+		}
+	}
+
+	for i, value := range c.Values {
+		tag := c.Tags[i]
+		if j := indexOf(s.Removed, tag); j >= 0 {
+			s.Removed = append(s.Removed[:j], s.Removed[j+1:]...)
+			continue
+		}
+		if indexOf(tags, tag) < 0 {
+			values = append(values, value)
+			tags = append(tags, tag)
+		}
+	}
+
+	_, err = r.tx.Set(db.Key(c.Key), values)
+	if err != nil {
+		return err
+	}
+
+	s.Tags = tags
+	return writeKeyState(r.tx, c.Key, s)
+}
+
+// isAdded returns true if a value with specified tag has been added already
+// Every region applies transactions of another region in the order they have been committed,
+// so tags that are older than the last applied transaction of their region have been applied
+func (r *resolver) isAdded(tag Tag) (bool, error) {
+	if tag.Origin == "" || tag.Origin == r.engine.origin {
+		return true, nil
+	}
+
+	hlc, ok := r.origins[tag.Origin]
+	if !ok {
+		s := &originState{}
+		_, err := readJSON(r.tx, originPrefix+tag.Origin, s)
+		if err != nil {
+			return false, err
+		}
+		hlc = s.HLC
+		r.origins[tag.Origin] = hlc
+	}
+
+	return tag.HLC <= hlc, nil
+}
+
+// tags returns tags of n key values
+// Values that have been written before region has been set up have no tags
+func (s *keyState) tags(n int) []Tag {
+	tags := make([]Tag, n)
+	copy(tags, s.Tags)
+	return tags
+}
+
+func indexOf(tags []Tag, tag Tag) int {
+	for i := range tags {
+		if tags[i] == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+func toValues(values [][]byte) []db.Value {
+	result := make([]db.Value, len(values))
+	for i := range values {
+		result[i] = values[i]
+	}
+	return result
+}
+
+// getValues returns a copy of key values, nil is returned if key doesn't exist
+func getValues(tx db.TX, key string) ([]db.Value, error) {
+	node, err := tx.Get(db.Key(key))
+	if err != nil {
+		if err == db.ErrNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	values := make([]db.Value, len(node.Values))
+	copy(values, node.Values)
+	return values, nil
+}
+
+// writeKeyState writes a replication state of a key, state is dropped once it's empty
+func writeKeyState(tx db.TX, key string, s *keyState) error {
+	if s.HLC == 0 && len(s.Tags) == 0 && len(s.Removed) == 0 {
+		_, err := tx.Set(db.Key(keyPrefix+key), nil)
+		return err
+	}
+
+	return writeJSON(tx, keyPrefix+key, s)
+}
+
+// readJSON reads a JSON value of a reserved key, false is returned if key doesn't exist
+func readJSON(tx db.TX, key string, v interface{}) (bool, error) {
+	node, err := tx.Get(db.Key(key))
+	if err != nil {
+		if err == db.ErrNoSuchKey {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, unmarshalNode(node, v)
+}
+
+func unmarshalNode(node *db.Node, v interface{}) error {
+	if len(node.Values) != 1 {
+		return fmt.Errorf("malformed %q key", node.Key)
+	}
+
+	err := json.Unmarshal(node.Values[0], v)
+	if err != nil {
+		return fmt.Errorf("malformed %q key: %s", node.Key, err)
+	}
+	return nil
+}
+
+// writeJSON writes a JSON value of a reserved key
+func writeJSON(tx db.TX, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Set(db.Key(key), []db.Value{data})
+	return err
+}
+
+// listAll returns every node with specified key prefix
+func listAll(tx db.TX, prefix string) ([]*db.Node, error) {
+	list, err := tx.List(db.Key(prefix), 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err = tx.List(db.Key(prefix), 0, list.TotalCount, 0)
+	if err != nil {
+		return nil, err
+	}
+	return list.Nodes, nil
+}
@@ -0,0 +1,231 @@
+package region_test
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/db"
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/region"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestLastWriterWins(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	a := newEngine(t, "a", region.LastWriterWins)
+	b := newEngine(t, "b", region.LastWriterWins)
+
+	set(t, a, "deleted", "value")
+	replicate(t, a, b)
+
+	// Concurrent writes are resolved in favor of the latest one in both regions
+	set(t, a, "key", "a")
+	set(t, a, "deleted", "a")
+	time.Sleep(2 * time.Millisecond)
+	set(t, b, "key", "b")
+	remove(t, b, "deleted")
+	replicate(t, a, b)
+	replicate(t, b, a)
+
+	for _, e := range []*region.Engine{a, b} {
+		expect(t, e, "key", "b")
+		expect(t, e, "deleted")
+	}
+
+	// Transactions that have come from a peer aren't sent back to it
+	if n := replicate(t, a, b); n != 0 {
+		t.Errorf("ERROR: %d transaction(s) have been applied again", n)
+	}
+
+	// Reserved keys are neither listed nor changed by clients
+	err := a.Tx(func(tx db.TX) error {
+		list, err := tx.List("", 0, 10, 0)
+		if err != nil {
+			return err
+		}
+		if list.TotalCount != 1 || len(list.Nodes) != 1 || list.Nodes[0].Key != "key" {
+			t.Errorf("ERROR: unexpected list %s", list)
+		}
+
+		_, err = tx.Set(region.ReservedPrefix+"key", nil)
+		if err != db.ErrReservedKey {
+			t.Errorf("ERROR: expected %s but got %v", db.ErrReservedKey, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddWins(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	a := newEngine(t, "a", region.AddWins)
+	b := newEngine(t, "b", region.AddWins)
+	c := newEngine(t, "c", region.AddWins)
+
+	add(t, a, "key", "x")
+	replicate(t, a, b)
+
+	// Removal doesn't drop a concurrent addition of the same value
+	remove(t, a, "key", "x")
+	add(t, b, "key", "x")
+	add(t, b, "key", "y")
+	replicate(t, a, b)
+	replicate(t, b, a)
+	expect(t, a, "key", "x", "y")
+	expect(t, b, "key", "x", "y")
+
+	// Removal that arrives before its addition drops it
+	add(t, a, "other", "z")
+	replicate(t, a, b)
+	remove(t, b, "other", "z")
+	replicate(t, b, c)
+	replicate(t, a, c)
+	expect(t, c, "other")
+
+	replicate(t, b, a)
+	replicate(t, c, a)
+	replicate(t, c, b)
+	replicate(t, a, c)
+	for _, e := range []*region.Engine{a, b, c} {
+		expect(t, e, "key", "x", "y")
+		expect(t, e, "other")
+	}
+}
+
+func newEngine(t *testing.T, origin string, strategy region.Strategy) *region.Engine {
+	driver, err := storage.NewDriver(storage.InMemoryOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := db.NewEngine(db.StorageDriverOption(driver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = engine.Close() })
+
+	e, err := region.NewEngine(engine, origin, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// replicate applies transactions of one region to another one and returns a count of applied transactions
+func replicate(t *testing.T, from, to *region.Engine) int {
+	changeID, err := to.Checkpoint(from.Origin())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	feed, err := from.Subscribe(changeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feed.Close()
+
+	count := 0
+	lastID := from.LastCommitID()
+	for changeID < lastID {
+		select {
+		case records := <-feed.Transactions():
+			applied, err := to.Apply(from.Origin(), records)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied {
+				count++
+			}
+			changeID = records[len(records)-1].ID
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transactions of \"%s\" haven't been received", from.Origin())
+		}
+	}
+	return count
+}
+
+func set(t *testing.T, e db.Engine, key string, values ...string) {
+	err := e.Tx(func(tx db.TX) error {
+		_, err := tx.Set(db.Key(key), toValues(values))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func add(t *testing.T, e db.Engine, key string, value string) {
+	err := e.Tx(func(tx db.TX) error {
+		_, err := tx.AddValue(db.Key(key), db.Value(value))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func remove(t *testing.T, e db.Engine, key string, values ...string) {
+	err := e.Tx(func(tx db.TX) error {
+		if len(values) == 0 {
+			return tx.RemoveKey(db.Key(key))
+		}
+		for _, value := range values {
+			_, err := tx.RemoveValue(db.Key(key), db.Value(value))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expect(t *testing.T, e *region.Engine, key string, values ...string) {
+	var actual []string
+	err := e.Tx(func(tx db.TX) error {
+		node, err := tx.Get(db.Key(key))
+		if err == db.ErrNoSuchKey {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, value := range node.Values {
+			actual = append(actual, string(value))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actual) != len(values) {
+		t.Errorf("ERROR: \"%s\" has values %q in region \"%s\", expected %q", key, actual, e.Origin(), values)
+		return
+	}
+	for i := range values {
+		if actual[i] != values[i] {
+			t.Errorf("ERROR: \"%s\" has values %q in region \"%s\", expected %q", key, actual, e.Origin(), values)
+			return
+		}
+	}
+}
+
+func toValues(values []string) []db.Value {
+	result := make([]db.Value, len(values))
+	for i := range values {
+		result[i] = db.Value(values[i])
+	}
+	return result
+}
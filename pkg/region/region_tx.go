@@ -0,0 +1,285 @@
+package region
+
+import (
+	"github.com/kapitanov/natandb/pkg/db"
+)
+
+// transaction is a transaction of a region engine
+// It keeps values that keys have had before their first change, so it's able to describe its changes once it's committed
+type transaction struct {
+	engine       *Engine
+	tx           db.TX
+	shouldCommit bool
+	keys         []string
+	values       map[string][]db.Value
+}
+
+func newTransaction(engine *Engine, tx db.TX) *transaction {
+	return &transaction{
+		engine: engine,
+		tx:     tx,
+		values: make(map[string][]db.Value),
+	}
+}
+
+// List returns paged list of DB keys (with values)
+// Reserved keys are skipped
+func (t *transaction) List(prefix db.Key, skip uint, limit uint, version uint64) (*db.PagedNodeList, error) {
+	if prefix != "" && !IsReserved(string(prefix)) {
+		return t.tx.List(prefix, skip, limit, version)
+	}
+
+	list, err := t.tx.List(prefix, 0, 0, version)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err = t.tx.List(prefix, 0, list.TotalCount, version)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*db.Node, 0, len(list.Nodes))
+	for _, node := range list.Nodes {
+		if !IsReserved(string(node.Key)) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	list.TotalCount = uint(len(nodes))
+	if int(skip) < len(nodes) {
+		nodes = nodes[skip:]
+	} else {
+		nodes = nodes[:0]
+	}
+	if len(nodes) > int(limit) {
+		nodes = nodes[:limit]
+	}
+	list.Nodes = nodes
+	return list, nil
+}
+
+// Keys returns sorted list of DB keys with specified prefix
+// Reserved keys are skipped
+func (t *transaction) Keys(prefix db.Key) []db.Key {
+	keys := t.tx.Keys(prefix)
+	result := keys[:0]
+	for _, key := range keys {
+		if !IsReserved(string(key)) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// GetVersion returns current data version
+func (t *transaction) GetVersion() uint64 {
+	return t.tx.GetVersion()
+}
+
+// Get gets a node value by its key
+// Reserved keys are reported as non-existing ones
+func (t *transaction) Get(key db.Key) (*db.Node, error) {
+	if IsReserved(string(key)) {
+		return nil, db.ErrNoSuchKey
+	}
+
+	return t.tx.Get(key)
+}
+
+// Set sets a node value, rewriting its value if node already exists
+func (t *transaction) Set(key db.Key, values []db.Value) (*db.Node, error) {
+	err := t.touch(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.tx.Set(key, values)
+}
+
+// AddValue defines an "append value" operation
+func (t *transaction) AddValue(key db.Key, value db.Value) (*db.Node, error) {
+	err := t.touch(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.tx.AddValue(key, value)
+}
+
+// AddUniqueValue defines an "append value" operation that rejects duplicate values
+func (t *transaction) AddUniqueValue(key db.Key, value db.Value) (*db.Node, error) {
+	err := t.touch(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.tx.AddUniqueValue(key, value)
+}
+
+// RemoveValue defines an "remove value" operation
+func (t *transaction) RemoveValue(key db.Key, value db.Value) (*db.Node, error) {
+	err := t.touch(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.tx.RemoveValue(key, value)
+}
+
+// RemoveAllValues defines an "remove value" operation that removes every matching value
+func (t *transaction) RemoveAllValues(key db.Key, value db.Value) (*db.Node, error) {
+	err := t.touch(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.tx.RemoveAllValues(key, value)
+}
+
+// RemoveKey removes a key completely
+func (t *transaction) RemoveKey(key db.Key) error {
+	err := t.touch(key)
+	if err != nil {
+		return err
+	}
+
+	return t.tx.RemoveKey(key)
+}
+
+// Commit marks transaction for committing
+func (t *transaction) Commit() {
+	t.shouldCommit = true
+}
+
+// Close terminates a transaction
+// Changes are stamped before transaction is committed, transaction is rolled back if it fails
+func (t *transaction) Close() error {
+	if t.shouldCommit {
+		err := t.stamp()
+		if err != nil {
+			_ = t.tx.Close()
+			return err
+		}
+		t.tx.Commit()
+	}
+
+	return t.tx.Close()
+}
+
+// touch keeps values of a key before its first change
+func (t *transaction) touch(key db.Key) error {
+	if IsReserved(string(key)) {
+		return db.ErrReservedKey
+	}
+
+	if _, ok := t.values[string(key)]; ok {
+		return nil
+	}
+
+	values, err := getValues(t.tx, string(key))
+	if err != nil {
+		return err
+	}
+
+	t.keys = append(t.keys, string(key))
+	t.values[string(key)] = values
+	return nil
+}
+
+// stamp updates replication state of changed keys and writes a description of transaction changes
+func (t *transaction) stamp() error {
+	if len(t.keys) == 0 {
+		return nil
+	}
+
+	d := &delta{Origin: t.engine.origin}
+	for _, key := range t.keys {
+		values, err := getValues(t.tx, key)
+		if err != nil {
+			return err
+		}
+
+		c := &change{Key: key}
+		if t.engine.strategy == LastWriterWins {
+			c.Values = toBytes(values)
+			d.Changes = append(d.Changes, c)
+			continue
+		}
+
+		s := &keyState{}
+		_, err = readJSON(t.tx, keyPrefix+key, s)
+		if err != nil {
+			return err
+		}
+
+		s.Tags = t.diff(c, t.values[key], s.tags(len(t.values[key])), values)
+		err = writeKeyState(t.tx, key, s)
+		if err != nil {
+			return err
+		}
+		if len(c.Values) > 0 || len(c.Removed) > 0 {
+			d.Changes = append(d.Changes, c)
+		}
+	}
+
+	if len(d.Changes) == 0 {
+		return nil
+	}
+
+	// Clock is read after tags are issued, so transaction clock is never less than clock of its tags
+	d.HLC = t.engine.clock.now()
+	if t.engine.strategy == LastWriterWins {
+		for _, c := range d.Changes {
+			err := writeJSON(t.tx, keyPrefix+c.Key, &keyState{HLC: d.HLC, Origin: d.Origin})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeJSON(t.tx, txKey, d)
+}
+
+// diff describes how values of a key have changed (see AddWins)
+// Values that have been kept keep their tags, new values get new tags
+// It returns tags of new values
+func (t *transaction) diff(c *change, before []db.Value, tags []Tag, after []db.Value) []Tag {
+	isKept := make([]bool, len(before))
+	result := make([]Tag, len(after))
+	for i, value := range after {
+		j := 0
+		for ; j < len(before); j++ {
+			if !isKept[j] && before[j].Equal(value) {
+				break
+			}
+		}
+
+		if j < len(before) {
+			isKept[j] = true
+			result[i] = tags[j]
+			continue
+		}
+
+		tag := Tag{Origin: t.engine.origin, HLC: t.engine.clock.now()}
+		result[i] = tag
+		c.Values = append(c.Values, value)
+		c.Tags = append(c.Tags, tag)
+	}
+
+	for j := range before {
+		if !isKept[j] && tags[j].Origin != "" {
+			c.Removed = append(c.Removed, tags[j])
+		}
+	}
+
+	return result
+}
+
+func toBytes(values []db.Value) [][]byte {
+	result := make([][]byte, len(values))
+	for i := range values {
+		result[i] = values[i]
+	}
+	return result
+}
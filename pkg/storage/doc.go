@@ -25,3 +25,6 @@ package storage
 // | 6 | N bytes | Payload | "Key" field          |
 // | 7 | N bytes | Payload | "Value" field        |
 // +---+---------+---------+----------------------+
+//
+// If encryption is enabled, record type has a 0x80 bit set
+// and record payload is sealed with AES-GCM (see storage_encryption.go)
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// errMapUnsupported is returned when a file can't be memory-mapped
+var errMapUnsupported = fmt.Errorf("file can't be memory-mapped")
+
+// bytesMapping is a SnapshotMapping of data that has been read into memory
+type bytesMapping []byte
+
+// ReadAt reads data at specified offset
+func (m bytesMapping) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if offset >= int64(len(m)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, m[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns length of data
+func (m bytesMapping) Size() int64 {
+	return int64(len(m))
+}
+
+// Close does nothing
+func (m bytesMapping) Close() error {
+	return nil
+}
+
+// isEncryptedSnapshot returns true if data starts with an encrypted snapshot header
+func isEncryptedSnapshot(data []byte) bool {
+	return len(data) >= 4 && binary.LittleEndian.Uint32(data) == encryptedSnapshotMagic
+}
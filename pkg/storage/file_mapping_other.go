@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package storage
+
+// mapFile is not supported on this platform, so snapshot is read into memory instead
+func mapFile(path string) (SnapshotMapping, error) {
+	return nil, errMapUnsupported
+}
@@ -0,0 +1,57 @@
+package storage_test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestSnapshotMap(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	data := bytes.Repeat([]byte("snapshot data "), 10000)
+	for name, opts := range map[string][]storage.DriverOption{
+		"plain text": {},
+		"encrypted":  {storage.EncryptionKeyOption(encryptionTestKey)},
+		"in-memory":  {storage.InMemoryOption()},
+	} {
+		driver := createEncryptedDriver(t, t.TempDir(), opts...)
+
+		// Missing snapshot is mapped as an empty one
+		mapping, err := driver.SnapshotFile().Map()
+		if err != nil {
+			t.Fatalf("ERROR: unable to map %s snapshot: %s", name, err)
+		}
+		if mapping.Size() != 0 {
+			t.Errorf("ERROR: expected empty %s snapshot but got %d bytes", name, mapping.Size())
+		}
+		_ = mapping.Close()
+
+		writeSnapshot(t, driver, data)
+		mapping, err = driver.SnapshotFile().Map()
+		if err != nil {
+			t.Fatalf("ERROR: unable to map %s snapshot: %s", name, err)
+		}
+
+		actual := make([]byte, mapping.Size())
+		_, err = mapping.ReadAt(actual, 0)
+		if err != nil || !bytes.Equal(actual, data) {
+			t.Errorf("ERROR: %s snapshot doesn't match (%v)", name, err)
+		}
+
+		_, err = mapping.ReadAt(make([]byte, 10), mapping.Size()-5)
+		if err != io.EOF {
+			t.Errorf("ERROR: expected EOF at the end of %s snapshot but got %v", name, err)
+		}
+
+		err = mapping.Close()
+		if err != nil {
+			t.Errorf("ERROR: unable to close %s snapshot: %s", name, err)
+		}
+	}
+}
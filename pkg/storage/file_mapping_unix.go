@@ -0,0 +1,59 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapMapping is a SnapshotMapping of a memory-mapped file
+type mmapMapping struct {
+	bytesMapping
+}
+
+// mapFile maps a plain text snapshot file into memory
+// Empty and encrypted files are not mapped, errMapUnsupported is returned instead
+func mapFile(path string) (SnapshotMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := stat.Size()
+	if size == 0 || int64(int(size)) != size {
+		return nil, errMapUnsupported
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	if isEncryptedSnapshot(data) {
+		_ = syscall.Munmap(data)
+		return nil, errMapUnsupported
+	}
+
+	return &mmapMapping{data}, nil
+}
+
+// Close unmaps a file
+func (m *mmapMapping) Close() error {
+	if m.bytesMapping == nil {
+		return nil
+	}
+
+	err := syscall.Munmap(m.bytesMapping)
+	m.bytesMapping = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// file is an abstract random-access file
+// WAL and snapshot routines use it instead of *os.File, so they don't depend on a physical storage
+type file interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	// Truncate changes the size of the file
+	Truncate(size int64) error
+
+	// Sync commits the current contents of the file to stable storage
+	Sync() error
+}
+
+// fileSystem is an abstract file storage
+type fileSystem interface {
+	// OpenFile opens a file using os.OpenFile() flags
+	OpenFile(path string, flag int) (file, error)
+
+	// ReadDir returns names of files within a directory
+	ReadDir(path string) ([]string, error)
+
+	// Size returns length of a file
+	Size(path string) (int64, error)
+
+	// Remove removes a file
+	Remove(path string) error
+
+	// Rename renames (moves) a file, replacing target file if it exists
+	Rename(oldPath, newPath string) error
+
+	// MkDir ensures that specified directory exists
+	MkDir(path string) error
+}
+
+// osFileSystem is a fileSystem based on physical files
+type osFileSystem struct{}
+
+// OpenFile opens a file using os.OpenFile() flags
+func (osFileSystem) OpenFile(path string, flag int) (file, error) {
+	f, err := os.OpenFile(path, flag, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ReadDir returns names of files within a directory
+func (osFileSystem) ReadDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// Size returns length of a file
+func (osFileSystem) Size(path string) (int64, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Size(), nil
+}
+
+// Remove removes a file
+func (osFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// Rename renames (moves) a file, replacing target file if it exists
+func (osFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// MkDir ensures that specified directory exists
+func (osFileSystem) MkDir(path string) error {
+	return util.MkDir(path)
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// memoryFileSystem is a fileSystem that keeps all files in memory
+type memoryFileSystem struct {
+	lock  *sync.Mutex
+	files map[string]*memoryFileData
+}
+
+// memoryFileData is a content of an in-memory file
+type memoryFileData struct {
+	lock *sync.Mutex
+	data []byte
+}
+
+func newMemoryFileSystem() *memoryFileSystem {
+	return &memoryFileSystem{
+		lock:  new(sync.Mutex),
+		files: make(map[string]*memoryFileData),
+	}
+}
+
+// OpenFile opens a file using os.OpenFile() flags
+func (fs *memoryFileSystem) OpenFile(path string, flag int) (file, error) {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	data, exists := fs.files[path]
+	if exists {
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+		}
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+
+		data = &memoryFileData{
+			lock: new(sync.Mutex),
+			data: make([]byte, 0),
+		}
+		fs.files[path] = data
+	}
+
+	f := &memoryFile{
+		file:     data,
+		position: 0,
+		readOnly: flag&(os.O_WRONLY|os.O_RDWR) == 0,
+	}
+
+	if flag&os.O_TRUNC != 0 && !f.readOnly {
+		err := f.Truncate(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// ReadDir returns names of files within a directory
+func (fs *memoryFileSystem) ReadDir(path string) ([]string, error) {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	names := make([]string, 0)
+	for p := range fs.files {
+		if filepath.Dir(p) == path {
+			names = append(names, filepath.Base(p))
+		}
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// Size returns length of a file
+func (fs *memoryFileSystem) Size(path string) (int64, error) {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	data, exists := fs.files[path]
+	fs.lock.Unlock()
+
+	if !exists {
+		return 0, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	return int64(len(data.data)), nil
+}
+
+// Remove removes a file
+func (fs *memoryFileSystem) Remove(path string) error {
+	path = filepath.Clean(path)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	_, exists := fs.files[path]
+	if !exists {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+
+	delete(fs.files, path)
+	return nil
+}
+
+// Rename renames (moves) a file, replacing target file if it exists
+func (fs *memoryFileSystem) Rename(oldPath, newPath string) error {
+	oldPath = filepath.Clean(oldPath)
+	newPath = filepath.Clean(newPath)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	data, exists := fs.files[oldPath]
+	if !exists {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: os.ErrNotExist}
+	}
+
+	delete(fs.files, oldPath)
+	fs.files[newPath] = data
+	return nil
+}
+
+// MkDir ensures that specified directory exists
+func (fs *memoryFileSystem) MkDir(path string) error {
+	// Directories are implicit for in-memory files
+	return nil
+}
+
+// memoryFile is a handle of an in-memory file
+type memoryFile struct {
+	file     *memoryFileData
+	position int64
+	readOnly bool
+	closed   bool
+}
+
+// Read reads data from current position
+func (f *memoryFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	if f.position >= int64(len(f.file.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.file.data[f.position:])
+	f.position += int64(n)
+	return n, nil
+}
+
+// ReadAt reads data at specified offset, current position is not changed
+func (f *memoryFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset: %d", offset)
+	}
+	if offset >= int64(len(f.file.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.file.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write writes data at current position
+func (f *memoryFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.readOnly {
+		return 0, fmt.Errorf("file is opened for reading only")
+	}
+
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	end := f.position + int64(len(p))
+	if end > int64(len(f.file.data)) {
+		f.file.data = append(f.file.data, make([]byte, end-int64(len(f.file.data)))...)
+	}
+
+	n := copy(f.file.data[f.position:], p)
+	f.position += int64(n)
+	return n, nil
+}
+
+// Seek sets current position
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = f.position + offset
+	case io.SeekEnd:
+		position = int64(len(f.file.data)) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if position < 0 {
+		return 0, fmt.Errorf("negative position: %d", position)
+	}
+
+	f.position = position
+	return position, nil
+}
+
+// Truncate changes the size of the file
+func (f *memoryFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.readOnly {
+		return fmt.Errorf("file is opened for reading only")
+	}
+
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	if size < int64(len(f.file.data)) {
+		f.file.data = f.file.data[:size]
+	} else {
+		f.file.data = append(f.file.data, make([]byte, size-int64(len(f.file.data)))...)
+	}
+
+	return nil
+}
+
+// Sync commits the current contents of the file to stable storage
+func (f *memoryFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	return nil
+}
+
+// Close closes file handle
+func (f *memoryFile) Close() error {
+	// Lock is held since a handle might be closed while it's read via ReadAt()
+	f.file.lock.Lock()
+	defer f.file.lock.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// Migration is a single step that converts a data file from one format version into another
+// Original file is always kept as a backup (see MigrationBackupPath)
+type Migration struct {
+	// Path to a file that is converted
+	Path string
+	// Format version of existing file
+	FromVersion uint32
+	// Format version of converted file
+	ToVersion uint32
+	// Human-readable description of a conversion
+	Description string
+	// Run performs a conversion
+	Run func() error
+}
+
+// String converts a migration into its string representation
+func (m *Migration) String() string {
+	return fmt.Sprintf("%s: v%d -> v%d, %s", filepath.Base(m.Path), m.FromVersion, m.ToVersion, m.Description)
+}
+
+// MigrationBackupPath returns a path to a backup of a file that is converted from specified version
+func MigrationBackupPath(path string, version uint32) string {
+	return fmt.Sprintf("%s.v%d.bak", path, version)
+}
+
+// AutoMigrateOption controls whether NewDriver converts WAL files of older format versions automatically
+// Automatic migration is on by default, turn it off to inspect pending migrations (see WALFile.Migrations)
+func AutoMigrateOption(enable bool) DriverOption {
+	return func(options *driverOptions) error {
+		options.noAutoMigrate = !enable
+		return nil
+	}
+}
+
+// walConversion converts WAL records between two adjacent WAL format versions
+type walConversion struct {
+	// Older version, newer one is version+1
+	version uint32
+	// Human-readable description of a conversion
+	description string
+	// upgrade converts a record of older version into a record of newer version
+	upgrade func(record *WALRecord) (*WALRecord, error)
+	// downgrade converts a record of newer version into a record of older version
+	downgrade func(record *WALRecord) (*WALRecord, error)
+}
+
+// walConversions contains a conversion for every supported WAL format version but the latest one, ordered by version
+// Once WALVersion is bumped, a conversion from previous version must be appended here
+var walConversions = []walConversion{}
+
+// walOldestVersion returns the oldest WAL format version that might be converted into current one
+func walOldestVersion() uint32 {
+	return WALVersion - uint32(len(walConversions))
+}
+
+// Migrations returns a list of steps that convert WAL into specified format version
+// Zero version stands for current WAL format version
+// Returned steps must be run in order, nothing is changed until then
+// Segments of unsupported versions are skipped, since they can't be converted
+func (f *walFile) Migrations(version uint32) ([]*Migration, error) {
+	if version == 0 {
+		version = WALVersion
+	}
+	if version < walOldestVersion() || version > WALVersion {
+		return nil, fmt.Errorf("wal file version v%d is not supported (expected v%d..v%d)", version, walOldestVersion(), WALVersion)
+	}
+
+	indices, err := f.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]*Migration, 0)
+	paths := make([]string, 0, len(indices)+1)
+
+	// Non-segmented WAL file turns into a first WAL segment
+	_, err = f.fs.Size(f.path)
+	if err == nil {
+		if len(indices) > 0 {
+			return nil, fmt.Errorf("both wal file \"%s\" and wal segments exist", f.path)
+		}
+
+		segmentPath := f.segmentPath(1)
+		version, _, err := f.segmentVersion(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, &Migration{
+			Path:        f.path,
+			FromVersion: version,
+			ToVersion:   version,
+			Description: fmt.Sprintf("convert non-segmented wal file into segment \"%s\"", filepath.Base(segmentPath)),
+			Run: func() error {
+				return f.migrateLegacyFile()
+			},
+		})
+		paths = append(paths, f.path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, index := range indices {
+		paths = append(paths, f.segmentPath(index))
+	}
+
+	for _, path := range paths {
+		from, ok, err := f.segmentVersion(path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || from == version {
+			continue
+		}
+		// Segment with unknown version is either damaged or written by a newer version, it's reported by Verify()
+		if from < walOldestVersion() || from > WALVersion {
+			log.Errorf("wal file \"%s\" has version v%d that is not supported (expected v%d..v%d), it's left as is", path, from, walOldestVersion(), WALVersion)
+			continue
+		}
+
+		// Legacy file is converted once it has been renamed
+		if path == f.path {
+			path = f.segmentPath(1)
+		}
+
+		migration := &Migration{
+			Path:        path,
+			FromVersion: from,
+			ToVersion:   version,
+			Description: walConversionDescription(from, version),
+		}
+		migration.Run = func() error {
+			return f.convertSegment(migration.Path, migration.FromVersion, migration.ToVersion)
+		}
+
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, nil
+}
+
+// migrate runs every step that converts WAL into current format version
+func (f *walFile) migrate() error {
+	migrations, err := f.Migrations(0)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		log.Printf("migrating %s", m)
+		err = m.Run()
+		if err != nil {
+			log.Errorf("unable to migrate \"%s\": %s", m.Path, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// segmentVersion reads format version of a WAL segment
+// It returns false if segment has no complete header yet
+func (f *walFile) segmentVersion(path string) (uint32, bool, error) {
+	length, err := f.fs.Size(path)
+	if err != nil {
+		return 0, false, err
+	}
+	if length < WALHeaderLength {
+		return 0, false, nil
+	}
+
+	file, err := f.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return 0, false, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	version, err := util.ReadUint32(file)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return version, true, nil
+}
+
+// walConversionDescription describes every conversion between specified versions
+func walConversionDescription(from, to uint32) string {
+	descriptions := make([]string, 0)
+	for v := from; v < to; v++ {
+		descriptions = append(descriptions, walConversions[v-walOldestVersion()].description)
+	}
+	for v := from; v > to; v-- {
+		descriptions = append(descriptions, "revert "+walConversions[v-1-walOldestVersion()].description)
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// convertRecord converts a plain text WAL record between specified versions
+func convertRecord(record *WALRecord, from, to uint32) (*WALRecord, error) {
+	var err error
+	for v := from; v < to && err == nil; v++ {
+		record, err = walConversions[v-walOldestVersion()].upgrade(record)
+	}
+	for v := from; v > to && err == nil; v-- {
+		record, err = walConversions[v-1-walOldestVersion()].downgrade(record)
+	}
+	return record, err
+}
+
+// convertSegment rewrites a WAL segment in specified format version
+// Segment is written into a temporary file first, then original segment is renamed into a backup file
+func (f *walFile) convertSegment(path string, from, to uint32) error {
+	input, err := f.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return err
+	}
+
+	tempPath := path + ".tmp"
+	output, err := f.fs.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		_ = input.Close()
+		log.Errorf("unable to create file \"%s\": %s", tempPath, err)
+		return err
+	}
+
+	err = f.convertRecords(bufio.NewReaderSize(input, walReadBufferSize), output, from, to)
+	_ = input.Close()
+	if err == nil {
+		err = output.Sync()
+	}
+	if err != nil {
+		_ = output.Close()
+		_ = f.fs.Remove(tempPath)
+		return err
+	}
+
+	err = output.Close()
+	if err != nil {
+		_ = f.fs.Remove(tempPath)
+		return err
+	}
+
+	backupPath := MigrationBackupPath(path, from)
+	err = f.fs.Rename(path, backupPath)
+	if err != nil {
+		log.Errorf("unable to rename \"%s\" to \"%s\": %s", path, backupPath, err)
+		_ = f.fs.Remove(tempPath)
+		return err
+	}
+
+	err = f.fs.Rename(tempPath, path)
+	if err != nil {
+		log.Errorf("unable to rename \"%s\" to \"%s\": %s", tempPath, path, err)
+		return err
+	}
+
+	log.Printf("wal segment \"%s\" has been converted from v%d into v%d, original segment is kept as \"%s\"", path, from, to, backupPath)
+	return nil
+}
+
+// convertRecords reads every record of a WAL segment and writes converted records into output
+// A damaged record stops conversion, since it must be repaired first
+func (f *walFile) convertRecords(input io.Reader, output io.Writer, from, to uint32) error {
+	_, err := util.ReadUint32(input)
+	if err != nil {
+		return err
+	}
+
+	err = util.WriteUint32(output, to)
+	if err != nil {
+		return err
+	}
+
+	for {
+		record, err := ReadWALRecord(input)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("unable to read wal record, data must be repaired first: %s", err)
+		}
+
+		id := record.ID
+		record, err = f.encryption.decryptRecord(record)
+		if err == nil {
+			record, err = decompressRecord(record)
+		}
+		if err == nil {
+			record, err = convertRecord(record, from, to)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to convert wal record #%d: %s", id, err)
+		}
+
+		record = compressRecord(record, f.compressionThreshold)
+		if f.encryption != nil {
+			record, err = f.encryption.encryptRecord(record)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = WriteWALRecord(output, record)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package storage_test
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestWALMigrations(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "journal.dat")
+	segmentPath := filepath.Join(dir, "journal-000001.dat")
+	writeWALSegment(t, legacyPath, []*storage.WALRecord{
+		{ID: 1, TxID: 1, Type: storage.WALAddValue, Key: "key", Value: []byte("value")},
+		{ID: 2, TxID: 1, Type: storage.WALCommitTx},
+	}, nil)
+
+	// Pending migrations are only listed unless automatic migration is on
+	driver, err := storage.NewDriver(storage.DirectoryOption(dir), storage.AutoMigrateOption(false))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	migrations, err := driver.WALFile().Migrations(0)
+	if err != nil {
+		t.Fatalf("ERROR: Migrations() failed: %s", err)
+	}
+	if len(migrations) != 1 || migrations[0].Path != legacyPath {
+		t.Errorf("ERROR: unexpected migrations %v", migrations)
+	}
+	if _, err = os.Stat(legacyPath); err != nil {
+		t.Errorf("ERROR: legacy wal file has been changed: %s", err)
+	}
+
+	_, err = driver.WALFile().Migrations(storage.WALVersion + 1)
+	if err == nil {
+		t.Errorf("ERROR: migration into unknown version should fail")
+	}
+
+	// Pending migrations are run by NewDriver by default
+	driver, err = storage.NewDriver(storage.DirectoryOption(dir))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+	if _, err = os.Stat(segmentPath); err != nil {
+		t.Errorf("ERROR: legacy wal file has not been converted: %s", err)
+	}
+
+	migrations, err = driver.WALFile().Migrations(0)
+	if err != nil {
+		t.Fatalf("ERROR: Migrations() failed: %s", err)
+	}
+	if len(migrations) != 0 {
+		t.Errorf("ERROR: unexpected migrations %v", migrations)
+	}
+
+	verification, err := driver.WALFile().Verify()
+	if err != nil {
+		t.Fatalf("ERROR: Verify() failed: %s", err)
+	}
+	if verification.LastCommitID != 2 || len(verification.Problems) > 0 {
+		t.Errorf("ERROR: migrated wal is damaged: %v", verification.Problems)
+	}
+}
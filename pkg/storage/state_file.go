@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// stateFile is a small file that is always rewritten as a whole
+type stateFile struct {
+	fs   fileSystem
+	path string
+}
+
+// StateFile provides access to a small state file with specified name
+func (d *driver) StateFile(name string) StateFile {
+	directory, _ := filepath.Split(d.snapshot.path)
+	return &stateFile{fs: d.snapshot.fs, path: filepath.Join(directory, name)}
+}
+
+// Read returns file contents, nil is returned if file doesn't exist or is empty
+func (f *stateFile) Read() ([]byte, error) {
+	file, err := f.fs.OpenFile(f.path, os.O_RDONLY|os.O_CREATE)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", f.path, err)
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	data, err := io.ReadAll(file)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Write replaces file contents atomically
+// Data is written into a temporary file first, then it replaces an existing file
+func (f *stateFile) Write(data []byte) error {
+	tempPath := f.path + ".tmp"
+	file, err := f.fs.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", tempPath, err)
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = f.fs.Remove(tempPath)
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.fs.Rename(tempPath, f.path)
+}
@@ -0,0 +1,557 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// Encrypted WAL record keeps its ID, TxID and type in plain text,
+// while its key and value are sealed together into record's "Value" field.
+// Record type has walEncryptedFlag bit set and "Key" field is empty:
+//
+// +---+----------+----------------------------------------+
+// | # | Length   | Field                                  |
+// +---+----------+----------------------------------------+
+// | 1 | 4 bytes  | Key ID                                 |
+// | 2 | 12 bytes | Nonce                                  |
+// | 3 | N bytes  | Sealed len(Key) (4 bytes), Key, Value  |
+// +---+----------+----------------------------------------+
+//
+// Record ID, TxID and type are authenticated as additional data,
+// so an encrypted payload can't be moved to another record.
+//
+// Encrypted snapshot file is a sequence of sealed chunks of plain snapshot:
+//
+// +---+----------+---------------------------------+
+// | # | Length   | Field                           |
+// +---+----------+---------------------------------+
+// | 1 | 4 bytes  | Magic ("NENC")                  |
+// | 2 | 4 bytes  | Key ID                          |
+// | 3 | 8 bytes  | Nonce prefix                    |
+// | 4 | variable | Chunks[0]                       |
+// |   | ...      | ...                             |
+// | N | variable | Chunks[N-1]                     |
+// +---+----------+---------------------------------+
+//
+// Each chunk is a 4-byte length followed by sealed data.
+// Chunk nonce is a nonce prefix followed by a 4-byte chunk index,
+// and the last chunk is marked within additional data, so a truncated snapshot is detected.
+
+const (
+	// EncryptionKeyEnvVar is an environment variable that contains an encryption key
+	// It's used when no key file is specified
+	EncryptionKeyEnvVar = "NATANDB_ENCRYPTION_KEY"
+
+	// walEncryptedFlag marks an encrypted WAL record within record type field
+	walEncryptedFlag WALRecordType = 0x80
+
+	// encryptedSnapshotMagic is "NENC" in little endian
+	encryptedSnapshotMagic uint32 = 0x434e454e
+
+	// encryptedSnapshotChunkSize is a max length of plain data within an encrypted snapshot chunk
+	encryptedSnapshotChunkSize = 64 * 1024
+)
+
+var (
+	// ErrNoEncryptionKey is returned when encrypted data is read without a matching key
+	ErrNoEncryptionKey = errors.New("data is encrypted with an unknown key")
+)
+
+// encryptionKey is a single AES-GCM key
+type encryptionKey struct {
+	id   uint32
+	aead cipher.AEAD
+}
+
+// encryption encrypts data with current key and decrypts data with any of known keys
+type encryption struct {
+	current *encryptionKey
+	keys    map[uint32]*encryptionKey
+}
+
+// EncryptionKeyOption turns encryption at rest on
+// WAL records and snapshots are encrypted with the key, while old keys are used only to read data encrypted before key rotation
+// Once a vacuum routine has run with a new key, old keys are not needed anymore (unless WAL archive is read)
+// Keys must be 16, 24 or 32 bytes long (AES-128, AES-192 or AES-256)
+func EncryptionKeyOption(key []byte, oldKeys ...[]byte) DriverOption {
+	return func(options *driverOptions) error {
+		e, err := newEncryption(key, oldKeys)
+		if err != nil {
+			return err
+		}
+
+		options.encryption = e
+		return nil
+	}
+}
+
+// EncryptionKeyFileOption turns encryption at rest on, reading keys from specified files (see EncryptionKeyOption)
+// If key file path is empty, a key is read from NATANDB_ENCRYPTION_KEY environment variable
+// If the variable is not set either, encryption stays off
+func EncryptionKeyFileOption(keyFile string, oldKeyFiles ...string) DriverOption {
+	return func(options *driverOptions) error {
+		var key []byte
+		var err error
+		if keyFile != "" {
+			key, err = ReadEncryptionKeyFile(keyFile)
+		} else if str := os.Getenv(EncryptionKeyEnvVar); str != "" {
+			key, err = ParseEncryptionKey(str)
+			if err != nil {
+				err = fmt.Errorf("malformed %s: %s", EncryptionKeyEnvVar, err)
+			}
+		} else if len(oldKeyFiles) > 0 {
+			err = fmt.Errorf("old encryption keys are specified without a new one")
+		} else {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		oldKeys := make([][]byte, len(oldKeyFiles))
+		for i, path := range oldKeyFiles {
+			oldKeys[i], err = ReadEncryptionKeyFile(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		return EncryptionKeyOption(key, oldKeys...)(options)
+	}
+}
+
+// ReadEncryptionKeyFile reads an encryption key from a file
+// File contains a key in hex or base64 encoding (see ParseEncryptionKey)
+func ReadEncryptionKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Errorf("unable to read encryption key file \"%s\": %s", path, err)
+		return nil, err
+	}
+
+	key, err := ParseEncryptionKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("malformed encryption key file \"%s\": %s", path, err)
+	}
+
+	return key, nil
+}
+
+// ParseEncryptionKey decodes an encryption key from its hex or base64 form
+func ParseEncryptionKey(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+
+	key, err := hex.DecodeString(str)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("key is neither hex nor base64 encoded")
+		}
+	}
+
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes long, got %d bytes", len(key))
+	}
+}
+
+func newEncryption(key []byte, oldKeys [][]byte) (*encryption, error) {
+	e := &encryption{
+		keys: make(map[uint32]*encryptionKey),
+	}
+
+	for i, k := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("malformed encryption key: %s", err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		// Key ID is derived from the key itself, so it doesn't disclose the key
+		hash := sha256.Sum256(k)
+		ek := &encryptionKey{
+			id:   binary.LittleEndian.Uint32(hash[:4]),
+			aead: aead,
+		}
+
+		if i == 0 {
+			e.current = ek
+		}
+		e.keys[ek.id] = ek
+	}
+
+	log.Verbosef("encryption is enabled, current key is #%08x, %d keys are known", e.current.id, len(e.keys))
+	return e, nil
+}
+
+// encryptRecord returns an encrypted copy of a WAL record
+// Commit and empty records carry no user data, so they are kept in plain text
+func (e *encryption) encryptRecord(record *WALRecord) (*WALRecord, error) {
+	if record.Type == WALCommitTx || record.Type == WALNone {
+		return record, nil
+	}
+
+	var plain bytes.Buffer
+	_ = util.WriteUint32(&plain, uint32(len(record.Key)))
+	_ = util.WriteString(&plain, record.Key)
+	_ = util.WriteBytes(&plain, record.Value)
+
+	encrypted := &WALRecord{
+		ID:   record.ID,
+		TxID: record.TxID,
+		Type: record.Type | walEncryptedFlag,
+	}
+
+	var err error
+	encrypted.Value, err = e.seal(plain.Bytes(), recordAdditionalData(encrypted))
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+// decryptRecord returns a decrypted copy of a WAL record
+// Plain text records are returned as is
+// Encryption might be nil, in this case encrypted records can't be read
+func (e *encryption) decryptRecord(record *WALRecord) (*WALRecord, error) {
+	if record.Type&walEncryptedFlag == 0 {
+		return record, nil
+	}
+
+	plain, err := e.open(record.Value, recordAdditionalData(record))
+	if err != nil {
+		if err != ErrNoEncryptionKey {
+			err = fmt.Errorf("unable to decrypt wal record #%d: %s", record.ID, err)
+		}
+		return nil, err
+	}
+
+	reader := bytes.NewReader(plain)
+	keyLength, err := util.ReadUint32(reader)
+	if err != nil || int(keyLength) > reader.Len() {
+		return nil, fmt.Errorf("malformed encrypted wal record #%d", record.ID)
+	}
+	k, _ := util.ReadString(reader, int(keyLength))
+
+	value := make([]byte, reader.Len())
+	_, _ = reader.Read(value)
+
+	return &WALRecord{
+		ID:    record.ID,
+		TxID:  record.TxID,
+		Type:  record.Type &^ walEncryptedFlag,
+		Key:   k,
+		Value: value,
+	}, nil
+}
+
+// seal encrypts data with current key
+// Sealed data is prefixed with key ID and nonce
+func (e *encryption) seal(plain, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, e.current.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 4, 4+len(nonce)+len(plain)+e.current.aead.Overhead())
+	binary.LittleEndian.PutUint32(sealed, e.current.id)
+	sealed = append(sealed, nonce...)
+	return e.current.aead.Seal(sealed, nonce, plain, additionalData), nil
+}
+
+// open decrypts data that has been sealed with any of known keys
+// Encryption might be nil, in this case ErrNoEncryptionKey is returned
+func (e *encryption) open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < 4 {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+
+	keyID := binary.LittleEndian.Uint32(sealed)
+	key := e.key(keyID)
+	if key == nil {
+		log.Errorf("data is encrypted with an unknown key #%08x", keyID)
+		return nil, ErrNoEncryptionKey
+	}
+
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < 4+nonceSize {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+
+	return key.aead.Open(nil, sealed[4:4+nonceSize], sealed[4+nonceSize:], additionalData)
+}
+
+// key returns a key by its ID (or nil if the key is unknown)
+func (e *encryption) key(id uint32) *encryptionKey {
+	if e == nil {
+		return nil
+	}
+
+	return e.keys[id]
+}
+
+// recordAdditionalData returns authenticated data of an encrypted WAL record
+func recordAdditionalData(record *WALRecord) []byte {
+	data := make([]byte, 8+8+1)
+	binary.LittleEndian.PutUint64(data[0:], record.ID)
+	binary.LittleEndian.PutUint64(data[8:], record.TxID)
+	data[16] = record.Type
+	return data
+}
+
+// chunkAdditionalData returns authenticated data of an encrypted snapshot chunk
+func chunkAdditionalData(isLast bool) []byte {
+	if isLast {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// chunkNonce returns a nonce of an encrypted snapshot chunk
+func chunkNonce(prefix []byte, index uint32) []byte {
+	nonce := make([]byte, len(prefix)+4)
+	copy(nonce, prefix)
+	binary.LittleEndian.PutUint32(nonce[len(prefix):], index)
+	return nonce
+}
+
+// encryptSnapshot wraps a snapshot writer with an encrypting one
+func (e *encryption) encryptSnapshot(w SnapshotWriter) (SnapshotWriter, error) {
+	prefix := make([]byte, e.current.aead.NonceSize()-4)
+	_, err := io.ReadFull(rand.Reader, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.WriteUint32(w, encryptedSnapshotMagic)
+	if err == nil {
+		err = util.WriteUint32(w, e.current.id)
+	}
+	if err == nil {
+		err = util.WriteBytes(w, prefix)
+	}
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+
+	return &snapshotEncryptor{
+		w:      w,
+		key:    e.current,
+		prefix: prefix,
+		buffer: make([]byte, 0, encryptedSnapshotChunkSize),
+	}, nil
+}
+
+// decryptSnapshot checks whether a snapshot file is encrypted and wraps it with a decrypting reader if it is
+// Plain text snapshots are read as is, so encryption might be turned on for existing data
+// Encryption might be nil, in this case encrypted snapshots can't be read
+func (e *encryption) decryptSnapshot(r io.ReadCloser) (io.ReadCloser, error) {
+	var header [4]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+
+	if n < 4 || binary.LittleEndian.Uint32(header[:]) != encryptedSnapshotMagic {
+		// Plain text snapshot, bytes that have been read already are put back
+		return &snapshotReader{
+			Reader: io.MultiReader(bytes.NewReader(header[:n]), r),
+			closer: r,
+		}, nil
+	}
+
+	keyID, err := util.ReadUint32(r)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted snapshot: %s", err)
+	}
+
+	key := e.key(keyID)
+	if key == nil {
+		log.Errorf("snapshot is encrypted with an unknown key #%08x", keyID)
+		return nil, ErrNoEncryptionKey
+	}
+
+	prefix, err := util.ReadBytes(r, key.aead.NonceSize()-4)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted snapshot: %s", err)
+	}
+
+	return &snapshotReader{
+		Reader: &snapshotDecryptor{
+			r:      r,
+			key:    key,
+			prefix: prefix,
+		},
+		closer: r,
+	}, nil
+}
+
+// snapshotEncryptor seals snapshot data chunk by chunk
+// The last chunk is written on Close
+type snapshotEncryptor struct {
+	w      SnapshotWriter
+	key    *encryptionKey
+	prefix []byte
+	buffer []byte
+	index  uint32
+	err    error
+}
+
+func (s *snapshotEncryptor) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	n := 0
+	for n < len(p) {
+		// A full chunk is flushed only when more data arrives, so the last chunk is always written on Close
+		if len(s.buffer) == encryptedSnapshotChunkSize {
+			s.err = s.flush(false)
+			if s.err != nil {
+				return n, s.err
+			}
+		}
+
+		length := encryptedSnapshotChunkSize - len(s.buffer)
+		if length > len(p)-n {
+			length = len(p) - n
+		}
+
+		s.buffer = append(s.buffer, p[n:n+length]...)
+		n += length
+	}
+
+	return n, nil
+}
+
+func (s *snapshotEncryptor) Close() error {
+	if s.err == nil {
+		s.err = s.flush(true)
+	}
+	if s.err != nil {
+		s.w.Abort()
+		return s.err
+	}
+
+	return s.w.Close()
+}
+
+// Abort drops written data without sealing the last chunk, so a partial snapshot is never seen as a complete one
+func (s *snapshotEncryptor) Abort() {
+	s.w.Abort()
+}
+
+// flush seals buffered data as a single chunk
+func (s *snapshotEncryptor) flush(isLast bool) error {
+	sealed := s.key.aead.Seal(nil, chunkNonce(s.prefix, s.index), s.buffer, chunkAdditionalData(isLast))
+	s.index++
+	s.buffer = s.buffer[:0]
+
+	err := util.WriteUint32(s.w, uint32(len(sealed)))
+	if err != nil {
+		return err
+	}
+
+	return util.WriteBytes(s.w, sealed)
+}
+
+// snapshotDecryptor opens snapshot chunks one by one
+type snapshotDecryptor struct {
+	r      io.Reader
+	key    *encryptionKey
+	prefix []byte
+	buffer []byte
+	index  uint32
+	isLast bool
+}
+
+func (s *snapshotDecryptor) Read(p []byte) (int, error) {
+	for len(s.buffer) == 0 {
+		if s.isLast {
+			return 0, io.EOF
+		}
+
+		err := s.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.buffer)
+	s.buffer = s.buffer[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (s *snapshotDecryptor) next() error {
+	length, err := util.ReadUint32(s.r)
+	if err != nil {
+		if err == io.EOF {
+			// Snapshot has been truncated right after a chunk
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("malformed encrypted snapshot: %s", err)
+	}
+
+	if length > encryptedSnapshotChunkSize+uint32(s.key.aead.Overhead()) {
+		return fmt.Errorf("malformed encrypted snapshot: chunk #%d is too large", s.index)
+	}
+
+	sealed, err := util.ReadBytes(s.r, int(length))
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("malformed encrypted snapshot: %s", err)
+	}
+
+	nonce := chunkNonce(s.prefix, s.index)
+	s.buffer, err = s.key.aead.Open(nil, nonce, sealed, chunkAdditionalData(false))
+	if err != nil {
+		s.buffer, err = s.key.aead.Open(nil, nonce, sealed, chunkAdditionalData(true))
+		if err != nil {
+			return fmt.Errorf("unable to decrypt snapshot chunk #%d: %s", s.index, err)
+		}
+
+		s.isLast = true
+		n, _ := s.r.Read(make([]byte, 1))
+		if n > 0 {
+			return fmt.Errorf("malformed encrypted snapshot: unexpected data after the last chunk")
+		}
+	}
+
+	s.index++
+	return nil
+}
+
+// snapshotReader is a snapshot file reader that might be wrapped with a decrypting one
+type snapshotReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *snapshotReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,306 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+var (
+	encryptionTestKey    = bytes.Repeat([]byte{0x42}, 32)
+	encryptionTestOldKey = bytes.Repeat([]byte{0x24}, 16)
+)
+
+func TestEncryptedWAL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	driver := createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestKey))
+	err := writeTx(t, driver, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkNoPlainText(t, dir, "foo/bar", "FooBar")
+
+	driver = createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestKey))
+	checkFooBarRecords(t, driver, 1)
+
+	// Data can't be read without a key or with a wrong one
+	for _, opt := range []storage.DriverOption{
+		storage.DirectoryOption(dir),
+		storage.EncryptionKeyOption(encryptionTestOldKey),
+	} {
+		driver = createEncryptedDriver(t, dir, opt)
+		reader, err := driver.WALFile().Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = reader.Read()
+		if !errors.Is(err, storage.ErrNoEncryptionKey) {
+			t.Errorf("ERROR: expected %s but got %v", storage.ErrNoEncryptionKey, err)
+		}
+		_ = reader.Close()
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	// Plain text data stays readable once encryption is turned on
+	dir := t.TempDir()
+	driver := createEncryptedDriver(t, dir)
+	err := writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver = createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestOldKey))
+	err = writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver = createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestKey, encryptionTestOldKey))
+	err = writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFooBarRecords(t, driver, 3)
+}
+
+func TestEncryptedSnapshot(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	// Snapshot spans multiple encrypted chunks
+	var data []byte
+	for i := 0; len(data) < 200*1024; i++ {
+		data = append(data, []byte("secret value ")...)
+		data = append(data, byte(i))
+	}
+
+	dir := t.TempDir()
+	driver := createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestKey))
+	writeSnapshot(t, driver, data)
+	checkNoPlainText(t, dir, "secret value")
+
+	actual, err := readSnapshot(createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestKey)))
+	if err != nil {
+		t.Fatalf("ERROR: unable to read snapshot: %s", err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Errorf("ERROR: snapshot doesn't match")
+	}
+
+	_, err = readSnapshot(createEncryptedDriver(t, dir))
+	if !errors.Is(err, storage.ErrNoEncryptionKey) {
+		t.Errorf("ERROR: expected %s but got %v", storage.ErrNoEncryptionKey, err)
+	}
+
+	// Tampered or truncated snapshot is never read successfully
+	snapshotPath := filepath.Join(dir, "snapshot.dat")
+	encrypted, err := os.ReadFile(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptions := map[string][]byte{
+		"truncated to the first chunk": encrypted[:16+4+64*1024+16],
+		"truncated by one byte":        encrypted[:len(encrypted)-1],
+		"with trailing data":           append(append([]byte{}, encrypted...), 0),
+	}
+	for _, offset := range []int{4, 10, 20, 1000, len(encrypted) - 1} {
+		corrupted := append([]byte{}, encrypted...)
+		corrupted[offset] ^= 0xFF
+		corruptions[fmt.Sprintf("with a corrupted byte at offset %d", offset)] = corrupted
+	}
+	for name, corrupted := range corruptions {
+		err = os.WriteFile(snapshotPath, corrupted, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = readSnapshot(createEncryptedDriver(t, dir, storage.EncryptionKeyOption(encryptionTestKey)))
+		if err == nil {
+			t.Errorf("ERROR: snapshot %s has been read successfully", name)
+		}
+	}
+}
+
+func TestAbortedSnapshot(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	for name, opts := range map[string][]storage.DriverOption{
+		"plain text": nil,
+		"encrypted":  {storage.EncryptionKeyOption(encryptionTestKey)},
+	} {
+		dir := t.TempDir()
+		driver := createEncryptedDriver(t, dir, opts...)
+		writeSnapshot(t, driver, []byte("good snapshot"))
+
+		// Aborted snapshot never replaces an existing one
+		w, err := driver.SnapshotFile().Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte("partial"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Abort()
+
+		actual, err := readSnapshot(createEncryptedDriver(t, dir, opts...))
+		if err != nil {
+			t.Fatalf("ERROR: unable to read %s snapshot: %s", name, err)
+		}
+		if string(actual) != "good snapshot" {
+			t.Errorf("ERROR: %s snapshot has been replaced with %q", name, actual)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if filepath.Ext(entry.Name()) == ".tmp" {
+				t.Errorf("ERROR: temporary file %s has been left behind", entry.Name())
+			}
+		}
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	tests := []struct {
+		str    string
+		length int
+	}{
+		{"000102030405060708090a0b0c0d0e0f", 16},
+		{"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=\n", 32},
+		{"0001", 0},
+		{"not a key", 0},
+	}
+
+	for _, test := range tests {
+		key, err := storage.ParseEncryptionKey(test.str)
+		if test.length == 0 {
+			if err == nil {
+				t.Errorf("ERROR: \"%s\" has been parsed as a key", test.str)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ERROR: unable to parse \"%s\": %s", test.str, err)
+		} else if len(key) != test.length {
+			t.Errorf("ERROR: expected %d bytes but got %d", test.length, len(key))
+		}
+	}
+}
+
+func createEncryptedDriver(t *testing.T, dir string, opts ...storage.DriverOption) storage.Driver {
+	driver, err := storage.NewDriver(append([]storage.DriverOption{storage.DirectoryOption(dir)}, opts...)...)
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	return driver
+}
+
+// checkNoPlainText checks that none of data files contains specified strings
+func checkNoPlainText(t *testing.T, dir string, strs ...string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, str := range strs {
+			if bytes.Contains(data, []byte(str)) {
+				t.Errorf("ERROR: file \"%s\" contains \"%s\" in plain text", entry.Name(), str)
+			}
+		}
+	}
+}
+
+// checkFooBarRecords checks that WAL contains txCount transactions written by writeTx()
+func checkFooBarRecords(t *testing.T, driver storage.Driver, txCount int) {
+	reader, err := driver.WALFile().Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ERROR: unable to read wal: %s", err)
+		}
+
+		switch record.Type {
+		case storage.WALAddValue:
+			if record.Key != "foo/bar" || string(record.Value) != "FooBar" {
+				t.Errorf("ERROR: unexpected record %s", record)
+			}
+		case storage.WALCommitTx:
+			count++
+		default:
+			t.Errorf("ERROR: unexpected record %s", record)
+		}
+	}
+
+	if count != txCount {
+		t.Errorf("ERROR: expected %d transactions but got %d", txCount, count)
+	}
+}
+
+func writeSnapshot(t *testing.T, driver storage.Driver, data []byte) {
+	w, err := driver.SnapshotFile().Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSnapshot(driver storage.Driver) ([]byte, error) {
+	r, err := driver.SnapshotFile().Read()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	return io.ReadAll(r)
+}
@@ -0,0 +1,431 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// ErrInjectedFault is returned by a file operation that has been failed on purpose by FaultInjector
+	ErrInjectedFault = errors.New("injected fault")
+	// ErrCrashed is returned by a file that has been opened before a crash simulated by FaultInjector
+	ErrCrashed = errors.New("file is lost in a simulated crash")
+)
+
+// FaultInjector wraps driver's files and simulates storage failures and crashes
+// It's designed for crash recovery testing and should never be used in production
+//
+// FaultInjector keeps track of durable (i.e. synced) content of every file.
+// On simulated crash, every file is rolled back to its durable content,
+// while creating, renaming and removing files are considered to be durable immediately
+//
+// FaultInjector binds to the first file system it wraps,
+// so every driver created with the same FaultInjector shares the same files (e.g. in-memory ones)
+type FaultInjector struct {
+	lock        *sync.Mutex
+	fs          fileSystem
+	files       map[string]*faultyFileState
+	generation  int
+	writeCount  int
+	failWriteAt int
+	syncCount   int
+	failSyncAt  int
+}
+
+// faultyFileState is a durable content of a file
+type faultyFileState struct {
+	durable []byte
+	isDirty bool
+}
+
+// NewFaultInjector creates new instance of FaultInjector
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{
+		lock:  new(sync.Mutex),
+		files: make(map[string]*faultyFileState),
+	}
+}
+
+// FaultInjectionOption makes driver access its files via specified FaultInjector
+func FaultInjectionOption(injector *FaultInjector) DriverOption {
+	return func(options *driverOptions) error {
+		options.faults = injector
+		return nil
+	}
+}
+
+// wrap binds FaultInjector to a file system
+func (f *FaultInjector) wrap(fs fileSystem) fileSystem {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.fs == nil {
+		f.fs = fs
+	}
+
+	return f
+}
+
+// FailWrite makes n-th file write (counting from now) fail
+// Failed write stores first half of its data, just like a torn write does
+// Zero value turns write failures off
+func (f *FaultInjector) FailWrite(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.writeCount = 0
+	f.failWriteAt = n
+}
+
+// FailSync makes n-th file sync (counting from now) fail
+// Failed sync doesn't make any data durable
+// Zero value turns sync failures off
+func (f *FaultInjector) FailSync(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.syncCount = 0
+	f.failSyncAt = n
+}
+
+// Crash simulates a power loss
+// Every data that hasn't been synced is dropped and every opened file becomes unusable
+// Files might be opened again once Crash() returns
+func (f *FaultInjector) Crash() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.generation++
+	f.failWriteAt = 0
+	f.failSyncAt = 0
+
+	for path, state := range f.files {
+		if !state.isDirty {
+			continue
+		}
+
+		err := f.writeFile(path, state.durable)
+		if err != nil {
+			return err
+		}
+
+		state.isDirty = false
+		log.Verbosef("crash: \"%s\" is rolled back to %d bytes", path, len(state.durable))
+	}
+
+	return nil
+}
+
+// TruncateFile changes a durable length of a file
+func (f *FaultInjector) TruncateFile(path string, size int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := f.readFile(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+
+	if size < int64(len(data)) {
+		data = data[:size]
+	}
+
+	return f.replaceFile(filepath.Clean(path), data)
+}
+
+// CorruptByte inverts all bits of a byte at specified offset of a file
+func (f *FaultInjector) CorruptByte(path string, offset int64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := f.readFile(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+
+	if offset < 0 || offset >= int64(len(data)) {
+		return io.ErrUnexpectedEOF
+	}
+
+	data[offset] ^= 0xFF
+	return f.replaceFile(filepath.Clean(path), data)
+}
+
+// OpenFile opens a file using os.OpenFile() flags
+func (f *FaultInjector) OpenFile(path string, flag int) (file, error) {
+	path = filepath.Clean(path)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, isTracked := f.files[path]
+	if !isTracked {
+		// File content is considered to be durable until it's modified
+		data, err := f.readFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		f.files[path] = &faultyFileState{durable: data}
+	}
+
+	inner, err := f.fs.OpenFile(path, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&os.O_TRUNC != 0 {
+		f.state(path).isDirty = true
+	}
+
+	handle := &faultyFile{
+		injector:   f,
+		file:       inner,
+		path:       path,
+		generation: f.generation,
+	}
+	return handle, nil
+}
+
+// ReadDir returns names of files within a directory
+func (f *FaultInjector) ReadDir(path string) ([]string, error) {
+	return f.fs.ReadDir(path)
+}
+
+// Size returns length of a file
+func (f *FaultInjector) Size(path string) (int64, error) {
+	return f.fs.Size(path)
+}
+
+// Remove removes a file
+func (f *FaultInjector) Remove(path string) error {
+	path = filepath.Clean(path)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err := f.fs.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	delete(f.files, path)
+	return nil
+}
+
+// Rename renames (moves) a file, replacing target file if it exists
+func (f *FaultInjector) Rename(oldPath, newPath string) error {
+	oldPath = filepath.Clean(oldPath)
+	newPath = filepath.Clean(newPath)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err := f.fs.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+
+	state, isTracked := f.files[oldPath]
+	delete(f.files, oldPath)
+	delete(f.files, newPath)
+	if isTracked {
+		f.files[newPath] = state
+	}
+
+	return nil
+}
+
+// MkDir ensures that specified directory exists
+func (f *FaultInjector) MkDir(path string) error {
+	return f.fs.MkDir(path)
+}
+
+// state returns durable state of a file
+func (f *FaultInjector) state(path string) *faultyFileState {
+	state, isTracked := f.files[path]
+	if !isTracked {
+		state = &faultyFileState{}
+		f.files[path] = state
+	}
+
+	return state
+}
+
+// readFile reads an entire file
+func (f *FaultInjector) readFile(path string) ([]byte, error) {
+	file, err := f.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return io.ReadAll(file)
+}
+
+// writeFile replaces an entire file content
+func (f *FaultInjector) writeFile(path string, data []byte) error {
+	file, err := f.fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// replaceFile replaces an entire file content and makes it durable
+func (f *FaultInjector) replaceFile(path string, data []byte) error {
+	err := f.writeFile(path, data)
+	if err != nil {
+		return err
+	}
+
+	f.files[path] = &faultyFileState{durable: data}
+	return nil
+}
+
+// faultyFile is a handle of a file opened via FaultInjector
+type faultyFile struct {
+	injector   *FaultInjector
+	file       file
+	path       string
+	generation int
+}
+
+// check returns an error if file has been lost in a simulated crash
+// FaultInjector's lock must be held by caller
+func (h *faultyFile) check() error {
+	if h.generation != h.injector.generation {
+		return ErrCrashed
+	}
+	return nil
+}
+
+// Read reads data from current position
+func (h *faultyFile) Read(p []byte) (int, error) {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.check()
+	if err != nil {
+		return 0, err
+	}
+
+	return h.file.Read(p)
+}
+
+// ReadAt reads data at specified offset
+func (h *faultyFile) ReadAt(p []byte, offset int64) (int, error) {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.check()
+	if err != nil {
+		return 0, err
+	}
+
+	return h.file.ReadAt(p, offset)
+}
+
+// Write writes data at current position
+func (h *faultyFile) Write(p []byte) (int, error) {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.check()
+	if err != nil {
+		return 0, err
+	}
+
+	h.injector.state(h.path).isDirty = true
+
+	h.injector.writeCount++
+	if h.injector.failWriteAt > 0 && h.injector.writeCount == h.injector.failWriteAt {
+		n, _ := h.file.Write(p[:len(p)/2])
+		log.Verbosef("write #%d to \"%s\" has failed on purpose", h.injector.writeCount, h.path)
+		return n, ErrInjectedFault
+	}
+
+	return h.file.Write(p)
+}
+
+// Seek sets current position
+func (h *faultyFile) Seek(offset int64, whence int) (int64, error) {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.check()
+	if err != nil {
+		return 0, err
+	}
+
+	return h.file.Seek(offset, whence)
+}
+
+// Truncate changes the size of the file
+func (h *faultyFile) Truncate(size int64) error {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.check()
+	if err != nil {
+		return err
+	}
+
+	h.injector.state(h.path).isDirty = true
+	return h.file.Truncate(size)
+}
+
+// Sync commits the current contents of the file to stable storage
+func (h *faultyFile) Sync() error {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.check()
+	if err != nil {
+		return err
+	}
+
+	h.injector.syncCount++
+	if h.injector.failSyncAt > 0 && h.injector.syncCount == h.injector.failSyncAt {
+		log.Verbosef("sync #%d of \"%s\" has failed on purpose", h.injector.syncCount, h.path)
+		return ErrInjectedFault
+	}
+
+	err = h.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	data, err := h.injector.readFile(h.path)
+	if err != nil {
+		return err
+	}
+
+	h.injector.files[h.path] = &faultyFileState{durable: data}
+	return nil
+}
+
+// Close closes file handle
+func (h *faultyFile) Close() error {
+	h.injector.lock.Lock()
+	defer h.injector.lock.Unlock()
+
+	err := h.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return h.check()
+}
@@ -0,0 +1,326 @@
+package storage_test
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+const (
+	// Length of a record written by writeTx()
+	faultTestRecordLength int64 = 8 + 8 + 1 + 4 + 4 + int64(len("foo/bar")) + int64(len("FooBar"))
+	// Length of a WALCommitTx record (with commit time)
+	faultTestCommitLength int64 = 8 + 8 + 1 + 4 + 4 + 8
+)
+
+// TestUnsyncedDataIsDropped tests that a crash drops an uncommitted transaction only
+func TestUnsyncedDataIsDropped(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	injector := storage.NewFaultInjector()
+	driver := createFaultyDriver(t, injector)
+
+	err := writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := driver.WALFile().Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Write(&storage.WALRecord{Type: storage.WALAddValue, Key: "foo/bar", Value: []byte("FooBar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = injector.Crash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writer that has been opened before crash must not be usable anymore
+	err = writer.CommitTx()
+	if err == nil {
+		t.Errorf("expected an error but got nil")
+	}
+
+	driver = createFaultyDriver(t, injector)
+	err = readTx(t, driver, func(wal *walValidator) {
+		wal.Expect(1, 1, storage.WALAddValue)
+		wal.Expect(2, 1, storage.WALCommitTx)
+		wal.ExpectEOF()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTornWAL tests recovery of a WAL that is truncated at every possible offset
+// Every transaction that has been completely written must survive
+func TestTornWAL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	const txCount = 3
+	const recordsPerTx = 2
+	txLength := recordsPerTx*faultTestRecordLength + faultTestCommitLength
+	walLength := storage.WALHeaderLength + txCount*txLength
+
+	for offset := int64(0); offset < walLength; offset++ {
+		injector := storage.NewFaultInjector()
+		driver := createFaultyDriver(t, injector)
+		for i := 0; i < txCount; i++ {
+			err := writeTx(t, driver, recordsPerTx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := injector.Crash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = injector.TruncateFile(walSegmentPath(t, driver), offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectedTxCount := 0
+		if offset >= storage.WALHeaderLength {
+			expectedTxCount = int((offset - storage.WALHeaderLength) / txLength)
+		}
+
+		driver = createFaultyDriver(t, injector)
+		checkCommittedTx(t, driver, offset, expectedTxCount, recordsPerTx)
+
+		// WAL must remain writable after recovery
+		err = writeTx(t, driver, recordsPerTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCommittedTx(t, driver, offset, expectedTxCount+1, recordsPerTx)
+	}
+}
+
+// TestCorruptedWALRecordID tests recovery of a WAL that has a damaged record ID
+// Every transaction that precedes a damaged record must survive
+func TestCorruptedWALRecordID(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	const txCount = 3
+	const recordsPerTx = 2
+
+	offset := int64(storage.WALHeaderLength)
+	for tx := 0; tx < txCount; tx++ {
+		for record := 0; record <= recordsPerTx; record++ {
+			injector := storage.NewFaultInjector()
+			driver := createFaultyDriver(t, injector)
+			for i := 0; i < txCount; i++ {
+				err := writeTx(t, driver, recordsPerTx)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := injector.CorruptByte(walSegmentPath(t, driver), offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			driver = createFaultyDriver(t, injector)
+			checkCommittedTx(t, driver, offset, tx, recordsPerTx)
+
+			if record < recordsPerTx {
+				offset += faultTestRecordLength
+			} else {
+				offset += faultTestCommitLength
+			}
+		}
+	}
+}
+
+// TestFailedWrite tests that a transaction which has failed to write is never visible
+// while transactions around it survive a crash
+func TestFailedWrite(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	const recordsPerTx = 2
+
+	for n := 1; ; n++ {
+		injector := storage.NewFaultInjector()
+		driver := createFaultyDriver(t, injector)
+
+		err := writeTx(t, driver, recordsPerTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		injector.FailWrite(n)
+		hasFailed := writeFailingTx(driver, recordsPerTx) != nil
+		injector.FailWrite(0)
+
+		err = writeTx(t, driver, recordsPerTx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = injector.Crash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		driver = createFaultyDriver(t, injector)
+		if !hasFailed {
+			checkCommittedTx(t, driver, int64(n), 3, recordsPerTx)
+			break
+		}
+
+		checkCommittedTx(t, driver, int64(n), 2, recordsPerTx)
+	}
+}
+
+// TestFailedSync tests that a transaction which has failed to sync is never visible after a crash
+func TestFailedSync(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	const recordsPerTx = 2
+
+	injector := storage.NewFaultInjector()
+	driver := createFaultyDriver(t, injector)
+
+	err := writeTx(t, driver, recordsPerTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	injector.FailSync(1)
+	err = writeFailingTx(driver, recordsPerTx)
+	if err != storage.ErrInjectedFault {
+		t.Errorf("expected %s but got %v", storage.ErrInjectedFault, err)
+	}
+
+	err = writeTx(t, driver, recordsPerTx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = injector.Crash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver = createFaultyDriver(t, injector)
+	checkCommittedTx(t, driver, 0, 2, recordsPerTx)
+}
+
+func createFaultyDriver(t *testing.T, injector *storage.FaultInjector) storage.Driver {
+	driver, err := storage.NewDriver(storage.InMemoryOption(), storage.FaultInjectionOption(injector))
+	if err != nil {
+		t.Fatalf("ERROR: NewDriver() failed: %s", err)
+	}
+
+	return driver
+}
+
+func walSegmentPath(t *testing.T, driver storage.Driver) string {
+	segments, err := driver.WALFile().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 wal segment but got %d", len(segments))
+	}
+
+	return filepath.Join(string(filepath.Separator), segments[0].Name)
+}
+
+// writeFailingTx writes a transaction and rolls it back if anything goes wrong
+func writeFailingTx(driver storage.Driver, count int) error {
+	writer, err := driver.WALFile().Write()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = writer.Close()
+	}()
+
+	err = writer.BeginTx()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		err = writer.Write(&storage.WALRecord{Type: storage.WALAddValue, Key: "foo/bar", Value: []byte("FooBar")})
+		if err != nil {
+			_ = writer.RollbackTx()
+			return err
+		}
+	}
+
+	err = writer.CommitTx()
+	if err != nil {
+		_ = writer.RollbackTx()
+		return err
+	}
+
+	return nil
+}
+
+// checkCommittedTx checks that WAL contains exactly txCount complete transactions
+func checkCommittedTx(t *testing.T, driver storage.Driver, fault int64, txCount, recordsPerTx int) {
+	reader, err := driver.WALFile().Read()
+	if err != nil {
+		t.Fatalf("fault at %d: WALFile().Read() failed: %s", fault, err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	var lastID uint64
+	for tx := 0; tx < txCount; tx++ {
+		var txID uint64
+		for i := 0; i <= recordsPerTx; i++ {
+			record, err := reader.Read()
+			if err != nil {
+				t.Fatalf("fault at %d: expected tx #%d record #%d but got %s", fault, tx+1, i+1, err)
+			}
+
+			if record.ID <= lastID {
+				t.Fatalf("fault at %d: expected record ID > %d but got %d", fault, lastID, record.ID)
+			}
+			lastID = record.ID
+
+			if i == 0 {
+				txID = record.TxID
+			} else if record.TxID != txID {
+				t.Fatalf("fault at %d: expected record txID %d but got %d", fault, txID, record.TxID)
+			}
+
+			expectedType := storage.WALAddValue
+			if i == recordsPerTx {
+				expectedType = storage.WALCommitTx
+			}
+			if record.Type != expectedType {
+				t.Fatalf("fault at %d: expected record type %d but got %d", fault, expectedType, record.Type)
+			}
+		}
+	}
+
+	_, err = reader.Read()
+	if err != io.EOF {
+		t.Fatalf("fault at %d: expected EOF after %d tx but got %v", fault, txCount, err)
+	}
+}
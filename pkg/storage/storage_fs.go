@@ -2,22 +2,38 @@ package storage
 
 import (
 	"fmt"
-	"github.com/kapitanov/natandb/pkg/util"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type driver struct {
 	wal      *walFile
 	snapshot *snapshotFile
+	values   *valueLog
 }
 
 type driverOptions struct {
-	walFilePath      string
-	snapshotFilePath string
+	fs                   fileSystem
+	walFilePath          string
+	walSegmentSize       int64
+	snapshotFilePath     string
+	archivePath          string
+	faults               *FaultInjector
+	encryption           *encryption
+	compressionThreshold int
+	valueLog             bool
+	valueCacheSize       int64
+	noAutoMigrate        bool
 }
 
+const (
+	// DefaultWALSegmentSize is a default max length of a single WAL segment file
+	DefaultWALSegmentSize int64 = 64 * 1024 * 1024
+)
+
 // DriverOption is a configuration function for NewDriver
 type DriverOption func(*driverOptions) error
 
@@ -48,6 +64,7 @@ func DirectoryOption(path string) DriverOption {
 }
 
 // WALFileOption sets path to WAL file
+// WAL segment file names are derived from this path, e.g. "journal.dat" turns into "journal-000001.dat"
 func WALFileOption(path string) DriverOption {
 	return func(options *driverOptions) error {
 		absPath, err := filepath.Abs(path)
@@ -56,17 +73,21 @@ func WALFileOption(path string) DriverOption {
 			return err
 		}
 
-		directory, _ := filepath.Split(absPath)
-		err = util.MkDir(directory)
-		if err != nil {
-			return err
-		}
-
 		options.walFilePath = absPath
 		return nil
 	}
 }
 
+// WALSegmentSizeOption sets max length of a single WAL segment file
+// WAL writer starts a new segment once current one gets larger than specified length
+// Zero or negative value turns segment rolling off
+func WALSegmentSizeOption(size int64) DriverOption {
+	return func(options *driverOptions) error {
+		options.walSegmentSize = size
+		return nil
+	}
+}
+
 // SnapshotFileOption sets path to snapshot file
 func SnapshotFileOption(path string) DriverOption {
 	return func(options *driverOptions) error {
@@ -76,20 +97,52 @@ func SnapshotFileOption(path string) DriverOption {
 			return err
 		}
 
-		directory, _ := filepath.Split(absPath)
-		err = util.MkDir(directory)
+		options.snapshotFilePath = absPath
+		return nil
+	}
+}
+
+// WALArchiveOption sets path to WAL archive directory
+// Once it's set, vacuum routine copies WAL segments and snapshots into archive directory instead of just dropping them
+// Archived files are never removed automatically, see OpenWALArchive
+func WALArchiveOption(path string) DriverOption {
+	return func(options *driverOptions) error {
+		absPath, err := filepath.Abs(path)
 		if err != nil {
+			log.Errorf("malformed path \"%s\": %s", path, err)
 			return err
 		}
 
-		options.snapshotFilePath = absPath
+		options.archivePath = absPath
 		return nil
 	}
 }
 
-// NewDriver creates an instance of Driver based on physical files
+// InMemoryOption makes driver keep WAL and snapshot files in memory instead of physical files
+// In-memory files are kept as long as driver instance exists
+// Unless DirectoryOption, WALFileOption or SnapshotFileOption are specified, files are placed into a virtual root directory
+func InMemoryOption() DriverOption {
+	return func(options *driverOptions) error {
+		options.fs = newMemoryFileSystem()
+
+		if options.walFilePath == "" {
+			options.walFilePath = string(filepath.Separator) + "journal.dat"
+		}
+
+		if options.snapshotFilePath == "" {
+			options.snapshotFilePath = string(filepath.Separator) + "snapshot.dat"
+		}
+
+		return nil
+	}
+}
+
+// NewDriver creates an instance of Driver based on physical files (or in-memory files, see InMemoryOption)
 func NewDriver(opts ...DriverOption) (Driver, error) {
-	options := &driverOptions{}
+	options := &driverOptions{
+		fs:             osFileSystem{},
+		walSegmentSize: DefaultWALSegmentSize,
+	}
 	for _, opt := range opts {
 		err := opt(options)
 		if err != nil {
@@ -97,6 +150,10 @@ func NewDriver(opts ...DriverOption) (Driver, error) {
 		}
 	}
 
+	if options.faults != nil {
+		options.fs = options.faults.wrap(options.fs)
+	}
+
 	if options.walFilePath == "" {
 		return nil, fmt.Errorf("wal path is not configured")
 	}
@@ -108,10 +165,54 @@ func NewDriver(opts ...DriverOption) (Driver, error) {
 	log.Verbosef("got wal file path \"%s\"", options.walFilePath)
 	log.Verbosef("got snapshot file path \"%s\"", options.snapshotFilePath)
 
+	for _, path := range []string{options.walFilePath, options.snapshotFilePath} {
+		directory, _ := filepath.Split(path)
+		err := options.fs.MkDir(directory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wal := newWALFile(options.fs, options.walFilePath, options.walSegmentSize)
+	wal.encryption = options.encryption
+	wal.compressionThreshold = options.compressionThreshold
+	if !options.noAutoMigrate {
+		err := wal.migrate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.archivePath != "" {
+		log.Verbosef("got wal archive path \"%s\"", options.archivePath)
+		err := options.fs.MkDir(options.archivePath)
+		if err != nil {
+			return nil, err
+		}
+
+		wal.archive = newWALArchive(options.fs, options.archivePath, options.walFilePath, options.snapshotFilePath)
+		wal.archive.wal.encryption = options.encryption
+	}
+
+	snapshot := &snapshotFile{options.fs, options.snapshotFilePath, options.encryption}
+	snapshot.dropTemporaryFiles()
+
 	d := &driver{
-		wal:      &walFile{options.walFilePath},
-		snapshot: &snapshotFile{options.snapshotFilePath},
+		wal:      wal,
+		snapshot: snapshot,
 	}
+
+	if options.valueLog {
+		// Archived snapshots refer to values that are dropped by vacuum, so they won't be restorable
+		if options.archivePath != "" {
+			return nil, fmt.Errorf("value log can't be combined with wal archive")
+		}
+
+		d.values = newValueLog(options.fs, valueLogPath(options.walFilePath), options.valueCacheSize)
+		d.values.encryption = options.encryption
+		d.values.compressionThreshold = options.compressionThreshold
+	}
+
 	return d, nil
 }
 
@@ -125,102 +226,191 @@ func (d *driver) SnapshotFile() SnapshotFile {
 	return d.snapshot
 }
 
-// walFile provides access to WAL file
-type walFile struct {
-	path string
+// ValueLog provides access to value log
+func (d *driver) ValueLog() ValueLog {
+	if d.values == nil {
+		return nil
+	}
+
+	return d.values
 }
 
-// Read opens WAL file for reading
-func (f *walFile) Read() (WALReader, error) {
-	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR, 0755)
+// SnapshotFile provides access to snapshot file
+type snapshotFile struct {
+	fs         fileSystem
+	path       string
+	encryption *encryption
+}
+
+// dropTemporaryFiles removes temporary snapshot files left after a crash
+func (f *snapshotFile) dropTemporaryFiles() {
+	directory, name := filepath.Split(f.path)
+	names, err := f.fs.ReadDir(directory)
 	if err != nil {
-		log.Errorf("unable to open file \"%s\": %s", f.path, err)
-		return nil, err
+		return
 	}
 
-	return newWALReader(file)
+	for _, n := range names {
+		if !strings.HasPrefix(n, name+".") || !strings.HasSuffix(n, ".tmp") {
+			continue
+		}
+
+		path := filepath.Join(directory, n)
+		err = f.fs.Remove(path)
+		if err != nil {
+			log.Errorf("unable to remove temporary file \"%s\": %s", path, err)
+			continue
+		}
+
+		log.Verbosef("removed temporary file \"%s\"", path)
+	}
 }
 
-// Write opens WAL file for writing
-func (f *walFile) Write() (WALWriter, error) {
-	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR, 0755)
+// Read opens snapshot file for reading
+// Encrypted snapshot is decrypted transparently
+func (f *snapshotFile) Read() (io.ReadCloser, error) {
+	file, err := f.fs.OpenFile(f.path, os.O_RDONLY|os.O_CREATE)
 	if err != nil {
 		log.Errorf("unable to open file \"%s\": %s", f.path, err)
 		return nil, err
 	}
 
-	return newWALWriter(file)
+	reader, err := f.encryption.decryptSnapshot(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return reader, nil
 }
 
-// BeginVacuum starts vacuum routine
-// WAL readers and writers must be closed before calling BeginVacuum()
-func (f *walFile) BeginVacuum(writer WALWriter) (WALVacuum, error) {
-	// Remember last ID/TX
-	w := writer.(*walWriter)
-	v := &walVacuum{
-		file:      f,
-		idCounter: w.idCounter,
-		txCounter: w.txCounter,
+// Map opens snapshot file for random access
+// Plain text snapshot file is memory-mapped if possible, otherwise snapshot is read into memory
+func (f *snapshotFile) Map() (SnapshotMapping, error) {
+	if _, ok := f.fs.(osFileSystem); ok {
+		mapping, err := mapFile(f.path)
+		if err == nil {
+			return mapping, nil
+		}
+		if os.IsNotExist(err) {
+			return bytesMapping{}, nil
+		}
+		if err != errMapUnsupported {
+			log.Errorf("unable to map file \"%s\": %s", f.path, err)
+			return nil, err
+		}
+	}
+
+	reader, err := f.Read()
+	if err != nil {
+		return nil, err
 	}
+	defer func() {
+		_ = reader.Close()
+	}()
 
-	// Drop WAL file
-	err := os.Remove(f.path)
-	if err != nil && err != os.ErrNotExist {
+	data, err := io.ReadAll(reader)
+	if err != nil {
 		return nil, err
 	}
 
-	return v, nil
+	return bytesMapping(data), nil
 }
 
-type walVacuum struct {
-	file      *walFile
-	idCounter uint64
-	txCounter uint64
+// Path returns a path to snapshot file
+func (f *snapshotFile) Path() string {
+	return f.path
 }
 
-// End opens WAL file for writing without resetting ID and TxID counters
-func (v *walVacuum) End() (WALWriter, error) {
-	writer, err := v.file.Write()
+// Backup copies snapshot file as is before it's converted from specified format version
+func (f *snapshotFile) Backup(version uint32) (string, error) {
+	backupPath := MigrationBackupPath(f.path, version)
+	err := copyFile(f.fs, f.path, backupPath)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	// Restore last ID/TX
-	w := writer.(*walWriter)
-	w.idCounter = v.idCounter
-	w.txCounter = v.txCounter
+	log.Printf("snapshot \"%s\" has been copied into \"%s\"", f.path, backupPath)
+	return backupPath, nil
+}
+
+// Write opens snapshot file for writing
+// Snapshot is written into a temporary file which replaces an existing snapshot file on Close()
+// This way a snapshot file is never seen partially written, even if process crashes
+// Writing must be aborted if snapshot hasn't been written completely
+func (f *snapshotFile) Write() (SnapshotWriter, error) {
+	for {
+		tempPath := fmt.Sprintf("%s.%d.tmp", f.path, rand.Uint32())
+		file, err := f.fs.OpenFile(tempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+		if err != nil {
+			if os.IsExist(err) {
+				continue
+			}
+			log.Errorf("unable to create temporary file for \"%s\": %s", f.path, err)
+			return nil, err
+		}
+
+		writer := &snapshotWriter{fs: f.fs, file: file, path: f.path, tempPath: tempPath}
+		if f.encryption != nil {
+			return f.encryption.encryptSnapshot(writer)
+		}
 
-	return writer, nil
+		return writer, nil
+	}
 }
 
-// SnapshotFile provides access to snapshot file
-type snapshotFile struct {
-	path string
+// snapshotWriter writes a snapshot into a temporary file
+type snapshotWriter struct {
+	fs       fileSystem
+	file     file
+	path     string
+	tempPath string
+	err      error
 }
 
-// Read opens snapshot file for reading
-func (f *snapshotFile) Read() (io.ReadCloser, error) {
-	file, err := os.OpenFile(f.path, os.O_RDONLY|os.O_CREATE, 0755)
+// Write writes data into a temporary snapshot file
+func (w *snapshotWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
 	if err != nil {
-		log.Errorf("unable to open file \"%s\": %s", f.path, err)
-		return nil, err
+		w.err = err
 	}
-
-	return file, nil
+	return n, err
 }
 
-// Write opens snapshot file for writing
-func (f *snapshotFile) Write() (io.WriteCloser, error) {
-	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY, 0755)
+// Close flushes a temporary snapshot file and replaces an existing snapshot file with it
+// If any write has failed, temporary file is dropped and existing snapshot file is kept intact
+func (w *snapshotWriter) Close() error {
+	if w.err != nil {
+		_ = w.file.Close()
+		_ = w.fs.Remove(w.tempPath)
+		return w.err
+	}
+
+	err := w.file.Sync()
 	if err != nil {
-		log.Errorf("unable to open file \"%s\": %s", f.path, err)
-		return nil, err
+		_ = w.file.Close()
+		_ = w.fs.Remove(w.tempPath)
+		return err
 	}
 
-	err = file.Truncate(0)
+	err = w.file.Close()
 	if err != nil {
-		return nil, err
+		_ = w.fs.Remove(w.tempPath)
+		return err
 	}
 
-	return file, nil
+	err = w.fs.Rename(w.tempPath, w.path)
+	if err != nil {
+		log.Errorf("unable to replace file \"%s\": %s", w.path, err)
+		_ = w.fs.Remove(w.tempPath)
+		return err
+	}
+
+	return nil
+}
+
+// Abort drops a temporary snapshot file, existing snapshot file is kept intact
+func (w *snapshotWriter) Abort() {
+	_ = w.file.Close()
+	_ = w.fs.Remove(w.tempPath)
 }
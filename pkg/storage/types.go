@@ -2,9 +2,11 @@ package storage
 
 import (
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	l "github.com/kapitanov/natandb/pkg/log"
 )
@@ -28,25 +30,118 @@ type Driver interface {
 
 	// SnapshotFile provides access to snapshot file
 	SnapshotFile() SnapshotFile
+
+	// ValueLog provides access to value log
+	// It returns nil unless value log is enabled (see ValueLogOption)
+	ValueLog() ValueLog
+
+	// StateFile provides access to a small state file with specified name (e.g. cluster state)
+	// State files are placed next to snapshot file
+	StateFile(name string) StateFile
+}
+
+// StateFile is a small file that is always rewritten as a whole
+type StateFile interface {
+	// Read returns file contents, nil is returned if file doesn't exist or is empty
+	Read() ([]byte, error)
+
+	// Write replaces file contents atomically
+	Write(data []byte) error
 }
 
 // WALFile provides access to WAL file
+// WAL is stored as a sequence of segments, each one is a standalone WAL file
 type WALFile interface {
 	// Read opens WAL file for reading
+	// Returned reader reads records across all WAL segments
 	Read() (WALReader, error)
 
+	// ReadLive opens WAL file for reading while WAL writer keeps going
+	// Unlike Read(), it never runs error correction routine, a partially written record at the end of WAL is treated as its end.
+	// Reader must stop at the last committed record, and WAL segments must not be dropped until reader is closed
+	ReadLive() (WALReader, error)
+
 	// Write opens WAL file for writing
 	Write() (WALWriter, error)
 
+	// Segments returns a list of existing WAL segments ordered by their index
+	Segments() ([]WALSegment, error)
+
 	// BeginVacuum starts vacuum routine
-	// WAL readers and writers must be closed before calling BeginVacuum()
+	// It seals active WAL segment and makes writer continue with a new one
+	// Writer must not have any pending (uncommitted) records
 	BeginVacuum(writer WALWriter) (WALVacuum, error)
+
+	// Reset drops every WAL segment and starts an empty WAL from specified segment index
+	// New WAL records continue specified ID and TxID counters
+	Reset(segment int, lastID, lastTxID uint64) error
+
+	// Verify reads every WAL segment and reports every problem found
+	// Unlike Read(), it never runs error correction routine, so WAL is never modified
+	Verify() (*WALVerification, error)
+
+	// TrimAfter drops every WAL record after specified one
+	// Segment that contains specified record is truncated, while every following segment is removed
+	TrimAfter(lastID uint64) error
+
+	// Migrations returns a list of steps that convert WAL into specified format version
+	// Zero version stands for current WAL format version
+	// Returned steps must be run in order, nothing is changed until then
+	Migrations(version uint32) ([]*Migration, error)
+}
+
+// WALSegment describes a single WAL segment
+type WALSegment struct {
+	// Segment index
+	Index int
+	// Segment file name
+	Name string
+	// Segment length in bytes
+	Length int64
 }
 
 // WALVacuum represents a pending WAL vacuum operation
 type WALVacuum interface {
-	// End opens WAL file for writing without resetting ID and TxID counters
-	End() (WALWriter, error)
+	// LastID returns ID of the last record within sealed WAL segments
+	LastID() uint64
+
+	// Read opens sealed WAL segments for reading
+	// Sealed segments are never modified, so they might be read while WAL writer keeps going
+	Read() (WALReader, error)
+
+	// End drops every sealed WAL segment that contains no records after lastChangeID
+	// Data up to LastID() must be saved into a snapshot before calling End(), lastChangeID might be lower
+	// to keep changes that are still needed
+	// If WAL archive is enabled, dropped segments and current snapshot are copied into archive directory
+	End(lastChangeID uint64) error
+}
+
+// WALArchive provides access to WAL segments and snapshots archived by vacuum routine
+type WALArchive interface {
+	// Snapshots returns a list of archived snapshots ordered by their last change ID
+	Snapshots() ([]ArchivedSnapshot, error)
+
+	// ReadSnapshot opens an archived snapshot for reading
+	ReadSnapshot(snapshot ArchivedSnapshot) (io.ReadCloser, error)
+
+	// Segments returns a list of archived WAL segments ordered by their index
+	// Segments of specified data directory (if any) that haven't been archived yet are listed too
+	Segments(dataPath string) ([]WALSegment, error)
+
+	// Read opens archived WAL segments for reading
+	// Segments of specified data directory (if any) that haven't been archived yet are read after archived ones
+	// Data directory is never modified, so it might be used by a running server
+	Read(dataPath string) (WALReader, error)
+}
+
+// ArchivedSnapshot describes an archived snapshot
+type ArchivedSnapshot struct {
+	// Max change ID of snapshot data
+	LastChangeID uint64
+	// Time when snapshot has been archived
+	Time time.Time
+	// Snapshot file name
+	Name string
 }
 
 // SnapshotFile provides access to snapshot file
@@ -55,9 +150,87 @@ type SnapshotFile interface {
 	Read() (io.ReadCloser, error)
 
 	// Write opens snapshot file for writing
-	Write() (io.WriteCloser, error)
+	Write() (SnapshotWriter, error)
+
+	// Map opens snapshot file for random access
+	// Plain text snapshot files are memory-mapped if possible, otherwise snapshot is read into memory
+	Map() (SnapshotMapping, error)
+
+	// Path returns a path to snapshot file
+	Path() string
+
+	// Backup copies snapshot file as is before it's converted from specified format version
+	// It returns a path to a backup file (see MigrationBackupPath)
+	Backup(version uint32) (string, error)
+}
+
+// SnapshotWriter writes a new snapshot file
+// Existing snapshot file is replaced on Close(), unless writing has been aborted
+type SnapshotWriter interface {
+	io.WriteCloser
+
+	// Abort drops written data, existing snapshot file is kept intact
+	Abort()
 }
 
+// SnapshotMapping provides random access to snapshot file contents
+type SnapshotMapping interface {
+	io.ReaderAt
+	io.Closer
+
+	// Size returns length of snapshot contents
+	Size() int64
+}
+
+// ValueLog keeps node values on disk, so only references to them are kept in memory
+// Value log is stored as a sequence of append-only segments
+type ValueLog interface {
+	// Append appends a value to value log and returns a reference to it
+	Append(value []byte) (ValueRef, error)
+
+	// Read reads a value by its reference
+	// Recently read values are cached
+	Read(ref ValueRef) ([]byte, error)
+
+	// Sync commits appended values to stable storage
+	Sync() error
+
+	// BeginVacuum starts value log vacuum routine
+	// It seals every existing segment, so values are appended into new segments
+	BeginVacuum() (ValueLogVacuum, error)
+
+	// Segments returns a list of existing value log segments ordered by their index
+	Segments() ([]ValueLogSegment, error)
+}
+
+// ValueLogVacuum represents a pending value log vacuum operation
+// It's a value log of its own that appends values into a compaction segment
+type ValueLogVacuum interface {
+	ValueLog
+
+	// IsSealed returns true if a value belongs to a segment that is dropped by End()
+	IsSealed(ref ValueRef) bool
+
+	// End drops every sealed value log segment
+	// Every reference to sealed segments must be replaced before calling End()
+	End() error
+}
+
+// ValueRef is a reference to a value within a value log
+type ValueRef struct {
+	// Segment index
+	Segment uint32
+	// Offset of value entry within segment
+	Offset uint64
+	// Value length
+	Length uint32
+	// Value checksum (see ValueChecksum)
+	Checksum uint32
+}
+
+// ValueLogSegment describes a single value log segment
+type ValueLogSegment = WALSegment
+
 // WALRecordType is a type code for a write-ahead log record
 type WALRecordType = uint8
 
@@ -97,6 +270,46 @@ func (r *WALRecord) ValueLength() int {
 	return len(r.Value)
 }
 
+// CommitTime returns a time when transaction has been committed
+// It's defined for WALCommitTx records only, zero value is returned for other records
+func (r *WALRecord) CommitTime() time.Time {
+	if r.Type != WALCommitTx || len(r.Value) < 8 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(r.Value)))
+}
+
+// CommitTerm returns a term of cluster leader that has committed transaction (see WALWriter.SetTerm)
+// It's defined for WALCommitTx records only, zero value is returned for other records
+func (r *WALRecord) CommitTerm() uint64 {
+	if r.Type != WALCommitTx || len(r.Value) < 16 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(r.Value[8:])
+}
+
+// encodeCommitTime converts a commit time into a WALCommitTx record value
+func encodeCommitTime(t time.Time) []byte {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(t.UnixNano()))
+	return value
+}
+
+// encodeCommit converts a commit time and a leader term into a WALCommitTx record value
+// Term is omitted unless it's set, so commit records of standalone servers keep their length
+func encodeCommit(t time.Time, term uint64) []byte {
+	if term == 0 {
+		return encodeCommitTime(t)
+	}
+
+	value := make([]byte, 16)
+	binary.LittleEndian.PutUint64(value, uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint64(value[8:], term)
+	return value
+}
+
 // String converts a record into its string representation
 func (r *WALRecord) String() string {
 	// String format:
@@ -158,6 +371,13 @@ type WALReader interface {
 	Close() error
 }
 
+// WALProgress is implemented by WAL readers that report how much data has been read
+// It's compared with WAL segment lengths (see WALFile.Segments) to estimate reading progress
+type WALProgress interface {
+	// BytesRead returns length of WAL data that has been read so far
+	BytesRead() int64
+}
+
 // WALWriter provides write-ahead log writing functions
 type WALWriter interface {
 	// BeginTx starts a WAL transaction
@@ -172,6 +392,18 @@ type WALWriter interface {
 	// Write writes a single record to a WAL file and sets its ID
 	Write(record *WALRecord) error
 
+	// WriteTx writes a transaction committed by another WAL as is, keeping IDs and TxIDs of its records
+	// Transaction must end with a WALCommitTx record and must follow the last committed transaction
+	// Transactions that have been written already are skipped, in this case false is returned
+	WriteTx(records []*WALRecord) (bool, error)
+
+	// LastCommit returns a commit record of the last committed transaction
+	// Its value is empty if transaction has been committed before writer has been opened
+	LastCommit() *WALRecord
+
+	// SetTerm sets a term of cluster leader that is stamped into subsequent commit records (see WALRecord.CommitTerm)
+	SetTerm(term uint64)
+
 	// Close shuts down WAL
 	Close() error
 }
@@ -0,0 +1,534 @@
+package storage
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/golang/snappy"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// Value log segment is a sequence of value entries:
+//
+// +---+----------+-----------------------------+
+// | # | Length   | Field                       |
+// +---+----------+-----------------------------+
+// | 1 | 1 byte   | Flags                       |
+// | 2 | 4 bytes  | Length of stored data       |
+// | 3 | N bytes  | Stored data                 |
+// +---+----------+-----------------------------+
+//
+// Stored data is a value that might be compressed and then encrypted (see flags).
+// Value length and checksum are kept within a value reference, so a damaged entry is detected on read.
+// Segments are append-only, a new segment is started each time a value log is opened,
+// so a partially written entry never precedes valid ones.
+
+const (
+	// valueCompressedFlag marks a value entry with compressed data
+	valueCompressedFlag uint8 = 0x01
+	// valueEncryptedFlag marks a value entry with encrypted data
+	valueEncryptedFlag uint8 = 0x02
+
+	// valueEntryHeaderLength is a length of value entry header
+	valueEntryHeaderLength = 1 + 4
+
+	// DefaultValueCacheSize is a default max length of cached values, in bytes
+	DefaultValueCacheSize int64 = 64 * 1024 * 1024
+)
+
+var valueChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ValueChecksum returns a checksum of a value
+// Values with different checksums are never equal
+func ValueChecksum(value []byte) uint32 {
+	return crc32.Checksum(value, valueChecksumTable)
+}
+
+// ValueLogOption makes driver keep node values in a value log next to WAL files
+// Only references to values are kept in memory, while values are read on demand
+// Cache size is a max length of recently read values that are kept in memory, in bytes
+func ValueLogOption(cacheSize int64) DriverOption {
+	return func(options *driverOptions) error {
+		if cacheSize < 0 {
+			return fmt.Errorf("value cache size must not be negative")
+		}
+
+		options.valueLog = true
+		options.valueCacheSize = cacheSize
+		return nil
+	}
+}
+
+// valueLog is a ValueLog based on segment files
+// Segment files are named like WAL ones, e.g. "values-000001.dat"
+type valueLog struct {
+	fs                   fileSystem
+	files                *walFile
+	encryption           *encryption
+	compressionThreshold int
+
+	lock      *sync.Mutex
+	readers   map[uint32]file
+	active    *valueSegmentWriter
+	nextIndex uint32
+	cache     *valueCache
+}
+
+func newValueLog(fs fileSystem, path string, cacheSize int64) *valueLog {
+	return &valueLog{
+		fs:      fs,
+		files:   newWALFile(fs, path, 0),
+		lock:    new(sync.Mutex),
+		readers: make(map[uint32]file),
+		cache:   newValueCache(cacheSize),
+	}
+}
+
+// valueLogPath returns a path to value log next to WAL file
+func valueLogPath(walFilePath string) string {
+	directory, _ := filepath.Split(walFilePath)
+	return filepath.Join(directory, "values.dat")
+}
+
+// Append appends a value to active value log segment
+func (l *valueLog) Append(value []byte) (ValueRef, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.active == nil {
+		index, err := l.allocateSegment()
+		if err != nil {
+			return ValueRef{}, err
+		}
+
+		l.active, err = l.createSegment(index)
+		if err != nil {
+			return ValueRef{}, err
+		}
+	}
+
+	return l.active.append(value)
+}
+
+// Read reads a value by its reference
+func (l *valueLog) Read(ref ValueRef) ([]byte, error) {
+	l.lock.Lock()
+	value, exists := l.cache.get(ref)
+	if exists {
+		l.lock.Unlock()
+		return value, nil
+	}
+
+	reader, err := l.reader(ref.Segment)
+	l.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are read via ReadAt() without the lock, so cache misses don't serialize readers
+	value, err = l.readEntry(reader, ref)
+	if err != nil {
+		log.Errorf("unable to read value at %d:%d: %s", ref.Segment, ref.Offset, err)
+		return nil, err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Values of segments that have been dropped meanwhile are not cached
+	if l.readers[ref.Segment] == reader {
+		l.cache.put(ref, value)
+	}
+	return value, nil
+}
+
+// Sync commits appended values to stable storage
+func (l *valueLog) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+
+	return l.active.file.Sync()
+}
+
+// BeginVacuum starts value log vacuum routine
+func (l *valueLog) BeginVacuum() (ValueLogVacuum, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	index, err := l.allocateSegment()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := l.createSegment(index)
+	if err != nil {
+		return nil, err
+	}
+
+	// Active segment is sealed, new values are appended into the next segment
+	if l.active != nil {
+		err = l.active.file.Sync()
+		if err == nil {
+			err = l.active.file.Close()
+		}
+		if err != nil {
+			_ = target.file.Close()
+			return nil, err
+		}
+		l.active = nil
+	}
+
+	log.Verbosef("value log vacuum started, values are compacted into segment #%d", index)
+	return &valueLogVacuum{log: l, target: target}, nil
+}
+
+// Segments returns a list of existing value log segments ordered by their index
+func (l *valueLog) Segments() ([]ValueLogSegment, error) {
+	return l.files.Segments()
+}
+
+// allocateSegment returns an index of a new segment
+// Lock must be held by caller
+func (l *valueLog) allocateSegment() (uint32, error) {
+	if l.nextIndex == 0 {
+		indices, err := l.files.listSegments()
+		if err != nil {
+			return 0, err
+		}
+
+		l.nextIndex = 1
+		if len(indices) > 0 {
+			l.nextIndex = uint32(indices[len(indices)-1]) + 1
+		}
+	}
+
+	index := l.nextIndex
+	l.nextIndex++
+	return index, nil
+}
+
+// createSegment creates a new segment file for writing
+func (l *valueLog) createSegment(index uint32) (*valueSegmentWriter, error) {
+	path := l.files.segmentPath(int(index))
+	f, err := l.fs.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR)
+	if err != nil {
+		log.Errorf("unable to create value log segment \"%s\": %s", path, err)
+		return nil, err
+	}
+
+	log.Verbosef("value log segment \"%s\" has been created", path)
+	return &valueSegmentWriter{log: l, index: index, file: f}, nil
+}
+
+// reader returns a reader of a segment file
+// Lock must be held by caller
+func (l *valueLog) reader(index uint32) (file, error) {
+	reader, exists := l.readers[index]
+	if exists {
+		return reader, nil
+	}
+
+	path := l.files.segmentPath(int(index))
+	reader, err := l.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open value log segment \"%s\": %s", path, err)
+		return nil, err
+	}
+
+	l.readers[index] = reader
+	return reader, nil
+}
+
+// readEntry reads and decodes a value entry
+// Reader handle is shared, so it's read at entry's offset and its position is never changed
+func (l *valueLog) readEntry(reader file, ref ValueRef) ([]byte, error) {
+	entry := io.NewSectionReader(reader, int64(ref.Offset), math.MaxInt64-int64(ref.Offset))
+
+	flags, err := util.ReadUint8(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := util.ReadUint32(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stored data is never much longer than a value itself, so a damaged entry never causes a large allocation
+	if int64(length) > int64(snappy.MaxEncodedLen(int(ref.Length)))+1024 {
+		return nil, fmt.Errorf("malformed value entry")
+	}
+
+	data, err := util.ReadBytes(entry, int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&valueEncryptedFlag != 0 {
+		data, err = l.encryption.open(data, valueAdditionalData(ref.Segment, ref.Offset))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if flags&valueCompressedFlag != 0 {
+		n, err := snappy.DecodedLen(data)
+		if err != nil || n != int(ref.Length) {
+			return nil, fmt.Errorf("malformed compressed value entry")
+		}
+
+		data, err = snappy.Decode(nil, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) != int(ref.Length) || ValueChecksum(data) != ref.Checksum {
+		return nil, fmt.Errorf("value checksum mismatch")
+	}
+
+	return data, nil
+}
+
+// dropSegments drops every segment before specified one
+func (l *valueLog) dropSegments(before uint32) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for index, reader := range l.readers {
+		if index < before {
+			_ = reader.Close()
+			delete(l.readers, index)
+		}
+	}
+
+	l.cache.drop(func(ref ValueRef) bool {
+		return ref.Segment < before
+	})
+
+	indices, err := l.files.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		if uint32(index) >= before {
+			continue
+		}
+
+		path := l.files.segmentPath(index)
+		err = l.fs.Remove(path)
+		if err != nil {
+			log.Errorf("unable to remove value log segment \"%s\": %s", path, err)
+			return err
+		}
+		log.Verbosef("value log segment \"%s\" has been removed", path)
+	}
+
+	return nil
+}
+
+// valueAdditionalData returns authenticated data of an encrypted value entry
+func valueAdditionalData(segment uint32, offset uint64) []byte {
+	data := make([]byte, 4+8)
+	binary.LittleEndian.PutUint32(data[0:], segment)
+	binary.LittleEndian.PutUint64(data[4:], offset)
+	return data
+}
+
+// valueSegmentWriter appends value entries to a segment file
+type valueSegmentWriter struct {
+	log      *valueLog
+	index    uint32
+	file     file
+	position int64
+}
+
+// append writes a value entry
+func (w *valueSegmentWriter) append(value []byte) (ValueRef, error) {
+	ref := ValueRef{
+		Segment:  w.index,
+		Offset:   uint64(w.position),
+		Length:   uint32(len(value)),
+		Checksum: ValueChecksum(value),
+	}
+
+	flags := uint8(0)
+	data := value
+	threshold := w.log.compressionThreshold
+	if threshold > 0 && len(value) >= threshold {
+		compressed := snappy.Encode(nil, value)
+		if len(compressed) < len(value) {
+			flags |= valueCompressedFlag
+			data = compressed
+		}
+	}
+
+	if w.log.encryption != nil {
+		var err error
+		data, err = w.log.encryption.seal(data, valueAdditionalData(ref.Segment, ref.Offset))
+		if err != nil {
+			return ValueRef{}, err
+		}
+		flags |= valueEncryptedFlag
+	}
+
+	entry := make([]byte, valueEntryHeaderLength, valueEntryHeaderLength+len(data))
+	entry[0] = flags
+	binary.LittleEndian.PutUint32(entry[1:], uint32(len(data)))
+	entry = append(entry, data...)
+
+	_, err := w.file.Write(entry)
+	if err != nil {
+		// Drop a partially written entry, so it won't be followed by next ones
+		if _, e := w.file.Seek(w.position, io.SeekStart); e == nil {
+			_ = w.file.Truncate(w.position)
+		}
+		return ValueRef{}, err
+	}
+
+	w.position += int64(len(entry))
+	return ref, nil
+}
+
+// valueLogVacuum appends values into a compaction segment
+type valueLogVacuum struct {
+	log    *valueLog
+	target *valueSegmentWriter
+}
+
+// Append appends a value to compaction segment
+func (v *valueLogVacuum) Append(value []byte) (ValueRef, error) {
+	v.log.lock.Lock()
+	defer v.log.lock.Unlock()
+
+	return v.target.append(value)
+}
+
+// Read reads a value by its reference
+func (v *valueLogVacuum) Read(ref ValueRef) ([]byte, error) {
+	return v.log.Read(ref)
+}
+
+// Sync commits compacted values to stable storage
+func (v *valueLogVacuum) Sync() error {
+	v.log.lock.Lock()
+	defer v.log.lock.Unlock()
+
+	return v.target.file.Sync()
+}
+
+// BeginVacuum is not supported for a pending vacuum
+func (v *valueLogVacuum) BeginVacuum() (ValueLogVacuum, error) {
+	return nil, fmt.Errorf("value log vacuum is already running")
+}
+
+// Segments returns a list of existing value log segments ordered by their index
+func (v *valueLogVacuum) Segments() ([]ValueLogSegment, error) {
+	return v.log.Segments()
+}
+
+// IsSealed returns true if a value belongs to a segment that is dropped by End()
+func (v *valueLogVacuum) IsSealed(ref ValueRef) bool {
+	return ref.Segment < v.target.index
+}
+
+// End drops every sealed value log segment
+func (v *valueLogVacuum) End() error {
+	err := v.Sync()
+	if err != nil {
+		return err
+	}
+
+	v.log.lock.Lock()
+	err = v.target.file.Close()
+	v.log.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = v.log.dropSegments(v.target.index)
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("value log vacuum completed, segments before #%d have been dropped", v.target.index)
+	return nil
+}
+
+// valueCache is a LRU cache of values
+type valueCache struct {
+	capacity int64
+	size     int64
+	items    map[ValueRef]*list.Element
+	order    *list.List
+}
+
+type valueCacheItem struct {
+	ref   ValueRef
+	value []byte
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		items:    make(map[ValueRef]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns a cached value and marks it as recently used
+func (c *valueCache) get(ref ValueRef) ([]byte, bool) {
+	element, exists := c.items[ref]
+	if !exists {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*valueCacheItem).value, true
+}
+
+// put adds a value to cache, evicting least recently used values
+// Value that is cached already is kept, since concurrent readers might have read it at the same time
+func (c *valueCache) put(ref ValueRef, value []byte) {
+	if int64(len(value)) > c.capacity {
+		return
+	}
+	if _, exists := c.items[ref]; exists {
+		return
+	}
+
+	c.items[ref] = c.order.PushFront(&valueCacheItem{ref, value})
+	c.size += int64(len(value))
+
+	for c.size > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// drop removes matching values from cache
+func (c *valueCache) drop(match func(ref ValueRef) bool) {
+	for ref, element := range c.items {
+		if match(ref) {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *valueCache) remove(element *list.Element) {
+	item := c.order.Remove(element).(*valueCacheItem)
+	delete(c.items, item.ref)
+	c.size -= int64(len(item.value))
+}
@@ -0,0 +1,219 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestValueLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	large := []byte(strings.Repeat("secret value ", 100))
+	for _, opts := range [][]storage.DriverOption{
+		{storage.ValueLogOption(0)},
+		{storage.ValueLogOption(1024), storage.WALCompressionOption(64), storage.EncryptionKeyOption(encryptionTestKey)},
+	} {
+		dir := t.TempDir()
+		values := createEncryptedDriver(t, dir, opts...).ValueLog()
+
+		refs := make([]storage.ValueRef, 0)
+		for i := 0; i < 10; i++ {
+			ref, err := values.Append(append([]byte(fmt.Sprintf("%d ", i)), large...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs = append(refs, ref)
+		}
+
+		err := values.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Values are readable by another driver instance
+		values = createEncryptedDriver(t, dir, opts...).ValueLog()
+		for i, ref := range refs {
+			value, err := values.Read(ref)
+			if err != nil {
+				t.Fatalf("ERROR: unable to read value #%d: %s", i, err)
+			}
+			if !bytes.Equal(value, append([]byte(fmt.Sprintf("%d ", i)), large...)) {
+				t.Errorf("ERROR: value #%d doesn't match", i)
+			}
+		}
+
+		// Damaged values are never read successfully
+		ref := refs[0]
+		ref.Checksum++
+		_, err = values.Read(ref)
+		if err == nil {
+			t.Errorf("ERROR: value with wrong checksum has been read successfully")
+		}
+	}
+}
+
+func TestValueLogNoPlainText(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	values := createEncryptedDriver(t, dir, storage.ValueLogOption(0), storage.EncryptionKeyOption(encryptionTestKey)).ValueLog()
+	_, err := values.Append([]byte("secret value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = values.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkNoPlainText(t, dir, "secret value")
+}
+
+func TestValueLogConcurrentReads(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	for _, opts := range [][]storage.DriverOption{
+		{storage.InMemoryOption(), storage.ValueLogOption(0)},
+		{storage.DirectoryOption(t.TempDir()), storage.ValueLogOption(0)},
+	} {
+		driver, err := storage.NewDriver(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := driver.ValueLog()
+
+		refs := make([]storage.ValueRef, 0)
+		for i := 0; i < 20; i++ {
+			ref, err := values.Append([]byte(fmt.Sprintf("value %d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs = append(refs, ref)
+		}
+
+		// Readers share segment handles, so none of them may see an entry of another one
+		errs := make(chan error, 8)
+		for j := 0; j < 8; j++ {
+			go func() {
+				for n := 0; n < 50; n++ {
+					for i, ref := range refs {
+						value, err := values.Read(ref)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if string(value) != fmt.Sprintf("value %d", i) {
+							errs <- fmt.Errorf("value #%d doesn't match: %q", i, value)
+							return
+						}
+					}
+				}
+				errs <- nil
+			}()
+		}
+		for j := 0; j < 8; j++ {
+			err = <-errs
+			if err != nil {
+				t.Errorf("ERROR: concurrent read has failed: %s", err)
+			}
+		}
+	}
+}
+
+func TestValueLogVacuum(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	values := createEncryptedDriver(t, dir, storage.ValueLogOption(1024)).ValueLog()
+
+	live, err := values.Append([]byte("live value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = values.Append([]byte("dead value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vacuum, err := values.BeginVacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values appended while vacuum is running are not sealed
+	active, err := values.Append([]byte("new value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vacuum.IsSealed(live) || vacuum.IsSealed(active) {
+		t.Errorf("ERROR: unexpected sealed segments")
+	}
+
+	value, err := vacuum.Read(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := vacuum.Append(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vacuum.IsSealed(compacted) {
+		t.Errorf("ERROR: compacted value belongs to a sealed segment")
+	}
+
+	err = vacuum.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := values.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Errorf("ERROR: expected 2 segments but got %d", len(segments))
+	}
+
+	for ref, expected := range map[storage.ValueRef]string{compacted: "live value", active: "new value"} {
+		value, err := values.Read(ref)
+		if err != nil || string(value) != expected {
+			t.Errorf("ERROR: expected \"%s\" but got \"%s\" (%v)", expected, value, err)
+		}
+	}
+
+	// Sealed values are dropped
+	_, err = values.Read(live)
+	if err == nil {
+		t.Errorf("ERROR: sealed value has been read after vacuum")
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "values-000001.dat"))
+	if !os.IsNotExist(err) {
+		t.Errorf("ERROR: sealed segment still exists (%v)", err)
+	}
+}
+
+func TestValueLogWithWALArchive(t *testing.T) {
+	_, err := storage.NewDriver(
+		storage.DirectoryOption(t.TempDir()),
+		storage.WALArchiveOption(t.TempDir()),
+		storage.ValueLogOption(0),
+	)
+	if err == nil {
+		t.Errorf("ERROR: value log has been combined with wal archive")
+	}
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	archivedSnapshotPrefix    = "snapshot-"
+	archivedSnapshotExtension = ".dat"
+)
+
+// walArchive is a directory that keeps WAL segments and snapshots dropped by vacuum routine
+// Archived WAL segments keep their names, while archived snapshots are named
+// "snapshot-<last change ID>-<unix time>.dat"
+type walArchive struct {
+	fs           fileSystem
+	directory    string
+	wal          *walFile
+	snapshotPath string
+}
+
+func newWALArchive(fs fileSystem, directory, walPath, snapshotPath string) *walArchive {
+	return &walArchive{
+		fs:           fs,
+		directory:    directory,
+		wal:          newWALFile(fs, filepath.Join(directory, filepath.Base(walPath)), 0),
+		snapshotPath: snapshotPath,
+	}
+}
+
+// OpenWALArchive opens WAL archive directory for reading
+// Archive is expected to be filled by a driver created with default file names (see DirectoryOption)
+// Options are used to decrypt encrypted archives (see EncryptionKeyOption), other options are ignored
+func OpenWALArchive(path string, opts ...DriverOption) (WALArchive, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		log.Errorf("malformed path \"%s\": %s", path, err)
+		return nil, err
+	}
+
+	options := &driverOptions{}
+	for _, opt := range opts {
+		err = opt(options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	archive := newWALArchive(osFileSystem{}, absPath, "journal.dat", "")
+	archive.wal.encryption = options.encryption
+	return archive, nil
+}
+
+// archiveSegment copies a WAL segment into archive directory
+func (a *walArchive) archiveSegment(path string) error {
+	target := filepath.Join(a.directory, filepath.Base(path))
+	err := a.copyFile(path, target)
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("wal segment \"%s\" has been archived", path)
+	return nil
+}
+
+// archiveSnapshot copies current snapshot file into archive directory
+func (a *walArchive) archiveSnapshot(lastChangeID uint64, t time.Time) error {
+	_, err := a.fs.Size(a.snapshotPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	name := fmt.Sprintf("%s%020d-%d%s", archivedSnapshotPrefix, lastChangeID, t.Unix(), archivedSnapshotExtension)
+	err = a.copyFile(a.snapshotPath, filepath.Join(a.directory, name))
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("snapshot \"%s\" has been archived as \"%s\"", a.snapshotPath, name)
+	return nil
+}
+
+// copyFile copies a file into archive directory
+// Archived files are never overwritten. A file that has been archived already
+// (e.g. before a crash interrupted vacuum) is kept as is if it's the same one
+func (a *walArchive) copyFile(source, target string) error {
+	_, err := a.fs.Size(target)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return copyFile(a.fs, source, target)
+	}
+
+	same, err := sameFiles(a.fs, source, target)
+	if err != nil {
+		return err
+	}
+	if !same {
+		log.Errorf("archived file \"%s\" differs from \"%s\"", target, source)
+		return fmt.Errorf("archived file \"%s\" already exists and differs from \"%s\"", target, source)
+	}
+
+	log.Verbosef("file \"%s\" has been archived already", source)
+	return nil
+}
+
+// Snapshots returns a list of archived snapshots ordered by their last change ID
+func (a *walArchive) Snapshots() ([]ArchivedSnapshot, error) {
+	names, err := a.fs.ReadDir(a.directory)
+	if err != nil {
+		log.Errorf("unable to list directory \"%s\": %s", a.directory, err)
+		return nil, err
+	}
+
+	snapshots := make([]ArchivedSnapshot, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, archivedSnapshotPrefix) || !strings.HasSuffix(name, archivedSnapshotExtension) {
+			continue
+		}
+
+		str := strings.TrimSuffix(strings.TrimPrefix(name, archivedSnapshotPrefix), archivedSnapshotExtension)
+		parts := strings.Split(str, "-")
+		if len(parts) != 2 {
+			continue
+		}
+
+		lastChangeID, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		unixTime, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		snapshots = append(snapshots, ArchivedSnapshot{
+			LastChangeID: lastChangeID,
+			Time:         time.Unix(unixTime, 0),
+			Name:         name,
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].LastChangeID < snapshots[j].LastChangeID
+	})
+	return snapshots, nil
+}
+
+// ReadSnapshot opens an archived snapshot for reading
+func (a *walArchive) ReadSnapshot(snapshot ArchivedSnapshot) (io.ReadCloser, error) {
+	path := filepath.Join(a.directory, snapshot.Name)
+	file, err := a.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return nil, err
+	}
+
+	reader, err := a.wal.encryption.decryptSnapshot(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Segments returns a list of archived WAL segments ordered by their index
+// Segments of specified data directory (if any) that haven't been archived yet are listed too
+func (a *walArchive) Segments(dataPath string) ([]WALSegment, error) {
+	paths, err := a.segmentPaths(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]WALSegment, 0, len(paths))
+	for _, index := range sortedSegmentIndices(paths) {
+		length, err := a.fs.Size(paths[index])
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, WALSegment{
+			Index:  index,
+			Name:   filepath.Base(paths[index]),
+			Length: length,
+		})
+	}
+
+	return segments, nil
+}
+
+// Read opens archived WAL segments for reading
+// Segments of specified data directory (if any) that haven't been archived yet are read after archived ones
+// Data directory is never modified, so it might be used by a running server
+func (a *walArchive) Read(dataPath string) (WALReader, error) {
+	paths, err := a.segmentPaths(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	indices := sortedSegmentIndices(paths)
+	sortedPaths := make([]string, len(indices))
+	for i, index := range indices {
+		// Archive must not have any gaps, otherwise some changes would be lost silently
+		if i > 0 && indices[i-1]+1 != index {
+			return nil, fmt.Errorf("wal segment #%d is missing", indices[i-1]+1)
+		}
+
+		sortedPaths[i] = paths[index]
+	}
+
+	return newWALSegmentReader(a.fs, a.wal.encryption, sortedPaths, dataPath != "")
+}
+
+// segmentPaths returns paths of archived and not yet archived WAL segments mapped by segment index
+func (a *walArchive) segmentPaths(dataPath string) (map[int]string, error) {
+	paths := make(map[int]string)
+
+	if dataPath != "" {
+		absPath, err := filepath.Abs(dataPath)
+		if err != nil {
+			log.Errorf("malformed path \"%s\": %s", dataPath, err)
+			return nil, err
+		}
+
+		live := newWALFile(a.fs, filepath.Join(absPath, filepath.Base(a.wal.path)), 0)
+		indices, err := live.listSegments()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, index := range indices {
+			paths[index] = live.segmentPath(index)
+		}
+	}
+
+	// Archived segments are preferred since they are never modified
+	indices, err := a.wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indices {
+		paths[index] = a.wal.segmentPath(index)
+	}
+
+	return paths, nil
+}
+
+// sortedSegmentIndices returns segment indices in ascending order
+func sortedSegmentIndices(paths map[int]string) []int {
+	indices := make([]int, 0, len(paths))
+	for index := range paths {
+		indices = append(indices, index)
+	}
+
+	sort.Ints(indices)
+	return indices
+}
+
+// copyFile copies a file, replacing target file if it exists
+func copyFile(fs fileSystem, source, target string) error {
+	input, err := fs.OpenFile(source, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", source, err)
+		return err
+	}
+	defer func() {
+		_ = input.Close()
+	}()
+
+	// A file is copied into a temporary file first, so target file is never seen partially copied
+	tempPath := target + ".tmp"
+	output, err := fs.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		log.Errorf("unable to create file \"%s\": %s", tempPath, err)
+		return err
+	}
+
+	_, err = io.Copy(output, input)
+	if err == nil {
+		err = output.Sync()
+	}
+	if err != nil {
+		_ = output.Close()
+		_ = fs.Remove(tempPath)
+		log.Errorf("unable to copy \"%s\" into \"%s\": %s", source, tempPath, err)
+		return err
+	}
+
+	err = output.Close()
+	if err != nil {
+		_ = fs.Remove(tempPath)
+		return err
+	}
+
+	return fs.Rename(tempPath, target)
+}
+
+// sameFiles returns true if both files have the same contents
+func sameFiles(fs fileSystem, path1, path2 string) (bool, error) {
+	size1, err := fs.Size(path1)
+	if err != nil {
+		return false, err
+	}
+	size2, err := fs.Size(path2)
+	if err != nil {
+		return false, err
+	}
+	if size1 != size2 {
+		return false, nil
+	}
+
+	file1, err := fs.OpenFile(path1, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path1, err)
+		return false, err
+	}
+	defer func() {
+		_ = file1.Close()
+	}()
+
+	file2, err := fs.OpenFile(path2, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path2, err)
+		return false, err
+	}
+	defer func() {
+		_ = file2.Close()
+	}()
+
+	buffer1 := make([]byte, 64*1024)
+	buffer2 := make([]byte, 64*1024)
+	for {
+		n1, err1 := io.ReadFull(file1, buffer1)
+		n2, err2 := io.ReadFull(file2, buffer2)
+		if !bytes.Equal(buffer1[:n1], buffer2[:n2]) {
+			return false, nil
+		}
+
+		for _, err := range []error{err1, err2} {
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return false, err
+			}
+		}
+		if err1 != nil || err2 != nil {
+			return err1 != nil && err2 != nil, nil
+		}
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"github.com/kapitanov/natandb/pkg/util"
 	"io"
-	"os"
 )
 
 const (
 	// WALHeaderLength is a byte-length of WAL file header
 	WALHeaderLength = 4
+
+	// walRecordHeaderLength is a byte-length of WAL record fields that precede its key and value
+	walRecordHeaderLength = 8 + 8 + 1 + 4 + 4
 )
 
 // ReadWALRecord reads a WALRecord from a file
@@ -148,14 +150,27 @@ type walInitResult struct {
 }
 
 // walInit performs WAL file init and error correction routine
-func walInit(file *os.File) (*walInitResult, error) {
+func walInit(file file) (*walInitResult, error) {
 	// Check if file is empty
 	length, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return nil, err
 	}
 
-	if length == 0 {
+	if length < WALHeaderLength {
+		if length > 0 {
+			// WAL header might be written partially if process has crashed right after file creation
+			log.Errorf("wal file is damaged: header is incomplete (%d bytes)", length)
+			err = file.Truncate(0)
+			if err != nil {
+				return nil, err
+			}
+			_, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		log.Verbosef("wal file is empty")
 		return walInitEmptyFile(file)
 	} else {
@@ -164,7 +179,7 @@ func walInit(file *os.File) (*walInitResult, error) {
 }
 
 // walInitEmptyFile performs a WAL init routine on an empty WAL file
-func walInitEmptyFile(file *os.File) (*walInitResult, error) {
+func walInitEmptyFile(file file) (*walInitResult, error) {
 	// Write WAL header
 	err := util.WriteUint32(file, WALVersion)
 	if err != nil {
@@ -179,7 +194,7 @@ func walInitEmptyFile(file *os.File) (*walInitResult, error) {
 }
 
 // walInitNonEmptyFile performs a WAL init routine on a non-empty WAL file
-func walInitNonEmptyFile(file *os.File) (*walInitResult, error) {
+func walInitNonEmptyFile(file file) (*walInitResult, error) {
 	// Read WAL header
 	_, err := file.Seek(0, io.SeekStart)
 	if err != nil {
@@ -219,7 +234,15 @@ func walInitNonEmptyFile(file *os.File) (*walInitResult, error) {
 				break
 			}
 
-			return nil, err
+			// A record might be written partially if process has crashed in the middle of a write
+			log.Errorf("wal file is damaged: unable to read record after #%d: %s", idCounter, err)
+
+			// Perform an automatic error correction (with inevitable data loss)
+			err = walTrimAfter(file, lastValidRecordID)
+			if err != nil {
+				return nil, err
+			}
+			break
 		}
 
 		if !hasAnyRecords {
@@ -229,7 +252,8 @@ func walInitNonEmptyFile(file *os.File) (*walInitResult, error) {
 			hasAnyRecords = true
 		} else {
 			// Check record ID - it must be prev record Id + 1
-			if idCounter+1 != record.ID {
+			// A gap is allowed between transactions only, since older WAL files don't reuse IDs of rolled back records
+			if idCounter+1 != record.ID && (!prevRecordWasCommitTx || record.ID <= idCounter) {
 				log.Errorf("wal file is damaged: expected record #%d after #%d but got #%d", idCounter+1, idCounter, record.ID)
 
 				// Perform an automatic error correction (with inevitable data loss)
@@ -274,7 +298,13 @@ func walInitNonEmptyFile(file *os.File) (*walInitResult, error) {
 }
 
 // walTrimAfter drops every record after specified
-func walTrimAfter(file *os.File, lastValidRecordID uint64) error {
+func walTrimAfter(file file, lastValidRecordID uint64) error {
+	if lastValidRecordID == 0 {
+		// There are no committed records in the file - keep only a WAL header
+		log.Verbosef("wal truncated %d", WALHeaderLength)
+		return file.Truncate(WALHeaderLength)
+	}
+
 	// Read WAL header
 	_, err := file.Seek(0, io.SeekStart)
 	if err != nil {
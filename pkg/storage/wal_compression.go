@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// Compressed WAL record keeps its value compressed with snappy,
+// while its record type has walCompressedFlag bit set.
+// Values are compressed before encryption, so a record might have both flags set.
+
+const (
+	// walCompressedFlag marks a WAL record with a compressed value within record type field
+	walCompressedFlag WALRecordType = 0x40
+
+	// maxCompressionRatio limits decompressed length of a value,
+	// so a damaged record never causes a large allocation
+	maxCompressionRatio = 32
+)
+
+// WALCompressionOption turns compression of large WAL record values on
+// Values that are at least threshold bytes long are compressed with snappy, if it makes them shorter
+// Zero threshold turns compression off, compressed records are readable anyway
+func WALCompressionOption(threshold int) DriverOption {
+	return func(options *driverOptions) error {
+		if threshold < 0 {
+			return fmt.Errorf("wal compression threshold must not be negative")
+		}
+
+		options.compressionThreshold = threshold
+		return nil
+	}
+}
+
+// compressRecord returns a copy of a WAL record with a compressed value
+// Record is returned as is if its value is too short or can't be compressed
+func compressRecord(record *WALRecord, threshold int) *WALRecord {
+	if threshold == 0 || len(record.Value) < threshold {
+		return record
+	}
+	if record.Type == WALCommitTx || record.Type == WALNone {
+		return record
+	}
+
+	value := snappy.Encode(nil, record.Value)
+	if len(value) >= len(record.Value) {
+		return record
+	}
+
+	return &WALRecord{
+		ID:    record.ID,
+		TxID:  record.TxID,
+		Type:  record.Type | walCompressedFlag,
+		Key:   record.Key,
+		Value: value,
+	}
+}
+
+// decompressRecord returns a copy of a WAL record with a decompressed value
+// Uncompressed records are returned as is
+func decompressRecord(record *WALRecord) (*WALRecord, error) {
+	if record.Type&walCompressedFlag == 0 {
+		return record, nil
+	}
+
+	length, err := snappy.DecodedLen(record.Value)
+	if err != nil || length > maxCompressionRatio*len(record.Value) {
+		return nil, fmt.Errorf("malformed compressed wal record #%d", record.ID)
+	}
+
+	value, err := snappy.Decode(nil, record.Value)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress wal record #%d: %s", record.ID, err)
+	}
+
+	return &WALRecord{
+		ID:    record.ID,
+		TxID:  record.TxID,
+		Type:  record.Type &^ walCompressedFlag,
+		Key:   record.Key,
+		Value: value,
+	}, nil
+}
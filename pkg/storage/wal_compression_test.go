@@ -0,0 +1,94 @@
+package storage_test
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+)
+
+func TestCompressedWAL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	short := []byte("short value")
+	large := []byte(strings.Repeat(`{"name": "value", "items": [1, 2, 3]}`, 100))
+	values := [][]byte{short, large}
+
+	for _, opts := range [][]storage.DriverOption{
+		{storage.WALCompressionOption(64)},
+		{storage.WALCompressionOption(64), storage.EncryptionKeyOption(encryptionTestKey)},
+	} {
+		dir := t.TempDir()
+		driver := createEncryptedDriver(t, dir, opts...)
+		writeValues(t, driver, values)
+
+		segments, err := driver.WALFile().Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if segments[0].Length > int64(len(large))/2 {
+			t.Errorf("ERROR: wal of %d bytes is not compressed", segments[0].Length)
+		}
+
+		// Compressed records are readable regardless of compression option
+		checkValues(t, createEncryptedDriver(t, dir, opts[1:]...), values)
+	}
+}
+
+func writeValues(t *testing.T, driver storage.Driver, values [][]byte) {
+	writer, err := driver.WALFile().Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = writer.Close()
+	}()
+
+	err = writer.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range values {
+		err = writer.Write(&storage.WALRecord{Type: storage.WALAddValue, Key: "key", Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = writer.CommitTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkValues(t *testing.T, driver storage.Driver, values [][]byte) {
+	reader, err := driver.WALFile().Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	for _, value := range values {
+		record, err := reader.Read()
+		if err != nil {
+			t.Fatalf("ERROR: unable to read wal: %s", err)
+		}
+
+		if record.Type != storage.WALAddValue || record.Key != "key" || !bytes.Equal(record.Value, value) {
+			t.Errorf("ERROR: unexpected record %s", record)
+		}
+	}
+
+	record, err := reader.Read()
+	if err != nil || record.Type != storage.WALCommitTx {
+		t.Errorf("ERROR: expected commit record but got %v (%v)", record, err)
+	}
+}
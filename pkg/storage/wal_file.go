@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// walFile provides access to WAL file
+// WAL is stored as a set of segment files named "<prefix>-<index><ext>",
+// e.g. "journal-000001.dat", "journal-000002.dat" and so on
+type walFile struct {
+	fs                   fileSystem
+	path                 string
+	directory            string
+	prefix               string
+	extension            string
+	segmentSize          int64
+	archive              *walArchive
+	encryption           *encryption
+	compressionThreshold int
+}
+
+func newWALFile(fs fileSystem, path string, segmentSize int64) *walFile {
+	directory, name := filepath.Split(path)
+	extension := filepath.Ext(name)
+
+	return &walFile{
+		fs:          fs,
+		path:        path,
+		directory:   directory,
+		prefix:      strings.TrimSuffix(name, extension),
+		extension:   extension,
+		segmentSize: segmentSize,
+	}
+}
+
+// segmentPath returns a path to a WAL segment file
+func (f *walFile) segmentPath(index int) string {
+	name := fmt.Sprintf("%s-%06d%s", f.prefix, index, f.extension)
+	return filepath.Join(f.directory, name)
+}
+
+// listSegments returns indices of existing WAL segments in ascending order
+func (f *walFile) listSegments() ([]int, error) {
+	names, err := f.fs.ReadDir(f.directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]int, 0), nil
+		}
+		log.Errorf("unable to list directory \"%s\": %s", f.directory, err)
+		return nil, err
+	}
+
+	indices := make([]int, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, f.prefix+"-") || !strings.HasSuffix(name, f.extension) {
+			continue
+		}
+
+		str := strings.TrimSuffix(strings.TrimPrefix(name, f.prefix+"-"), f.extension)
+		index, err := strconv.Atoi(str)
+		if err != nil || index <= 0 {
+			continue
+		}
+
+		indices = append(indices, index)
+	}
+
+	sort.Ints(indices)
+	return indices, nil
+}
+
+// migrateLegacyFile turns a non-segmented WAL file into a first WAL segment
+func (f *walFile) migrateLegacyFile() error {
+	_, err := f.fs.Size(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	indices, err := f.listSegments()
+	if err != nil {
+		return err
+	}
+	if len(indices) > 0 {
+		return fmt.Errorf("both wal file \"%s\" and wal segments exist", f.path)
+	}
+
+	segmentPath := f.segmentPath(1)
+	err = f.fs.Rename(f.path, segmentPath)
+	if err != nil {
+		log.Errorf("unable to rename \"%s\" to \"%s\": %s", f.path, segmentPath, err)
+		return err
+	}
+
+	log.Printf("wal file \"%s\" has been converted into segment \"%s\"", f.path, segmentPath)
+	return nil
+}
+
+// Read opens WAL file for reading
+func (f *walFile) Read() (WALReader, error) {
+	indices, err := f.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	return newWALReader(f, indices)
+}
+
+// ReadLive opens WAL file for reading while WAL writer keeps going
+func (f *walFile) ReadLive() (WALReader, error) {
+	indices, err := f.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(indices))
+	for i, index := range indices {
+		paths[i] = f.segmentPath(index)
+	}
+
+	return newWALSegmentReader(f.fs, f.encryption, paths, true)
+}
+
+// Write opens WAL file for writing
+func (f *walFile) Write() (WALWriter, error) {
+	indices, err := f.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	return newWALWriter(f, indices)
+}
+
+// Segments returns a list of existing WAL segments ordered by their index
+func (f *walFile) Segments() ([]WALSegment, error) {
+	indices, err := f.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]WALSegment, len(indices))
+	for i, index := range indices {
+		path := f.segmentPath(index)
+		length, err := f.fs.Size(path)
+		if err != nil {
+			return nil, err
+		}
+
+		segments[i] = WALSegment{
+			Index:  index,
+			Name:   filepath.Base(path),
+			Length: length,
+		}
+	}
+
+	return segments, nil
+}
+
+// BeginVacuum starts vacuum routine
+// It seals active WAL segment and makes writer continue with a new one
+// Writer must not have any pending (uncommitted) records
+func (f *walFile) BeginVacuum(writer WALWriter) (WALVacuum, error) {
+	w := writer.(*walWriter)
+	if w.isInTx && w.position != w.prevTxPosition {
+		log.Errorf("BeginVacuum: wal writer has uncommitted records")
+		return nil, ErrAlreadyInTx
+	}
+
+	sealedSegment := w.segment
+	lastID := w.idCounter
+	err := w.roll()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &walVacuum{
+		file:          f,
+		sealedSegment: sealedSegment,
+		lastID:        lastID,
+	}
+	return v, nil
+}
+
+// Reset drops every WAL segment and starts an empty WAL from specified segment index
+// New WAL records continue specified ID and TxID counters
+func (f *walFile) Reset(segment int, lastID, lastTxID uint64) error {
+	indices, err := f.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indices {
+		path := f.segmentPath(index)
+		err = f.fs.Remove(path)
+		if err != nil {
+			log.Errorf("unable to remove wal segment \"%s\": %s", path, err)
+			return err
+		}
+	}
+
+	path := f.segmentPath(segment)
+	file, err := f.fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	err = util.WriteUint32(file, WALVersion)
+	if err != nil {
+		return err
+	}
+
+	if lastID > 0 {
+		// A standalone commit record carries ID and TxID counters
+		// It's never replayed since model snapshot already contains every change up to lastID
+		record := &WALRecord{
+			ID:    lastID,
+			TxID:  lastTxID,
+			Type:  WALCommitTx,
+			Value: encodeCommitTime(time.Now()),
+		}
+		_, err = WriteWALRecord(file, record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+type walVacuum struct {
+	file          *walFile
+	sealedSegment int
+	lastID        uint64
+}
+
+// LastID returns ID of the last record within sealed WAL segments
+func (v *walVacuum) LastID() uint64 {
+	return v.lastID
+}
+
+// Read opens sealed WAL segments for reading
+func (v *walVacuum) Read() (WALReader, error) {
+	indices, err := v.file.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]int, 0, len(indices))
+	for _, index := range indices {
+		if index <= v.sealedSegment {
+			sealed = append(sealed, index)
+		}
+	}
+
+	return newSealedWALReader(v.file, sealed)
+}
+
+// End drops every sealed WAL segment that contains no records after lastChangeID
+func (v *walVacuum) End(lastChangeID uint64) error {
+	indices, err := v.file.listSegments()
+	if err != nil {
+		return err
+	}
+
+	// Snapshot contains every sealed change, even if some of them are kept within WAL
+	if v.file.archive != nil {
+		err = v.file.archive.archiveSnapshot(v.lastID, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, index := range indices {
+		if index > v.sealedSegment {
+			break
+		}
+
+		path := v.file.segmentPath(index)
+		result, err := walScanSegment(v.file.fs, path)
+		if err != nil {
+			return err
+		}
+
+		// Segments must be dropped in order, otherwise WAL would get a gap
+		if result.LastID > lastChangeID {
+			break
+		}
+
+		if v.file.archive != nil {
+			err = v.file.archive.archiveSegment(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = v.file.fs.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("unable to remove wal segment \"%s\": %s", path, err)
+			return err
+		}
+
+		log.Verbosef("wal segment \"%s\" has been removed", path)
+	}
+
+	return nil
+}
+
+// walScanSegment reads a sealed WAL segment and returns its last committed record ID and TxID
+func walScanSegment(fs fileSystem, path string) (*walInitResult, error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	result := &walInitResult{
+		IsEmpty:  true,
+		LastID:   0,
+		LastTxID: 0,
+	}
+
+	err = walReadHeader(file)
+	if err != nil {
+		if err == io.EOF {
+			return result, nil
+		}
+		return nil, err
+	}
+
+	for {
+		record, err := ReadWALRecord(file)
+		if err != nil {
+			if err == io.EOF {
+				return result, nil
+			}
+			return nil, err
+		}
+
+		result.IsEmpty = false
+		if record.Type == WALCommitTx {
+			result.LastID = record.ID
+			result.LastTxID = record.TxID
+		}
+	}
+}
+
+// walReadHeader reads and checks a WAL segment header
+func walReadHeader(file io.Reader) error {
+	version, err := util.ReadUint32(file)
+	if err != nil {
+		return err
+	}
+	if version != WALVersion {
+		return fmt.Errorf("wal file version v%d is not supported (expected v%d)", version, WALVersion)
+	}
+
+	return nil
+}
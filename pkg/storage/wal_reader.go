@@ -1,42 +1,161 @@
 package storage
 
 import (
+	"bufio"
 	"io"
 	"os"
 )
 
+// walReadBufferSize is a size of WAL segment read buffer
+const walReadBufferSize = 64 * 1024
+
 type walReader struct {
-	file *os.File
+	fs         fileSystem
+	encryption *encryption
+	paths      []string
+	index      int
+	file       file
+	buffer     *bufio.Reader
+	isLive     bool
+	bytesRead  int64
 }
 
-func newWALReader(f *os.File) (WALReader, error) {
-	_, err := walInit(f)
-	if err != nil {
+func newWALReader(wal *walFile, segments []int) (WALReader, error) {
+	if len(segments) > 0 {
+		// Only the last segment might be damaged, all previous ones are sealed
+		path := wal.segmentPath(segments[len(segments)-1])
+		f, err := wal.fs.OpenFile(path, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			log.Errorf("unable to open file \"%s\": %s", path, err)
+			return nil, err
+		}
+
+		_, err = walInit(f)
 		_ = f.Close()
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return newSealedWALReader(wal, segments)
+}
+
+// newSealedWALReader creates a reader for WAL segments without running error correction routine
+func newSealedWALReader(wal *walFile, segments []int) (WALReader, error) {
+	paths := make([]string, len(segments))
+	for i, index := range segments {
+		paths[i] = wal.segmentPath(index)
+	}
+
+	return newWALSegmentReader(wal.fs, wal.encryption, paths, false)
+}
+
+// newWALSegmentReader creates a reader for specified WAL segment files
+// If isLive is set, last segment might be written concurrently,
+// so a partially written record at its end is treated as an end of WAL
+// Encrypted and compressed records are decrypted and decompressed transparently
+func newWALSegmentReader(fs fileSystem, encryption *encryption, paths []string, isLive bool) (WALReader, error) {
+	reader := &walReader{
+		fs:         fs,
+		encryption: encryption,
+		paths:      paths,
+		index:      -1,
+		file:       nil,
+		isLive:     isLive,
 	}
 
-	_, err = f.Seek(WALHeaderLength, io.SeekStart)
+	err := reader.nextSegment()
 	if err != nil {
-		_ = f.Close()
 		return nil, err
 	}
 
-	reader := &walReader{f}
 	return reader, nil
 }
 
+// nextSegment closes current WAL segment and opens the next one (if any)
+func (r *walReader) nextSegment() error {
+	if r.file != nil {
+		err := r.file.Close()
+		if err != nil {
+			log.Errorf("unable to close wal file reader: %s", err)
+			return err
+		}
+		r.file = nil
+		r.buffer = nil
+	}
+
+	r.index++
+	if r.index >= len(r.paths) {
+		return nil
+	}
+
+	path := r.paths[r.index]
+	f, err := r.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return err
+	}
+
+	buffer := bufio.NewReaderSize(f, walReadBufferSize)
+	err = walReadHeader(buffer)
+	if err != nil && err != io.EOF {
+		_ = f.Close()
+		return err
+	}
+	if err == nil {
+		r.bytesRead += WALHeaderLength
+	}
+
+	log.Verbosef("WALReader: reading segment \"%s\"", path)
+	r.file = f
+	r.buffer = buffer
+	return nil
+}
+
 // Read read a record from a WAL file. Returns io.EOF if there are no more records to read
 func (r *walReader) Read() (*WALRecord, error) {
-	return ReadWALRecord(r.file)
+	for r.file != nil {
+		record, err := ReadWALRecord(r.buffer)
+		if err != nil && err != io.EOF && r.isLive && r.index == len(r.paths)-1 {
+			log.Verbosef("WALReader: ignoring incomplete record at the end of live wal: %s", err)
+			err = io.EOF
+		}
+		if err != io.EOF {
+			if err != nil {
+				return nil, err
+			}
+			r.bytesRead += walRecordHeaderLength + int64(len(record.Key)+record.ValueLength())
+			record, err = r.encryption.decryptRecord(record)
+			if err != nil {
+				return nil, err
+			}
+			return decompressRecord(record)
+		}
+
+		err = r.nextSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, io.EOF
+}
+
+// BytesRead returns length of WAL data that has been read so far
+func (r *walReader) BytesRead() int64 {
+	return r.bytesRead
 }
 
 // Close shuts down WAL
 func (r *walReader) Close() error {
-	err := r.file.Close()
-	if err != nil {
-		log.Errorf("unable to close wal file reader: %s", err)
-		return err
+	if r.file != nil {
+		err := r.file.Close()
+		if err != nil {
+			log.Errorf("unable to close wal file reader: %s", err)
+			return err
+		}
+		r.file = nil
+		r.buffer = nil
 	}
 	log.Verbosef("WALReader: closed")
 	return nil
@@ -35,6 +35,46 @@ func TestEmptyLog(t *testing.T) {
 	}
 }
 
+func TestInMemoryDriver(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	driver, err := storage.NewDriver(storage.InMemoryOption(), storage.WALSegmentSizeOption(128))
+	if err != nil {
+		t.Errorf("ERROR: NewDriver() failed: %s", err)
+		return
+	}
+
+	const txCount = 10
+	for txID := uint64(1); txID <= txCount; txID++ {
+		err = writeTx(t, driver, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := driver.WALFile().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Errorf("ERROR: expected multiple wal segments but got %d", len(segments))
+	}
+
+	err = readTx(t, driver, func(wal *walValidator) {
+		id := uint64(1)
+		for txID := uint64(1); txID <= txCount; txID++ {
+			wal.Expect(id+0, txID, storage.WALAddValue)
+			wal.Expect(id+1, txID, storage.WALCommitTx)
+			id += 2
+		}
+		wal.ExpectEOF()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSingleItemTransaction(t *testing.T) {
 	log.SetOutput(io.Discard)
 	l.SetMinLevel(l.Verbose)
@@ -194,6 +234,140 @@ func TestErrorCorrection(t *testing.T) {
 	}
 }
 
+// TestSegmentRolling tests that WAL writer starts new segments
+// and WAL reader reads records across all of them
+func TestSegmentRolling(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver, err := storage.NewDriver(storage.DirectoryOption(dir), storage.WALSegmentSizeOption(128))
+	if err != nil {
+		t.Errorf("ERROR: NewDriver() failed: %s", err)
+		return
+	}
+
+	const txCount = 10
+	for txID := uint64(1); txID <= txCount; txID++ {
+		err = writeTx(t, driver, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	segments, err := driver.WALFile().Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Errorf("ERROR: expected multiple wal segments but got %d", len(segments))
+	}
+
+	err = readTx(t, driver, func(wal *walValidator) {
+		id := uint64(1)
+		for txID := uint64(1); txID <= txCount; txID++ {
+			wal.Expect(id+0, txID, storage.WALAddValue)
+			wal.Expect(id+1, txID, storage.WALAddValue)
+			wal.Expect(id+2, txID, storage.WALCommitTx)
+			id += 3
+		}
+		wal.ExpectEOF()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSegmentVacuum tests that vacuum drops only segments
+// that don't contain any records after specified change ID
+func TestSegmentVacuum(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir, err := os.MkdirTemp(os.TempDir(), "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver, err := storage.NewDriver(storage.DirectoryOption(dir), storage.WALSegmentSizeOption(0))
+	if err != nil {
+		t.Errorf("ERROR: NewDriver() failed: %s", err)
+		return
+	}
+
+	// Segment #1 contains records [1..2], segment #2 contains records [3..4]
+	err = writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := driver.WALFile().Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = driver.WALFile().BeginVacuum(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seal segment #2 and drop everything up to record #2
+	writer, err = driver.WALFile().Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vacuum, err := driver.WALFile().BeginVacuum(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vacuum.End(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readTx(t, driver, func(wal *walValidator) {
+		wal.Expect(3, 2, storage.WALAddValue)
+		wal.Expect(4, 2, storage.WALCommitTx)
+		wal.ExpectEOF()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New records must continue ID sequence
+	err = writeTx(t, driver, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = readTx(t, driver, func(wal *walValidator) {
+		wal.Expect(3, 2, storage.WALAddValue)
+		wal.Expect(4, 2, storage.WALCommitTx)
+		wal.Expect(5, 3, storage.WALAddValue)
+		wal.Expect(6, 3, storage.WALCommitTx)
+		wal.ExpectEOF()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func writeTx(t *testing.T, driver storage.Driver, count int) error {
 	writer, err := driver.WALFile().Write()
 	if err != nil {
@@ -293,3 +467,51 @@ func readTx(t *testing.T, driver storage.Driver, check func(v *walValidator)) er
 	check(&walValidator{t, reader})
 	return nil
 }
+
+func TestWALReadProgress(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	values := [][]byte{[]byte("foo"), []byte("bar"), make([]byte, 100*1024)}
+	for _, opts := range [][]storage.DriverOption{
+		{},
+		{storage.WALCompressionOption(64), storage.EncryptionKeyOption(encryptionTestKey)},
+	} {
+		driver := createEncryptedDriver(t, t.TempDir(), append(opts, storage.WALSegmentSizeOption(1024))...)
+		writeValues(t, driver, values)
+		writeValues(t, driver, values)
+
+		segments, err := driver.WALFile().Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		length := int64(0)
+		for _, segment := range segments {
+			length += segment.Length
+		}
+
+		reader, err := driver.WALFile().Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		progress, ok := reader.(storage.WALProgress)
+		if !ok {
+			t.Fatalf("ERROR: WAL reader doesn't report its progress")
+		}
+
+		for {
+			_, err = reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = reader.Close()
+
+		if progress.BytesRead() != length {
+			t.Errorf("ERROR: %d bytes read, expected %d bytes", progress.BytesRead(), length)
+		}
+	}
+}
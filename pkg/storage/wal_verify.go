@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+// WALProblem describes a problem found by WAL verification
+type WALProblem struct {
+	// Segment file name
+	Segment string
+	// Offset of damaged data within segment
+	Offset int64
+	// Problem description
+	Message string
+}
+
+// String converts a problem into its string representation
+func (p WALProblem) String() string {
+	return fmt.Sprintf("%s at %d: %s", p.Segment, p.Offset, p.Message)
+}
+
+// WALVerification is a result of WAL verification
+type WALVerification struct {
+	// Count of verified segments
+	Segments int
+	// Count of readable records
+	Records uint64
+	// Count of properly committed transactions
+	Transactions uint64
+	// ID of the first record, zero if WAL is empty
+	FirstID uint64
+	// True if the first record is a standalone commit record that carries ID and TxID counters (see WALFile.Reset)
+	FirstIsCommit bool
+	// ID of the last record that is committed properly and precedes any problem, zero if none
+	LastCommitID uint64
+	// TxID of the last transaction that is committed properly and precedes any problem, zero if none
+	LastCommitTxID uint64
+	// Every problem found, ordered by its position within WAL
+	Problems []WALProblem
+}
+
+// walVerifier checks WAL records one by one
+type walVerifier struct {
+	result            *WALVerification
+	segment           string
+	hasAnyRecords     bool
+	prevWasCommitTx   bool
+	idCounter         uint64
+	txCounter         uint64
+	isBeforeProblems  bool
+	segmentHasRecords bool
+}
+
+// Verify reads every WAL segment and reports every problem found
+// Unlike Read(), it never runs error correction routine, so WAL is never modified
+func (f *walFile) Verify() (*WALVerification, error) {
+	indices, err := f.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &walVerifier{
+		result:           &WALVerification{Problems: make([]WALProblem, 0)},
+		isBeforeProblems: true,
+	}
+
+	for i, index := range indices {
+		err = v.verifySegment(f, f.segmentPath(index), i == len(indices)-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return v.result, nil
+}
+
+// verifySegment checks a single WAL segment
+func (v *walVerifier) verifySegment(f *walFile, path string, isLast bool) error {
+	v.segment = filepath.Base(path)
+	v.segmentHasRecords = false
+	v.result.Segments++
+
+	length, err := f.fs.Size(path)
+	if err != nil {
+		return err
+	}
+
+	file, err := f.fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	if length < WALHeaderLength {
+		// Active segment might be empty if it has just been created
+		if length > 0 || !isLast {
+			v.problem(0, "header is incomplete (%d bytes)", length)
+		}
+		return nil
+	}
+
+	r := bufio.NewReaderSize(file, walReadBufferSize)
+	version, err := util.ReadUint32(r)
+	if err != nil {
+		return err
+	}
+	if version != WALVersion {
+		v.problem(0, "wal file version v%d is not supported (expected v%d)", version, WALVersion)
+		return nil
+	}
+
+	offset := int64(WALHeaderLength)
+	for {
+		record, err := ReadWALRecord(r)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			// Nothing might be read after a damaged record
+			v.problem(offset, "unable to read record after #%d: %s", v.idCounter, err)
+			return nil
+		}
+
+		position := offset
+		offset += walRecordHeaderLength + int64(len(record.Key)+record.ValueLength())
+		v.verifyRecord(f, position, record)
+	}
+
+	if v.segmentHasRecords && !v.prevWasCommitTx {
+		if isLast {
+			v.problem(offset, "tx #%d was not committed properly (at #%d)", v.txCounter, v.idCounter)
+		} else {
+			v.problem(offset, "segment ends with uncommitted tx #%d (at #%d)", v.txCounter, v.idCounter)
+		}
+	}
+
+	return nil
+}
+
+// verifyRecord checks a single WAL record
+func (v *walVerifier) verifyRecord(f *walFile, offset int64, record *WALRecord) {
+	v.result.Records++
+	v.segmentHasRecords = true
+
+	decoded, err := f.encryption.decryptRecord(record)
+	if err == nil {
+		decoded, err = decompressRecord(decoded)
+	}
+	if err != nil {
+		v.problem(offset, "record #%d is unreadable: %s", record.ID, err)
+	} else {
+		switch decoded.Type {
+		case WALNone, WALAddValue, WALRemoveValue, WALRemoveKey, WALCommitTx:
+		default:
+			v.problem(offset, "record #%d has unknown type %d", record.ID, decoded.Type)
+		}
+	}
+
+	if !v.hasAnyRecords {
+		v.hasAnyRecords = true
+		v.result.FirstID = record.ID
+		v.txCounter = record.TxID
+	} else {
+		// A gap is allowed between transactions only, since older WAL files don't reuse IDs of rolled back records
+		if v.idCounter+1 != record.ID && (!v.prevWasCommitTx || record.ID <= v.idCounter) {
+			v.problem(offset, "expected record #%d after #%d but got #%d", v.idCounter+1, v.idCounter, record.ID)
+		}
+
+		// TxID change is only allowed if prev record was a WALCommitTx record
+		if v.txCounter != record.TxID {
+			if !v.prevWasCommitTx {
+				v.problem(offset, "tx #%d was not committed properly (at #%d)", v.txCounter, record.ID)
+			} else if record.TxID < v.txCounter {
+				v.problem(offset, "tx #%d follows tx #%d", record.TxID, v.txCounter)
+			}
+		}
+	}
+
+	v.idCounter = record.ID
+	v.txCounter = record.TxID
+	v.prevWasCommitTx = record.Type&^(walEncryptedFlag|walCompressedFlag) == WALCommitTx
+	if v.result.Records == 1 {
+		v.result.FirstIsCommit = v.prevWasCommitTx
+	}
+
+	if v.prevWasCommitTx {
+		v.result.Transactions++
+		if v.isBeforeProblems {
+			v.result.LastCommitID = record.ID
+			v.result.LastCommitTxID = record.TxID
+		}
+	}
+}
+
+// problem reports a problem at specified offset within current segment
+func (v *walVerifier) problem(offset int64, format string, args ...interface{}) {
+	v.isBeforeProblems = false
+	v.result.Problems = append(v.result.Problems, WALProblem{
+		Segment: v.segment,
+		Offset:  offset,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// TrimAfter drops every WAL record after specified one
+// Segment that contains specified record is truncated, while every following segment is removed
+// If lastID is zero, WAL is trimmed to an empty segment
+func (f *walFile) TrimAfter(lastID uint64) error {
+	indices, err := f.listSegments()
+	if err != nil {
+		return err
+	}
+	if len(indices) == 0 {
+		return nil
+	}
+
+	position := int64(WALHeaderLength)
+	found := 0
+	if lastID == 0 {
+		found = indices[0]
+	} else {
+		for _, index := range indices {
+			position, err = walFindRecordEnd(f.fs, f.segmentPath(index), lastID)
+			if err != nil {
+				return err
+			}
+			if position > 0 {
+				found = index
+				break
+			}
+		}
+		if found == 0 {
+			return fmt.Errorf("wal record #%d is not found", lastID)
+		}
+	}
+
+	for _, index := range indices {
+		path := f.segmentPath(index)
+		if index > found {
+			err = f.fs.Remove(path)
+			if err != nil {
+				log.Errorf("unable to remove wal segment \"%s\": %s", path, err)
+				return err
+			}
+			log.Printf("wal segment \"%s\" has been removed", path)
+			continue
+		}
+		if index < found {
+			continue
+		}
+
+		file, err := f.fs.OpenFile(path, os.O_RDWR)
+		if err != nil {
+			log.Errorf("unable to open file \"%s\": %s", path, err)
+			return err
+		}
+
+		// A segment with a damaged header is rewritten from scratch
+		if lastID == 0 {
+			err = file.Truncate(0)
+			if err == nil {
+				_, err = walInitEmptyFile(file)
+			}
+		} else {
+			err = file.Truncate(position)
+		}
+		if err == nil {
+			err = file.Sync()
+		}
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+		log.Printf("wal segment \"%s\" has been truncated after record #%d", path, lastID)
+	}
+
+	return nil
+}
+
+// walFindRecordEnd returns an offset right after specified record within a WAL segment, zero if not found
+func walFindRecordEnd(fs fileSystem, path string, id uint64) (int64, error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return 0, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	r := bufio.NewReaderSize(file, walReadBufferSize)
+	err = walReadHeader(r)
+	if err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	offset := int64(WALHeaderLength)
+	for {
+		record, err := ReadWALRecord(r)
+		if err != nil {
+			// Records after a damaged one are unreachable anyway
+			return 0, nil
+		}
+
+		offset += walRecordHeaderLength + int64(len(record.Key)+record.ValueLength())
+		if record.ID == id {
+			return offset, nil
+		}
+	}
+}
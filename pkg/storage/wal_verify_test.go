@@ -0,0 +1,177 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	l "github.com/kapitanov/natandb/pkg/log"
+	"github.com/kapitanov/natandb/pkg/storage"
+	"github.com/kapitanov/natandb/pkg/util"
+)
+
+func TestWALVerify(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	add := func(id, txID uint64) *storage.WALRecord {
+		return &storage.WALRecord{ID: id, TxID: txID, Type: storage.WALAddValue, Key: "key", Value: []byte("value")}
+	}
+	commit := func(id, txID uint64) *storage.WALRecord {
+		return &storage.WALRecord{ID: id, TxID: txID, Type: storage.WALCommitTx}
+	}
+
+	for _, test := range []struct {
+		Name         string
+		Segments     [][]*storage.WALRecord
+		Problems     int
+		LastCommitID uint64
+	}{
+		{
+			Name:         "valid wal",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1)}, {add(5, 3), commit(6, 3)}},
+			LastCommitID: 6,
+		},
+		{
+			Name:         "id gap within tx",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1), add(3, 2), add(5, 2), commit(6, 2)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+		{
+			Name:         "id goes backwards",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1)}, {add(2, 2), commit(3, 2)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+		{
+			Name:         "uncommitted tx",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1), add(3, 2), add(4, 3), commit(5, 3)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+		{
+			Name:         "uncommitted tail",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1)}, {add(3, 2)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+		{
+			Name:         "sealed segment with uncommitted tail",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1), add(3, 2)}, {commit(4, 2)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+		{
+			Name:         "tx id goes backwards",
+			Segments:     [][]*storage.WALRecord{{add(1, 2), commit(2, 2), add(3, 1), commit(4, 1)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+		{
+			Name:         "unknown record type",
+			Segments:     [][]*storage.WALRecord{{add(1, 1), commit(2, 1), {ID: 3, TxID: 2, Type: 0x3f}, commit(4, 2)}},
+			Problems:     1,
+			LastCommitID: 2,
+		},
+	} {
+		dir := t.TempDir()
+		for i, records := range test.Segments {
+			writeWALSegment(t, filepath.Join(dir, fmt.Sprintf("journal-%06d.dat", i+1)), records, nil)
+		}
+
+		driver := createEncryptedDriver(t, dir)
+		result, err := driver.WALFile().Verify()
+		if err != nil {
+			t.Errorf("ERROR: %s: Verify() failed: %s", test.Name, err)
+			continue
+		}
+		if len(result.Problems) != test.Problems {
+			t.Errorf("ERROR: %s: expected %d problems but got %v", test.Name, test.Problems, result.Problems)
+		}
+		if result.LastCommitID != test.LastCommitID {
+			t.Errorf("ERROR: %s: expected last commit #%d but got #%d", test.Name, test.LastCommitID, result.LastCommitID)
+		}
+
+		// WAL is valid once it's trimmed to the last valid commit
+		err = driver.WALFile().TrimAfter(result.LastCommitID)
+		if err != nil {
+			t.Errorf("ERROR: %s: TrimAfter() failed: %s", test.Name, err)
+			continue
+		}
+		result, err = driver.WALFile().Verify()
+		if err != nil {
+			t.Errorf("ERROR: %s: Verify() failed: %s", test.Name, err)
+			continue
+		}
+		if len(result.Problems) != 0 || result.LastCommitID != test.LastCommitID {
+			t.Errorf("ERROR: %s: trimmed wal ends at #%d and has problems %v", test.Name, result.LastCommitID, result.Problems)
+		}
+	}
+}
+
+func TestWALVerifyDamagedData(t *testing.T) {
+	log.SetOutput(io.Discard)
+	l.SetMinLevel(l.Verbose)
+
+	dir := t.TempDir()
+	records := []*storage.WALRecord{
+		{ID: 1, TxID: 1, Type: storage.WALAddValue, Key: "key", Value: []byte("value")},
+		{ID: 2, TxID: 1, Type: storage.WALCommitTx},
+	}
+	writeWALSegment(t, filepath.Join(dir, "journal-000001.dat"), records, []byte{1, 2, 3})
+
+	// Second segment has an unknown version
+	err := os.WriteFile(filepath.Join(dir, "journal-000002.dat"), []byte{9, 0, 0, 0}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verification never modifies WAL
+	before, err := os.ReadFile(filepath.Join(dir, "journal-000001.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := createEncryptedDriver(t, dir).WALFile().Verify()
+	if err != nil {
+		t.Fatalf("ERROR: Verify() failed: %s", err)
+	}
+	if len(result.Problems) != 2 || result.LastCommitID != 2 || result.Records != 2 {
+		t.Errorf("ERROR: unexpected verification result: %+v", result)
+	}
+
+	after, err := os.ReadFile(filepath.Join(dir, "journal-000001.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("ERROR: wal has been modified by Verify()")
+	}
+}
+
+// writeWALSegment writes a WAL segment file with specified records followed by a tail of raw data
+func writeWALSegment(t *testing.T, path string, records []*storage.WALRecord, tail []byte) {
+	buffer := new(bytes.Buffer)
+	err := util.WriteUint32(buffer, storage.WALVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, record := range records {
+		_, err = storage.WriteWALRecord(buffer, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffer.Write(tail)
+
+	err = os.WriteFile(path, buffer.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,25 +5,53 @@ import (
 	"github.com/kapitanov/natandb/pkg/util"
 	"io"
 	"os"
+	"time"
 )
 
 type walWriter struct {
-	file           *os.File
+	wal            *walFile
+	segment        int
+	file           file
 	txCounter      uint64
 	idCounter      uint64
 	currentTxId    uint64
 	isInTx         bool
 	position       int64
 	prevTxPosition int64
+	prevIDCounter  uint64
+	lastCommit     *WALRecord
+	term           uint64
 }
 
-func newWALWriter(f *os.File) (WALWriter, error) {
+func newWALWriter(wal *walFile, segments []int) (WALWriter, error) {
+	segment := 1
+	if len(segments) > 0 {
+		segment = segments[len(segments)-1]
+	}
+
+	path := wal.segmentPath(segment)
+	f, err := wal.fs.OpenFile(path, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return nil, err
+	}
+
 	result, err := walInit(f)
 	if err != nil {
 		_ = f.Close()
 		return nil, err
 	}
 
+	// Active segment might contain no committed records (e.g. it has just been created)
+	// In this case ID and TxID counters are restored from previous segments
+	for i := len(segments) - 2; i >= 0 && result.LastID == 0; i-- {
+		result, err = walScanSegment(wal.fs, wal.segmentPath(segments[i]))
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+
 	position, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
 		_ = f.Close()
@@ -31,6 +59,8 @@ func newWALWriter(f *os.File) (WALWriter, error) {
 	}
 
 	writer := &walWriter{
+		wal:            wal,
+		segment:        segment,
 		file:           f,
 		idCounter:      result.LastID,
 		txCounter:      result.LastTxID,
@@ -38,10 +68,50 @@ func newWALWriter(f *os.File) (WALWriter, error) {
 		isInTx:         false,
 		position:       position,
 		prevTxPosition: 0,
+		lastCommit:     &WALRecord{ID: result.LastID, TxID: result.LastTxID, Type: WALCommitTx},
 	}
 	return writer, nil
 }
 
+// roll seals current WAL segment and continues writing into a new one
+func (w *walWriter) roll() error {
+	err := w.file.Close()
+	if err != nil {
+		log.Errorf("unable to close wal file writer: %s", err)
+		return err
+	}
+
+	segment := w.segment + 1
+	path := w.wal.segmentPath(segment)
+	f, err := w.wal.fs.OpenFile(path, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		log.Errorf("unable to open file \"%s\": %s", path, err)
+		return err
+	}
+
+	_, err = walInit(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	position, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	w.file = f
+	w.segment = segment
+	w.position = position
+	if w.isInTx {
+		w.prevTxPosition = position
+	}
+
+	log.Verbosef("WALWriter: switched to segment \"%s\"", path)
+	return nil
+}
+
 // InitializeEmptyFile performs a WAL init routine on an empty WAL file
 func (w *walWriter) InitializeEmptyFile() error {
 	// Write WAL header
@@ -183,6 +253,7 @@ func (w *walWriter) BeginTx() error {
 	w.currentTxId = w.txCounter
 	w.isInTx = true
 	w.prevTxPosition = w.position
+	w.prevIDCounter = w.idCounter
 
 	log.Verbosef("BeginTx: txID=%d started, now at %d, rollback to %d", w.currentTxId, w.position, w.prevTxPosition)
 	return nil
@@ -201,26 +272,122 @@ func (w *walWriter) CommitTx() error {
 
 		// Write a WALCommitTx record
 		record := &WALRecord{
-			Type: WALCommitTx,
+			Type:  WALCommitTx,
+			Value: encodeCommit(time.Now(), w.term),
 		}
 		err := w.WriteImpl(record)
 		if err != nil {
 			return err
 		}
 
+		// Transaction is committed only when its records have reached stable storage
+		err = w.file.Sync()
+		if err != nil {
+			log.Errorf("CommitTx: unable to flush wal file: %s", err)
+			return err
+		}
+
+		w.lastCommit = record
 		log.Verbosef("CommitTx: txID=%d committed, now at %d", w.currentTxId, w.position)
 	} else {
 		w.txCounter--
 	}
 
-	// Reset transaction state
+	return w.endTx()
+}
+
+// endTx resets transaction state once a transaction is committed
+func (w *walWriter) endTx() error {
 	w.currentTxId = 0
 	w.isInTx = false
 	w.prevTxPosition = 0
 
+	// Start a new segment if current one has grown too large
+	if w.wal.segmentSize > 0 && w.position >= w.wal.segmentSize {
+		return w.roll()
+	}
+
 	return nil
 }
 
+// WriteTx writes a transaction committed by another WAL as is, keeping IDs and TxIDs of its records
+// Transaction must end with a WALCommitTx record and must follow the last committed transaction
+// Transactions that have been written already are skipped, in this case false is returned
+func (w *walWriter) WriteTx(records []*WALRecord) (bool, error) {
+	if w.isInTx {
+		log.Errorf("WriteTx: already in transaction")
+		return false, ErrAlreadyInTx
+	}
+
+	err := checkTx(records)
+	if err != nil {
+		return false, err
+	}
+
+	commit := records[len(records)-1]
+	if commit.ID <= w.idCounter {
+		log.Verbosef("WriteTx: txID=%d is already written", commit.TxID)
+		return false, nil
+	}
+	if records[0].ID <= w.idCounter || commit.TxID <= w.txCounter {
+		return false, fmt.Errorf("wal write error: tx #%d at #%d doesn't follow tx #%d at #%d", commit.TxID, records[0].ID, w.txCounter, w.idCounter)
+	}
+
+	idCounter, txCounter := w.idCounter, w.txCounter
+	w.isInTx = true
+	w.currentTxId = commit.TxID
+	w.prevTxPosition = w.position
+	for _, record := range records {
+		w.idCounter = record.ID - 1
+		err = w.WriteImpl(&WALRecord{Type: record.Type, Key: record.Key, Value: record.Value})
+		if err == nil && record.Type == WALCommitTx {
+			err = w.file.Sync()
+		}
+		if err != nil {
+			_ = w.RollbackTx()
+			w.idCounter, w.txCounter = idCounter, txCounter
+			return false, err
+		}
+	}
+
+	w.txCounter = commit.TxID
+	w.lastCommit = commit
+	log.Verbosef("WriteTx: txID=%d written, now at %d", commit.TxID, w.position)
+	return true, w.endTx()
+}
+
+// checkTx checks that records form a single committed transaction
+func checkTx(records []*WALRecord) error {
+	if len(records) == 0 || records[len(records)-1].Type != WALCommitTx {
+		return fmt.Errorf("wal write error: transaction must end with a commit record")
+	}
+
+	for i, record := range records {
+		if record.TxID != records[0].TxID {
+			return fmt.Errorf("wal write error: record #%d belongs to tx #%d instead of tx #%d", record.ID, record.TxID, records[0].TxID)
+		}
+		if i > 0 && record.ID <= records[i-1].ID {
+			return fmt.Errorf("wal write error: record #%d follows record #%d", record.ID, records[i-1].ID)
+		}
+		if record.Type == WALCommitTx && i != len(records)-1 {
+			return fmt.Errorf("wal write error: commit record #%d is not the last one", record.ID)
+		}
+	}
+
+	return nil
+}
+
+// LastCommit returns a commit record of the last committed transaction
+// Its value is empty if transaction has been committed before writer has been opened
+func (w *walWriter) LastCommit() *WALRecord {
+	return w.lastCommit
+}
+
+// SetTerm sets a term of cluster leader that is stamped into subsequent commit records
+func (w *walWriter) SetTerm(term uint64) {
+	w.term = term
+}
+
 // RollbackTx rolls a WAL transaction back
 func (w *walWriter) RollbackTx() error {
 	// Check if prev transaction is not committed
@@ -245,10 +412,13 @@ func (w *walWriter) RollbackTx() error {
 		}
 
 		log.Verbosef("RollbackTx: txID=%d rolled back, now at %d", w.currentTxId, w.prevTxPosition)
-	} else {
-		w.txCounter--
 	}
 
+	// IDs of dropped records are reused, so WAL of a primary that has rolled back a transaction
+	// still matches WAL of a replica that is promoted next and keeps numbering from the last commit
+	w.idCounter = w.prevIDCounter
+	w.txCounter--
+
 	// Reset transaction state
 	w.currentTxId = 0
 	w.isInTx = false
@@ -282,8 +452,22 @@ func (w *walWriter) WriteImpl(record *WALRecord) error {
 	record.TxID = w.currentTxId
 
 	// Write a record
-	length, err := WriteWALRecord(w.file, record)
+	stored := compressRecord(record, w.wal.compressionThreshold)
+	if w.wal.encryption != nil {
+		var err error
+		stored, err = w.wal.encryption.encryptRecord(stored)
+		if err != nil {
+			w.idCounter--
+			return err
+		}
+	}
+	length, err := WriteWALRecord(w.file, stored)
 	if err != nil {
+		// Drop a partially written record, so it won't be followed by next ones
+		w.idCounter--
+		if _, e := w.file.Seek(w.position, io.SeekStart); e == nil {
+			_ = w.file.Truncate(w.position)
+		}
 		return err
 	}
 
@@ -2,18 +2,22 @@ package util
 
 import (
 	"encoding/binary"
-	"fmt"
 	"io"
 )
 
+const (
+	// maxPreallocatedLength is a max length of a buffer that is allocated before reading
+	maxPreallocatedLength = 64 * 1024
+)
+
 var (
-	readerBuffer    = make([]byte, 8)
 	readerByteOrder = binary.LittleEndian
 )
 
 // ReadUint64 reads an uint64 binary value from a stream
 func ReadUint64(r io.Reader) (uint64, error) {
-	buffer := readerBuffer[0:8]
+	var array [8]byte
+	buffer := array[:]
 	err := readBuffer(r, buffer)
 	if err != nil {
 		return 0, err
@@ -25,7 +29,8 @@ func ReadUint64(r io.Reader) (uint64, error) {
 
 // ReadUint32 reads an uint32 binary value from a stream
 func ReadUint32(r io.Reader) (uint32, error) {
-	buffer := readerBuffer[0:4]
+	var array [4]byte
+	buffer := array[:]
 	err := readBuffer(r, buffer)
 	if err != nil {
 		return 0, err
@@ -37,7 +42,8 @@ func ReadUint32(r io.Reader) (uint32, error) {
 
 // ReadUint16 reads an uint32 binary value from a stream
 func ReadUint16(r io.Reader) (uint16, error) {
-	buffer := readerBuffer[0:]
+	var array [2]byte
+	buffer := array[:]
 	err := readBuffer(r, buffer)
 	if err != nil {
 		return 0, err
@@ -49,7 +55,8 @@ func ReadUint16(r io.Reader) (uint16, error) {
 
 // ReadUint8 reads an uint8 binary value from a stream
 func ReadUint8(r io.Reader) (uint8, error) {
-	buffer := readerBuffer[0:1]
+	var array [1]byte
+	buffer := array[:]
 	err := readBuffer(r, buffer)
 	if err != nil {
 		return 0, err
@@ -61,8 +68,7 @@ func ReadUint8(r io.Reader) (uint8, error) {
 
 // ReadString reads an UTF-8 string from a stream
 func ReadString(r io.Reader, len int) (string, error) {
-	buffer := make([]byte, len)
-	err := readBuffer(r, buffer)
+	buffer, err := ReadBytes(r, len)
 	if err != nil {
 		return "", err
 	}
@@ -70,20 +76,34 @@ func ReadString(r io.Reader, len int) (string, error) {
 }
 
 // ReadBytes reads a byte array string from a stream
-func ReadBytes(r io.Reader, len int) ([]byte, error) {
-	buffer := make([]byte, len)
-	err := readBuffer(r, buffer)
+func ReadBytes(r io.Reader, length int) ([]byte, error) {
+	if length <= maxPreallocatedLength {
+		buffer := make([]byte, length)
+		err := readBuffer(r, buffer)
+		if err != nil {
+			return nil, err
+		}
+		return buffer, nil
+	}
+
+	// Length might be read from damaged data, so large buffers are grown as data arrives
+	buffer, err := io.ReadAll(io.LimitReader(r, int64(length)))
 	if err != nil {
 		return nil, err
 	}
+	if len(buffer) == 0 {
+		return nil, io.EOF
+	}
+	if len(buffer) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
 	return buffer, nil
 }
 
+// readBuffer fills a buffer completely
+// It returns io.EOF if stream has ended before the buffer
+// and io.ErrUnexpectedEOF if stream has ended in the middle of the buffer
 func readBuffer(r io.Reader, buffer []byte) error {
-	n, err := r.Read(buffer)
-	if err == nil && n < len(buffer) {
-		err = fmt.Errorf("not enough data has been read (expected %d, got %d)", len(buffer), n)
-	}
-
+	_, err := io.ReadFull(r, buffer)
 	return err
 }
@@ -7,32 +7,34 @@ import (
 )
 
 var (
-	writerBuffer    = make([]byte, 8)
 	writerByteOrder = binary.LittleEndian
 )
 
 // WriteUint64 writes an uint64 value into a stream
 func WriteUint64(w io.Writer, value uint64) error {
-	writerByteOrder.PutUint64(writerBuffer, value)
-	return writeBuffer(w, writerBuffer[0:8])
+	var buffer [8]byte
+	writerByteOrder.PutUint64(buffer[:], value)
+	return writeBuffer(w, buffer[:])
 }
 
 // WriteUint32 writes an uint32 value into a stream
 func WriteUint32(w io.Writer, value uint32) error {
-	writerByteOrder.PutUint32(writerBuffer, value)
-	return writeBuffer(w, writerBuffer[0:4])
+	var buffer [4]byte
+	writerByteOrder.PutUint32(buffer[:], value)
+	return writeBuffer(w, buffer[:])
 }
 
 // WriteUint16 writes an uint32 value into a stream
 func WriteUint16(w io.Writer, value uint16) error {
-	writerByteOrder.PutUint16(writerBuffer, value)
-	return writeBuffer(w, writerBuffer[0:2])
+	var buffer [2]byte
+	writerByteOrder.PutUint16(buffer[:], value)
+	return writeBuffer(w, buffer[:])
 }
 
 // WriteUint8 writes an uint8 value into a stream
 func WriteUint8(w io.Writer, value uint8) error {
-	writerBuffer[0] = value
-	return writeBuffer(w, writerBuffer[0:1])
+	buffer := [1]byte{value}
+	return writeBuffer(w, buffer[:])
 }
 
 // WriteString writes an UTF-8 string into a stream